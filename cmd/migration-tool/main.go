@@ -5,10 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	interfaces "github.com/IceWhaleTech/CasaOS-Common"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/constants"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/systemctl"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"gopkg.in/ini.v1"
 )
 
 const (
@@ -16,6 +19,7 @@ const (
 	localStorageConfigFilePath = "/etc/casaos/local-storage.conf"
 	localStorageName           = "casaos-local-storage.service"
 	localStorageNameShort      = "local-storage"
+	localStorageDBFileName     = "local-storage.db"
 )
 
 //go:embedded ../../build/sysroot/etc/casaos/local-storage.conf.sample
@@ -69,7 +73,7 @@ func main() {
 	}
 
 	migrationTools := []interfaces.MigrationTool{
-		NewMigrationDummy(),
+		NewMigrationSchema(filepath.Join(dbPath(), localStorageDBFileName)),
 	}
 
 	var selectedMigrationTool interfaces.MigrationTool
@@ -104,3 +108,18 @@ func main() {
 		_logger.Error("Migration succeeded, but post-migration failed: %s", err)
 	}
 }
+
+// dbPath returns the directory of the database, as in the config file of the service.
+func dbPath() string {
+	cfg, err := ini.Load(localStorageConfigFilePath)
+	if err != nil {
+		_logger.Debug("Failed to load %s, using the default database path: %s", localStorageConfigFilePath, err)
+		return constants.DefaultDataPath
+	}
+
+	if path := cfg.Section("app").Key("DBPath").String(); path != "" {
+		return path
+	}
+
+	return constants.DefaultDataPath
+}
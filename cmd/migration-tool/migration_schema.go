@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	interfaces "github.com/IceWhaleTech/CasaOS-Common"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// schemaMigration upgrades the schema of the database to Version, from the version before it.
+type schemaMigration struct {
+	Version     int
+	Description string
+	Up          func(tx *gorm.DB) error
+}
+
+// in order of version, starting from 1 - the version of a database is kept in its user_version. Only changes that
+// AutoMigrate of the service cannot make have a migration here - see sqlite.SchemaVersion.
+var schemaMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "add filesystem, disk, mount options, last seen time and notes to volumes",
+		Up:          addVolumeDetails,
+	},
+}
+
+type migrationSchema struct {
+	dbFile     string
+	migrations []schemaMigration
+
+	version    int    // of the database before migrating
+	backupFile string // copy of the database before migrating, to roll back to
+}
+
+func (u *migrationSchema) IsMigrationNeeded() (bool, error) {
+	// a new database is created by the service itself, with the latest schema
+	if _, err := os.Stat(u.dbFile); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	version, err := u.schemaVersion()
+	if err != nil {
+		return false, err
+	}
+
+	_logger.Debug("schema version of %s is %d, latest is %d", u.dbFile, version, u.latestVersion())
+
+	return version < u.latestVersion(), nil
+}
+
+func (u *migrationSchema) PreMigrate() error {
+	db, err := u.open()
+	if err != nil {
+		return err
+	}
+	defer closeDB(db)
+
+	if err := db.Raw("PRAGMA user_version").Scan(&u.version).Error; err != nil {
+		return err
+	}
+
+	// VACUUM INTO makes a consistent copy even if the database is in use, but fails if the file exists
+	u.backupFile = fmt.Sprintf("%s.v%d.bak", u.dbFile, u.version)
+	if err := os.Remove(u.backupFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	_logger.Info("Backing up %s to %s...", u.dbFile, u.backupFile)
+
+	return db.Exec("VACUUM INTO ?", u.backupFile).Error
+}
+
+func (u *migrationSchema) Migrate() error {
+	db, err := u.open()
+	if err != nil {
+		return err
+	}
+
+	// all migrations are in one transaction - sqlite rolls back schema changes too
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, migration := range u.migrations {
+			if migration.Version <= u.version {
+				continue
+			}
+
+			_logger.Info("Migrating schema to version %d: %s...", migration.Version, migration.Description)
+
+			if err := migration.Up(tx); err != nil {
+				return fmt.Errorf("migration to version %d failed: %w", migration.Version, err)
+			}
+
+			// PRAGMA does not take parameters
+			if err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", migration.Version)).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	closeDB(db)
+
+	if err == nil {
+		return nil
+	}
+
+	_logger.Error("Migration failed, restoring %s from %s: %s", u.dbFile, u.backupFile, err)
+
+	if restoreErr := u.restore(); restoreErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to restore database from %s: %w", u.backupFile, restoreErr))
+	}
+
+	return err
+}
+
+func (u *migrationSchema) PostMigrate() error {
+	version, err := u.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version != u.latestVersion() {
+		return fmt.Errorf("schema version of %s is %d after migration, not %d", u.dbFile, version, u.latestVersion())
+	}
+
+	_logger.Info("Schema of %s migrated from version %d to %d. The backup is kept at %s.", u.dbFile, u.version, version, u.backupFile)
+
+	return nil
+}
+
+func (u *migrationSchema) open() (*gorm.DB, error) {
+	return gorm.Open(sqlite.Open(u.dbFile), &gorm.Config{Logger: gormlogger.Default.LogMode(gormlogger.Silent)})
+}
+
+func (u *migrationSchema) schemaVersion() (int, error) {
+	db, err := u.open()
+	if err != nil {
+		return 0, err
+	}
+	defer closeDB(db)
+
+	var version int
+	if err := db.Raw("PRAGMA user_version").Scan(&version).Error; err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (u *migrationSchema) latestVersion() int {
+	if len(u.migrations) == 0 {
+		return 0
+	}
+
+	return u.migrations[len(u.migrations)-1].Version
+}
+
+// restore copies the backup over the database, in case the transaction could not be rolled back.
+func (u *migrationSchema) restore() error {
+	if u.backupFile == "" {
+		return errors.New("no backup was made")
+	}
+
+	source, err := os.Open(u.backupFile)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(u.dbFile, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+
+	return destination.Close()
+}
+
+func closeDB(db *gorm.DB) {
+	if c, err := db.DB(); err == nil {
+		c.Close()
+	}
+}
+
+// columns are added as the service itself would add them with AutoMigrate, which it still runs at startup
+func addVolumeDetails(tx *gorm.DB) error {
+	// created by the service itself, with the latest schema
+	if !tx.Migrator().HasTable("o_disk") {
+		return nil
+	}
+
+	columns := []struct {
+		name     string
+		dataType string
+	}{
+		{"fs_type", "text"},
+		{"label", "text"},
+		{"size", "integer"},
+		{"disk_id", "text"},
+		{"mount_options", "text"},
+		{"last_seen_at", "integer"},
+		{"notes", "text"},
+	}
+
+	for _, column := range columns {
+		if tx.Migrator().HasColumn("o_disk", column.name) {
+			continue
+		}
+
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE `o_disk` ADD `%s` %s", column.name, column.dataType)).Error; err != nil {
+			return err
+		}
+	}
+
+	// as good a guess as any, until the service sees the volume again
+	return tx.Exec("UPDATE `o_disk` SET `last_seen_at` = `created_at` WHERE `last_seen_at` IS NULL OR `last_seen_at` = 0").Error
+}
+
+func NewMigrationSchema(dbFile string) interfaces.MigrationTool {
+	return &migrationSchema{
+		dbFile:     dbFile,
+		migrations: schemaMigrations,
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/sqlite"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"gorm.io/gorm"
+	"gotest.tools/v3/assert"
+)
+
+// o_disk as created by AutoMigrate before volumes had details
+func createOldDB(t *testing.T) string {
+	dbFile := filepath.Join(t.TempDir(), localStorageDBFileName)
+
+	u := &migrationSchema{dbFile: dbFile}
+	db, err := u.open()
+	assert.NilError(t, err)
+	defer closeDB(db)
+
+	assert.NilError(t, db.Exec("CREATE TABLE `o_disk` (`id` integer,`uuid` text,`mount_point` text,`created_at` integer,`crypt_uuid` text,`auto_unlock` numeric,PRIMARY KEY (`id`))").Error)
+	assert.NilError(t, db.Exec("INSERT INTO `o_disk` (`uuid`,`mount_point`,`created_at`) VALUES ('5c682e86-cec3-4761-9350-8e1a0c2d1ae9','/media/sdb1',1700000000)").Error)
+
+	return dbFile
+}
+
+func columnsOf(t *testing.T, db *gorm.DB) []string {
+	columnTypes, err := db.Migrator().ColumnTypes("o_disk")
+	assert.NilError(t, err)
+
+	columns := make([]string, 0, len(columnTypes))
+	for _, columnType := range columnTypes {
+		columns = append(columns, columnType.Name())
+	}
+
+	return columns
+}
+
+func TestMigrationSchema(t *testing.T) {
+	_logger = NewLogger()
+
+	tool := NewMigrationSchema(filepath.Join(t.TempDir(), localStorageDBFileName))
+	needed, err := tool.IsMigrationNeeded()
+	assert.NilError(t, err)
+	assert.Assert(t, !needed)
+
+	dbFile := createOldDB(t)
+	tool = NewMigrationSchema(dbFile)
+
+	needed, err = tool.IsMigrationNeeded()
+	assert.NilError(t, err)
+	assert.Assert(t, needed)
+
+	assert.NilError(t, tool.PreMigrate())
+	assert.NilError(t, tool.Migrate())
+	assert.NilError(t, tool.PostMigrate())
+
+	_, err = os.Stat(dbFile + ".v0.bak")
+	assert.NilError(t, err)
+
+	needed, err = tool.IsMigrationNeeded()
+	assert.NilError(t, err)
+	assert.Assert(t, !needed)
+
+	db, err := tool.(*migrationSchema).open()
+	assert.NilError(t, err)
+	defer closeDB(db)
+
+	// the service adds no column of its own, as the names are the same
+	columns := columnsOf(t, db)
+	assert.NilError(t, db.AutoMigrate(&model.Volume{}))
+	assert.DeepEqual(t, columnsOf(t, db), columns)
+
+	var volume model.Volume
+	assert.NilError(t, db.First(&volume).Error)
+	assert.Equal(t, volume.MountPoint, "/media/sdb1")
+	assert.Equal(t, volume.LastSeenAt, int64(1700000000))
+	assert.Equal(t, volume.FSType, "")
+}
+
+func TestMigrationSchemaNewDB(t *testing.T) {
+	_logger = NewLogger()
+
+	dbFile := filepath.Join(t.TempDir(), localStorageDBFileName)
+	closeDB(sqlite.GetDBByFile(dbFile))
+
+	tool := NewMigrationSchema(dbFile)
+	assert.Equal(t, tool.(*migrationSchema).latestVersion(), sqlite.SchemaVersion)
+
+	// created by the service with the latest schema
+	needed, err := tool.IsMigrationNeeded()
+	assert.NilError(t, err)
+	assert.Assert(t, !needed)
+}
+
+func TestMigrationSchemaRollback(t *testing.T) {
+	_logger = NewLogger()
+
+	dbFile := createOldDB(t)
+
+	migrations := append([]schemaMigration{}, schemaMigrations...)
+	migrations = append(migrations, schemaMigration{
+		Version:     len(migrations) + 1,
+		Description: "fail half way",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("ALTER TABLE `o_disk` ADD `foo` text").Error; err != nil {
+				return err
+			}
+			return errors.New("failed")
+		},
+	})
+
+	tool := &migrationSchema{dbFile: dbFile, migrations: migrations}
+
+	assert.NilError(t, tool.PreMigrate())
+	assert.ErrorContains(t, tool.Migrate(), "failed")
+
+	version, err := tool.schemaVersion()
+	assert.NilError(t, err)
+	assert.Equal(t, version, 0)
+
+	db, err := tool.open()
+	assert.NilError(t, err)
+	defer closeDB(db)
+
+	assert.DeepEqual(t, columnsOf(t, db), []string{"id", "uuid", "mount_point", "created_at", "crypt_uuid", "auto_unlock"})
+}
@@ -5,3 +5,6 @@ const (
 	ServiceName       = "local-storage"
 	DefaultMountPoint = "/DATA"
 )
+
+// parent directories of managed mounts, which need shared propagation for app containers to see mounts made below them later
+var ManagedParentDirs = []string{"/media", "/mnt", DefaultMountPoint}
@@ -6,13 +6,16 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/IceWhaleTech/CasaOS-Common/model"
@@ -23,10 +26,12 @@ import (
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/cache"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/sqlite"
-	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/merge"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/union"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/route"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2/fs"
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/robfig/cron/v3"
 	"github.com/samber/lo"
@@ -84,8 +89,14 @@ func init() {
 		os.Exit(0)
 		return
 	}
+	for _, dir := range common.ManagedParentDirs {
+		if err := mount.EnsureSharedPropagation(dir); err != nil {
+			logger.Error("error when ensuring shared propagation", zap.Error(err), zap.String("dir", dir))
+		}
+	}
+
 	if strings.ToLower(config.ServerInfo.EnableMergerFS) == "true" {
-		if !merge.IsMergerFSInstalled() {
+		if !fs.IsMergeSupported() {
 			config.ServerInfo.EnableMergerFS = "false"
 			logger.Info("mergerfs is disabled")
 		}
@@ -98,11 +109,13 @@ func init() {
 		}
 	}
 
-	if strings.ToLower(config.ServerInfo.EnableMergerFS) == "true" {
-		go service.MyService.LocalStorage().CheckMergeMount()
-	}
+	// volumes first, then network and cloud mounts, then the merges over them - waiting for slow disks and the network
+	go service.MyService.Reconciler().Restore(context.Background(), service.DefaultRestoreTimeout)
 
 	checkToken2_11()
+
+	// USB drives are mounted as per the USB rules, rather than by udevil
+	go service.MyService.USB().ApplyUSBAutoMount(config.ServerInfo.USBAutoMount)
 	go ensureDefaultDirectories()
 	//service.MyService.Disk().EnsureDefaultMergePoint()
 
@@ -120,7 +133,7 @@ func checkToken2_11() {
 
 	if service.MyService.USB().GetSysInfo().KernelArch == "aarch64" && strings.ToLower(config.ServerInfo.USBAutoMount) != "true" && strings.Contains(deviceTree, "Raspberry Pi") {
 		service.MyService.USB().UpdateUSBAutoMount("False")
-		service.MyService.USB().ExecUSBAutoMountShell("False")
+		service.MyService.USB().ApplyUSBAutoMount("False")
 	}
 }
 
@@ -160,9 +173,20 @@ func main() {
 		logger.Error("crontab add func error", zap.Error(err))
 	}
 
+	if _, err := crontab.AddFunc("@every 30s", service.MyService.Watchdog().Check); err != nil {
+		logger.Error("crontab add func error", zap.Error(err))
+	}
+
+	if _, err := crontab.AddFunc("@daily", service.MyService.Disk().AutoPruneOrphanedVolumes); err != nil {
+		logger.Error("crontab add func error", zap.Error(err))
+	}
+
 	crontab.Start()
 	defer crontab.Stop()
 
+	// syncs and scrubs of the parity of merges, on their own schedules
+	service.MyService.SnapRAID().Start()
+
 	listener, err := net.Listen("tcp", net.JoinHostPort(localhost, "0"))
 	if err != nil {
 		panic(err)
@@ -218,8 +242,23 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		logger.Info("LocalStorage service is shutting down...")
+
+		// served by this process - they would be left as dead mounts otherwise
+		union.UnmountAll()
+
+		if err := server.Shutdown(context.Background()); err != nil {
+			logger.Error("error when shutting down http server", zap.Error(err))
+		}
+	}()
+
 	err = server.Serve(listener)
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
 }
@@ -227,8 +266,15 @@ func RegMsg() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var events []message_bus.EventType
-	events = append(events, message_bus.EventType{Name: common.ServiceName + ":merge_status", SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventMergeStatus, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
 	events = append(events, message_bus.EventType{Name: common.ServiceName + ":storage_status", SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventMountStatus, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventCryptStatus, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventRebalanceStatus, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventConflictStatus, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventSnapRAIDStatus, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventSnapRAIDError, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
+	events = append(events, message_bus.EventType{Name: service.EventVolumeOrphansPruned, SourceID: common.ServiceName, PropertyTypeList: []message_bus.PropertyType{}})
 	// register at message bus
 	for i := 0; i < 10; i++ {
 		response, err := service.MyService.MessageBus().RegisterEventTypesWithResponse(context.Background(), events)
@@ -150,8 +150,46 @@ func monitorUEvent(ctx context.Context) {
 			switch uevent.Env["DEVTYPE"] {
 			case "partition":
 
+				if uevent.Action == netlink.ADD {
+					// give udev a moment to settle, e.g. to create the by-uuid symlinks
+					go func() {
+						time.Sleep(1 * time.Second)
+
+						// so that it is not pruned as orphaned for having been away
+						service.MyService.Disk().RefreshVolumesInDB()
+
+						// picked up by the next round of restoring, which also holds back merges until all their source volumes are present
+						if service.MyService.Reconciler().RestoreStatus().State == service.RestoreStateRunning {
+							return
+						}
+
+						// also adds the volume to any merge that was mounted without it
+						if _, err := service.MyService.Reconciler().Apply(); err != nil {
+							logger.Error("error when reconciling mounts", zap.Error(err))
+						}
+					}()
+				}
+
 				switch uevent.Env["ID_BUS"] {
 				case "usb":
+					switch uevent.Action {
+					case netlink.ADD:
+						device := service.USBDeviceFromEnv(uevent.Env)
+						go func() {
+							time.Sleep(1 * time.Second)
+
+							if err := service.MyService.USB().AutoMountUSB(device); err != nil {
+								logger.Error("error when auto-mounting USB partition", zap.Error(err), zap.String("device", device.Path))
+							}
+						}()
+
+					case netlink.REMOVE:
+						device := service.USBDeviceFromEnv(uevent.Env)
+						if err := service.MyService.USB().AutoUmountUSB(device.Path); err != nil {
+							logger.Error("error when umounting removed USB partition", zap.Error(err), zap.String("device", device.Path))
+						}
+					}
+
 					time.Sleep(1 * time.Second)
 					sendUSBBySocket()
 					continue
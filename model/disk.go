@@ -95,7 +95,9 @@ type Storage struct {
 	Path        string `json:"path"`
 	DriveName   string `json:"drive_name"`
 	Label       string `json:"label"`
-	PersistedIn string `json:"persisted_in"` // none, fstab, casaos
+	PersistedIn string `json:"persisted_in"` // none, fstab, casaos, systemd
+	Encrypted   bool   `json:"encrypted,omitempty"`
+	Locked      bool   `json:"locked,omitempty"` // encrypted, and not yet unlocked
 }
 type Storages struct {
 	DiskName string    `json:"disk_name"`
@@ -14,6 +14,11 @@ type APPModel struct {
 
 // 服务配置
 type ServerModel struct {
-	USBAutoMount   string
-	EnableMergerFS string
+	USBAutoMount           string
+	EnableMergerFS         string
+	MountPointTemplate     string // for volumes mounted by user with a name, e.g. /media/{name}
+	AutoMountPointTemplate string // for volumes mounted without a name, e.g. /media/{label}
+	PersistentType         string // how new volumes are restored after reboot - casaos, or systemd for .mount units
+
+	OrphanedVolumePruneDays int // volumes not seen for that many days are pruned - 0 means never
 }
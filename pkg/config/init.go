@@ -7,6 +7,7 @@ import (
 
 	"github.com/IceWhaleTech/CasaOS-Common/utils/constants"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/model"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mountpoint"
 	"gopkg.in/ini.v1"
 )
 
@@ -24,8 +25,11 @@ var (
 	}
 
 	ServerInfo = &model.ServerModel{
-		USBAutoMount:   "True",
-		EnableMergerFS: "False",
+		USBAutoMount:           "True",
+		EnableMergerFS:         "False",
+		MountPointTemplate:     mountpoint.DefaultTemplate,
+		AutoMountPointTemplate: mountpoint.DefaultAutoTemplate,
+		PersistentType:         "casaos",
 	}
 )
 
@@ -3,10 +3,13 @@ package fstab
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -15,13 +18,21 @@ const (
 	PassCheckAfterBoot  = 2
 
 	DefaultPath = "/etc/fstab"
+
+	// comment appended to entries added by this service, unless given one
+	DefaultComment = "Added by the CasaOS"
+
+	// number of backups kept, i.e. fstab.casaos.bak, then fstab.casaos.bak.1, ... up to the oldest
+	maxBackups = 5
 )
 
 var (
-	_fstab *FStab
+	_fstab     *FStab
+	_fstabOnce sync.Once
 
 	ErrInvalidFSTabEntry                     = errors.New("invalid fstab entry")
 	ErrDifferentFSTabEntryWithSameMountPoint = errors.New("a different fstab entry with the same mount point already exists")
+	ErrFSTabEntryNotFound                    = errors.New("fstab entry not found")
 )
 
 type (
@@ -43,95 +54,179 @@ type (
 
 		// A number indicating the order in which the fsck program will check the devices for errors at boot time
 		Pass int
+
+		// The comment at the end of the line, if any
+		Comment string
+
+		// The line number in the file, starting from 1 - set when read from the file only
+		LineNumber int
 	}
 
 	FStab struct {
-		path string
+		path   string
+		verify bool // verify changes with findmnt or mount before writing them
+		dryRun bool // verify changes only, without writing them
+
+		mu sync.Mutex // held from reading the file to writing it back, so that concurrent changes are not lost
+	}
+
+	// a line of the file, kept as is unless its entry is changed
+	line struct {
+		raw   string
+		entry *Entry
 	}
 )
 
 func (e *Entry) String() string {
-	return e.Source + "\t" + e.MountPoint + "\t" + e.FSType + "\t" + e.Options + "\t" + strconv.Itoa(e.Dump) + "\t" + strconv.Itoa(e.Pass)
+	return escape(e.Source) + "\t" + escape(e.MountPoint) + "\t" + e.FSType + "\t" + e.Options + "\t" + strconv.Itoa(e.Dump) + "\t" + strconv.Itoa(e.Pass)
 }
 
-func (f *FStab) Add(e Entry, replace bool) error {
-	entry, err := f.GetEntryByMountPoint(e.MountPoint)
-	if err != nil {
-		return err
+// Validate checks if the entry could be written as a line of fstab.
+func (e *Entry) Validate() error {
+	if e.Source == "" || e.MountPoint == "" || e.FSType == "" {
+		return fmt.Errorf("%w: source, mount point and fstype should not be empty", ErrInvalidFSTabEntry)
 	}
 
-	if entry != nil {
-		if !replace &&
-			(entry.Source != e.Source ||
-				entry.FSType != e.FSType ||
-				entry.Options != e.Options ||
-				entry.Dump != e.Dump ||
-				entry.Pass != e.Pass) {
-			return ErrDifferentFSTabEntryWithSameMountPoint
-		}
+	if e.MountPoint != "none" && !filepath.IsAbs(e.MountPoint) {
+		return fmt.Errorf("%w: mount point should be an absolute path, or none", ErrInvalidFSTabEntry)
+	}
 
-		if err := f.RemoveByMountPoint(e.MountPoint, false); err != nil {
-			return err
-		}
+	if strings.ContainsAny(e.FSType+e.Options, " \t\n#") {
+		return fmt.Errorf("%w: fstype and options should not contain whitespace or #", ErrInvalidFSTabEntry)
 	}
 
-	if err := copy(f.path, f.path+".casaos.bak"); err != nil {
-		return err
+	if strings.ContainsAny(e.Source+e.MountPoint+e.Comment, "\n") {
+		return fmt.Errorf("%w: entry should not contain line breaks", ErrInvalidFSTabEntry)
 	}
 
-	fstabFile, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY, 0o644)
-	if err != nil {
-		return err
+	if e.Dump != 0 && e.Dump != 1 {
+		return fmt.Errorf("%w: dump should be 0 or 1", ErrInvalidFSTabEntry)
 	}
-	defer fstabFile.Close()
 
-	_, err = fstabFile.WriteString(e.String() + "\t# Added by the CasaOS\n")
-	if err != nil {
-		return err
+	if e.Pass < PassDoNotCheck || e.Pass > PassCheckAfterBoot {
+		return fmt.Errorf("%w: pass should be 0, 1 or 2", ErrInvalidFSTabEntry)
 	}
 
-	return err
+	return nil
 }
 
-func (f *FStab) RemoveByMountPoint(mountpoint string, comment bool) error {
-	FStabPathNew := f.path + ".casaos.new"
-	FStabFileNew, err := os.OpenFile(FStabPathNew, os.O_CREATE|os.O_WRONLY, 0o644)
-	if err != nil {
+func (e *Entry) line() string {
+	if e.Comment == "" {
+		return e.String()
+	}
+
+	return e.String() + "\t# " + e.Comment
+}
+
+func (e *Entry) equal(other *Entry) bool {
+	return e.Source == other.Source &&
+		e.FSType == other.FSType &&
+		e.Options == other.Options &&
+		e.Dump == other.Dump &&
+		e.Pass == other.Pass
+}
+
+// DryRun returns a copy of f that verifies changes without writing them.
+func (f *FStab) DryRun() *FStab {
+	return &FStab{path: f.path, verify: true, dryRun: true}
+}
+
+// Add appends e, or replaces the entry with the same mount point in place if replace is true.
+func (f *FStab) Add(e Entry, replace bool) error {
+	if e.Options == "" {
+		e.Options = "defaults"
+	}
+
+	if err := e.Validate(); err != nil {
 		return err
 	}
 
-	if err := foreachLine(f.path, func(line string) error {
-		entry, _ := parseEntry(line)
-		if entry != nil && entry.MountPoint == mountpoint {
-			if comment {
-				_, err := FStabFileNew.WriteString("#" + line + "\n")
-				return err
+	return f.modify(func(lines []line) ([]line, error) {
+		for i := range lines {
+			if lines[i].entry == nil || lines[i].entry.MountPoint != e.MountPoint {
+				continue
 			}
-			return nil
+
+			if !replace && !lines[i].entry.equal(&e) {
+				return nil, ErrDifferentFSTabEntryWithSameMountPoint
+			}
+
+			if e.Comment == "" {
+				e.Comment = lines[i].entry.Comment
+			}
+
+			lines[i] = line{raw: e.line(), entry: &e}
+			return lines, nil
 		}
 
-		_, err := FStabFileNew.WriteString(line + "\n")
-		return err
-	}); err != nil {
-		return err
+		if e.Comment == "" {
+			e.Comment = DefaultComment
+		}
+
+		return append(lines, line{raw: e.line(), entry: &e}), nil
+	})
+}
+
+// Update replaces the entry with mountpoint in place with e, keeping its comment unless e has one.
+func (f *FStab) Update(mountpoint string, e Entry) error {
+	if e.Options == "" {
+		e.Options = "defaults"
 	}
 
-	if err := copy(f.path, f.path+".casaos.bak"); err != nil {
+	if err := e.Validate(); err != nil {
 		return err
 	}
 
-	return os.Rename(FStabPathNew, f.path)
+	return f.modify(func(lines []line) ([]line, error) {
+		for i := range lines {
+			if lines[i].entry == nil || lines[i].entry.MountPoint != mountpoint {
+				continue
+			}
+
+			if e.Comment == "" {
+				e.Comment = lines[i].entry.Comment
+			}
+
+			lines[i] = line{raw: e.line(), entry: &e}
+			return lines, nil
+		}
+
+		return nil, ErrFSTabEntryNotFound
+	})
+}
+
+// RemoveByMountPoint removes the entries with mountpoint, or comments them out if comment is true.
+func (f *FStab) RemoveByMountPoint(mountpoint string, comment bool) error {
+	return f.modify(func(lines []line) ([]line, error) {
+		result := make([]line, 0, len(lines))
+		for _, l := range lines {
+			if l.entry != nil && l.entry.MountPoint == mountpoint {
+				if comment {
+					result = append(result, line{raw: "#" + l.raw})
+				}
+				continue
+			}
+
+			result = append(result, l)
+		}
+
+		return result, nil
+	})
 }
 
 func (f *FStab) GetEntries() ([]*Entry, error) {
 	entries := []*Entry{}
 
+	lineNumber := 0
 	if err := foreachLine(f.path, func(line string) error {
+		lineNumber++
+
 		entry, err := parseEntry(line)
 		if err != nil {
 			return err
 		}
 		if entry != nil {
+			entry.LineNumber = lineNumber
 			entries = append(entries, entry)
 		}
 		return nil
@@ -157,6 +252,8 @@ func (f *FStab) GetEntryByMountPoint(mountpoint string) (*Entry, error) {
 	return nil, nil
 }
 
+// GetEntryBySource finds the entry for source, which could be a device path, a bare UUID, or any of UUID=, LABEL=, PARTUUID=
+// and PARTLABEL= - matched against the source of each entry as is, and as the device both resolve to, if present.
 func (f *FStab) GetEntryBySource(source string) (*Entry, error) {
 	entries, err := f.GetEntries()
 	if err != nil {
@@ -164,7 +261,22 @@ func (f *FStab) GetEntryBySource(source string) (*Entry, error) {
 	}
 
 	for _, entry := range entries {
-		if entry.Source == source {
+		if entry.Source == source || entry.Source == "UUID="+source {
+			return entry, nil
+		}
+	}
+
+	device := ResolveSource(source)
+	if device == "" {
+		device = ResolveSource("UUID=" + source)
+	}
+
+	if device == "" {
+		return nil, nil
+	}
+
+	for _, entry := range entries {
+		if ResolveSource(entry.Source) == device {
 			return entry, nil
 		}
 	}
@@ -173,33 +285,150 @@ func (f *FStab) GetEntryBySource(source string) (*Entry, error) {
 }
 
 func Get() *FStab {
-	if _fstab == nil {
+	// once, as changes are only serialized within the same instance
+	_fstabOnce.Do(func() {
 		_fstab = &FStab{
-			path: DefaultPath,
+			path:   DefaultPath,
+			verify: true,
 		}
-	}
+	})
 
 	return _fstab
 }
 
+// modify reads the lines of the file, changes them, then verifies and writes them back atomically, keeping backups.
+func (f *FStab) modify(change func(lines []line) ([]line, error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lines, err := f.readLines()
+	if err != nil {
+		return err
+	}
+
+	current := render(lines)
+
+	lines, err = change(lines)
+	if err != nil {
+		return err
+	}
+
+	content := render(lines)
+
+	if f.verify {
+		if err := Verify(current, content); err != nil {
+			return err
+		}
+	}
+
+	if f.dryRun {
+		return nil
+	}
+
+	return f.write(content)
+}
+
+func (f *FStab) readLines() ([]line, error) {
+	lines := []line{}
+
+	if err := foreachLine(f.path, func(raw string) error {
+		// an invalid entry is kept as is
+		entry, _ := parseEntry(raw)
+		lines = append(lines, line{raw: raw, entry: entry})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+func (f *FStab) write(content string) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(f.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	pathNew := f.path + ".casaos.new"
+	fileNew, err := os.OpenFile(pathNew, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fileNew.WriteString(content); err != nil {
+		fileNew.Close()
+		return err
+	}
+
+	if err := fileNew.Sync(); err != nil {
+		fileNew.Close()
+		return err
+	}
+
+	if err := fileNew.Close(); err != nil {
+		return err
+	}
+
+	if err := f.rotateBackups(); err != nil {
+		return err
+	}
+
+	return os.Rename(pathNew, f.path)
+}
+
+// keep the current file as fstab.casaos.bak, shifting older backups to fstab.casaos.bak.1, ... and dropping the oldest
+func (f *FStab) rotateBackups() error {
+	backup := func(i int) string {
+		if i == 0 {
+			return f.path + ".casaos.bak"
+		}
+		return f.path + ".casaos.bak." + strconv.Itoa(i)
+	}
+
+	for i := maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backup(i-1), backup(i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return copy(f.path, backup(0))
+}
+
+func render(lines []line) string {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l.raw)
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
 func parseEntry(line string) (*Entry, error) {
 	line = strings.TrimSpace(line)
 	if line == "" || strings.HasPrefix(line, "#") {
 		return nil, nil
 	}
 
+	comment := ""
+	if i := strings.Index(line, "#"); i > 0 && (line[i-1] == ' ' || line[i-1] == '\t') {
+		comment = strings.TrimSpace(line[i+1:])
+		line = line[:i]
+	}
+
 	fields := strings.Fields(line)
 	if len(fields) < 4 {
 		return nil, nil
 	}
 
 	entry := Entry{
-		Dump: 0,
-		Pass: PassDoNotCheck,
+		Dump:    0,
+		Pass:    PassDoNotCheck,
+		Comment: comment,
 	}
 
-	entry.Source = fields[0]
-	entry.MountPoint = fields[1]
+	entry.Source = unescape(fields[0])
+	entry.MountPoint = unescape(fields[1])
 	entry.FSType = fields[2]
 	entry.Options = fields[3]
 
@@ -222,6 +451,20 @@ func parseEntry(line string) (*Entry, error) {
 	return &entry, nil
 }
 
+// spaces and tabs in source and mount point are written as octal escapes, as in fstab(5)
+var (
+	escaper   = strings.NewReplacer(`\`, `\134`, " ", `\040`, "\t", `\011`, "#", `\043`)
+	unescaper = strings.NewReplacer(`\134`, `\`, `\040`, " ", `\011`, "\t", `\043`, "#")
+)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func unescape(s string) string {
+	return unescaper.Replace(s)
+}
+
 func foreachLine(path string, handle func(line string) error) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -1,7 +1,11 @@
 package fstab
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"gotest.tools/v3/assert"
@@ -55,3 +59,104 @@ func TestFSTab(t *testing.T) {
 	assert.Equal(t, entry.Dump, 0)
 	assert.Equal(t, entry.Pass, PassDoNotCheck)
 }
+
+func TestFSTabPreservesCommentsAndOrder(t *testing.T) {
+	fstab := &FStab{path: filepath.Join(t.TempDir(), "fstab")}
+
+	err := os.WriteFile(fstab.path, []byte(fstabContent), 0o600)
+	assert.NilError(t, err)
+
+	err = fstab.Update("/media", Entry{
+		Source:     "/mnt/sdb:/mnt/sdc:/mnt/sdd",
+		MountPoint: "/media",
+		FSType:     "mergerfs",
+		Options:    "defaults,allow_other",
+		Comment:    "three branches",
+	})
+	assert.NilError(t, err)
+
+	err = fstab.Add(Entry{Source: "LABEL=My Photos", MountPoint: "/media/My Photos", FSType: "ext4"}, false)
+	assert.NilError(t, err)
+
+	content, err := os.ReadFile(fstab.path)
+	assert.NilError(t, err)
+
+	assert.Equal(t, string(content), "\n"+
+		"\t# UNCONFIGURED FSTAB FOR BASE SYSTEM\n"+
+		"\tLABEL=UEFI      /boot/efi       vfat    umask=0077      0 1\n"+
+		"/mnt/sdb:/mnt/sdc:/mnt/sdd\t/media\tmergerfs\tdefaults,allow_other\t0\t0\t# three branches\n"+
+		"\tLABEL=desktop-rootfs    /               ext4    defaults        0 1\n"+
+		"LABEL=My\\040Photos\t/media/My\\040Photos\text4\tdefaults\t0\t0\t# Added by the CasaOS\n")
+
+	entries, err := fstab.GetEntries()
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 4)
+
+	assert.Equal(t, entries[1].LineNumber, 4)
+	assert.Equal(t, entries[1].Comment, "three branches")
+
+	assert.Equal(t, entries[3].LineNumber, 6)
+	assert.Equal(t, entries[3].Source, "LABEL=My Photos")
+	assert.Equal(t, entries[3].MountPoint, "/media/My Photos")
+
+	err = fstab.Update("/nonexistent", *entries[3])
+	assert.ErrorIs(t, err, ErrFSTabEntryNotFound)
+
+	err = fstab.Add(Entry{Source: "/dev/sdb1", MountPoint: "relative", FSType: "ext4"}, false)
+	assert.ErrorIs(t, err, ErrInvalidFSTabEntry)
+
+	// 2 changes, 2 backups
+	_, err = os.Stat(fstab.path + ".casaos.bak")
+	assert.NilError(t, err)
+
+	_, err = os.Stat(fstab.path + ".casaos.bak.1")
+	assert.NilError(t, err)
+}
+
+func TestFSTabConcurrentChanges(t *testing.T) {
+	fstab := &FStab{path: filepath.Join(t.TempDir(), "fstab")}
+
+	err := os.WriteFile(fstab.path, []byte(fstabContent), 0o600)
+	assert.NilError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Check(t, fstab.Add(Entry{Source: fmt.Sprintf("/dev/sdz%d", i), MountPoint: fmt.Sprintf("/media/sdz%d", i), FSType: "ext4"}, false))
+		}(i)
+	}
+	wg.Wait()
+
+	// none of them lost to another one read before it was written
+	entries, err := fstab.GetEntries()
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 23)
+}
+
+func TestParseFindmntVerify(t *testing.T) {
+	output := `/mnt/xx
+   [E] unreachable on boot required target: No such file or directory
+   [E] unreachable on boot required source: UUID=nonexist
+/mnt/yy
+   [W] unreachable source: /dev/sda1: No such file or directory
+`
+
+	assert.DeepEqual(t, parseFindmntVerify(output), []string{"/mnt/xx: unreachable on boot required source: UUID=nonexist"})
+}
+
+func TestVerify(t *testing.T) {
+	if _, err := exec.LookPath("findmnt"); err != nil {
+		t.Skip("findmnt is not available")
+	}
+
+	current := "UUID=00000000-0000-0000-0000-000000000001\t/mnt/broken\text4\tdefaults\t0\t0\n"
+
+	// an unrelated broken entry does not block the change
+	err := Verify(current, current+"UUID=00000000-0000-0000-0000-000000000002\t/mnt/new\text4\tdefaults,nofail\t0\t0\n")
+	assert.NilError(t, err)
+
+	err = Verify(current, current+"UUID=00000000-0000-0000-0000-000000000002\t/mnt/new\text4\tdefaults\t0\t0\n")
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+}
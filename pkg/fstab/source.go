@@ -0,0 +1,42 @@
+package fstab
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// symlinks maintained by udev for each way of specifying a source by tag
+var tagDirs = map[string]string{
+	"UUID":      "/dev/disk/by-uuid",
+	"LABEL":     "/dev/disk/by-label",
+	"PARTUUID":  "/dev/disk/by-partuuid",
+	"PARTLABEL": "/dev/disk/by-partlabel",
+}
+
+// ResolveSource returns the device source refers to, e.g. /dev/sdb1 for UUID=..., LABEL=..., PARTUUID=..., PARTLABEL=...
+// or a symlink below /dev. It returns an empty string if source is not a device, or the device is not present.
+func ResolveSource(source string) string {
+	path := source
+
+	if tag, value, found := strings.Cut(source, "="); found {
+		dir, ok := tagDirs[strings.ToUpper(tag)]
+		if !ok || value == "" {
+			return ""
+		}
+
+		// udev escapes labels with spaces and slashes
+		value = strings.ReplaceAll(strings.Trim(value, `"`), "/", `\x2f`)
+		path = filepath.Join(dir, strings.ReplaceAll(value, " ", `\x20`))
+	}
+
+	if !strings.HasPrefix(path, "/dev/") {
+		return ""
+	}
+
+	device, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+
+	return device
+}
@@ -0,0 +1,143 @@
+package fstab
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var ErrVerificationFailed = errors.New("fstab verification failed")
+
+// Verify checks content as fstab with `findmnt --verify`, or with `mount --fake --all` if findmnt is not available, without mounting anything.
+//
+// Only problems not in current are reported, so that a change is not blocked by an unrelated entry that is broken already.
+// A mount point directory that does not exist yet is not a problem, as it is created on mount, nor is a device that is not present
+// for an entry with nofail.
+func Verify(current, content string) error {
+	if _, err := exec.LookPath("findmnt"); err != nil {
+		_, err := verifyFile(content, "mount", "--fake", "--all", "--verbose", "--fstab")
+		return err
+	}
+
+	problems, err := verifyFile(content, "findmnt", "--verify", "--tab-file")
+	if err == nil {
+		return nil
+	}
+
+	known, _ := verifyFile(current, "findmnt", "--verify", "--tab-file")
+	knownSet := make(map[string]bool, len(known))
+	for _, problem := range known {
+		knownSet[problem] = true
+	}
+
+	newProblems := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		if !knownSet[problem] {
+			newProblems = append(newProblems, problem)
+		}
+	}
+
+	if len(newProblems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrVerificationFailed, strings.Join(newProblems, "; "))
+}
+
+// verifyFile writes content to a temporary file, verifies it with name and args, followed by the path of the file,
+// and returns the problems found, if verification fails.
+func verifyFile(content string, name string, args ...string) ([]string, error) {
+	file, err := os.CreateTemp("", "fstab.casaos.verify.*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	nofail := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		if entry, _ := parseEntry(line); entry != nil {
+			for _, option := range strings.Split(entry.Options, ",") {
+				if option == "nofail" {
+					nofail[escape(entry.MountPoint)] = true
+				}
+			}
+		}
+	}
+
+	output, err := exec.Command(name, append(args, file.Name())...).CombinedOutput() // #nosec
+	if err == nil {
+		return nil, nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	if name != "findmnt" {
+		return nil, fmt.Errorf("%w: %s", ErrVerificationFailed, strings.TrimSpace(string(output)))
+	}
+
+	problems := make([]string, 0)
+	for _, problem := range parseFindmntVerify(string(output)) {
+		// a device that is not present is expected for nofail, e.g. a USB disk that is not always plugged in
+		target, message, _ := strings.Cut(problem, ": ")
+		if strings.HasPrefix(message, "unreachable") && nofail[target] {
+			continue
+		}
+
+		problems = append(problems, problem)
+	}
+
+	if len(problems) == 0 {
+		return nil, nil
+	}
+
+	return problems, ErrVerificationFailed
+}
+
+// parseFindmntVerify returns the errors in the output of `findmnt --verify`, each prefixed by its target, e.g.
+//
+//	/mnt/foo
+//	   [E] unreachable on boot required source: UUID=...
+//
+// becomes "/mnt/foo: unreachable on boot required source: UUID=..."
+func parseFindmntVerify(output string) []string {
+	problems := []string{}
+
+	target := ""
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			target = strings.TrimSpace(line)
+			continue
+		}
+
+		message, found := strings.CutPrefix(strings.TrimSpace(line), "[E] ")
+		if !found {
+			continue
+		}
+
+		if strings.Contains(message, "target: No such file or directory") {
+			continue
+		}
+
+		problems = append(problems, target+": "+message)
+	}
+
+	return problems
+}
@@ -0,0 +1,135 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
+)
+
+const (
+	FSType = "crypto_LUKS"
+
+	mapperPrefix   = "luks-"
+	mapperPath     = "/dev/mapper"
+	keyFileDir     = "/etc/casaos/keys"
+	keyFileSize    = 4096
+	keyFileSuffix  = ".key"
+	cryptsetupPath = "cryptsetup"
+)
+
+var ErrEmptyPassphrase = errors.New("passphrase should not be empty")
+
+// IsLUKS tells if the device at path is a LUKS container.
+func IsLUKS(device string) bool {
+	_, err := command.ExecuteCommand(cryptsetupPath, "isLuks", device)
+	return err == nil
+}
+
+// Format formats the device at path as a LUKS2 container unlocked by passphrase. Anything on it is lost.
+func Format(device, passphrase string) error {
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	_, err := command.ExecuteCommandWithStdin([]byte(passphrase), cryptsetupPath, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file=-", device)
+	return err
+}
+
+// GetUUID returns the UUID of the LUKS container at device, which is different from the UUID of the filesystem inside it.
+func GetUUID(device string) (string, error) {
+	out, err := command.ExecuteCommand(cryptsetupPath, "luksUUID", device)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// Open unlocks the LUKS container at device with passphrase, into /dev/mapper/<name>.
+func Open(device, name, passphrase string) error {
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	_, err := command.ExecuteCommandWithStdin([]byte(passphrase), cryptsetupPath, "open", "--type", "luks", "--key-file=-", device, name)
+	return err
+}
+
+// OpenWithKeyFile unlocks the LUKS container at device with keyFile, into /dev/mapper/<name>.
+func OpenWithKeyFile(device, name, keyFile string) error {
+	_, err := command.ExecuteCommand(cryptsetupPath, "open", "--type", "luks", "--key-file", keyFile, device, name)
+	return err
+}
+
+// Close locks the LUKS container opened as /dev/mapper/<name>. Anything mounted from it should be unmounted first.
+func Close(name string) error {
+	_, err := command.ExecuteCommand(cryptsetupPath, "close", name)
+	return err
+}
+
+// IsOpen tells if /dev/mapper/<name> exists.
+func IsOpen(name string) bool {
+	_, err := os.Stat(MapperPath(name))
+	return err == nil
+}
+
+// MapperName returns the name a LUKS container is opened as, e.g. luks-<uuid>, the same as systemd-cryptsetup does.
+func MapperName(uuid string) string {
+	return mapperPrefix + uuid
+}
+
+func MapperPath(name string) string {
+	return filepath.Join(mapperPath, name)
+}
+
+// KeyFilePath returns where the key file for auto-unlocking the LUKS container with uuid is kept.
+func KeyFilePath(uuid string) string {
+	return filepath.Join(keyFileDir, uuid+keyFileSuffix)
+}
+
+// AddKeyFile generates a root-only key file for the LUKS container at device if there is none yet, and adds it to a key slot,
+// authorized by passphrase.
+func AddKeyFile(device, passphrase, keyFile string) error {
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		if err := generateKeyFile(keyFile); err != nil {
+			return err
+		}
+	}
+
+	_, err := command.ExecuteCommandWithStdin([]byte(passphrase), cryptsetupPath, "luksAddKey", "--key-file=-", device, keyFile)
+	return err
+}
+
+// RemoveKeyFile removes keyFile from the key slots of the LUKS container at device, and deletes it.
+func RemoveKeyFile(device, keyFile string) error {
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	if _, err := command.ExecuteCommand(cryptsetupPath, "luksRemoveKey", "--batch-mode", "--key-file", keyFile, device); err != nil {
+		return err
+	}
+
+	return os.Remove(keyFile)
+}
+
+func generateKeyFile(keyFile string) error {
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0o700); err != nil {
+		return err
+	}
+
+	key := make([]byte, keyFileSize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyFile, key, 0o400)
+}
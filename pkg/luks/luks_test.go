@@ -0,0 +1,73 @@
+package luks
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// needs root, cryptsetup and a free loop device
+func setupLoopDevice(t *testing.T) string {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	if _, err := exec.LookPath(cryptsetupPath); err != nil {
+		t.Skip("requires cryptsetup")
+	}
+
+	image := filepath.Join(t.TempDir(), "luks.img")
+	assert.NilError(t, os.WriteFile(image, nil, 0o600))
+	assert.NilError(t, os.Truncate(image, 32<<20))
+
+	out, err := exec.Command("losetup", "--find", "--show", image).Output()
+	if err != nil {
+		t.Skip("requires a free loop device")
+	}
+
+	device := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		_ = exec.Command("losetup", "--detach", device).Run()
+	})
+
+	return device
+}
+
+func TestFormatOpenClose(t *testing.T) {
+	device := setupLoopDevice(t)
+
+	assert.ErrorIs(t, Format(device, ""), ErrEmptyPassphrase)
+
+	assert.NilError(t, Format(device, "correct horse battery staple"))
+	assert.Assert(t, IsLUKS(device))
+
+	uuid, err := GetUUID(device)
+	assert.NilError(t, err)
+	assert.Assert(t, uuid != "")
+
+	name := MapperName(uuid)
+
+	assert.Assert(t, Open(device, name, "wrong") != nil)
+	assert.Assert(t, !IsOpen(name))
+
+	assert.NilError(t, Open(device, name, "correct horse battery staple"))
+	assert.Assert(t, IsOpen(name))
+	assert.NilError(t, Close(name))
+
+	keyFile := filepath.Join(t.TempDir(), uuid+keyFileSuffix)
+	assert.NilError(t, AddKeyFile(device, "correct horse battery staple", keyFile))
+
+	info, err := os.Stat(keyFile)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0o400))
+
+	assert.NilError(t, OpenWithKeyFile(device, name, keyFile))
+	assert.NilError(t, Close(name))
+
+	assert.NilError(t, RemoveKeyFile(device, keyFile))
+	assert.Assert(t, OpenWithKeyFile(device, name, keyFile) != nil)
+}
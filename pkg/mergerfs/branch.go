@@ -0,0 +1,93 @@
+package mergerfs
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	BranchModeRW = "RW" // read/write - the default
+	BranchModeRO = "RO" // read-only - files are never created, changed or removed on it
+	BranchModeNC = "NC" // no-create - existing files can be changed or removed, but no new file is created on it
+)
+
+var BranchModes = []string{BranchModeRW, BranchModeRO, BranchModeNC}
+
+// Branch is a source of a mergerfs mount, as in user.mergerfs.branches, e.g. /mnt/a=NC,4G
+type Branch struct {
+	Path         string
+	Mode         string // empty means RW
+	MinFreeSpace string // overrides minfreespace of the mount for this branch, e.g. 4G
+}
+
+// ParseBranch parses a branch like /mnt/a, /mnt/a=RO or /mnt/a=NC,4G
+func ParseBranch(value string) (Branch, error) {
+	path, options, found := strings.Cut(value, "=")
+	branch := Branch{Path: path}
+
+	if found {
+		branch.Mode, branch.MinFreeSpace, _ = strings.Cut(options, ",")
+	}
+
+	if err := branch.Validate(); err != nil {
+		return Branch{}, err
+	}
+
+	return branch, nil
+}
+
+// ParseBranches parses a value of user.mergerfs.branches, i.e. branches separated by colons.
+func ParseBranches(value string) ([]Branch, error) {
+	branches := make([]Branch, 0)
+	for _, v := range strings.Split(value, ":") {
+		if v == "" {
+			continue
+		}
+
+		branch, err := ParseBranch(v)
+		if err != nil {
+			return nil, err
+		}
+
+		branches = append(branches, branch)
+	}
+
+	return branches, nil
+}
+
+// Validate returns ErrInvalidOption if the mode or minfreespace of b is not something mergerfs takes.
+func (b Branch) Validate() error {
+	if b.Path == "" {
+		return fmt.Errorf("%w: branch without path", ErrInvalidOption)
+	}
+
+	if b.Mode != "" && !slices.Contains(BranchModes, b.Mode) {
+		return fmt.Errorf("%w: unknown mode %s for branch %s", ErrInvalidOption, b.Mode, b.Path)
+	}
+
+	if b.MinFreeSpace != "" && !minFreeSpacePattern.MatchString(b.MinFreeSpace) {
+		return fmt.Errorf("%w: %s of branch %s should be a size like 500M or 4G, not %s", ErrInvalidOption, OptionMinFreeSpace, b.Path, b.MinFreeSpace)
+	}
+
+	return nil
+}
+
+// String returns b as in user.mergerfs.branches - only the path for a RW branch without minfreespace, so that a branch
+// read back from mergerfs, which always has the mode, compares equal to the one it was set with.
+func (b Branch) String() string {
+	mode := b.Mode
+	if mode == "" {
+		mode = BranchModeRW
+	}
+
+	if b.MinFreeSpace != "" {
+		return b.Path + "=" + mode + "," + b.MinFreeSpace
+	}
+
+	if mode != BranchModeRW {
+		return b.Path + "=" + mode
+	}
+
+	return b.Path
+}
@@ -0,0 +1,34 @@
+package mergerfs
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseBranches(t *testing.T) {
+	branches, err := ParseBranches("/var/lib/casaos/files=RW:/mnt/archive=RO:/mnt/full=NC,4G")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, branches, []Branch{
+		{Path: "/var/lib/casaos/files", Mode: BranchModeRW},
+		{Path: "/mnt/archive", Mode: BranchModeRO},
+		{Path: "/mnt/full", Mode: BranchModeNC, MinFreeSpace: "4G"},
+	})
+
+	_, err = ParseBranches("/mnt/a=XX")
+	assert.Assert(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestBranchString(t *testing.T) {
+	// round-trips, as mergerfs always reports the mode
+	for _, value := range []string{"/mnt/a", "/mnt/a=RO", "/mnt/a=NC,4G", "/mnt/a=RW,500M"} {
+		branch, err := ParseBranch(value)
+		assert.NilError(t, err)
+		assert.Equal(t, branch.String(), value)
+	}
+
+	branch, err := ParseBranch("/mnt/a=RW")
+	assert.NilError(t, err)
+	assert.Equal(t, branch.String(), "/mnt/a")
+}
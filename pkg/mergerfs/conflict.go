@@ -0,0 +1,317 @@
+package mergerfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	ConflictActionKeepNewest  = "keep_newest"  // remove all copies but the most recently modified one
+	ConflictActionKeepLargest = "keep_largest" // remove all copies but the largest one
+	ConflictActionRename      = "rename"       // rename the shadowed copies, so that all of them show up in the merge
+)
+
+var (
+	ConflictActions = []string{ConflictActionKeepNewest, ConflictActionKeepLargest, ConflictActionRename}
+
+	ErrInvalidConflictAction = errors.New("invalid conflict resolution action")
+	ErrNoConflict            = errors.New("path is not on more than one branch")
+	ErrBranchReadOnly        = errors.New("a copy to change is on a read-only branch")
+)
+
+// ConflictFile is a copy of a conflicting file, on one branch.
+type ConflictFile struct {
+	Branch  string
+	Mode    string // of the branch, empty meaning RW
+	Size    int64
+	ModTime time.Time
+	Hash    string // sha256, only if hashed
+}
+
+// Conflict is a regular file at the same path, relative to the branches, on more than one branch. Only the copy on the
+// first branch shows up in the merge - the others are shadowed by it.
+type Conflict struct {
+	Path  string
+	Files []ConflictFile // in the order of the branches, the first one being the visible one
+
+	// all copies have the same size and content - or the same size and modification time, if not hashed
+	Identical bool
+}
+
+// FindConflicts walks the branches and calls found for each regular file on more than one of them, without crossing into
+// other filesystems. The copies are hashed if withHash and they all have the same size, as copies with different sizes
+// differ anyway. It returns the number of files scanned.
+func FindConflicts(ctx context.Context, branches []Branch, withHash bool, found func(Conflict)) (int64, error) {
+	var scanned int64
+
+	for i, branch := range branches {
+		var root syscall.Stat_t
+		if err := syscall.Stat(branch.Path, &root); err != nil {
+			return scanned, err
+		}
+
+		err := filepath.WalkDir(branch.Path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// e.g. removed while walking
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if d.IsDir() {
+				info, err := d.Info()
+				if err != nil {
+					return nil
+				}
+
+				if stat, ok := info.Sys().(*syscall.Stat_t); ok && uint64(stat.Dev) != uint64(root.Dev) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), rebalanceTempPrefix) {
+				return nil
+			}
+
+			scanned++
+
+			rel, err := filepath.Rel(branch.Path, p)
+			if err != nil {
+				return err
+			}
+
+			// reported already, when walking the earlier branch
+			for _, earlier := range branches[:i] {
+				if info, err := os.Lstat(filepath.Join(earlier.Path, rel)); err == nil && info.Mode().IsRegular() {
+					return nil
+				}
+			}
+
+			conflict, err := findConflict(branches[i:], rel, withHash)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if conflict != nil {
+				found(*conflict)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return scanned, err
+		}
+	}
+
+	return scanned, nil
+}
+
+// GetConflict returns the conflict at path, relative to the branches - ErrNoConflict if the file is on one branch only.
+func GetConflict(branches []Branch, path string, withHash bool) (*Conflict, error) {
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == "." || strings.HasPrefix(path, "../") || path == ".." {
+		return nil, fmt.Errorf("%w: %s should be relative to the merge", ErrNoConflict, path)
+	}
+
+	conflict, err := findConflict(branches, path, withHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if conflict == nil {
+		return nil, ErrNoConflict
+	}
+
+	return conflict, nil
+}
+
+// findConflict returns the conflict at path on branches, or nil if the file is on one branch only.
+func findConflict(branches []Branch, path string, withHash bool) (*Conflict, error) {
+	conflict := Conflict{Path: path}
+
+	for _, branch := range branches {
+		info, err := os.Lstat(filepath.Join(branch.Path, path))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		conflict.Files = append(conflict.Files, ConflictFile{
+			Branch:  branch.Path,
+			Mode:    branch.Mode,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	if len(conflict.Files) < 2 {
+		return nil, nil
+	}
+
+	sameSize, sameModTime := true, true
+	for _, file := range conflict.Files[1:] {
+		sameSize = sameSize && file.Size == conflict.Files[0].Size
+		sameModTime = sameModTime && file.ModTime.Equal(conflict.Files[0].ModTime)
+	}
+
+	if !sameSize || !withHash {
+		conflict.Identical = sameSize && sameModTime
+		return &conflict, nil
+	}
+
+	conflict.Identical = true
+	for i := range conflict.Files {
+		hash, err := hashFile(filepath.Join(conflict.Files[i].Branch, path))
+		if err != nil {
+			return nil, err
+		}
+
+		conflict.Files[i].Hash = hash
+		conflict.Identical = conflict.Identical && hash == conflict.Files[0].Hash
+	}
+
+	return &conflict, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ResolveConflict resolves conflict, found on branches, with action, and returns the full paths of the copies removed or
+// renamed, and what they were renamed to. Copies on RO branches are never changed, and nothing is changed if a copy is
+// open, or changed since conflict was found. On a tie, the copy on the earliest branch is kept.
+func ResolveConflict(branches []Branch, conflict Conflict, action string) (removed []string, renamed map[string]string, err error) {
+	if len(conflict.Files) < 2 {
+		return nil, nil, ErrNoConflict
+	}
+
+	var changed []ConflictFile
+	switch action {
+	case ConflictActionKeepNewest, ConflictActionKeepLargest:
+		keep := 0
+		for i, file := range conflict.Files {
+			if action == ConflictActionKeepNewest && file.ModTime.After(conflict.Files[keep].ModTime) ||
+				action == ConflictActionKeepLargest && file.Size > conflict.Files[keep].Size {
+				keep = i
+			}
+		}
+
+		for i, file := range conflict.Files {
+			if i != keep {
+				changed = append(changed, file)
+			}
+		}
+
+	case ConflictActionRename:
+		changed = conflict.Files[1:]
+
+	default:
+		return nil, nil, fmt.Errorf("%w: %s should be one of %s", ErrInvalidConflictAction, action, strings.Join(ConflictActions, ", "))
+	}
+
+	open, err := OpenFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, file := range changed {
+		if file.Mode == BranchModeRO {
+			return nil, nil, fmt.Errorf("%w: %s", ErrBranchReadOnly, file.Branch)
+		}
+
+		path := filepath.Join(file.Branch, conflict.Path)
+		if open[path] {
+			return nil, nil, fmt.Errorf("%w: %s", ErrFileOpen, path)
+		}
+	}
+
+	for _, file := range conflict.Files {
+		path := filepath.Join(file.Branch, conflict.Path)
+
+		info, err := os.Lstat(path)
+		if err != nil || !sameFile(info, file.Size, file.ModTime) {
+			return nil, nil, fmt.Errorf("%w: %s", ErrFileChanged, path)
+		}
+	}
+
+	if action != ConflictActionRename {
+		for _, file := range changed {
+			path := filepath.Join(file.Branch, conflict.Path)
+			if err := os.Remove(path); err != nil {
+				return removed, nil, err
+			}
+			removed = append(removed, path)
+		}
+
+		return removed, nil, nil
+	}
+
+	renamed = make(map[string]string)
+	for _, file := range changed {
+		name, err := conflictName(branches, conflict.Path)
+		if err != nil {
+			return nil, renamed, err
+		}
+
+		path := filepath.Join(file.Branch, conflict.Path)
+		if err := os.Rename(path, filepath.Join(file.Branch, name)); err != nil {
+			return nil, renamed, err
+		}
+		renamed[path] = filepath.Join(file.Branch, name)
+	}
+
+	return nil, renamed, nil
+}
+
+// conflictName returns a name for a renamed copy of path, e.g. a (conflict 1).mkv for a.mkv, that is on none of branches.
+func conflictName(branches []Branch, path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	for n := 1; n < 1000; n++ {
+		name := fmt.Sprintf("%s (conflict %d)%s", base, n, ext)
+
+		free := true
+		for _, branch := range branches {
+			if _, err := os.Lstat(filepath.Join(branch.Path, name)); err == nil {
+				free = false
+				break
+			}
+		}
+
+		if free {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrFileExists, path)
+}
@@ -0,0 +1,110 @@
+package mergerfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestFindConflicts(t *testing.T) {
+	a, b, c := t.TempDir(), t.TempDir(), t.TempDir()
+
+	for _, dir := range []string{a, b, c} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(dir, "Media"), 0o755))
+	}
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	writeFile(t, filepath.Join(a, "Media", "a.mkv"), "old but large", old)
+	writeFile(t, filepath.Join(c, "Media", "a.mkv"), "newer", old.Add(time.Minute))
+	writeFile(t, filepath.Join(b, "Media", "same.txt"), "same", old)
+	writeFile(t, filepath.Join(c, "Media", "same.txt"), "same", old.Add(time.Minute))
+	writeFile(t, filepath.Join(b, "Media", "only.txt"), "only", old)
+
+	branches := []Branch{{Path: a}, {Path: b}, {Path: c, Mode: BranchModeRO}}
+
+	conflicts := make(map[string]Conflict)
+	scanned, err := FindConflicts(context.Background(), branches, true, func(conflict Conflict) {
+		conflicts[conflict.Path] = conflict
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, scanned, int64(5))
+	assert.Equal(t, len(conflicts), 2)
+
+	conflict := conflicts["Media/a.mkv"]
+	assert.Equal(t, len(conflict.Files), 2)
+	assert.Equal(t, conflict.Files[0].Branch, a)
+	assert.Equal(t, conflict.Files[1].Branch, c)
+	assert.Assert(t, !conflict.Identical)
+	assert.Equal(t, conflict.Files[0].Hash, "") // not hashed, as the sizes differ
+
+	// same content, even though modified at different times
+	assert.Assert(t, conflicts["Media/same.txt"].Identical)
+	assert.Assert(t, conflicts["Media/same.txt"].Files[0].Hash != "")
+
+	// the shadowed copy is on a read-only branch, so it is neither renamed nor removed
+	_, _, err = ResolveConflict(branches, conflict, ConflictActionRename)
+	assert.ErrorIs(t, err, ErrBranchReadOnly)
+
+	_, _, err = ResolveConflict(branches, conflict, ConflictActionKeepLargest)
+	assert.ErrorIs(t, err, ErrBranchReadOnly)
+
+	_, _, err = ResolveConflict(branches, conflict, "merge")
+	assert.ErrorIs(t, err, ErrInvalidConflictAction)
+
+	removed, _, err := ResolveConflict(branches, conflict, ConflictActionKeepNewest)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed, []string{filepath.Join(a, "Media", "a.mkv")})
+}
+
+func TestResolveConflict(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	branches := []Branch{{Path: a}, {Path: b}}
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	writeFile(t, filepath.Join(a, "a.mkv"), "old but large", old)
+	writeFile(t, filepath.Join(b, "a.mkv"), "newer", old.Add(time.Minute))
+	writeFile(t, filepath.Join(b, "a (conflict 1).mkv"), "taken", old)
+
+	conflict, err := GetConflict(branches, "a.mkv", false)
+	assert.NilError(t, err)
+
+	// changed since found
+	writeFile(t, filepath.Join(b, "a.mkv"), "newest", old.Add(2*time.Minute))
+	_, _, err = ResolveConflict(branches, *conflict, ConflictActionKeepNewest)
+	assert.ErrorIs(t, err, ErrFileChanged)
+
+	conflict, err = GetConflict(branches, "a.mkv", false)
+	assert.NilError(t, err)
+
+	_, renamed, err := ResolveConflict(branches, *conflict, ConflictActionRename)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, renamed, map[string]string{filepath.Join(b, "a.mkv"): filepath.Join(b, "a (conflict 2).mkv")})
+
+	_, err = GetConflict(branches, "a.mkv", false)
+	assert.ErrorIs(t, err, ErrNoConflict)
+
+	writeFile(t, filepath.Join(a, "b.txt"), "old but large", old)
+	writeFile(t, filepath.Join(b, "b.txt"), "newer", old.Add(time.Minute))
+
+	conflict, err = GetConflict(branches, "b.txt", false)
+	assert.NilError(t, err)
+
+	removed, _, err := ResolveConflict(branches, *conflict, ConflictActionKeepLargest)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed, []string{filepath.Join(b, "b.txt")})
+
+	content, err := os.ReadFile(filepath.Join(a, "b.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "old but large")
+}
+
+func writeFile(t *testing.T, path, content string, modTime time.Time) {
+	assert.NilError(t, os.WriteFile(path, []byte(content), 0o644))
+	assert.NilError(t, os.Chtimes(path, modTime, modTime))
+}
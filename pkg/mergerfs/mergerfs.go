@@ -2,6 +2,9 @@ package mergerfs
 
 import (
 	"bytes"
+	"context"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
@@ -14,54 +17,97 @@ func ControlFile(fspath string) string {
 	return filepath.Join(fspath, ".mergerfs")
 }
 
+// ListValues returns all user.mergerfs.* values of the mergerfs mount at fspath, from its control file, by key - of any size.
 func ListValues(fspath string) (map[string]string, error) {
 	ctrlfile := ControlFile(fspath)
 
-	buf := make([]byte, 4096)
-	size, err := syscall.Listxattr(ctrlfile, buf)
+	keys, err := listxattr(ctrlfile)
 	if err != nil {
 		return nil, err
 	}
 
-	buf = buf[:size]
-
 	values := make(map[string]string)
-	for _, keyBuf := range bytes.Split(buf, []byte{0}) {
-		if len(keyBuf) == 0 {
-			continue
-		}
-		key := string(keyBuf)
-		value := make([]byte, 512)
-		size, err := syscall.Getxattr(ctrlfile, key, value)
+	for _, key := range keys {
+		value, err := getxattr(ctrlfile, key)
 		if err != nil {
 			return nil, err
 		}
-		value = value[:size]
 		values[key] = string(value)
 	}
 
 	return values, nil
 }
 
+// listxattr returns the names of the extended attributes of path. The size is asked first, and asked again should the
+// names grow in between, e.g. as a branch is added.
+func listxattr(path string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keys := make([]string, 0)
+		for _, key := range bytes.Split(buf[:size], []byte{0}) {
+			if len(key) > 0 {
+				keys = append(keys, string(key))
+			}
+		}
+
+		return keys, nil
+	}
+}
+
+// getxattr returns the extended attribute key of path, of any size, the same way as listxattr.
+func getxattr(path, key string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, key, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, key, value)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return value[:size], nil
+	}
+}
+
+// SetSource sets the branches of the mergerfs mount at fspath, in order. Each source is a path, optionally with a mode and
+// minfreespace, e.g. /mnt/a=NC,4G - the first one wins if a path is given more than once.
 func SetSource(fspath string, sources []string) error {
 	ctrlfile := ControlFile(fspath)
 
 	key := "user.mergerfs.branches"
 
-	sourceMap := make(map[string]interface{})
+	seen := make(map[string]bool)
+	dedupedSources := make([]string, 0, len(sources))
 	for _, source := range sources {
-		sourceMap[source] = true
-	}
-
-	dedupedSources := make([]string, 0)
-	for source := range sourceMap {
+		path, _, _ := strings.Cut(source, "=")
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
 		dedupedSources = append(dedupedSources, source)
 	}
 
 	value := []byte(strings.Join(dedupedSources, ":"))
-	//str, err := command.ExecResultStr("setfattr -n " + key + " -v " + string(string(value)) + " " + ctrlfile)
 	err := syscall.Setxattr(ctrlfile, key, value, 0)
-	//logger.Error("SetSourceStr", zap.String("str", str))
 	if err != nil {
 		logger.Error("SetSource", zap.Error(err))
 		return err
@@ -69,13 +115,58 @@ func SetSource(fspath string, sources []string) error {
 	return err
 }
 
+// GetSource returns the branches of the mergerfs mount at fspath, in the same form as SetSource takes them.
 func GetSource(fspath string) ([]string, error) {
+	branches, err := GetBranches(fspath)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]string, 0, len(branches))
+	for _, branch := range branches {
+		sources = append(sources, branch.String())
+	}
+
+	return sources, nil
+}
+
+// GetMinFreeSpace returns the minfreespace of the mergerfs mount at fspath, in bytes, which applies to the branches without
+// their own.
+func GetMinFreeSpace(fspath string) (uint64, error) {
+	values, err := ListValues(fspath)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := values["user.mergerfs."+OptionMinFreeSpace]
+	if !ok || value == "" {
+		return 0, nil
+	}
+
+	return ParseSize(value)
+}
+
+// GetBranches returns the branches of the mergerfs mount at fspath, with their modes.
+func GetBranches(fspath string) ([]Branch, error) {
 	values, err := ListValues(fspath)
 	if err != nil {
 		return nil, err
 	}
 
-	return strings.Split(values["user.mergerfs.srcmounts"], ":"), nil
+	return ParseBranches(values["user.mergerfs.branches"])
+}
+
+// SetBranches sets the branches of the mergerfs mount at fspath, with their modes.
+func SetBranches(fspath string, branches []Branch) error {
+	sources := make([]string, 0, len(branches))
+	for _, branch := range branches {
+		if err := branch.Validate(); err != nil {
+			return err
+		}
+		sources = append(sources, branch.String())
+	}
+
+	return SetSource(fspath, sources)
 }
 
 func AddSource(fspath string, source string) error {
@@ -105,3 +196,79 @@ func RemovePath(fspath string, path string) error {
 	ctrlfile := ControlFile(fspath)
 	return RemoveSource(ctrlfile, path)
 }
+
+// AllPaths returns the paths on all branches of a file or directory at path in the merged view, from user.mergerfs.allpaths
+func AllPaths(path string) ([]string, error) {
+	value, err := getFileValue(path, "user.mergerfs.allpaths")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for _, p := range strings.Split(value, "\x00") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths, nil
+}
+
+// BasePath returns the branch a file or directory at path in the merged view is read from, from user.mergerfs.basepath
+func BasePath(path string) (string, error) {
+	return getFileValue(path, "user.mergerfs.basepath")
+}
+
+func getFileValue(path, key string) (string, error) {
+	value, err := getxattr(path, key)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(value), "\x00"), nil
+}
+
+// CountFiles returns the number and total size of regular files under path, without crossing into other filesystems.
+func CountFiles(ctx context.Context, path string) (int64, int64, error) {
+	var root syscall.Stat_t
+	if err := syscall.Stat(path, &root); err != nil {
+		return 0, 0, err
+	}
+
+	var files, size int64
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// e.g. removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if d.IsDir() {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && uint64(stat.Dev) != uint64(root.Dev) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		files++
+		size += info.Size()
+		return nil
+	})
+
+	return files, size, err
+}
@@ -0,0 +1,30 @@
+package mergerfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCountFiles(t *testing.T) {
+	branch := t.TempDir()
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(branch, "Media", "Movies"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(branch, "Media", "Movies", "a.mkv"), make([]byte, 1000), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(branch, "b.txt"), make([]byte, 24), 0o644))
+	assert.NilError(t, os.Symlink("b.txt", filepath.Join(branch, "c.txt")))
+
+	files, size, err := CountFiles(context.Background(), branch)
+	assert.NilError(t, err)
+	assert.Equal(t, files, int64(2))
+	assert.Equal(t, size, int64(1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err = CountFiles(ctx, branch)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,267 @@
+package mergerfs
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	OptionCategoryCreate = "category.create"
+	OptionMinFreeSpace   = "minfreespace"
+	OptionMoveOnENOSPC   = "moveonenospc"
+	OptionCacheFiles     = "cache.files"
+	OptionFuncPrefix     = "func."
+
+	keyPrefix = "user.mergerfs."
+)
+
+var (
+	// see https://github.com/trapexit/mergerfs#policy-descriptions
+	Policies = []string{
+		"all", "epall", "epff", "eplfs", "eplus", "epmfs", "eppfrd", "eprand", "erofs",
+		"ff", "lfs", "lus", "mfs", "msplfs", "msplus", "mspmfs", "msppfrd", "newest", "pfrd", "rand",
+	}
+
+	// functions whose policy can be set with func.<function>
+	Functions = []string{
+		"access", "chmod", "chown", "create", "getattr", "getxattr", "link", "listxattr", "mkdir", "mknod", "open",
+		"readlink", "removexattr", "rename", "rmdir", "setxattr", "truncate", "unlink", "utimens",
+	}
+
+	// category of each function, whose policy a function takes unless it is set with func.<function> - see
+	// https://github.com/trapexit/mergerfs#functions-categories-and-policies
+	FunctionCategories = map[string]string{
+		"chmod": "action", "chown": "action", "link": "action", "removexattr": "action", "rename": "action",
+		"rmdir": "action", "setxattr": "action", "truncate": "action", "unlink": "action", "utimens": "action",
+		"create": "create", "mkdir": "create", "mknod": "create",
+		"access": "search", "getattr": "search", "getxattr": "search", "listxattr": "search", "open": "search", "readlink": "search",
+	}
+
+	// policies mergerfs defaults the categories to, but for create, which is category.create
+	defaultCategoryPolicies = map[string]string{"action": "epall", "search": "ff"}
+
+	CacheFilesModes = []string{"libfuse", "off", "partial", "full", "auto-full", "per-process"}
+
+	// DefaultOptions is what a merge is mounted with, for any option it does not set
+	DefaultOptions = Options{
+		CategoryCreate: "mfs",
+		MinFreeSpace:   "1M",
+		MoveOnENOSPC:   &[]bool{true}[0],
+	}
+
+	ErrInvalidOption = errors.New("invalid mergerfs option")
+
+	minFreeSpacePattern = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+)
+
+// Options are the policies and options of a mergerfs mount that can be set per merge. Empty means the mergerfs default.
+type Options struct {
+	CategoryCreate string            // policy to create files and directories with, e.g. epmfs, mfs, lfs or pfrd
+	MinFreeSpace   string            // minimum free space of a branch to create on, e.g. 4G
+	MoveOnENOSPC   *bool             // move the file to another branch when the branch it is being written to runs out of space
+	CacheFiles     string            // page caching mode of files, e.g. off or auto-full
+	Func           map[string]string // policy per function, e.g. getattr -> newest
+}
+
+// Validate returns ErrInvalidOption if any option is set to something mergerfs does not take.
+func (o Options) Validate() error {
+	if o.CategoryCreate != "" && !slices.Contains(Policies, o.CategoryCreate) {
+		return fmt.Errorf("%w: unknown policy %s for %s", ErrInvalidOption, o.CategoryCreate, OptionCategoryCreate)
+	}
+
+	if o.MinFreeSpace != "" && !minFreeSpacePattern.MatchString(o.MinFreeSpace) {
+		return fmt.Errorf("%w: %s should be a size like 500M or 4G, not %s", ErrInvalidOption, OptionMinFreeSpace, o.MinFreeSpace)
+	}
+
+	if o.CacheFiles != "" && !slices.Contains(CacheFilesModes, o.CacheFiles) {
+		return fmt.Errorf("%w: unknown mode %s for %s", ErrInvalidOption, o.CacheFiles, OptionCacheFiles)
+	}
+
+	for function, policy := range o.Func {
+		if !slices.Contains(Functions, function) {
+			return fmt.Errorf("%w: unknown function %s", ErrInvalidOption, OptionFuncPrefix+function)
+		}
+
+		if !slices.Contains(Policies, policy) {
+			return fmt.Errorf("%w: unknown policy %s for %s", ErrInvalidOption, policy, OptionFuncPrefix+function)
+		}
+	}
+
+	return nil
+}
+
+// WithDefaults returns a copy of o with anything not set taken from defaults.
+func (o Options) WithDefaults(defaults Options) Options {
+	if o.CategoryCreate == "" {
+		o.CategoryCreate = defaults.CategoryCreate
+	}
+
+	if o.MinFreeSpace == "" {
+		o.MinFreeSpace = defaults.MinFreeSpace
+	}
+
+	if o.MoveOnENOSPC == nil {
+		o.MoveOnENOSPC = defaults.MoveOnENOSPC
+	}
+
+	if o.CacheFiles == "" {
+		o.CacheFiles = defaults.CacheFiles
+	}
+
+	if len(defaults.Func) > 0 {
+		functions := make(map[string]string, len(defaults.Func)+len(o.Func))
+		for function, policy := range defaults.Func {
+			functions[function] = policy
+		}
+		for function, policy := range o.Func {
+			functions[function] = policy
+		}
+		o.Func = functions
+	}
+
+	return o
+}
+
+// WithFuncDefaults returns a copy of o with the policy of every function not set being the default of its category, so
+// that a function policy unset is reverted on a live mount. Create functions are left alone if category.create is not set.
+func (o Options) WithFuncDefaults() Options {
+	functions := make(map[string]string, len(Functions))
+	for _, function := range Functions {
+		policy, ok := o.Func[function]
+		if !ok {
+			policy = defaultCategoryPolicies[FunctionCategories[function]]
+			if FunctionCategories[function] == "create" {
+				policy = o.CategoryCreate
+			}
+		}
+
+		if policy != "" {
+			functions[function] = policy
+		}
+	}
+
+	o.Func = functions
+	return o
+}
+
+// Values returns the options that are set, by option name, e.g. category.create -> epmfs
+func (o Options) Values() map[string]string {
+	values := make(map[string]string)
+
+	if o.CategoryCreate != "" {
+		values[OptionCategoryCreate] = o.CategoryCreate
+	}
+
+	if o.MinFreeSpace != "" {
+		values[OptionMinFreeSpace] = o.MinFreeSpace
+	}
+
+	if o.MoveOnENOSPC != nil {
+		values[OptionMoveOnENOSPC] = strconv.FormatBool(*o.MoveOnENOSPC)
+	}
+
+	if o.CacheFiles != "" {
+		values[OptionCacheFiles] = o.CacheFiles
+	}
+
+	for function, policy := range o.Func {
+		values[OptionFuncPrefix+function] = policy
+	}
+
+	return values
+}
+
+// String returns the options as mount options, e.g. category.create=mfs,minfreespace=1M,moveonenospc=true
+func (o Options) String() string {
+	values := o.Values()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := make([]string, 0, len(names))
+	for _, name := range names {
+		options = append(options, name+"="+values[name])
+	}
+
+	return strings.Join(options, ",")
+}
+
+// ParseSize parses a size as mergerfs takes it, e.g. 500M or 4G
+func ParseSize(value string) (uint64, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(value, "T"):
+		multiplier = 1 << 40
+	}
+
+	size, err := strconv.ParseUint(strings.TrimRight(value, "KMGT"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s should be a size like 500M or 4G, not %s", ErrInvalidOption, OptionMinFreeSpace, value)
+	}
+
+	return size * multiplier, nil
+}
+
+// ApplyOptions sets the options on the mergerfs mount at fspath, through its control file, without remounting. Functions
+// whose policy is not set are reset to the default of their category.
+//
+// cache.files cannot be changed at runtime - it takes effect next time the merge is mounted.
+func ApplyOptions(fspath string, o Options) error {
+	ctrlfile := ControlFile(fspath)
+
+	values := o.WithFuncDefaults().Values()
+
+	// in order, as setting category.create sets the policy of every create function
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := values[name]
+		if err := syscall.Setxattr(ctrlfile, keyPrefix+name, []byte(value), 0); err != nil {
+			if name == OptionCacheFiles {
+				logger.Info("cache.files will be changed next time the merge is mounted", zap.String("path", fspath), zap.String("value", value), zap.Error(err))
+				continue
+			}
+
+			return fmt.Errorf("failed to set %s=%s on %s: %w", name, value, fspath, err)
+		}
+	}
+
+	return nil
+}
+
+// OptionValues returns the options of the mergerfs mount at fspath, from ListValues, by option name, e.g. category.create -> mfs
+func OptionValues(fspath string) (map[string]string, error) {
+	values, err := ListValues(fspath)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]string, len(values))
+	for key, value := range values {
+		results[strings.TrimPrefix(key, keyPrefix)] = value
+	}
+
+	return results, nil
+}
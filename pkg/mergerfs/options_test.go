@@ -0,0 +1,69 @@
+package mergerfs
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestOptionsString(t *testing.T) {
+	assert.Equal(t, DefaultOptions.String(), "category.create=mfs,minfreespace=1M,moveonenospc=true")
+
+	moveOnENOSPC := false
+	o := Options{
+		CategoryCreate: "epmfs",
+		MoveOnENOSPC:   &moveOnENOSPC,
+		CacheFiles:     "off",
+		Func:           map[string]string{"getattr": "newest"},
+	}
+
+	assert.Equal(t, o.WithDefaults(DefaultOptions).String(), "cache.files=off,category.create=epmfs,func.getattr=newest,minfreespace=1M,moveonenospc=false")
+	assert.Equal(t, Options{}.String(), "")
+}
+
+func TestOptionsWithFuncDefaults(t *testing.T) {
+	o := Options{CategoryCreate: "epmfs", Func: map[string]string{"getattr": "newest", "unlink": "all"}}.WithFuncDefaults()
+
+	assert.Equal(t, len(o.Func), len(Functions))
+	assert.Equal(t, o.Func["getattr"], "newest")
+	assert.Equal(t, o.Func["unlink"], "all")
+	assert.Equal(t, o.Func["open"], "ff")
+	assert.Equal(t, o.Func["rename"], "epall")
+	assert.Equal(t, o.Func["mkdir"], "epmfs")
+
+	// whatever mergerfs was mounted with
+	_, ok := Options{}.WithFuncDefaults().Func["create"]
+	assert.Assert(t, !ok)
+
+	for _, function := range Functions {
+		_, ok := FunctionCategories[function]
+		assert.Assert(t, ok, function)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	assert.NilError(t, DefaultOptions.Validate())
+	assert.NilError(t, Options{MinFreeSpace: "4G", Func: map[string]string{"mkdir": "epall"}}.Validate())
+
+	for _, o := range []Options{
+		{CategoryCreate: "most-free"},
+		{MinFreeSpace: "4 GB"},
+		{CacheFiles: "on"},
+		{Func: map[string]string{"stat": "ff"}},
+		{Func: map[string]string{"getattr": "oldest"}},
+	} {
+		assert.Assert(t, errors.Is(o.Validate(), ErrInvalidOption), o)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]uint64{"0": 0, "500M": 500 << 20, "4G": 4 << 30, "1T": 1 << 40} {
+		size, err := ParseSize(value)
+		assert.NilError(t, err)
+		assert.Equal(t, size, expected)
+	}
+
+	_, err := ParseSize("4GB")
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
@@ -0,0 +1,700 @@
+package mergerfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// prefix of the file being copied to the destination branch, until it is complete
+	rebalanceTempPrefix = ".casaos-rebalance-"
+
+	rebalanceChunkSize = 1 << 20
+)
+
+var (
+	ErrFileOpen       = errors.New("file is open")
+	ErrFileChanged    = errors.New("file changed while being moved")
+	ErrFileExists     = errors.New("file already exists on the destination branch")
+	ErrNotEnoughSpace = errors.New("not enough free space on the other branches")
+	ErrPartialLinks   = errors.New("file has hard links outside the branch, which moving it would break")
+)
+
+// BranchUsage is a branch of a merge with the space used on it.
+type BranchUsage struct {
+	Branch
+	Total uint64
+	Used  uint64
+	Free  uint64 // available to create files on, as mergerfs sees it - less than Total - Used if space is reserved for root
+}
+
+// Percent returns the used space of the branch, in percentage.
+func (b BranchUsage) Percent() float64 {
+	if b.Total == 0 {
+		return 0
+	}
+	return float64(b.Used) * 100 / float64(b.Total)
+}
+
+// FileGroup is a regular file on a branch, with all its hard links, or a symlink.
+type FileGroup struct {
+	Paths   []string // relative to the branch
+	Size    int64
+	ModTime time.Time
+	Symlink bool
+	Partial bool // has hard links outside the branch, which are not moved along
+}
+
+// BranchScan is what is on a branch.
+type BranchScan struct {
+	Files  []FileGroup
+	Dirs   []string // relative to the branch
+	Others []string // e.g. sockets, fifos and device files, which are not moved
+}
+
+// Move is moving a file, with all its hard links, from a branch to another.
+type Move struct {
+	From string
+	To   string
+	FileGroup
+}
+
+// GetBranchUsages returns the space used on each of branches, from statfs.
+func GetBranchUsages(branches []Branch) ([]BranchUsage, error) {
+	usages := make([]BranchUsage, 0, len(branches))
+	for _, branch := range branches {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(branch.Path, &stat); err != nil {
+			return nil, err
+		}
+
+		// in fragments, which is what the block counts are in
+		total := stat.Blocks * uint64(stat.Frsize)
+		usages = append(usages, BranchUsage{
+			Branch: branch,
+			Total:  total,
+			Used:   total - stat.Bfree*uint64(stat.Frsize),
+			Free:   stat.Bavail * uint64(stat.Frsize),
+		})
+	}
+
+	return usages, nil
+}
+
+// Spread returns the difference in percentage points between the most and the least used of branches, but for RO ones,
+// which a rebalance leaves as they are.
+func Spread(branches []BranchUsage) float64 {
+	lowest, highest := -1.0, -1.0
+	for _, branch := range branches {
+		if branch.Mode == BranchModeRO {
+			continue
+		}
+
+		p := branch.Percent()
+		if lowest == -1 || p < lowest {
+			lowest = p
+		}
+		if highest == -1 || p > highest {
+			highest = p
+		}
+	}
+
+	return highest - lowest
+}
+
+// ScanBranch returns what is on the branch at path, without crossing into other filesystems. Hard links of the same file
+// are grouped together.
+func ScanBranch(ctx context.Context, path string) (*BranchScan, error) {
+	var root syscall.Stat_t
+	if err := syscall.Stat(path, &root); err != nil {
+		return nil, err
+	}
+
+	type inode struct{ dev, ino uint64 }
+
+	scan := &BranchScan{}
+	groups := make(map[inode]*FileGroup)
+	links := make(map[inode]uint64)
+	order := make([]inode, 0)
+
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if uint64(stat.Dev) != uint64(root.Dev) {
+				return filepath.SkipDir
+			}
+
+			if rel != "." {
+				scan.Dirs = append(scan.Dirs, rel)
+			}
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			scan.Files = append(scan.Files, FileGroup{Paths: []string{rel}, ModTime: info.ModTime(), Symlink: true})
+
+		case info.Mode().IsRegular():
+			if strings.HasPrefix(d.Name(), rebalanceTempPrefix) {
+				return nil
+			}
+
+			key := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if group, ok := groups[key]; ok {
+				group.Paths = append(group.Paths, rel)
+				return nil
+			}
+
+			groups[key] = &FileGroup{Paths: []string{rel}, Size: info.Size(), ModTime: info.ModTime()}
+			links[key] = uint64(stat.Nlink)
+			order = append(order, key)
+
+		default:
+			scan.Others = append(scan.Others, rel)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range order {
+		group := groups[key]
+		group.Partial = uint64(len(group.Paths)) < links[key]
+		scan.Files = append(scan.Files, *group)
+	}
+
+	return scan, nil
+}
+
+// PlanRebalance returns the moves, of files by branch path, that bring the usage of branches within spread percentage points
+// of each other, or as close as the files allow. Files are moved from the most used branches to the least used RW branches,
+// largest first, and never off RO branches. Files with hard links outside the branch are not moved, as that would break
+// them, and neither are empty files and symlinks, as moving them frees nothing.
+//
+// branches is updated with the usage after the moves.
+func PlanRebalance(branches []BranchUsage, files map[string][]FileGroup, spread float64) []Move {
+	// RO branches neither give nor take files, so the others are balanced among themselves
+	var total, used float64
+	for _, branch := range branches {
+		if branch.Mode == BranchModeRO {
+			continue
+		}
+
+		total += float64(branch.Total)
+		used += float64(branch.Used)
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	average := used / total
+
+	remaining := make(map[string][]FileGroup, len(files))
+	for path, groups := range files {
+		sorted := make([]FileGroup, 0, len(groups))
+		for _, group := range groups {
+			if group.Size > 0 && !group.Symlink && !group.Partial {
+				sorted = append(sorted, group)
+			}
+		}
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+		remaining[path] = sorted
+	}
+
+	exhausted := make(map[int]bool)
+	moves := make([]Move, 0)
+
+	for {
+		from, to := -1, -1
+		for i, branch := range branches {
+			if branch.Total == 0 {
+				continue
+			}
+
+			if branch.Mode != BranchModeRO && !exhausted[i] && (from == -1 || branch.Percent() > branches[from].Percent()) {
+				from = i
+			}
+
+			if (branch.Mode == "" || branch.Mode == BranchModeRW) && (to == -1 || branch.Percent() < branches[to].Percent()) {
+				to = i
+			}
+		}
+
+		if from == -1 || to == -1 || from == to || branches[from].Percent()-branches[to].Percent() <= spread {
+			break
+		}
+
+		// move no more than what brings either branch to the average
+		limit := float64(branches[from].Used) - average*float64(branches[from].Total)
+		if deficit := average*float64(branches[to].Total) - float64(branches[to].Used); deficit < limit {
+			limit = deficit
+		}
+
+		groups := remaining[branches[from].Path]
+		picked := -1
+		for i, group := range groups {
+			if float64(group.Size) <= limit {
+				picked = i
+				break
+			}
+		}
+
+		if picked == -1 {
+			exhausted[from] = true
+			continue
+		}
+
+		group := groups[picked]
+		remaining[branches[from].Path] = append(groups[:picked:picked], groups[picked+1:]...)
+
+		moves = append(moves, Move{From: branches[from].Path, To: branches[to].Path, FileGroup: group})
+
+		branches[from].Used -= uint64(group.Size)
+		branches[to].Used += uint64(group.Size)
+	}
+
+	return moves
+}
+
+// PlanDrain returns the moves of all files off the branch at from, each to the RW branch with the most free space left, or
+// ErrNotEnoughSpace if they do not fit on the other branches. Files with hard links outside the branch cannot be moved
+// without breaking them, nor left behind, so ErrPartialLinks is returned if there are any.
+//
+// The space left on each branch is what is free to create files on, less its minfreespace, or minFreeSpace of the merge
+// if it has none, which mergerfs keeps free for files written through the merge.
+func PlanDrain(from string, branches []BranchUsage, files []FileGroup, minFreeSpace uint64) ([]Move, error) {
+	partial := make([]string, 0)
+	for _, group := range files {
+		if group.Partial {
+			partial = append(partial, group.Paths[0])
+		}
+	}
+
+	if len(partial) > 0 {
+		return nil, fmt.Errorf("%w: %d files, e.g. %s", ErrPartialLinks, len(partial), partial[0])
+	}
+
+	free := make(map[string]int64)
+	for _, branch := range branches {
+		if branch.Path == from || branch.Mode != "" && branch.Mode != BranchModeRW {
+			continue
+		}
+
+		reserved := minFreeSpace
+		if branch.MinFreeSpace != "" {
+			size, err := ParseSize(branch.MinFreeSpace)
+			if err != nil {
+				return nil, err
+			}
+			reserved = size
+		}
+
+		free[branch.Path] = int64(branch.Free) - int64(reserved)
+	}
+
+	if len(free) == 0 {
+		return nil, fmt.Errorf("%w: no other RW branch", ErrNotEnoughSpace)
+	}
+
+	sorted := append([]FileGroup{}, files...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+
+	moves := make([]Move, 0, len(sorted))
+	for _, group := range sorted {
+		to := ""
+		for _, branch := range branches {
+			if _, ok := free[branch.Path]; ok && (to == "" || free[branch.Path] > free[to]) {
+				to = branch.Path
+			}
+		}
+
+		if free[to] < group.Size {
+			return nil, fmt.Errorf("%w: %s does not fit", ErrNotEnoughSpace, group.Paths[0])
+		}
+
+		free[to] -= group.Size
+		moves = append(moves, Move{From: from, To: to, FileGroup: group})
+	}
+
+	return moves, nil
+}
+
+// CopyDirs creates dirs, relative to the branches, on the destination branch as they are on the source branch, e.g. so that
+// empty directories are kept when draining a branch.
+func CopyDirs(from, to string, dirs []string) error {
+	for _, dir := range dirs {
+		if err := ensureDir(from, to, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MoveFiles moves the file of m, with all its hard links, to the destination branch, keeping ownership, permissions, xattrs
+// and times. Directories it is in are created on the destination branch as they are on the source branch.
+//
+// mountPoint is the merge the branches are in, to tell if the file is open through it, along with open, the snapshot of open
+// files from OpenFiles, which the file itself is checked against again right before it is moved. The file is copied under a
+// temporary name first, and the source is only removed once the copy is complete, so it is never lost. progress is called
+// with the number of bytes copied each time, and limiter, if not nil, throttles the copy.
+func MoveFiles(ctx context.Context, mountPoint string, m Move, open map[string]bool, limiter *rate.Limiter, progress func(n int64)) error {
+	if len(m.Paths) == 0 {
+		return nil
+	}
+
+	if m.Symlink {
+		return moveSymlink(m.From, m.To, m.Paths[0])
+	}
+
+	for _, path := range m.Paths {
+		if open[filepath.Join(m.From, path)] || open[filepath.Join(mountPoint, path)] {
+			return ErrFileOpen
+		}
+
+		if _, err := os.Lstat(filepath.Join(m.To, path)); err == nil {
+			return ErrFileExists
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	source := filepath.Join(m.From, m.Paths[0])
+
+	before, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	if !sameFile(before, m.Size, m.ModTime) {
+		return ErrFileChanged
+	}
+
+	// it could have been opened since the snapshot
+	if err := checkNotOpen(source); err != nil {
+		return err
+	}
+
+	for _, path := range m.Paths {
+		if err := ensureDir(m.From, m.To, filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	destination := filepath.Join(m.To, m.Paths[0])
+	temp := filepath.Join(filepath.Dir(destination), rebalanceTempPrefix+filepath.Base(destination))
+
+	if err := copyFile(ctx, source, temp, limiter, progress); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+
+	if err := copyMetadata(source, temp); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+
+	after, err := os.Lstat(source)
+	if err != nil || !sameFile(after, before.Size(), before.ModTime()) {
+		_ = os.Remove(temp)
+		return ErrFileChanged
+	}
+
+	if err := os.Rename(temp, destination); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+
+	for i, path := range m.Paths[1:] {
+		if err := os.Link(destination, filepath.Join(m.To, path)); err != nil {
+			// undo, so that the file is only on the source branch
+			for _, linked := range m.Paths[:i+1] {
+				_ = os.Remove(filepath.Join(m.To, linked))
+			}
+			return err
+		}
+	}
+
+	for _, path := range m.Paths {
+		if err := os.Remove(filepath.Join(m.From, path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func moveSymlink(from, to, path string) error {
+	source := filepath.Join(from, path)
+	destination := filepath.Join(to, path)
+
+	if _, err := os.Lstat(destination); err == nil {
+		return ErrFileExists
+	}
+
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	target, err := os.Readlink(source)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDir(from, to, filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if err := os.Symlink(target, destination); err != nil {
+		return err
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(destination, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+
+		times := []unix.Timespec{unix.NsecToTimespec(stat.Atim.Nano()), unix.NsecToTimespec(info.ModTime().UnixNano())}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, destination, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(source)
+}
+
+func sameFile(info os.FileInfo, size int64, modTime time.Time) bool {
+	return info.Mode().IsRegular() && info.Size() == size && info.ModTime().Equal(modTime)
+}
+
+// OpenFiles returns the paths of all files open by any process, including mergerfs itself, which has the files on the
+// branches open for files open through the merge. It reads every fd of every process, so it is a snapshot to be taken once
+// for many moves.
+func OpenFiles() (map[string]bool, error) {
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, err
+	}
+
+	open := make(map[string]bool)
+	for _, fd := range fds {
+		// the process or the fd could be gone by now
+		if target, err := os.Readlink(fd); err == nil && strings.HasPrefix(target, "/") {
+			open[target] = true
+		}
+	}
+
+	return open, nil
+}
+
+// checkNotOpen returns ErrFileOpen if the file at path is open by any process, including through another hard link, as a
+// write lease on it is refused then - unless the filesystem does not support leases, which leaves it to OpenFiles.
+func checkNotOpen(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_SETLEASE, unix.F_WRLCK); err != nil {
+		if errors.Is(err, unix.EAGAIN) {
+			return ErrFileOpen
+		}
+		return nil
+	}
+
+	// only to tell - it is not held while the file is copied, as opening the file would then block on it
+	_, _ = unix.FcntlInt(f.Fd(), unix.F_SETLEASE, unix.F_UNLCK)
+
+	return nil
+}
+
+// ensureDir creates dir, relative to the branches, on the destination branch, with each directory along the path as on the
+// source branch.
+func ensureDir(from, to, dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(to, dir)); err == nil {
+		return nil
+	}
+
+	if err := ensureDir(from, to, filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	source := filepath.Join(from, dir)
+	destination := filepath.Join(to, dir)
+
+	if err := os.Mkdir(destination, 0o700); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return copyMetadata(source, destination)
+}
+
+func copyFile(ctx context.Context, source, destination string, limiter *rate.Limiter, progress func(n int64)) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := make([]byte, rebalanceChunkSize)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		n, err := in.Read(buf)
+		if n > 0 {
+			if limiter != nil {
+				if err := limiter.WaitN(ctx, n); err != nil {
+					return err
+				}
+			}
+
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+
+			if progress != nil {
+				progress(int64(n))
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// copyMetadata copies ownership, permissions, xattrs and times of source to destination
+func copyMetadata(source, destination string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	if err := os.Lchown(destination, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+
+	// after chown, which clears setuid and setgid
+	if err := syscall.Chmod(destination, stat.Mode&0o7777); err != nil {
+		return err
+	}
+
+	if err := copyXattrs(source, destination); err != nil {
+		return err
+	}
+
+	return os.Chtimes(destination, time.Unix(stat.Atim.Unix()), info.ModTime())
+}
+
+func copyXattrs(source, destination string) error {
+	size, err := unix.Llistxattr(source, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(source, buf)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		valueSize, err := unix.Lgetxattr(source, name, nil)
+		if err != nil {
+			return err
+		}
+
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(source, name, value); err != nil {
+			return err
+		}
+
+		if err := unix.Lsetxattr(destination, name, value[:valueSize], 0); err != nil {
+			// e.g. security.* without the privilege, or the destination filesystem not supporting it
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package mergerfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	const gb = 1 << 30
+
+	branches := []BranchUsage{
+		{Branch: Branch{Path: "/mnt/full"}, Total: 100 * gb, Used: 90 * gb},
+		{Branch: Branch{Path: "/mnt/archive", Mode: BranchModeRO}, Total: 100 * gb, Used: 95 * gb},
+		{Branch: Branch{Path: "/mnt/new"}, Total: 100 * gb, Used: 10 * gb},
+	}
+
+	files := map[string][]FileGroup{
+		"/mnt/full": {
+			{Paths: []string{"small"}, Size: 5 * gb},
+			{Paths: []string{"huge"}, Size: 80 * gb},
+			{Paths: []string{"large", "large.link"}, Size: 30 * gb},
+		},
+		"/mnt/archive": {
+			{Paths: []string{"old"}, Size: 10 * gb},
+		},
+	}
+
+	moves := PlanRebalance(branches, files, 10)
+
+	// the average usage of the branches other than /mnt/archive is 50%, so at most 40G can be moved off /mnt/full - and
+	// nothing off /mnt/archive, nor the huge file
+	assert.DeepEqual(t, moves, []Move{
+		{From: "/mnt/full", To: "/mnt/new", FileGroup: FileGroup{Paths: []string{"large", "large.link"}, Size: 30 * gb}},
+		{From: "/mnt/full", To: "/mnt/new", FileGroup: FileGroup{Paths: []string{"small"}, Size: 5 * gb}},
+	})
+	assert.Assert(t, Spread(branches) <= 10)
+	assert.Equal(t, branches[1].Used, uint64(95*gb))
+
+	assert.Equal(t, len(PlanRebalance(branches, files, 100)), 0)
+}
+
+func TestMoveFiles(t *testing.T) {
+	from, to := t.TempDir(), t.TempDir()
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(from, "Media", "Movies"), 0o750))
+	assert.NilError(t, os.WriteFile(filepath.Join(from, "Media", "Movies", "a.mkv"), []byte("movie"), 0o640))
+	assert.NilError(t, os.Link(filepath.Join(from, "Media", "Movies", "a.mkv"), filepath.Join(from, "Media", "a.mkv")))
+
+	scan, err := ScanBranch(context.Background(), from)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, scan.Dirs, []string{"Media", "Media/Movies"})
+
+	files := scan.Files
+	assert.Equal(t, len(files), 1)
+	assert.Assert(t, !files[0].Partial)
+	assert.Equal(t, len(files[0].Paths), 2)
+
+	var copied int64
+	err = MoveFiles(context.Background(), "/nonexistent", Move{From: from, To: to, FileGroup: files[0]}, map[string]bool{}, nil, func(n int64) { copied += n })
+	assert.NilError(t, err)
+	assert.Equal(t, copied, int64(5))
+
+	for _, path := range files[0].Paths {
+		_, err := os.Stat(filepath.Join(from, path))
+		assert.Assert(t, os.IsNotExist(err))
+	}
+
+	info, err := os.Stat(filepath.Join(to, "Media", "Movies", "a.mkv"))
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0o640))
+	assert.Equal(t, info.ModTime(), files[0].ModTime)
+	assert.Equal(t, uint64(info.Sys().(*syscall.Stat_t).Nlink), uint64(2))
+
+	dir, err := os.Stat(filepath.Join(to, "Media", "Movies"))
+	assert.NilError(t, err)
+	assert.Equal(t, dir.Mode().Perm(), os.FileMode(0o750))
+
+	// the file is gone from the source branch since it was scanned
+	err = MoveFiles(context.Background(), "/nonexistent", Move{From: from, To: to, FileGroup: files[0]}, map[string]bool{}, nil, nil)
+	assert.ErrorIs(t, err, ErrFileExists)
+}
+
+func TestMoveFilesOpen(t *testing.T) {
+	from, to := t.TempDir(), t.TempDir()
+
+	assert.NilError(t, os.WriteFile(filepath.Join(from, "a.mkv"), []byte("movie"), 0o640))
+
+	scan, err := ScanBranch(context.Background(), from)
+	assert.NilError(t, err)
+
+	move := Move{From: from, To: to, FileGroup: scan.Files[0]}
+
+	// open as of the snapshot
+	err = MoveFiles(context.Background(), "/nonexistent", move, map[string]bool{filepath.Join(from, "a.mkv"): true}, nil, nil)
+	assert.ErrorIs(t, err, ErrFileOpen)
+
+	// opened since
+	f, err := os.Open(filepath.Join(from, "a.mkv"))
+	assert.NilError(t, err)
+
+	err = MoveFiles(context.Background(), "/nonexistent", move, map[string]bool{}, nil, nil)
+	assert.ErrorIs(t, err, ErrFileOpen)
+
+	assert.NilError(t, f.Close())
+
+	err = MoveFiles(context.Background(), "/nonexistent", move, map[string]bool{}, nil, nil)
+	assert.NilError(t, err)
+}
+
+func TestPlanDrain(t *testing.T) {
+	const gb = 1 << 30
+
+	branches := []BranchUsage{
+		{Branch: Branch{Path: "/mnt/old"}, Total: 100 * gb, Used: 60 * gb, Free: 35 * gb},
+		{Branch: Branch{Path: "/mnt/a"}, Total: 100 * gb, Used: 70 * gb, Free: 25 * gb}, // 5G reserved for root
+		{Branch: Branch{Path: "/mnt/b"}, Total: 100 * gb, Used: 50 * gb, Free: 50 * gb},
+		{Branch: Branch{Path: "/mnt/archive", Mode: BranchModeRO}, Total: 100 * gb, Used: 0, Free: 100 * gb},
+	}
+
+	files := []FileGroup{
+		{Paths: []string{"x"}, Size: 20 * gb},
+		{Paths: []string{"y"}, Size: 40 * gb},
+		{Paths: []string{"link"}, Symlink: true},
+	}
+
+	moves, err := PlanDrain("/mnt/old", branches, files, gb)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, moves, []Move{
+		{From: "/mnt/old", To: "/mnt/b", FileGroup: files[1]},
+		{From: "/mnt/old", To: "/mnt/a", FileGroup: files[0]},
+		{From: "/mnt/old", To: "/mnt/b", FileGroup: files[2]},
+	})
+
+	// nothing goes to RO branches
+	_, err = PlanDrain("/mnt/old", branches, append(files, FileGroup{Paths: []string{"z"}, Size: 40 * gb}), gb)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+
+	// nor into the space kept free by minfreespace, of the merge or of the branch
+	_, err = PlanDrain("/mnt/old", branches, files, 6*gb)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+
+	branches[2].MinFreeSpace = "11G"
+	_, err = PlanDrain("/mnt/old", branches, files, gb)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+
+	// linked from outside the branch, e.g. by a hard link on the same disk but not in the merge
+	_, err = PlanDrain("/mnt/old", branches, append(files, FileGroup{Paths: []string{"linked"}, Size: gb, Partial: true}), gb)
+	assert.ErrorIs(t, err, ErrPartialLinks)
+	assert.ErrorContains(t, err, "linked")
+}
@@ -0,0 +1,201 @@
+package mergerfs
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	valueBranches  = "branches"
+	valueSrcMounts = "srcmounts" // the same as branches, from older versions of mergerfs
+	valueVersion   = "version"
+	valuePID       = "pid"
+
+	DriftBranches = valueBranches
+)
+
+var versionPattern = regexp.MustCompile(`v?(\d+\.\d+(\.\d+)?\S*)`)
+
+// Runtime is the state of a running mergerfs mount, as read from its control file.
+type Runtime struct {
+	Version  string // empty if not known
+	PID      int    // 0 if not known
+	Branches []Branch
+	Options  map[string]string // all other values, by option name, e.g. category.create -> mfs
+}
+
+// Drift is an option, or the branches, of a running mergerfs mount that differs from what it is expected to have.
+type Drift struct {
+	Name     string // option name, or branches
+	Expected string
+	Actual   string
+}
+
+// GetRuntime returns the state of the mergerfs mount at fspath. The version and pid are taken from the control file of
+// mergerfs versions that have them, or else from mergerfs -V and the process that mounted fspath.
+func GetRuntime(fspath string) (*Runtime, error) {
+	values, err := ListValues(fspath)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime := &Runtime{Options: make(map[string]string)}
+	for key, value := range values {
+		name := strings.TrimPrefix(key, keyPrefix)
+
+		switch name {
+		case valueBranches:
+			if runtime.Branches, err = ParseBranches(value); err != nil {
+				return nil, err
+			}
+		case valueSrcMounts:
+		case valueVersion:
+			runtime.Version = value
+		case valuePID:
+			runtime.PID, _ = strconv.Atoi(value)
+		default:
+			runtime.Options[name] = value
+		}
+	}
+
+	if runtime.Version == "" {
+		runtime.Version = installedVersion()
+	}
+
+	if runtime.PID == 0 {
+		runtime.PID = mountPID(fspath)
+	}
+
+	return runtime, nil
+}
+
+// Compare returns how r differs from branches and options - only options that are set are compared, as the others are
+// whatever the version of mergerfs defaults to.
+func (r Runtime) Compare(branches []Branch, options Options) []Drift {
+	drifts := make([]Drift, 0)
+
+	if !sameBranches(branches, r.Branches) {
+		drifts = append(drifts, Drift{Name: DriftBranches, Expected: branchesString(branches), Actual: branchesString(r.Branches)})
+	}
+
+	expected := options.Values()
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		actual, ok := r.Options[name]
+		if ok && sameOption(name, expected[name], actual) {
+			continue
+		}
+
+		drifts = append(drifts, Drift{Name: name, Expected: expected[name], Actual: actual})
+	}
+
+	return drifts
+}
+
+func sameBranches(a, b []Branch) bool {
+	return slices.EqualFunc(a, b, func(a, b Branch) bool {
+		modeA, modeB := a.Mode, b.Mode
+		if modeA == "" {
+			modeA = BranchModeRW
+		}
+		if modeB == "" {
+			modeB = BranchModeRW
+		}
+
+		return filepath.Clean(a.Path) == filepath.Clean(b.Path) && modeA == modeB && sameSize(a.MinFreeSpace, b.MinFreeSpace)
+	})
+}
+
+func branchesString(branches []Branch) string {
+	values := make([]string, 0, len(branches))
+	for _, branch := range branches {
+		values = append(values, branch.String())
+	}
+
+	return strings.Join(values, ":")
+}
+
+// sameOption tells if the value of option name, as set, is the same as the value mergerfs reports - which is in bytes
+// for sizes, and can be a policy for moveonenospc=true.
+func sameOption(name, expected, actual string) bool {
+	if expected == actual {
+		return true
+	}
+
+	switch name {
+	case OptionMinFreeSpace:
+		return sameSize(expected, actual)
+	case OptionMoveOnENOSPC:
+		return expected == "true" && actual != "false" && actual != ""
+	}
+
+	return false
+}
+
+func sameSize(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	sizeA, errA := ParseSize(a)
+	sizeB, errB := ParseSize(b)
+	return errA == nil && errB == nil && sizeA == sizeB
+}
+
+// installedVersion returns the version of the installed mergerfs, from mergerfs -V, e.g. 2.33.5
+func installedVersion() string {
+	out, err := exec.Command("mergerfs", "-V").CombinedOutput()
+	if err != nil {
+		return ""
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	if match := versionPattern.FindStringSubmatch(line); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+// mountPID returns the pid of the mergerfs process with fspath as its mount point, or 0 if not found.
+func mountPID(fspath string) int {
+	cmdlines, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return 0
+	}
+
+	for _, cmdline := range cmdlines {
+		// the process could be gone by now
+		content, err := os.ReadFile(cmdline)
+		if err != nil {
+			continue
+		}
+
+		args := bytes.Split(bytes.TrimRight(content, "\x00"), []byte{0})
+		if len(args) == 0 || filepath.Base(string(args[0])) != "mergerfs" {
+			continue
+		}
+
+		for _, arg := range args[1:] {
+			if filepath.Clean(string(arg)) == filepath.Clean(fspath) {
+				pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(cmdline)))
+				return pid
+			}
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,82 @@
+package mergerfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGetRuntime(t *testing.T) {
+	fspath := t.TempDir()
+
+	// a control file with values as mergerfs has them - with more names than fit in 512 bytes, and a branch list longer
+	// than that, as far as the filesystem of the test allows
+	ctrlfile := ControlFile(fspath)
+	assert.NilError(t, os.WriteFile(ctrlfile, nil, 0o644))
+
+	branches := make([]string, 0)
+	for i := 0; i < 30; i++ {
+		branches = append(branches, "/media/"+strings.Repeat("a", 40)+string(rune('a'+i%26))+"=RW")
+	}
+
+	values := map[string]string{
+		"user.mergerfs.branches":        strings.Join(branches, ":"),
+		"user.mergerfs.category.create": "mfs",
+		"user.mergerfs.minfreespace":    "4294967296",
+		"user.mergerfs.version":         "2.33.5",
+		"user.mergerfs.pid":             "1234",
+	}
+
+	options := map[string]string{"category.create": "mfs", "minfreespace": "4294967296"}
+	for _, function := range Functions {
+		values[keyPrefix+OptionFuncPrefix+function] = "ff"
+		options[OptionFuncPrefix+function] = "ff"
+	}
+
+	for key, value := range values {
+		if err := syscall.Setxattr(ctrlfile, key, []byte(value), 0); err != nil {
+			if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOSPC) {
+				t.Skip("user extended attributes of this size are not supported here")
+			}
+			assert.NilError(t, err)
+		}
+	}
+
+	runtime, err := GetRuntime(fspath)
+	assert.NilError(t, err)
+
+	assert.Equal(t, runtime.Version, "2.33.5")
+	assert.Equal(t, runtime.PID, 1234)
+	assert.Equal(t, len(runtime.Branches), 30)
+	assert.DeepEqual(t, runtime.Options, options)
+}
+
+func TestRuntimeCompare(t *testing.T) {
+	moveOnENOSPC := true
+
+	runtime := Runtime{
+		Branches: []Branch{{Path: "/var/lib/casaos/files", Mode: BranchModeRW}, {Path: "/media/sdb1", Mode: BranchModeRW, MinFreeSpace: "1073741824"}},
+		Options: map[string]string{
+			OptionCategoryCreate: "mfs",
+			OptionMinFreeSpace:   "4294967296",
+			OptionMoveOnENOSPC:   "pfrd",
+		},
+	}
+
+	branches := []Branch{{Path: "/var/lib/casaos/files/"}, {Path: "/media/sdb1", MinFreeSpace: "1G"}}
+	options := Options{CategoryCreate: "mfs", MinFreeSpace: "4G", MoveOnENOSPC: &moveOnENOSPC}
+
+	assert.DeepEqual(t, runtime.Compare(branches, options), []Drift{})
+
+	branches = append(branches, Branch{Path: "/media/sdc1", Mode: BranchModeNC})
+	options.CategoryCreate = "epmfs"
+
+	assert.DeepEqual(t, runtime.Compare(branches, options), []Drift{
+		{Name: DriftBranches, Expected: "/var/lib/casaos/files/:/media/sdb1=RW,1G:/media/sdc1=NC", Actual: "/var/lib/casaos/files:/media/sdb1=RW,1073741824"},
+		{Name: OptionCategoryCreate, Expected: "epmfs", Actual: "mfs"},
+	})
+}
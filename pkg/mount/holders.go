@@ -0,0 +1,237 @@
+package mount
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
+	"github.com/moby/sys/mountinfo"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	ReferenceFD         = "fd"
+	ReferenceCWD        = "cwd"
+	ReferenceRoot       = "root"
+	ReferenceMaps       = "maps"
+	ReferenceMountInfo  = "mountinfo"
+	defaultProcPath     = "/proc"
+	defaultDockerPath   = "/var/lib/docker"
+	messageTargetIsBusy = "target is busy"
+)
+
+var (
+	ErrTargetBusy = errors.New(messageTargetIsBusy)
+
+	// e.g. 0::/system.slice/docker-<id>.scope, or 12:pids:/docker/<id>
+	containerIDInCGroup = regexp.MustCompile(`(?:docker[-/])([0-9a-f]{64})`)
+)
+
+// A process that holds a reference to a path below a mount point, preventing it from being unmounted.
+type Holder struct {
+	PID           int      `json:"pid"`
+	Command       string   `json:"command"`
+	References    []string `json:"references"` // fd, cwd, root, maps, mountinfo
+	ContainerID   string   `json:"container_id,omitempty"`
+	ContainerName string   `json:"container_name,omitempty"`
+}
+
+type BusyError struct {
+	MountPoint string
+	Holders    []Holder
+	err        error
+}
+
+func (e *BusyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *BusyError) Unwrap() error {
+	return e.err
+}
+
+func (e *BusyError) Is(target error) bool {
+	return target == ErrTargetBusy
+}
+
+// FindHolders scans /proc for processes holding a reference to any path below the mount point.
+func FindHolders(mountpoint string) ([]Holder, error) {
+	return findHolders(defaultProcPath, defaultDockerPath, mountpoint)
+}
+
+// StopHolderContainers stops the app containers among the holders. Holders that are not containers are left alone.
+func StopHolderContainers(holders []Holder) error {
+	stopped := make(map[string]bool)
+	for _, holder := range holders {
+		if holder.ContainerID == "" || stopped[holder.ContainerID] {
+			continue
+		}
+
+		if _, err := command.ExecuteCommand("docker", "stop", holder.ContainerID); err != nil {
+			return err
+		}
+
+		stopped[holder.ContainerID] = true
+	}
+
+	return nil
+}
+
+// RetryStoppingHolders calls umount, and if it fails because the target is busy, stops the app containers holding it and calls umount once more.
+func RetryStoppingHolders(umount func() error) error {
+	err := umount()
+
+	var busyErr *BusyError
+	if !errors.As(err, &busyErr) {
+		return err
+	}
+
+	if err := StopHolderContainers(busyErr.Holders); err != nil {
+		return err
+	}
+
+	return umount()
+}
+
+func newBusyError(mountpoint string, err error) error {
+	if err == nil || !strings.Contains(err.Error(), messageTargetIsBusy) {
+		return err
+	}
+
+	holders, findErr := FindHolders(mountpoint)
+	if findErr != nil {
+		return err
+	}
+
+	return &BusyError{MountPoint: mountpoint, Holders: holders, err: err}
+}
+
+func findHolders(procPath, dockerPath, mountpoint string) ([]Holder, error) {
+	mountpoint = filepath.Clean(mountpoint)
+
+	targets, err := readMountInfo(filepath.Join(procPath, "self", "mountinfo"), mountinfo.SingleEntryFilter(mountpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	// the filesystem as seen from other mount namespaces, e.g. a container bind-mounting a path below the mount point
+	targetDevices := make(map[[2]int]bool)
+	for _, target := range targets {
+		targetDevices[[2]int{target.Major, target.Minor}] = true
+	}
+
+	selfNamespace, _ := os.Readlink(filepath.Join(procPath, "self", "ns", "mnt"))
+
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaceHeld := make(map[string]bool)
+
+	holders := make([]Holder, 0)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		pidPath := filepath.Join(procPath, entry.Name())
+		references := make([]string, 0)
+
+		if fds, err := os.ReadDir(filepath.Join(pidPath, "fd")); err == nil {
+			for _, fd := range fds {
+				if link, err := os.Readlink(filepath.Join(pidPath, "fd", fd.Name())); err == nil && isBelow(link, mountpoint) {
+					references = append(references, ReferenceFD)
+					break
+				}
+			}
+		}
+
+		if link, err := os.Readlink(filepath.Join(pidPath, "cwd")); err == nil && isBelow(link, mountpoint) {
+			references = append(references, ReferenceCWD)
+		}
+
+		if link, err := os.Readlink(filepath.Join(pidPath, "root")); err == nil && isBelow(link, mountpoint) {
+			references = append(references, ReferenceRoot)
+		}
+
+		if maps, err := os.ReadFile(filepath.Join(pidPath, "maps")); err == nil {
+			for _, line := range strings.Split(string(maps), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 6 && isBelow(fields[5], mountpoint) {
+					references = append(references, ReferenceMaps)
+					break
+				}
+			}
+		}
+
+		if len(targetDevices) > 0 {
+			if namespace, err := os.Readlink(filepath.Join(pidPath, "ns", "mnt")); err == nil && namespace != selfNamespace {
+				held, ok := namespaceHeld[namespace]
+				if !ok {
+					mounts, _ := readMountInfo(filepath.Join(pidPath, "mountinfo"), func(i *mountinfo.Info) (skip bool, stop bool) {
+						return !targetDevices[[2]int{i.Major, i.Minor}], false
+					})
+					held = len(mounts) > 0
+					namespaceHeld[namespace] = held
+				}
+
+				if held {
+					references = append(references, ReferenceMountInfo)
+				}
+			}
+		}
+
+		if len(references) == 0 {
+			continue
+		}
+
+		holder := Holder{PID: pid, References: references}
+
+		if comm, err := os.ReadFile(filepath.Join(pidPath, "comm")); err == nil {
+			holder.Command = strings.TrimSpace(string(comm))
+		}
+
+		if cgroup, err := os.ReadFile(filepath.Join(pidPath, "cgroup")); err == nil {
+			if match := containerIDInCGroup.FindStringSubmatch(string(cgroup)); match != nil {
+				holder.ContainerID = match[1]
+				holder.ContainerName = containerName(dockerPath, holder.ContainerID)
+			}
+		}
+
+		holders = append(holders, holder)
+	}
+
+	sort.Slice(holders, func(i, j int) bool { return holders[i].PID < holders[j].PID })
+
+	return holders, nil
+}
+
+func readMountInfo(path string, filter mountinfo.FilterFunc) ([]*mountinfo.Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return mountinfo.GetMountsFromReader(f, filter)
+}
+
+func containerName(dockerPath, containerID string) string {
+	buf, err := os.ReadFile(filepath.Join(dockerPath, "containers", containerID, "config.v2.json"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(gjson.GetBytes(buf, "Name").String(), "/")
+}
+
+func isBelow(path, mountpoint string) bool {
+	return path == mountpoint || strings.HasPrefix(path, strings.TrimRight(mountpoint, "/")+"/")
+}
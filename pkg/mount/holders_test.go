@@ -0,0 +1,74 @@
+package mount
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+const containerID = "4c01db0b339c0e1f2d8a6e5b0e8d1b5f3c0c1a2b3d4e5f60718293a4b5c6d7e8"
+
+func TestFindHolders(t *testing.T) {
+	procPath := t.TempDir()
+	dockerPath := t.TempDir()
+
+	selfMountInfo := "29 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+		"90 29 8:17 / /media/sdb1 rw,relatime shared:40 - ext4 /dev/sdb1 rw\n"
+
+	// a container bind-mounting a directory below /media/sdb1, in its own mount namespace
+	containerMountInfo := "500 400 0:50 / / rw,relatime - overlay overlay rw\n" +
+		"501 500 8:17 /Movies /movies rw,relatime - ext4 /dev/sdb1 rw\n"
+
+	writeProc(t, procPath, "self", map[string]string{"mountinfo": selfMountInfo}, map[string]string{"ns/mnt": "mnt:[1]"})
+
+	// not holding anything
+	writeProc(t, procPath, "1", map[string]string{"comm": "systemd\n", "mountinfo": selfMountInfo}, map[string]string{"ns/mnt": "mnt:[1]", "cwd": "/"})
+
+	// an open file below the mount point
+	writeProc(t, procPath, "100", map[string]string{"comm": "bash\n", "mountinfo": selfMountInfo}, map[string]string{"ns/mnt": "mnt:[1]", "cwd": "/media/sdb1/Documents", "fd/3": "/media/sdb1/Documents/a.txt"})
+
+	// a similar but different mount point
+	writeProc(t, procPath, "101", map[string]string{"comm": "bash\n", "mountinfo": selfMountInfo}, map[string]string{"ns/mnt": "mnt:[1]", "cwd": "/media/sdb10"})
+
+	// a memory mapped file
+	writeProc(t, procPath, "102", map[string]string{
+		"comm":      "python3\n",
+		"mountinfo": selfMountInfo,
+		"maps":      "7f0000000000-7f0000001000 r--p 00000000 08:11 12 /media/sdb1/lib/libfoo.so\n",
+	}, map[string]string{"ns/mnt": "mnt:[1]", "cwd": "/"})
+
+	// a container
+	writeProc(t, procPath, "200", map[string]string{
+		"comm":      "jellyfin\n",
+		"mountinfo": containerMountInfo,
+		"cgroup":    "0::/system.slice/docker-" + containerID + ".scope\n",
+	}, map[string]string{"ns/mnt": "mnt:[2]", "cwd": "/"})
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(dockerPath, "containers", containerID), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(dockerPath, "containers", containerID, "config.v2.json"), []byte(`{"ID":"`+containerID+`","Name":"/jellyfin"}`), 0o644))
+
+	holders, err := findHolders(procPath, dockerPath, "/media/sdb1/")
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, holders, []Holder{
+		{PID: 100, Command: "bash", References: []string{ReferenceFD, ReferenceCWD}},
+		{PID: 102, Command: "python3", References: []string{ReferenceMaps}},
+		{PID: 200, Command: "jellyfin", References: []string{ReferenceMountInfo}, ContainerID: containerID, ContainerName: "jellyfin"},
+	})
+}
+
+func writeProc(t *testing.T, procPath, pid string, files map[string]string, links map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(procPath, pid, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NilError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	for name, target := range links {
+		path := filepath.Join(procPath, pid, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NilError(t, os.Symlink(target, path))
+	}
+}
@@ -22,8 +22,18 @@ func Mount(source string, mountpoint string, fstype *string, options *string) er
 	return nil
 }
 
+// UmountByMountPoint returns a *BusyError listing the processes holding the mount point, if it is busy.
 func UmountByMountPoint(mountpoint string) error {
 	if _, err := command.ExecuteCommand("umount", "--force", "--verbose", "--quiet", mountpoint); err != nil {
+		return newBusyError(mountpoint, err)
+	}
+
+	return nil
+}
+
+// UmountLazy detaches mountpoint from the file hierarchy now, and cleans up all references to it once it is no longer busy.
+func UmountLazy(mountpoint string) error {
+	if _, err := command.ExecuteCommand("umount", "--lazy", "--verbose", "--quiet", mountpoint); err != nil {
 		return err
 	}
 
@@ -0,0 +1,88 @@
+package mount
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/moby/sys/mountinfo"
+)
+
+type State string
+
+const (
+	StateHealthy State = "healthy"
+	StateStale   State = "stale" // still in mountinfo, but I/O fails or hangs, e.g. a dead FUSE daemon or a USB disk that dropped off
+	StateGone    State = "gone"  // no longer in mountinfo
+
+	DefaultProbeTimeout = 5 * time.Second
+)
+
+var ErrProbeTimeout = errors.New("statfs timed out")
+
+// Probe checks if mountpoint is still mounted and responsive, using a statfs that is given up after timeout.
+//
+// If fstype is not empty, the topmost mount at mountpoint must also be of that type, as the mount point itself
+// could be a mount, e.g. a bind mount for shared propagation underneath a mergerfs mount.
+//
+// Note a statfs against a hung FUSE mount may never return, in which case the goroutine doing it is leaked.
+func Probe(mountpoint string, fstype string, timeout time.Duration) (State, error) {
+	mounted, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(mountpoint))
+	if err != nil {
+		return StateGone, err
+	}
+
+	if len(mounted) == 0 {
+		return StateGone, nil
+	}
+
+	if fstype != "" && mounted[len(mounted)-1].FSType != fstype {
+		return StateGone, nil
+	}
+
+	if _, err := statfs(mountpoint, timeout); err != nil {
+		if errors.Is(err, ErrProbeTimeout) {
+			return StateStale, err
+		}
+		return classifyStatfsError(err), err
+	}
+
+	return StateHealthy, nil
+}
+
+// statfs that is given up after timeout - the goroutine doing it is leaked if it never returns
+func statfs(path string, timeout time.Duration) (*syscall.Statfs_t, error) {
+	type statfsResult struct {
+		stat syscall.Statfs_t
+		err  error
+	}
+
+	result := make(chan statfsResult, 1)
+	go func() {
+		var r statfsResult
+		r.err = syscall.Statfs(path, &r.stat)
+		result <- r
+	}()
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &r.stat, nil
+	case <-time.After(timeout):
+		return nil, ErrProbeTimeout
+	}
+}
+
+func classifyStatfsError(err error) State {
+	switch {
+	case err == nil:
+		return StateHealthy
+	case errors.Is(err, syscall.ENOENT):
+		return StateGone
+	default:
+		// ENOTCONN, EIO, ESTALE and anything else means the mount is there but unusable
+		return StateStale
+	}
+}
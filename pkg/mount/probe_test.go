@@ -0,0 +1,36 @@
+package mount
+
+import (
+	"syscall"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestClassifyStatfsError(t *testing.T) {
+	assert.Equal(t, classifyStatfsError(nil), StateHealthy)
+	assert.Equal(t, classifyStatfsError(syscall.ENOENT), StateGone)
+	assert.Equal(t, classifyStatfsError(syscall.ENOTCONN), StateStale)
+	assert.Equal(t, classifyStatfsError(syscall.EIO), StateStale)
+}
+
+func TestProbe(t *testing.T) {
+	state, err := Probe("/", "", DefaultProbeTimeout)
+	assert.NilError(t, err)
+	assert.Equal(t, state, StateHealthy)
+
+	state, err = Probe(t.TempDir(), "", DefaultProbeTimeout)
+	assert.NilError(t, err)
+	assert.Equal(t, state, StateGone)
+}
+
+func TestGetUsage(t *testing.T) {
+	usage, err := GetUsage("/", DefaultProbeTimeout)
+	assert.NilError(t, err)
+
+	// as df has it, in fragments
+	var stat syscall.Statfs_t
+	assert.NilError(t, syscall.Statfs("/", &stat))
+	assert.Equal(t, usage.Total, stat.Blocks*uint64(stat.Frsize))
+	assert.Assert(t, usage.Used <= usage.Total)
+}
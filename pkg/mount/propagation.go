@@ -0,0 +1,101 @@
+package mount
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/file"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
+	"github.com/moby/sys/mountinfo"
+)
+
+const (
+	PropagationShared     = "shared"
+	PropagationSlave      = "slave"
+	PropagationPrivate    = "private"
+	PropagationUnbindable = "unbindable"
+)
+
+var ErrNotMounted = errors.New("not mounted")
+
+// Propagation returns the propagation type of a mount from the optional fields of its mountinfo, e.g. "shared:1 master:2"
+func Propagation(optional string) string {
+	fields := strings.Fields(optional)
+
+	for _, field := range fields {
+		if strings.HasPrefix(field, "shared:") {
+			return PropagationShared
+		}
+	}
+
+	for _, field := range fields {
+		if strings.HasPrefix(field, "master:") {
+			return PropagationSlave
+		}
+
+		if field == "unbindable" {
+			return PropagationUnbindable
+		}
+	}
+
+	return PropagationPrivate
+}
+
+// PropagatesToBindMounts tells if a mount propagates, on the host, to bind mounts of its parent, i.e. if the parent mount is
+// shared. This is only what the host side allows: a container also needs its own bind mount of the parent to be rslave or
+// rshared to see it - with rprivate, the default of Docker, it does not.
+//
+// A mount without a parent, i.e. the root mount, always propagates.
+func PropagatesToBindMounts(parent *mountinfo.Info) bool {
+	return parent == nil || Propagation(parent.Optional) == PropagationShared
+}
+
+// IsPropagatingToBindMounts is PropagatesToBindMounts for the topmost mount at mountpoint.
+func IsPropagatingToBindMounts(mountpoint string) (bool, error) {
+	mounts, err := mountinfo.GetMounts(nil)
+	if err != nil {
+		return false, err
+	}
+
+	byID := make(map[int]*mountinfo.Info, len(mounts))
+	var target *mountinfo.Info
+	for _, m := range mounts {
+		byID[m.ID] = m
+		if m.Mountpoint == mountpoint {
+			target = m
+		}
+	}
+
+	if target == nil {
+		return false, ErrNotMounted
+	}
+
+	return PropagatesToBindMounts(byID[target.Parent]), nil
+}
+
+// EnsureSharedPropagation makes sure dir is a mount point with rshared propagation, by bind mounting it onto itself if needed,
+// so that anything mounted below it later also shows up in containers that bind mount it.
+func EnsureSharedPropagation(dir string) error {
+	if err := file.IsNotExistMkDir(dir); err != nil {
+		return err
+	}
+
+	mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(dir))
+	if err != nil {
+		return err
+	}
+
+	if len(mounts) == 0 {
+		if _, err := command.ExecuteCommand("mount", "--bind", dir, dir); err != nil {
+			return err
+		}
+	} else if Propagation(mounts[len(mounts)-1].Optional) == PropagationShared {
+		return nil
+	}
+
+	if _, err := command.ExecuteCommand("mount", "--make-rshared", dir); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package mount
+
+import (
+	"time"
+)
+
+type Usage struct {
+	Total       uint64 `json:"total"`
+	Used        uint64 `json:"used"`
+	Available   uint64 `json:"available"` // to unprivileged users, i.e. excluding reserved blocks
+	InodesTotal uint64 `json:"inodes_total"`
+	InodesUsed  uint64 `json:"inodes_used"`
+	InodesFree  uint64 `json:"inodes_free"`
+}
+
+// GetUsage returns the space and inode usage of the filesystem mounted at mountpoint, using a statfs that is given up after timeout.
+func GetUsage(mountpoint string, timeout time.Duration) (*Usage, error) {
+	stat, err := statfs(mountpoint, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// in fragments, which is what the block counts are in - not the preferred I/O size in Bsize
+	blockSize := uint64(stat.Frsize)
+
+	return &Usage{
+		Total:       stat.Blocks * blockSize,
+		Used:        (stat.Blocks - stat.Bfree) * blockSize,
+		Available:   stat.Bavail * blockSize,
+		InodesTotal: stat.Files,
+		InodesUsed:  stat.Files - stat.Ffree,
+		InodesFree:  stat.Ffree,
+	}, nil
+}
@@ -0,0 +1,203 @@
+package mountpoint
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultTemplate     = "/media/{name}"
+	DefaultAutoTemplate = "/media/{label}"
+
+	maxNameLength = 64
+)
+
+var (
+	ErrTemplateNotAbsolute        = errors.New("mount point template should be an absolute path")
+	ErrTemplateOutsideMediaDirs   = errors.New("mount point template should be below /media or /mnt")
+	ErrTemplateUnknownPlaceholder = errors.New("mount point template has an unknown placeholder")
+	ErrTemplateRenderedEmpty      = errors.New("mount point template rendered an empty name")
+
+	placeholder = regexp.MustCompile(`\{[a-z0-9]+\}`)
+
+	allowedParentDirs = []string{"/media", "/mnt"}
+)
+
+// Values to fill the placeholders of a mount point template with.
+type Values struct {
+	Name   string // {name} - given by user, if any
+	Label  string // {label}
+	Model  string // {model}
+	Serial string // {serial}, and {serial8} for its last 8 characters
+	Vendor string // {vendor}
+	UUID   string // {uuid}
+	Device string // {device}, e.g. sdb1
+}
+
+func (v Values) lookup(key string) (string, bool) {
+	switch key {
+	case "{name}":
+		return v.Name, true
+	case "{label}":
+		return v.Label, true
+	case "{model}":
+		return v.Model, true
+	case "{serial}":
+		return v.Serial, true
+	case "{serial8}":
+		if len(v.Serial) > 8 {
+			return v.Serial[len(v.Serial)-8:], true
+		}
+		return v.Serial, true
+	case "{vendor}":
+		return v.Vendor, true
+	case "{uuid}":
+		return v.UUID, true
+	case "{device}":
+		return v.Device, true
+	}
+
+	return "", false
+}
+
+// Validate checks if template is an absolute path below /media or /mnt, with known placeholders only.
+func Validate(template string) error {
+	if !filepath.IsAbs(template) {
+		return ErrTemplateNotAbsolute
+	}
+
+	below := false
+	for _, dir := range allowedParentDirs {
+		if strings.HasPrefix(filepath.Clean(template), dir+"/") {
+			below = true
+			break
+		}
+	}
+
+	if !below {
+		return ErrTemplateOutsideMediaDirs
+	}
+
+	for _, key := range placeholder.FindAllString(template, -1) {
+		if _, ok := (Values{}).lookup(key); !ok {
+			return ErrTemplateUnknownPlaceholder
+		}
+	}
+
+	return nil
+}
+
+// Render fills the placeholders of template with values, sanitising each path segment.
+//
+// A segment that ends up empty, e.g. `{label}` for a volume without label, falls back to `{model}-{serial8}`, then `{uuid}`, then `{device}`.
+func Render(template string, values Values) (string, error) {
+	if err := Validate(template); err != nil {
+		return "", err
+	}
+
+	segments := strings.Split(filepath.Clean(template), "/")
+	for i, segment := range segments {
+		if i == 0 || !placeholder.MatchString(segment) {
+			continue
+		}
+
+		name := renderSegment(segment, values)
+		for _, fallback := range []string{"{model}-{serial8}", "{uuid}", "{device}"} {
+			if name != "" {
+				break
+			}
+			name = renderSegment(fallback, values)
+		}
+
+		if name == "" {
+			return "", ErrTemplateRenderedEmpty
+		}
+
+		segments[i] = name
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+func renderSegment(segment string, values Values) string {
+	empty := true
+
+	rendered := placeholder.ReplaceAllStringFunc(segment, func(key string) string {
+		value, _ := values.lookup(key)
+		if Sanitize(value) != "" {
+			empty = false
+		}
+		return value
+	})
+
+	// a segment made of separators only, e.g. "-" for "{model}-{serial8}" without model or serial
+	if empty {
+		return ""
+	}
+
+	return Sanitize(rendered)
+}
+
+// Sanitize makes name safe to be used as a directory name, by replacing anything but letters, digits, '.', '-' and '_' with '_'.
+func Sanitize(name string) string {
+	var b strings.Builder
+
+	lastReplaced := false
+	for _, r := range strings.TrimSpace(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			b.WriteRune(r)
+			lastReplaced = false
+			continue
+		}
+
+		if !lastReplaced {
+			b.WriteRune('_')
+			lastReplaced = true
+		}
+	}
+
+	result := strings.Trim(b.String(), "._-")
+
+	if runes := []rune(result); len(runes) > maxNameLength {
+		result = strings.Trim(string(runes[:maxNameLength]), "._-")
+	}
+
+	return result
+}
+
+// Resolve returns path if it is not taken, or else the first candidate not taken, with suffixes derived from uuid,
+// so that the same volume always ends up with the same path regardless of the order volumes are mounted in.
+func Resolve(path, uuid string, taken func(path string) bool) string {
+	if !taken(path) {
+		return path
+	}
+
+	id := Sanitize(strings.ReplaceAll(uuid, "-", ""))
+
+	candidates := make([]string, 0, 2)
+	if len(id) > 8 {
+		candidates = append(candidates, path+"-"+id[:8])
+	}
+	if id != "" {
+		candidates = append(candidates, path+"-"+id)
+		path = path + "-" + id
+	}
+
+	for _, candidate := range candidates {
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+
+	// last resort, e.g. a volume without UUID
+	for i := 1; ; i++ {
+		candidate := path + "-" + strconv.Itoa(i)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package mountpoint
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRender(t *testing.T) {
+	values := Values{
+		Label:  "My Photos/2023",
+		Model:  "Samsung SSD 870",
+		Serial: "S5Y2NJ0R123456A",
+		UUID:   "8a1c7e52-65f4-4b5e-9e0b-8f2b9b2f0a11",
+		Device: "sdb1",
+	}
+
+	path, err := Render("/media/{label}", values)
+	assert.NilError(t, err)
+	assert.Equal(t, path, "/media/My_Photos_2023")
+
+	path, err = Render("/media/{model}-{serial8}", values)
+	assert.NilError(t, err)
+	assert.Equal(t, path, "/media/Samsung_SSD_870-R123456A")
+
+	path, err = Render("/mnt/{uuid}", values)
+	assert.NilError(t, err)
+	assert.Equal(t, path, "/mnt/8a1c7e52-65f4-4b5e-9e0b-8f2b9b2f0a11")
+
+	// falls back to {model}-{serial8} without label
+	values.Label = "  "
+	path, err = Render("/media/{label}", values)
+	assert.NilError(t, err)
+	assert.Equal(t, path, "/media/Samsung_SSD_870-R123456A")
+
+	// then {uuid}
+	values.Model, values.Serial = "", ""
+	path, err = Render("/media/{label}", values)
+	assert.NilError(t, err)
+	assert.Equal(t, path, "/media/8a1c7e52-65f4-4b5e-9e0b-8f2b9b2f0a11")
+
+	_, err = Render("media/{label}", values)
+	assert.ErrorIs(t, err, ErrTemplateNotAbsolute)
+
+	_, err = Render("/etc/{label}", values)
+	assert.ErrorIs(t, err, ErrTemplateOutsideMediaDirs)
+
+	_, err = Render("/media/{color}", values)
+	assert.ErrorIs(t, err, ErrTemplateUnknownPlaceholder)
+}
+
+func TestSanitize(t *testing.T) {
+	assert.Equal(t, Sanitize("../../etc"), "etc")
+	assert.Equal(t, Sanitize("Foo  Bar!"), "Foo_Bar")
+	assert.Equal(t, Sanitize("照片"), "照片")
+	assert.Equal(t, Sanitize(".."), "")
+}
+
+func TestResolve(t *testing.T) {
+	taken := map[string]bool{
+		"/media/Foo":          true,
+		"/media/Foo-8a1c7e52": true,
+	}
+
+	isTaken := func(path string) bool { return taken[path] }
+
+	assert.Equal(t, Resolve("/media/Bar", "8a1c7e52-65f4", isTaken), "/media/Bar")
+	assert.Equal(t, Resolve("/media/Foo", "0b2d9f63-1234", isTaken), "/media/Foo-0b2d9f63")
+	assert.Equal(t, Resolve("/media/Foo", "8a1c7e52-65f4", isTaken), "/media/Foo-8a1c7e5265f4")
+	assert.Equal(t, Resolve("/media/Foo", "", isTaken), "/media/Foo-1")
+}
@@ -0,0 +1,99 @@
+package partition
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
+	"github.com/tidwall/gjson"
+)
+
+const diskByIDPath = "/dev/disk/by-id"
+
+// The disk backing a block device, e.g. /dev/sdb for /dev/sdb1
+type Disk struct {
+	Path      string
+	ID        string // name under /dev/disk/by-id, e.g. ata-Samsung_SSD_870_EVO_1TB_S5Y2NJ0R123456A
+	Model     string
+	Serial    string
+	Transport string
+}
+
+// GetDiskOf returns the disk backing the block device at path, following partitions, device mapper and so on.
+func GetDiskOf(path string) (*Disk, error) {
+	out, err := command.ExecuteCommand("lsblk", "--json", "--inverse", "--output", "PATH,TYPE,MODEL,SERIAL,TRAN", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDiskOf(out, diskByIDPath), nil
+}
+
+func parseDiskOf(out []byte, byIDPath string) *Disk {
+	result := findDisk(gjson.GetBytes(out, "blockdevices"))
+	if !result.Exists() {
+		return nil
+	}
+
+	disk := &Disk{
+		Path:      result.Get("path").String(),
+		Model:     strings.TrimSpace(result.Get("model").String()),
+		Serial:    strings.TrimSpace(result.Get("serial").String()),
+		Transport: result.Get("tran").String(),
+	}
+
+	disk.ID = diskID(byIDPath, disk.Path)
+
+	return disk
+}
+
+// in inverse mode, the parents of a device are listed as its children
+func findDisk(devices gjson.Result) gjson.Result {
+	for _, device := range devices.Array() {
+		if device.Get("type").String() == "disk" {
+			return device
+		}
+
+		if disk := findDisk(device.Get("children")); disk.Exists() {
+			return disk
+		}
+	}
+
+	return gjson.Result{}
+}
+
+// the most descriptive name of the disk under /dev/disk/by-id, preferring those with model and serial over WWN and EUI ones
+func diskID(byIDPath, path string) string {
+	entries, err := os.ReadDir(byIDPath)
+	if err != nil {
+		return ""
+	}
+
+	ids := make([]string, 0)
+	for _, entry := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join(byIDPath, entry.Name()))
+		if err != nil || target != path {
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+
+	sort.SliceStable(ids, func(i, j int) bool {
+		return rankDiskID(ids[i]) < rankDiskID(ids[j]) || (rankDiskID(ids[i]) == rankDiskID(ids[j]) && ids[i] < ids[j])
+	})
+
+	if len(ids) == 0 {
+		return ""
+	}
+
+	return ids[0]
+}
+
+func rankDiskID(id string) int {
+	if strings.HasPrefix(id, "wwn-") || strings.HasPrefix(id, "nvme-eui.") || strings.HasPrefix(id, "nvme-nvme.") {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package partition
+
+import (
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
+	"github.com/tidwall/gjson"
+)
+
+// The filesystem on a block device
+type Filesystem struct {
+	Type  string
+	Label string
+	Size  uint64 // of the filesystem if mounted, or else of the device, in bytes
+}
+
+// GetFilesystem returns the filesystem on the block device at path, e.g. /dev/sdb1
+func GetFilesystem(path string) (*Filesystem, error) {
+	out, err := command.ExecuteCommand("lsblk", "--json", "--bytes", "--nodeps", "--output", "FSTYPE,LABEL,FSSIZE,SIZE", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFilesystem(out), nil
+}
+
+func parseFilesystem(out []byte) *Filesystem {
+	result := gjson.GetBytes(out, "blockdevices.0")
+	if !result.Exists() {
+		return nil
+	}
+
+	// numbers are strings in older versions of lsblk
+	size := result.Get("fssize").Uint()
+	if size == 0 {
+		size = result.Get("size").Uint()
+	}
+
+	return &Filesystem{
+		Type:  result.Get("fstype").String(),
+		Label: strings.TrimSpace(result.Get("label").String()),
+		Size:  size,
+	}
+}
@@ -25,6 +25,40 @@ func GetDevicePath(uuid string) (string, error) {
 	return string(bytes.TrimSpace(out)), nil
 }
 
+// GetUUID returns the filesystem UUID of the device at path, e.g. /dev/sda1
+func GetUUID(path string) (string, error) {
+	out, err := command.ExecuteCommand("blkid", "--match-tag", "UUID", "--output", "value", path)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// GetUUIDs returns the filesystem UUID of each device that has one, by device path - with a single blkid for all of them.
+func GetUUIDs() (map[string]string, error) {
+	out, err := command.ExecuteCommand("blkid", "--match-tag", "UUID", "--output", "export")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseUUIDs(out), nil
+}
+
+// parseUUIDs parses the output of blkid --output export, which has a block of KEY=value lines per device.
+func parseUUIDs(out []byte) map[string]string {
+	uuids := map[string]string{}
+
+	for _, block := range bytes.Split(out, []byte("\n\n")) {
+		pairs := parsePairs(block)
+		if pairs["DEVNAME"] != "" && pairs["UUID"] != "" {
+			uuids[pairs["DEVNAME"]] = pairs["UUID"]
+		}
+	}
+
+	return uuids
+}
+
 // path - device path, e.g. /dev/sda
 func GetPartitions(path string) ([]Partition, error) {
 	var partitions []Partition
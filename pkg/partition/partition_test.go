@@ -90,3 +90,49 @@ func TestMergeOutputs(t *testing.T) {
 
 	assert.Equal(t, partition.LSBLKProperties["PARTUUID"], partition.PARTXProperties["UUID"])
 }
+
+func TestParseDiskOf(t *testing.T) {
+	out := []byte(`{
+		"blockdevices": [
+			{"path":"/dev/mapper/data", "type":"crypt", "model":null, "serial":null, "tran":null,
+				"children": [
+					{"path":"/dev/sdb1", "type":"part", "model":null, "serial":null, "tran":null,
+						"children": [
+							{"path":"/dev/sdb", "type":"disk", "model":"Samsung SSD 870 EVO 1TB ", "serial":"S5Y2NJ0R123456A", "tran":"sata"}
+						]
+					}
+				]
+			}
+		]
+	}`)
+
+	disk := parseDiskOf(out, t.TempDir())
+	assert.Assert(t, disk != nil)
+	assert.Equal(t, disk.Path, "/dev/sdb")
+	assert.Equal(t, disk.Model, "Samsung SSD 870 EVO 1TB")
+	assert.Equal(t, disk.Serial, "S5Y2NJ0R123456A")
+	assert.Equal(t, disk.Transport, "sata")
+	assert.Equal(t, disk.ID, "")
+
+	assert.Assert(t, parseDiskOf([]byte(`{"blockdevices": [{"path":"/dev/loop0", "type":"loop"}]}`), t.TempDir()) == nil)
+}
+
+func TestParseFilesystem(t *testing.T) {
+	filesystem := parseFilesystem([]byte(`{"blockdevices": [{"fstype":"ext4", "label":"Backup ", "fssize":983349346304, "size":1000203091968}]}`))
+	assert.DeepEqual(t, filesystem, &Filesystem{Type: "ext4", Label: "Backup", Size: 983349346304})
+
+	// not mounted, and from an older lsblk
+	filesystem = parseFilesystem([]byte(`{"blockdevices": [{"fstype":"xfs", "label":null, "fssize":null, "size":"1000203091968"}]}`))
+	assert.DeepEqual(t, filesystem, &Filesystem{Type: "xfs", Size: 1000203091968})
+
+	assert.Assert(t, parseFilesystem([]byte(`{"blockdevices": []}`)) == nil)
+}
+
+func TestParseUUIDs(t *testing.T) {
+	out := []byte("DEVNAME=/dev/sda1\nUUID=6E3B-1A2C\nBLOCK_SIZE=512\nTYPE=vfat\n\nDEVNAME=/dev/sda2\nTYPE=swap\n\nDEVNAME=/dev/mapper/luks-1234\nUUID=0c1d2e3f-4a5b-4c6d-8e7f-8091a2b3c4d5\nTYPE=ext4\n")
+
+	assert.DeepEqual(t, parseUUIDs(out), map[string]string{
+		"/dev/sda1":             "6E3B-1A2C",
+		"/dev/mapper/luks-1234": "0c1d2e3f-4a5b-4c6d-8e7f-8091a2b3c4d5",
+	})
+}
@@ -0,0 +1,97 @@
+// Package secret seals values with a key derived from a passphrase, e.g. the secrets in an exported config.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// as recommended for interactive use, see https://pkg.go.dev/golang.org/x/crypto/scrypt#Key
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+
+	keySize  = 32 // AES-256
+	SaltSize = 16
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase, or the sealed value is corrupted")
+	ErrEmptyPassphrase = errors.New("passphrase should not be empty")
+)
+
+// Sealer seals and opens values with AES-256-GCM.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSalt returns a random salt, to derive a key with.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// NewSealer returns a Sealer with the key derived from passphrase and salt with scrypt - the same passphrase and salt
+// are needed to open what it seals.
+func NewSealer(passphrase string, salt []byte) (*Sealer, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal returns value encrypted with a random nonce, base64 encoded.
+func (s *Sealer) Seal(value string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// Open returns the value sealed by Seal, or ErrWrongPassphrase if it was sealed with another key.
+func (s *Sealer) Open(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrWrongPassphrase, err.Error())
+	}
+
+	if len(data) < s.aead.NonceSize() {
+		return "", ErrWrongPassphrase
+	}
+
+	value, err := s.aead.Open(nil, data[:s.aead.NonceSize()], data[s.aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrWrongPassphrase
+	}
+
+	return string(value), nil
+}
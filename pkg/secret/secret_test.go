@@ -0,0 +1,40 @@
+package secret
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSealer(t *testing.T) {
+	salt, err := NewSalt()
+	assert.NilError(t, err)
+
+	sealer, err := NewSealer("correct horse battery staple", salt)
+	assert.NilError(t, err)
+
+	sealed, err := sealer.Seal(`{"access_token":"ya29.a0Af"}`)
+	assert.NilError(t, err)
+	assert.Assert(t, sealed != `{"access_token":"ya29.a0Af"}`)
+
+	value, err := sealer.Open(sealed)
+	assert.NilError(t, err)
+	assert.Equal(t, value, `{"access_token":"ya29.a0Af"}`)
+
+	// with a random nonce each time
+	again, err := sealer.Seal(`{"access_token":"ya29.a0Af"}`)
+	assert.NilError(t, err)
+	assert.Assert(t, again != sealed)
+
+	other, err := NewSealer("wrong", salt)
+	assert.NilError(t, err)
+
+	_, err = other.Open(sealed)
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+
+	_, err = sealer.Open("not base64!")
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+
+	_, err = NewSealer("", salt)
+	assert.ErrorIs(t, err, ErrEmptyPassphrase)
+}
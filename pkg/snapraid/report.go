@@ -0,0 +1,218 @@
+package snapraid
+
+import (
+	"bufio"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	ChangeAdded    = "add"
+	ChangeRemoved  = "remove"
+	ChangeUpdated  = "update"
+	ChangeMoved    = "move"
+	ChangeCopied   = "copy"
+	ChangeRestored = "restore"
+)
+
+var (
+	// e.g. "     120       0       0       0.0       1      49   2% d1" - Wasted, Used and Free can be "-"
+	statusDiskPattern = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+(\d+)\s+(\S+)\s+(\S+)\s+(\S+)\s+(\d+)%\s+(\S+)\s*$`)
+	scrubAgePattern   = regexp.MustCompile(`oldest block was scrubbed (\d+) days ago, the median (\d+), the newest (\d+)`)
+	syncingPattern    = regexp.MustCompile(`sync in progress at (\d+)%`)
+	scrubbedPattern   = regexp.MustCompile(`The (\d+)% of the array is (not )?scrubbed`)
+	errorsPattern     = regexp.MustCompile(`(?i)there are (\d+) errors`)
+	countPattern      = regexp.MustCompile(`^\s*(\d+)\s+(equal|added|removed|updated|moved|copied|restored|file errors|io errors|data errors)\s*$`)
+
+	changes = []string{ChangeAdded, ChangeRemoved, ChangeUpdated, ChangeMoved, ChangeCopied, ChangeRestored}
+)
+
+// DiskStatus is a data disk, as in the report of status.
+type DiskStatus struct {
+	Name            string
+	Files           int64
+	FragmentedFiles int64
+	ExcessFragments int64
+	WastedGB        float64 // 0 if not known
+	UsedGB          int64
+	FreeGB          int64
+	Use             int // in percentage
+}
+
+// Status is the report of status.
+type Status struct {
+	Disks []DiskStatus
+
+	// age of the scrubbed blocks, in days - -1 if not known, e.g. if the array is empty
+	OldestScrubDays int
+	MedianScrubDays int
+	NewestScrubDays int
+
+	ScrubbedPercent int  // of the array
+	Syncing         bool // a sync was interrupted, and is still to be completed
+	SyncPercent     int  // of the interrupted sync
+	Errors          int  // found by a scrub or sync, and not fixed yet
+}
+
+// Change is a file changed since the last sync, as in the report of diff.
+type Change struct {
+	Type string // add, remove, update, move, copy or restore
+	Path string
+	From string // for move and copy only
+}
+
+// Diff is the report of diff.
+type Diff struct {
+	Changes []Change
+	Equal   int64
+	Counts  map[string]int64 // by type of change
+}
+
+// SyncNeeded tells if there are changes, which are not in the parity until the next sync.
+func (d Diff) SyncNeeded() bool {
+	for _, count := range d.Counts {
+		if count > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Result is the outcome of a sync or scrub, from its report.
+type Result struct {
+	FileErrors int64
+	IOErrors   int64
+	DataErrors int64
+}
+
+// Errors returns the number of all errors.
+func (r Result) Errors() int64 {
+	return r.FileErrors + r.IOErrors + r.DataErrors
+}
+
+// ParseStatus parses the output of status.
+func ParseStatus(output string) Status {
+	status := Status{OldestScrubDays: -1, MedianScrubDays: -1, NewestScrubDays: -1}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := statusDiskPattern.FindStringSubmatch(line); match != nil {
+			disk := DiskStatus{Name: match[8]}
+			disk.Files, _ = strconv.ParseInt(match[1], 10, 64)
+			disk.FragmentedFiles, _ = strconv.ParseInt(match[2], 10, 64)
+			disk.ExcessFragments, _ = strconv.ParseInt(match[3], 10, 64)
+			disk.WastedGB, _ = strconv.ParseFloat(match[4], 64)
+			disk.UsedGB, _ = strconv.ParseInt(match[5], 10, 64)
+			disk.FreeGB, _ = strconv.ParseInt(match[6], 10, 64)
+			disk.Use, _ = strconv.Atoi(match[7])
+
+			status.Disks = append(status.Disks, disk)
+			continue
+		}
+
+		if match := scrubAgePattern.FindStringSubmatch(line); match != nil {
+			status.OldestScrubDays, _ = strconv.Atoi(match[1])
+			status.MedianScrubDays, _ = strconv.Atoi(match[2])
+			status.NewestScrubDays, _ = strconv.Atoi(match[3])
+			continue
+		}
+
+		if match := syncingPattern.FindStringSubmatch(line); match != nil {
+			status.Syncing = true
+			status.SyncPercent, _ = strconv.Atoi(match[1])
+			continue
+		}
+
+		if match := scrubbedPattern.FindStringSubmatch(line); match != nil {
+			percent, _ := strconv.Atoi(match[1])
+			if match[2] != "" {
+				percent = 100 - percent
+			}
+			status.ScrubbedPercent = percent
+			continue
+		}
+
+		if match := errorsPattern.FindStringSubmatch(line); match != nil {
+			status.Errors, _ = strconv.Atoi(match[1])
+		}
+	}
+
+	return status
+}
+
+// ParseDiff parses the output of diff.
+func ParseDiff(output string) Diff {
+	diff := Diff{Changes: make([]Change, 0), Counts: make(map[string]int64)}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := countPattern.FindStringSubmatch(line); match != nil {
+			count, _ := strconv.ParseInt(match[1], 10, 64)
+			switch match[2] {
+			case "equal":
+				diff.Equal = count
+			case "added":
+				diff.Counts[ChangeAdded] = count
+			case "removed":
+				diff.Counts[ChangeRemoved] = count
+			case "updated":
+				diff.Counts[ChangeUpdated] = count
+			case "moved":
+				diff.Counts[ChangeMoved] = count
+			case "copied":
+				diff.Counts[ChangeCopied] = count
+			case "restored":
+				diff.Counts[ChangeRestored] = count
+			}
+			continue
+		}
+
+		kind, path, ok := strings.Cut(line, " ")
+		if !ok || !slices.Contains(changes, kind) {
+			continue
+		}
+
+		change := Change{Type: kind, Path: path}
+		if kind == ChangeMoved || kind == ChangeCopied {
+			if from, to, ok := strings.Cut(path, " -> "); ok {
+				change.From, change.Path = from, to
+			}
+		}
+
+		diff.Changes = append(diff.Changes, change)
+	}
+
+	return diff
+}
+
+// ParseResult parses the output of sync or scrub.
+func ParseResult(output string) Result {
+	var result Result
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		match := countPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+
+		count, _ := strconv.ParseInt(match[1], 10, 64)
+		switch match[2] {
+		case "file errors":
+			result.FileErrors = count
+		case "io errors":
+			result.IOErrors = count
+		case "data errors":
+			result.DataErrors = count
+		}
+	}
+
+	return result
+}
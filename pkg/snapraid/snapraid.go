@@ -0,0 +1,167 @@
+// Package snapraid runs SnapRAID, which keeps parity of data disks on dedicated parity disks, and parses what it reports.
+package snapraid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	CommandSync   = "sync"
+	CommandScrub  = "scrub"
+	CommandStatus = "status"
+	CommandDiff   = "diff"
+
+	// parity levels SnapRAID supports - parity, 2-parity, ... 6-parity
+	MaxParityLevels = 6
+
+	// exit code of diff when a sync is needed
+	exitCodeSyncNeeded = 2
+)
+
+var (
+	// Binary is the snapraid executable, e.g. replaced with a fake one in tests.
+	Binary = "snapraid"
+
+	// StopTimeout is how long SnapRAID is given to save its state once interrupted, before it is killed.
+	StopTimeout = 5 * time.Minute
+
+	ErrNotInstalled = errors.New("snapraid is not installed")
+
+	// files that should never be in the parity - e.g. those rebalance copies to, until complete
+	DefaultExcludes = []string{"*.unrecoverable", "/tmp/", "/lost+found/", ".casaos-rebalance-*"}
+)
+
+// Disk is a data disk, by name - which should not change, as SnapRAID tracks files by it.
+type Disk struct {
+	Name string
+	Path string
+}
+
+// Config is what goes into a snapraid.conf.
+type Config struct {
+	Parity   []string // parity files, one per level
+	Content  []string // content files, with the state of the array - more than one in case a disk is lost
+	Data     []Disk
+	Excludes []string
+}
+
+// Validate tells if c is a config SnapRAID takes.
+func (c Config) Validate() error {
+	if len(c.Parity) == 0 || len(c.Parity) > MaxParityLevels {
+		return fmt.Errorf("there should be 1 to %d parity files, not %d", MaxParityLevels, len(c.Parity))
+	}
+
+	if len(c.Content) == 0 {
+		return errors.New("there should be at least one content file")
+	}
+
+	if len(c.Data) == 0 {
+		return errors.New("there should be at least one data disk")
+	}
+
+	names := make(map[string]bool)
+	for _, disk := range c.Data {
+		if disk.Name == "" || strings.ContainsAny(disk.Name, " \t\n") {
+			return fmt.Errorf("name of data disk %s should not be empty or contain spaces", disk.Path)
+		}
+
+		if names[disk.Name] {
+			return fmt.Errorf("name of data disk %s is not unique", disk.Name)
+		}
+		names[disk.Name] = true
+	}
+
+	return nil
+}
+
+// String returns c in the format of snapraid.conf.
+func (c Config) String() string {
+	var b strings.Builder
+
+	b.WriteString("# generated by CasaOS LocalStorage - changes are overwritten\n\n")
+
+	for i, parity := range c.Parity {
+		if i == 0 {
+			fmt.Fprintf(&b, "parity %s\n", parity)
+		} else {
+			fmt.Fprintf(&b, "%d-parity %s\n", i+1, parity)
+		}
+	}
+	b.WriteString("\n")
+
+	for _, content := range c.Content {
+		fmt.Fprintf(&b, "content %s\n", content)
+	}
+	b.WriteString("\n")
+
+	for _, disk := range c.Data {
+		fmt.Fprintf(&b, "data %s %s\n", disk.Name, strings.TrimSuffix(disk.Path, "/")+"/")
+	}
+	b.WriteString("\n")
+
+	for _, exclude := range c.Excludes {
+		fmt.Fprintf(&b, "exclude %s\n", exclude)
+	}
+
+	return b.String()
+}
+
+// WriteConfig writes c to path, creating the directory of path if missing.
+func WriteConfig(path string, c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(c.String()), 0o644)
+}
+
+// Installed tells if snapraid is installed.
+func Installed() bool {
+	_, err := exec.LookPath(Binary)
+	return err == nil
+}
+
+// Run runs snapraid command with the config at configPath, and returns its output, which has both stdout and stderr, as
+// SnapRAID reports errors on both. The output is returned along with the error, if any, as it tells what went wrong.
+func Run(ctx context.Context, configPath, command string, args ...string) (string, error) {
+	if !Installed() {
+		return "", ErrNotInstalled
+	}
+
+	cmd := exec.CommandContext(ctx, Binary, append([]string{"-c", configPath, command}, args...)...)
+
+	// interrupted rather than killed, so that SnapRAID saves its state, and the next sync goes on from there
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = StopTimeout
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+
+	var exitError *exec.ExitError
+	if command == CommandDiff && errors.As(err, &exitError) && exitError.ExitCode() == exitCodeSyncNeeded {
+		err = nil
+	}
+
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return output.String(), err
+}
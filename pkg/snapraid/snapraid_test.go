@@ -0,0 +1,185 @@
+package snapraid
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+const statusOutput = `Self test...
+Loading state from /var/lib/casaos/snapraid/merge-1.content...
+Using 0 MiB of memory for the file-system.
+SnapRAID status report:
+
+   Files Fragmented Excess  Wasted  Used    Free  Use Name
+            Files  Fragments  GB      GB      GB
+   29452       0       0     0.0    1001     944  51% 0b4d2c1e-1f33-4d0e-9c1a-7d0c8c2b1a11
+   29691       3      12       -     999     946  51% 5c682e86-cec3-4761-9350-8e1a0c2d1ae9
+ --------------------------------------------------------------------------
+   59143       3      12     0.0    2000    1890  51%
+
+
+ 62%|o
+    |o
+    |o                                                              *
+    |o________________________________________________________________
+     9                    days ago of the last scrub/sync               0
+
+The oldest block was scrubbed 9 days ago, the median 5, the newest 0.
+
+You have a sync in progress at 80%.
+The 12% of the array is not scrubbed.
+No file has a zero sub-second timestamp.
+No rehash is in progress or needed.
+DANGER! In the array there are 3 errors!
+`
+
+const diffOutput = `Loading state from /var/lib/casaos/snapraid/merge-1.content...
+Comparing...
+add Media/Movies/b.mkv
+remove Media/old.txt
+move Media/a.mkv -> Media/Movies/a.mkv
+
+   29452 equal
+       1 added
+       1 removed
+       0 updated
+       1 moved
+       0 copied
+       0 restored
+There are differences!
+`
+
+func TestConfig(t *testing.T) {
+	config := Config{
+		Parity:   []string{"/media/sdd1/snapraid.parity", "/media/sde1/snapraid.parity"},
+		Content:  []string{"/var/lib/casaos/snapraid/merge-1.content", "/media/sdd1/snapraid.content"},
+		Data:     []Disk{{Name: "a", Path: "/media/sdb1"}, {Name: "b", Path: "/media/sdc1/"}},
+		Excludes: []string{"/tmp/"},
+	}
+
+	assert.NilError(t, config.Validate())
+	assert.Equal(t, config.String(), `# generated by CasaOS LocalStorage - changes are overwritten
+
+parity /media/sdd1/snapraid.parity
+2-parity /media/sde1/snapraid.parity
+
+content /var/lib/casaos/snapraid/merge-1.content
+content /media/sdd1/snapraid.content
+
+data a /media/sdb1/
+data b /media/sdc1/
+
+exclude /tmp/
+`)
+
+	config.Data = append(config.Data, Disk{Name: "a", Path: "/media/sdf1"})
+	assert.ErrorContains(t, config.Validate(), "not unique")
+
+	config.Parity = nil
+	assert.ErrorContains(t, config.Validate(), "parity")
+}
+
+func TestParseStatus(t *testing.T) {
+	status := ParseStatus(statusOutput)
+
+	assert.Equal(t, len(status.Disks), 2)
+	assert.DeepEqual(t, status.Disks[1], DiskStatus{
+		Name:            "5c682e86-cec3-4761-9350-8e1a0c2d1ae9",
+		Files:           29691,
+		FragmentedFiles: 3,
+		ExcessFragments: 12,
+		UsedGB:          999,
+		FreeGB:          946,
+		Use:             51,
+	})
+
+	assert.Equal(t, status.OldestScrubDays, 9)
+	assert.Equal(t, status.MedianScrubDays, 5)
+	assert.Equal(t, status.NewestScrubDays, 0)
+	assert.Equal(t, status.ScrubbedPercent, 88)
+	assert.Assert(t, status.Syncing)
+	assert.Equal(t, status.SyncPercent, 80)
+	assert.Equal(t, status.Errors, 3)
+}
+
+func TestParseDiff(t *testing.T) {
+	diff := ParseDiff(diffOutput)
+
+	assert.DeepEqual(t, diff.Changes, []Change{
+		{Type: ChangeAdded, Path: "Media/Movies/b.mkv"},
+		{Type: ChangeRemoved, Path: "Media/old.txt"},
+		{Type: ChangeMoved, Path: "Media/Movies/a.mkv", From: "Media/a.mkv"},
+	})
+	assert.Equal(t, diff.Equal, int64(29452))
+	assert.Equal(t, diff.Counts[ChangeMoved], int64(1))
+	assert.Assert(t, diff.SyncNeeded())
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+
+	// a fake snapraid, which reports errors on sync, and differences on diff with exit code 2, as snapraid does
+	script := `#!/bin/sh
+echo "$@" > "` + filepath.Join(dir, "args") + `"
+case "$3" in
+sync) printf "       1 file errors\n       0 io errors\n       2 data errors\n"; exit 1 ;;
+diff) printf "add a.txt\n       1 added\n"; exit 2 ;;
+esac
+`
+	binary := filepath.Join(dir, "snapraid")
+	assert.NilError(t, os.WriteFile(binary, []byte(script), 0o755))
+
+	defer func(binary string) { Binary = binary }(Binary)
+	Binary = binary
+
+	output, err := Run(context.Background(), "/etc/snapraid.conf", CommandDiff)
+	assert.NilError(t, err)
+	assert.Assert(t, ParseDiff(output).SyncNeeded())
+
+	output, err = Run(context.Background(), "/etc/snapraid.conf", CommandSync, "--force-zero")
+	assert.ErrorContains(t, err, "exit status 1")
+	assert.Equal(t, ParseResult(output), Result{FileErrors: 1, DataErrors: 2})
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(args), "-c /etc/snapraid.conf sync --force-zero\n")
+}
+
+func TestRunCancel(t *testing.T) {
+	dir := t.TempDir()
+
+	// a fake snapraid, which saves its state when interrupted, as snapraid does
+	script := `#!/bin/sh
+trap 'echo saved > "` + filepath.Join(dir, "state") + `"; exit 1' INT
+touch "` + filepath.Join(dir, "started") + `"
+while :; do sleep 0.1; done
+`
+	binary := filepath.Join(dir, "snapraid")
+	assert.NilError(t, os.WriteFile(binary, []byte(script), 0o755))
+
+	defer func(binary string) { Binary = binary }(Binary)
+	Binary = binary
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			if _, err := os.Stat(filepath.Join(dir, "started")); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	_, err := Run(ctx, "/etc/snapraid.conf", CommandSync)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	state, err := os.ReadFile(filepath.Join(dir, "state"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(state), "saved\n")
+}
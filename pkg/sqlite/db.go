@@ -2,6 +2,7 @@ package sqlite
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 	"time"
 
@@ -17,6 +18,13 @@ type ContextKey string
 const (
 	contextKeyGlobalDB = ContextKey("gdb")
 
+	// SchemaVersion is the version of the schema, as kept in the user_version of the database - the version of the last
+	// migration of cmd/migration-tool. It is only bumped for changes AutoMigrate cannot make, e.g. filling in a new
+	// column from existing data. Additive changes - new tables, and new columns that are fine empty, e.g. crypt_uuid
+	// and auto_unlock of o_disk, the options and branches of o_merge, o_snapraid and o_usb_rule - are owned by
+	// AutoMigrate, which runs at every start, and do not change the version.
+	SchemaVersion = 1
+
 	// GORM's lifecyle
 	HookBeforeCreate = "before_create"
 	HookAfterCreate  = "after_create"
@@ -120,10 +128,21 @@ func GetDBByFile(dbFile string) *gorm.DB {
 	c.SetMaxOpenConns(1)
 	c.SetConnMaxIdleTime(time.Second * 1000)
 
-	if err := db.AutoMigrate(&model.Merge{}, &model.Volume{}); err != nil {
+	// o_disk is in every database ever created by the service
+	created := !db.Migrator().HasTable(&model.Volume{})
+
+	if err := db.AutoMigrate(&model.Merge{}, &model.Volume{}, &model.SnapRAID{}, &model.USBRule{}); err != nil {
 		panic(err)
 	}
 
+	// or the migration tool would run every migration against a schema that is already the latest
+	if created {
+		// PRAGMA does not take parameters
+		if err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion)).Error; err != nil {
+			panic(err)
+		}
+	}
+
 	if err := initializeHooks(db); err != nil {
 		panic(err)
 	}
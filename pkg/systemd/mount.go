@@ -0,0 +1,382 @@
+package systemd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/coreos/go-systemd/v22/unit"
+)
+
+const (
+	DefaultDeviceTimeout = 30 * time.Second
+
+	// first line of each unit file generated here - files without it are never touched
+	header = "# Generated by CasaOS LocalStorage - changes will be overwritten"
+
+	jobDone = "done"
+)
+
+var (
+	// UnitDir is where the unit files are written to
+	UnitDir = "/etc/systemd/system"
+
+	ErrUnitNotFound = errors.New("mount unit not found")
+	ErrUnitNotOwned = errors.New("mount unit is not generated by this service")
+	ErrJobFailed    = errors.New("systemd job failed")
+
+	// parsed unit files by path, so that listing does not parse every file again while it is unchanged
+	parsedUnits   = map[string]cachedUnit{}
+	parsedUnitsMu sync.Mutex
+)
+
+type cachedUnit struct {
+	modTime time.Time
+	size    int64
+	unit    *MountUnit
+	err     error
+}
+
+// MountUnit describes a .mount unit, and optionally an .automount unit along with it, for a mount point.
+type MountUnit struct {
+	What          string // e.g. /dev/disk/by-uuid/<uuid>
+	Where         string
+	Type          string
+	Options       string // without nofail and x-systemd.device-timeout, which are always added
+	DeviceTimeout time.Duration
+	Automount     bool // mount on first access rather than at boot
+}
+
+// MountUnitName returns the name of the .mount unit for where, e.g. media-Foo\x20Bar.mount for /media/Foo Bar
+func MountUnitName(where string) string {
+	return unit.UnitNamePathEscape(filepath.Clean(where)) + ".mount"
+}
+
+// AutomountUnitName returns the name of the .automount unit for where
+func AutomountUnitName(where string) string {
+	return unit.UnitNamePathEscape(filepath.Clean(where)) + ".automount"
+}
+
+// RenderMount returns the content of the .mount unit file.
+//
+// The volume is wanted by local-fs.target, and ordered before docker.service, so that it is mounted before any app container
+// starts, regardless of this service. With nofail, boot carries on if the device does not show up within the device timeout.
+func (u *MountUnit) RenderMount() string {
+	timeout := u.DeviceTimeout
+	if timeout <= 0 {
+		timeout = DefaultDeviceTimeout
+	}
+
+	options := []string{}
+	for _, option := range strings.Split(u.Options, ",") {
+		if option == "" || option == "nofail" || strings.HasPrefix(option, "x-systemd.device-timeout=") {
+			continue
+		}
+		options = append(options, option)
+	}
+
+	if len(options) == 0 {
+		options = append(options, "defaults")
+	}
+
+	options = append(options, "nofail", "x-systemd.device-timeout="+timeout.String())
+
+	lines := []string{
+		header,
+		"[Unit]",
+		"Description=CasaOS volume at " + u.Where,
+		"Before=docker.service",
+		"",
+		"[Mount]",
+		"What=" + u.What,
+		"Where=" + u.Where,
+		"Type=" + u.Type,
+		"Options=" + strings.Join(options, ","),
+	}
+
+	if !u.Automount {
+		lines = append(lines, "", "[Install]", "WantedBy=local-fs.target")
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// RenderAutomount returns the content of the .automount unit file.
+func (u *MountUnit) RenderAutomount() string {
+	lines := []string{
+		header,
+		"[Unit]",
+		"Description=CasaOS volume at " + u.Where + " (automount)",
+		"Before=docker.service",
+		"",
+		"[Automount]",
+		"Where=" + u.Where,
+		"",
+		"[Install]",
+		"WantedBy=local-fs.target",
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Install writes the unit files of u, enables them, and starts them, replacing any unit generated before for the same mount point.
+//
+// Starting the .mount unit of a volume that is already mounted at the same mount point is a no-op.
+func Install(ctx context.Context, u MountUnit) error {
+	if err := checkOwned(u.Where); err != nil && !errors.Is(err, ErrUnitNotFound) {
+		return err
+	}
+
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	mountPath := filepath.Join(UnitDir, MountUnitName(u.Where))
+	automountPath := filepath.Join(UnitDir, AutomountUnitName(u.Where))
+
+	if err := os.WriteFile(mountPath, []byte(u.RenderMount()), 0o644); err != nil { // #nosec
+		return err
+	}
+
+	enable, start := mountPath, MountUnitName(u.Where)
+	if u.Automount {
+		if err := os.WriteFile(automountPath, []byte(u.RenderAutomount()), 0o644); err != nil { // #nosec
+			return err
+		}
+		enable, start = automountPath, AutomountUnitName(u.Where)
+	} else if err := removeUnitFile(ctx, conn, automountPath); err != nil {
+		return err
+	}
+
+	if err := conn.ReloadContext(ctx); err != nil {
+		return err
+	}
+
+	if _, _, err := conn.EnableUnitFilesContext(ctx, []string{enable}, false, true); err != nil {
+		return err
+	}
+
+	return startUnit(ctx, conn, start)
+}
+
+// Uninstall disables and removes the unit files for where, without stopping them, so the volume stays mounted until next boot.
+func Uninstall(ctx context.Context, where string) error {
+	if err := checkOwned(where); err != nil {
+		return err
+	}
+
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, name := range []string{AutomountUnitName(where), MountUnitName(where)} {
+		if err := removeUnitFile(ctx, conn, filepath.Join(UnitDir, name)); err != nil {
+			return err
+		}
+	}
+
+	return conn.ReloadContext(ctx)
+}
+
+// Get returns the mount unit generated for where.
+func Get(where string) (*MountUnit, error) {
+	if err := checkOwned(where); err != nil {
+		return nil, err
+	}
+
+	return readUnit(filepath.Join(UnitDir, MountUnitName(where)))
+}
+
+// List returns the mount units generated by this service.
+func List() ([]MountUnit, error) {
+	paths, err := filepath.Glob(filepath.Join(UnitDir, "*.mount"))
+	if err != nil {
+		return nil, err
+	}
+
+	forgetUnitsExcept(paths)
+
+	units := []MountUnit{}
+	for _, path := range paths {
+		u, err := readUnit(path)
+		if err != nil {
+			if errors.Is(err, ErrUnitNotOwned) {
+				continue
+			}
+			return nil, err
+		}
+
+		units = append(units, *u)
+	}
+
+	return units, nil
+}
+
+func readUnit(path string) (*MountUnit, error) {
+	u, err := parseUnit(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(strings.TrimSuffix(path, ".mount") + ".automount"); err == nil {
+		u.Automount = true
+	}
+
+	return u, nil
+}
+
+// parseUnit parses the unit file at path, or returns what it was parsed to if the file is unchanged since.
+func parseUnit(path string) (*MountUnit, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		parsedUnitsMu.Lock()
+		delete(parsedUnits, path)
+		parsedUnitsMu.Unlock()
+
+		if os.IsNotExist(err) {
+			return nil, ErrUnitNotFound
+		}
+		return nil, err
+	}
+
+	parsedUnitsMu.Lock()
+	cached, ok := parsedUnits[path]
+	parsedUnitsMu.Unlock()
+
+	if !ok || !cached.modTime.Equal(info.ModTime()) || cached.size != info.Size() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, ErrUnitNotFound
+			}
+			return nil, err
+		}
+
+		cached = cachedUnit{modTime: info.ModTime(), size: info.Size()}
+		cached.unit, cached.err = parseMount(string(content))
+
+		parsedUnitsMu.Lock()
+		parsedUnits[path] = cached
+		parsedUnitsMu.Unlock()
+	}
+
+	if cached.err != nil {
+		return nil, cached.err
+	}
+
+	// a copy, as the caller may change it
+	u := *cached.unit
+	return &u, nil
+}
+
+// forgetUnitsExcept drops the parsed unit files that are not in paths, i.e. removed since.
+func forgetUnitsExcept(paths []string) {
+	parsedUnitsMu.Lock()
+	defer parsedUnitsMu.Unlock()
+
+	for path := range parsedUnits {
+		if !slices.Contains(paths, path) {
+			delete(parsedUnits, path)
+		}
+	}
+}
+
+func parseMount(content string) (*MountUnit, error) {
+	if !strings.HasPrefix(content, header) {
+		return nil, ErrUnitNotOwned
+	}
+
+	u := &MountUnit{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "What":
+			u.What = value
+		case "Where":
+			u.Where = value
+		case "Type":
+			u.Type = value
+		case "Options":
+			options := []string{}
+			for _, option := range strings.Split(value, ",") {
+				if timeout, found := strings.CutPrefix(option, "x-systemd.device-timeout="); found {
+					if d, err := time.ParseDuration(timeout); err == nil {
+						u.DeviceTimeout = d
+					}
+					continue
+				}
+
+				if option != "nofail" {
+					options = append(options, option)
+				}
+			}
+			u.Options = strings.Join(options, ",")
+		}
+	}
+
+	return u, nil
+}
+
+func checkOwned(where string) error {
+	content, err := os.ReadFile(filepath.Join(UnitDir, MountUnitName(where)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrUnitNotFound
+		}
+		return err
+	}
+
+	if !strings.HasPrefix(string(content), header) {
+		return ErrUnitNotOwned
+	}
+
+	return nil
+}
+
+func removeUnitFile(ctx context.Context, conn *dbus.Conn, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if _, err := conn.DisableUnitFilesContext(ctx, []string{filepath.Base(path)}, false); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func startUnit(ctx context.Context, conn *dbus.Conn, name string) error {
+	result := make(chan string, 1)
+	if _, err := conn.StartUnitContext(ctx, name, "replace", result); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case r := <-result:
+		if r != jobDone {
+			return fmt.Errorf("%w: %s %s", ErrJobFailed, name, r)
+		}
+	}
+
+	return nil
+}
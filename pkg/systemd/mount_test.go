@@ -0,0 +1,120 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestMountUnitName(t *testing.T) {
+	assert.Equal(t, MountUnitName("/media/Foo Bar"), `media-Foo\x20Bar.mount`)
+	assert.Equal(t, AutomountUnitName("/media/sdb1/"), "media-sdb1.automount")
+}
+
+func TestRenderAndParseMount(t *testing.T) {
+	u := MountUnit{
+		What:    "/dev/disk/by-uuid/5c682e86-cec3-4761-9350-8e1a0c2d1ae9",
+		Where:   "/media/Backup",
+		Type:    "ext4",
+		Options: "defaults,nofail,noatime",
+	}
+
+	content := u.RenderMount()
+	assert.Equal(t, content, header+`
+[Unit]
+Description=CasaOS volume at /media/Backup
+Before=docker.service
+
+[Mount]
+What=/dev/disk/by-uuid/5c682e86-cec3-4761-9350-8e1a0c2d1ae9
+Where=/media/Backup
+Type=ext4
+Options=defaults,noatime,nofail,x-systemd.device-timeout=30s
+
+[Install]
+WantedBy=local-fs.target
+`)
+
+	parsed, err := parseMount(content)
+	assert.NilError(t, err)
+	assert.Equal(t, parsed.What, u.What)
+	assert.Equal(t, parsed.Where, u.Where)
+	assert.Equal(t, parsed.Type, u.Type)
+	assert.Equal(t, parsed.Options, "defaults,noatime")
+	assert.Equal(t, parsed.DeviceTimeout, DefaultDeviceTimeout)
+
+	_, err = parseMount("[Mount]\nWhere=/media/Backup\n")
+	assert.ErrorIs(t, err, ErrUnitNotOwned)
+}
+
+func TestList(t *testing.T) {
+	UnitDir = t.TempDir()
+
+	u := MountUnit{What: "/dev/disk/by-uuid/1234", Where: "/media/USB", Type: "vfat", DeviceTimeout: 10 * time.Second, Automount: true}
+
+	err := os.WriteFile(filepath.Join(UnitDir, MountUnitName(u.Where)), []byte(u.RenderMount()), 0o600)
+	assert.NilError(t, err)
+
+	err = os.WriteFile(filepath.Join(UnitDir, AutomountUnitName(u.Where)), []byte(u.RenderAutomount()), 0o600)
+	assert.NilError(t, err)
+
+	// not generated here
+	err = os.WriteFile(filepath.Join(UnitDir, "mnt-other.mount"), []byte("[Mount]\nWhere=/mnt/other\n"), 0o600)
+	assert.NilError(t, err)
+
+	units, err := List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(units), 1)
+	assert.Equal(t, units[0].Where, u.Where)
+	assert.Equal(t, units[0].Options, "defaults")
+	assert.Equal(t, units[0].DeviceTimeout, 10*time.Second)
+	assert.Assert(t, units[0].Automount)
+
+	_, err = Get("/mnt/other")
+	assert.ErrorIs(t, err, ErrUnitNotOwned)
+
+	_, err = Get("/mnt/nothing")
+	assert.ErrorIs(t, err, ErrUnitNotFound)
+}
+
+func TestListCached(t *testing.T) {
+	UnitDir = t.TempDir()
+
+	u := MountUnit{What: "/dev/disk/by-uuid/1234", Where: "/media/USB", Type: "vfat"}
+	path := filepath.Join(UnitDir, MountUnitName(u.Where))
+
+	assert.NilError(t, os.WriteFile(path, []byte(u.RenderMount()), 0o600))
+
+	units, err := List()
+	assert.NilError(t, err)
+	assert.Equal(t, units[0].Type, "vfat")
+
+	// changed, but with the same size and modification time, so it is not parsed again
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+
+	u.Type = "ext4"
+	assert.NilError(t, os.WriteFile(path, []byte(u.RenderMount()), 0o600))
+	assert.NilError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+
+	units, err = List()
+	assert.NilError(t, err)
+	assert.Equal(t, units[0].Type, "vfat")
+
+	modTime := info.ModTime().Add(time.Second)
+	assert.NilError(t, os.Chtimes(path, modTime, modTime))
+
+	units, err = List()
+	assert.NilError(t, err)
+	assert.Equal(t, units[0].Type, "ext4")
+
+	assert.NilError(t, os.Remove(path))
+
+	units, err = List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(units), 0)
+	assert.Equal(t, len(parsedUnits), 0)
+}
@@ -0,0 +1,136 @@
+package union
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+)
+
+// controlFile is the .mergerfs file at the root of the union, through whose extended attributes the branches are read and
+// changed, as for mergerfs - so that pkg/mergerfs works the same on a union.
+type controlFile struct {
+	fs *FS
+}
+
+var (
+	_ fusefs.Node            = (*controlFile)(nil)
+	_ fusefs.NodeGetxattrer  = (*controlFile)(nil)
+	_ fusefs.NodeListxattrer = (*controlFile)(nil)
+	_ fusefs.NodeSetxattrer  = (*controlFile)(nil)
+)
+
+func (c *controlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0o444
+	return nil
+}
+
+// values returns the extended attributes of the control file, by name.
+func (c *controlFile) values() map[string]string {
+	branches := make([]string, 0)
+	for _, branch := range c.fs.Branches() {
+		// always with the mode, as mergerfs has it
+		mode := branch.Mode
+		if mode == "" {
+			mode = mergerfs.BranchModeRW
+		}
+
+		value := branch.Path + "=" + mode
+		if branch.MinFreeSpace != "" {
+			value += "," + branch.MinFreeSpace
+		}
+
+		branches = append(branches, value)
+	}
+
+	return map[string]string{
+		keyPrefix + "branches":                    strings.Join(branches, ":"),
+		keyPrefix + "srcmounts":                   strings.Join(branches, ":"),
+		keyPrefix + mergerfs.OptionCategoryCreate: CreatePolicy,
+		keyPrefix + mergerfs.OptionMinFreeSpace:   strconv.FormatUint(c.fs.minFreeSpace, 10),
+		keyPrefix + "version":                     Subtype,
+		keyPrefix + "pid":                         strconv.Itoa(os.Getpid()),
+	}
+}
+
+func (c *controlFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, ok := c.values()[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	return respondXattr(req.Size, []byte(value), resp)
+}
+
+func (c *controlFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	names := make([]string, 0)
+	for name := range c.values() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resp.Append(names...)
+
+	if req.Size != 0 && uint32(len(resp.Xattr)) > req.Size {
+		return syscall.ERANGE
+	}
+
+	return nil
+}
+
+// Setxattr changes the branches, as mergerfs takes them: all of them, or +<path to prepend, +>path or +path to append, and
+// -path to remove one. No other option can be changed.
+func (c *controlFile) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if req.Name != keyPrefix+"branches" && req.Name != keyPrefix+"srcmounts" {
+		return syscall.ENOTSUP
+	}
+
+	value := string(req.Xattr)
+	branches := c.fs.Branches()
+
+	switch {
+	case strings.HasPrefix(value, "+<"):
+		added, err := mergerfs.ParseBranches(value[2:])
+		if err != nil {
+			return syscall.EINVAL
+		}
+		branches = append(added, branches...)
+
+	case strings.HasPrefix(value, "+>"), strings.HasPrefix(value, "+"):
+		added, err := mergerfs.ParseBranches(strings.TrimPrefix(strings.TrimPrefix(value, "+"), ">"))
+		if err != nil {
+			return syscall.EINVAL
+		}
+		branches = append(branches, added...)
+
+	case strings.HasPrefix(value, "-"):
+		removed := make(map[string]bool)
+		for _, path := range strings.Split(value[1:], ":") {
+			removed[path] = true
+		}
+
+		remaining := make([]mergerfs.Branch, 0, len(branches))
+		for _, branch := range branches {
+			if !removed[branch.Path] {
+				remaining = append(remaining, branch)
+			}
+		}
+		branches = remaining
+
+	default:
+		replaced, err := mergerfs.ParseBranches(strings.TrimPrefix(value, "="))
+		if err != nil {
+			return syscall.EINVAL
+		}
+		branches = replaced
+	}
+
+	c.fs.SetBranches(branches)
+	return nil
+}
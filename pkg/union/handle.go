@@ -0,0 +1,46 @@
+package union
+
+import (
+	"context"
+	"syscall"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+// handle is an open file, on the branch it was opened on.
+type handle struct {
+	fd int
+}
+
+var (
+	_ fusefs.HandleReader   = (*handle)(nil)
+	_ fusefs.HandleWriter   = (*handle)(nil)
+	_ fusefs.HandleReleaser = (*handle)(nil)
+)
+
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+
+	n, err := syscall.Pread(h.fd, buf, req.Offset)
+	if err != nil {
+		return err
+	}
+
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n, err := syscall.Pwrite(h.fd, req.Data, req.Offset)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = n
+	return nil
+}
+
+func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return syscall.Close(h.fd)
+}
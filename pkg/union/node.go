@@ -0,0 +1,610 @@
+package union
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	"golang.org/x/sys/unix"
+)
+
+const keyPrefix = "user.mergerfs."
+
+// node is a file, directory or symlink of the union, by path - whichever branches it is on.
+type node struct {
+	fs   *FS
+	path string // in the union, "" for the root - read with FS.pathOf, as it changes on rename
+}
+
+var (
+	_ fusefs.Node                = (*node)(nil)
+	_ fusefs.NodeRequestLookuper = (*node)(nil)
+	_ fusefs.HandleReadDirAller  = (*node)(nil)
+	_ fusefs.NodeOpener          = (*node)(nil)
+	_ fusefs.NodeCreater         = (*node)(nil)
+	_ fusefs.NodeMkdirer         = (*node)(nil)
+	_ fusefs.NodeSymlinker       = (*node)(nil)
+	_ fusefs.NodeReadlinker      = (*node)(nil)
+	_ fusefs.NodeLinker          = (*node)(nil)
+	_ fusefs.NodeRemover         = (*node)(nil)
+	_ fusefs.NodeRenamer         = (*node)(nil)
+	_ fusefs.NodeSetattrer       = (*node)(nil)
+	_ fusefs.NodeFsyncer         = (*node)(nil)
+	_ fusefs.NodeGetxattrer      = (*node)(nil)
+	_ fusefs.NodeListxattrer     = (*node)(nil)
+	_ fusefs.NodeSetxattrer      = (*node)(nil)
+	_ fusefs.NodeRemovexattrer   = (*node)(nil)
+	_ fusefs.NodeForgetter       = (*node)(nil)
+)
+
+func (n *node) Attr(ctx context.Context, a *fuse.Attr) error {
+	_, stat, err := n.fs.find(n.fs.pathOf(n))
+	if err != nil {
+		return err
+	}
+
+	fillAttr(stat, a)
+	return nil
+}
+
+func (n *node) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fusefs.Node, error) {
+	path := n.fs.pathOf(n)
+
+	if path == "" && req.Name == ".mergerfs" {
+		return &controlFile{fs: n.fs}, nil
+	}
+
+	child := filepath.Join(path, req.Name)
+	if _, _, err := n.fs.find(child); err != nil {
+		return nil, err
+	}
+
+	resp.EntryValid = attrValid
+	return n.fs.node(child), nil
+}
+
+// ReadDirAll lists the entries of the directory on all branches, the first one winning for an entry on more than one.
+func (n *node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	path := n.fs.pathOf(n)
+
+	seen := make(map[string]bool)
+	dirents := make([]fuse.Dirent, 0)
+	found := false
+
+	for _, branch := range n.fs.Branches() {
+		entries, err := os.ReadDir(filepath.Join(branch.Path, path))
+		if err != nil {
+			continue
+		}
+		found = true
+
+		for _, entry := range entries {
+			if seen[entry.Name()] {
+				continue
+			}
+			seen[entry.Name()] = true
+
+			dirent := fuse.Dirent{Name: entry.Name(), Type: fuse.DT_Unknown}
+			switch mode := entry.Type(); {
+			case mode.IsDir():
+				dirent.Type = fuse.DT_Dir
+			case mode.IsRegular():
+				dirent.Type = fuse.DT_File
+			case mode&os.ModeSymlink != 0:
+				dirent.Type = fuse.DT_Link
+			}
+
+			dirents = append(dirents, dirent)
+		}
+	}
+
+	if !found {
+		return nil, syscall.ENOENT
+	}
+
+	return dirents, nil
+}
+
+func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if req.Dir {
+		return n, nil
+	}
+
+	path := n.fs.pathOf(n)
+
+	branch, _, err := n.fs.find(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.Flags.IsReadOnly() && !writable(branch.Mode) {
+		return nil, syscall.EROFS
+	}
+
+	fd, err := syscall.Open(filepath.Join(branch.Path, path), int(req.Flags)|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &handle{fd: fd}, nil
+}
+
+func (n *node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	child := filepath.Join(n.fs.pathOf(n), req.Name)
+
+	branch, err := n.fs.createBranch(child)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mode := unixMode(req.Mode &^ req.Umask)
+
+	fd, err := syscall.Open(filepath.Join(branch.Path, child), int(req.Flags)|syscall.O_CREAT|syscall.O_CLOEXEC, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// as created by root, and with the umask of this process rather than of the caller
+	if err := syscall.Fchmod(fd, mode); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+
+	if err := syscall.Fchown(fd, int(req.Uid), int(req.Gid)); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+
+	return n.fs.node(child), &handle{fd: fd}, nil
+}
+
+func (n *node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
+	child := filepath.Join(n.fs.pathOf(n), req.Name)
+
+	branch, err := n.fs.createBranch(child)
+	if err != nil {
+		return nil, err
+	}
+
+	target := filepath.Join(branch.Path, child)
+	mode := unixMode(req.Mode &^ req.Umask)
+
+	if err := syscall.Mkdir(target, mode); err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Chmod(target, mode); err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Lchown(target, int(req.Uid), int(req.Gid)); err != nil {
+		return nil, err
+	}
+
+	return n.fs.node(child), nil
+}
+
+func (n *node) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fusefs.Node, error) {
+	child := filepath.Join(n.fs.pathOf(n), req.NewName)
+
+	branch, err := n.fs.createBranch(child)
+	if err != nil {
+		return nil, err
+	}
+
+	target := filepath.Join(branch.Path, child)
+
+	if err := syscall.Symlink(req.Target, target); err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Lchown(target, int(req.Uid), int(req.Gid)); err != nil {
+		return nil, err
+	}
+
+	return n.fs.node(child), nil
+}
+
+func (n *node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	path := n.fs.pathOf(n)
+
+	branch, _, err := n.fs.find(path)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := os.Readlink(filepath.Join(branch.Path, path))
+	if err != nil {
+		return "", errno(err)
+	}
+
+	return target, nil
+}
+
+// Link links the file on the first branch it exists on, as hard links cannot cross branches.
+func (n *node) Link(ctx context.Context, req *fuse.LinkRequest, old fusefs.Node) (fusefs.Node, error) {
+	oldNode, ok := old.(*node)
+	if !ok {
+		return nil, syscall.EPERM
+	}
+
+	oldPath := n.fs.pathOf(oldNode)
+	child := filepath.Join(n.fs.pathOf(n), req.NewName)
+
+	branch, _, err := n.fs.find(oldPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !writable(branch.Mode) {
+		return nil, syscall.EROFS
+	}
+
+	if err := n.fs.clonePath(branch, filepath.Dir(child)); err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Link(filepath.Join(branch.Path, oldPath), filepath.Join(branch.Path, child)); err != nil {
+		return nil, err
+	}
+
+	return n.fs.node(child), nil
+}
+
+// Remove removes the entry from all branches it exists on.
+func (n *node) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	child := filepath.Join(n.fs.pathOf(n), req.Name)
+
+	return n.fs.forAll(child, func(target string) error {
+		if req.Dir {
+			return syscall.Rmdir(target)
+		}
+		return syscall.Unlink(target)
+	})
+}
+
+// Rename renames the entry on all branches it exists on, and removes any file it replaces from the other branches, so
+// that the file is not shadowed by the one it replaces.
+func (n *node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	newDirNode, ok := newDir.(*node)
+	if !ok {
+		return syscall.EXDEV
+	}
+
+	oldPath := filepath.Join(n.fs.pathOf(n), req.OldName)
+	newPath := filepath.Join(n.fs.pathOf(newDirNode), req.NewName)
+
+	branches := n.fs.findAll(oldPath)
+	if len(branches) == 0 {
+		return syscall.ENOENT
+	}
+
+	for _, branch := range branches {
+		if !writable(branch.Mode) {
+			return syscall.EROFS
+		}
+	}
+
+	renamed := make(map[string]bool)
+	for _, branch := range branches {
+		if err := n.fs.clonePath(branch, filepath.Dir(newPath)); err != nil {
+			return err
+		}
+
+		if err := syscall.Rename(filepath.Join(branch.Path, oldPath), filepath.Join(branch.Path, newPath)); err != nil {
+			return err
+		}
+
+		renamed[branch.Path] = true
+	}
+
+	for _, branch := range n.fs.findAll(newPath) {
+		if renamed[branch.Path] || !writable(branch.Mode) {
+			continue
+		}
+
+		target := filepath.Join(branch.Path, newPath)
+
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(target, &stat); err == nil && stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			if err := syscall.Unlink(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	n.fs.renamed(oldPath, newPath)
+	return nil
+}
+
+// Setattr changes the entry on all branches it exists on.
+func (n *node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	path := n.fs.pathOf(n)
+
+	err := n.fs.forAll(path, func(target string) error {
+		if req.Valid.Size() {
+			if err := syscall.Truncate(target, int64(req.Size)); err != nil {
+				return err
+			}
+		}
+
+		if req.Valid.Mode() {
+			if err := syscall.Chmod(target, unixMode(req.Mode)); err != nil {
+				return err
+			}
+		}
+
+		if req.Valid.Uid() || req.Valid.Gid() {
+			uid, gid := -1, -1
+			if req.Valid.Uid() {
+				uid = int(req.Uid)
+			}
+			if req.Valid.Gid() {
+				gid = int(req.Gid)
+			}
+
+			if err := syscall.Lchown(target, uid, gid); err != nil {
+				return err
+			}
+		}
+
+		if req.Valid.Atime() || req.Valid.Mtime() || req.Valid.AtimeNow() || req.Valid.MtimeNow() {
+			times := []unix.Timespec{
+				timespec(req.Valid.Atime(), req.Valid.AtimeNow(), req.Atime),
+				timespec(req.Valid.Mtime(), req.Valid.MtimeNow(), req.Mtime),
+			}
+
+			if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return n.Attr(ctx, &resp.Attr)
+}
+
+func (n *node) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	path := n.fs.pathOf(n)
+
+	branch, _, err := n.fs.find(path)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.Open(filepath.Join(branch.Path, path), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	return syscall.Fsync(fd)
+}
+
+// Getxattr returns the extended attribute of the entry on the first branch it exists on - or, for user.mergerfs.basepath,
+// relpath, fullpath and allpaths, where it is, as mergerfs does.
+func (n *node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	path := n.fs.pathOf(n)
+
+	branch, _, err := n.fs.find(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(req.Name, keyPrefix) {
+		var value string
+
+		switch strings.TrimPrefix(req.Name, keyPrefix) {
+		case "basepath":
+			value = branch.Path
+		case "relpath":
+			value = "/" + path
+		case "fullpath":
+			value = filepath.Join(branch.Path, path)
+		case "allpaths":
+			paths := make([]string, 0)
+			for _, b := range n.fs.findAll(path) {
+				paths = append(paths, filepath.Join(b.Path, path))
+			}
+			value = strings.Join(paths, "\x00")
+		default:
+			return fuse.ErrNoXattr
+		}
+
+		return respondXattr(req.Size, []byte(value), resp)
+	}
+
+	target := filepath.Join(branch.Path, path)
+
+	size, err := unix.Lgetxattr(target, req.Name, nil)
+	if err != nil {
+		return errno(err)
+	}
+
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(target, req.Name, value)
+	if err != nil {
+		return errno(err)
+	}
+
+	return respondXattr(req.Size, value[:size], resp)
+}
+
+func (n *node) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	path := n.fs.pathOf(n)
+
+	branch, _, err := n.fs.find(path)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(branch.Path, path)
+
+	size, err := unix.Llistxattr(target, nil)
+	if err != nil {
+		return errno(err)
+	}
+
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(target, names)
+	if err != nil {
+		return errno(err)
+	}
+
+	if req.Size != 0 && uint32(size) > req.Size {
+		return syscall.ERANGE
+	}
+
+	resp.Xattr = names[:size]
+	return nil
+}
+
+func (n *node) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if strings.HasPrefix(req.Name, keyPrefix) {
+		return syscall.ENOTSUP
+	}
+
+	return n.fs.forAll(n.fs.pathOf(n), func(target string) error {
+		return unix.Lsetxattr(target, req.Name, req.Xattr, int(req.Flags))
+	})
+}
+
+func (n *node) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if strings.HasPrefix(req.Name, keyPrefix) {
+		return syscall.ENOTSUP
+	}
+
+	return n.fs.forAll(n.fs.pathOf(n), func(target string) error {
+		return unix.Lremovexattr(target, req.Name)
+	})
+}
+
+func (n *node) Forget() {
+	n.fs.forget(n)
+}
+
+// forAll calls fn with the path of path on each branch it exists on, and returns the first error - or EROFS without
+// calling fn at all if it exists on a read-only branch, as it would still be seen there unchanged.
+func (f *FS) forAll(path string, fn func(target string) error) error {
+	branches := f.findAll(path)
+	if len(branches) == 0 {
+		return syscall.ENOENT
+	}
+
+	for _, branch := range branches {
+		if !writable(branch.Mode) {
+			return syscall.EROFS
+		}
+	}
+
+	var result error
+	for _, branch := range branches {
+		if err := fn(filepath.Join(branch.Path, path)); err != nil && result == nil {
+			result = errno(err)
+		}
+	}
+
+	return result
+}
+
+// writable tells if files on a branch with mode can be changed - NC only stops new files from being created on it.
+func writable(mode string) bool {
+	return mode != mergerfs.BranchModeRO
+}
+
+func respondXattr(size uint32, value []byte, resp *fuse.GetxattrResponse) error {
+	if size != 0 && uint32(len(value)) > size {
+		return syscall.ERANGE
+	}
+
+	resp.Xattr = value
+	return nil
+}
+
+func timespec(valid, now bool, t time.Time) unix.Timespec {
+	switch {
+	case now:
+		return unix.Timespec{Nsec: unix.UTIME_NOW}
+	case valid:
+		return unix.NsecToTimespec(t.UnixNano())
+	default:
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+}
+
+func fillAttr(stat *syscall.Stat_t, a *fuse.Attr) {
+	a.Valid = attrValid
+	a.Size = uint64(stat.Size)
+	a.Blocks = uint64(stat.Blocks)
+	a.Atime = time.Unix(stat.Atim.Unix())
+	a.Mtime = time.Unix(stat.Mtim.Unix())
+	a.Ctime = time.Unix(stat.Ctim.Unix())
+	a.Mode = fileMode(stat.Mode)
+	a.Nlink = uint32(stat.Nlink)
+	a.Uid = stat.Uid
+	a.Gid = stat.Gid
+	a.Rdev = uint32(stat.Rdev)
+	a.BlockSize = uint32(stat.Blksize)
+}
+
+// fileMode returns the os.FileMode of a mode from stat(2)
+func fileMode(mode uint32) os.FileMode {
+	result := os.FileMode(mode & 0o777)
+
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		result |= os.ModeDevice
+	case syscall.S_IFCHR:
+		result |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		result |= os.ModeDir
+	case syscall.S_IFIFO:
+		result |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		result |= os.ModeSymlink
+	case syscall.S_IFREG:
+	case syscall.S_IFSOCK:
+		result |= os.ModeSocket
+	default:
+		result |= os.ModeIrregular
+	}
+
+	if mode&syscall.S_ISUID != 0 {
+		result |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		result |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		result |= os.ModeSticky
+	}
+
+	return result
+}
+
+// unixMode returns the permission bits of mode as chmod(2) takes them
+func unixMode(mode os.FileMode) uint32 {
+	result := uint32(mode.Perm())
+
+	if mode&os.ModeSetuid != 0 {
+		result |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		result |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		result |= syscall.S_ISVTX
+	}
+
+	return result
+}
@@ -0,0 +1,446 @@
+// Package union is a FUSE union filesystem served by this process, to merge directories on systems without mergerfs.
+//
+// It has fewer features than mergerfs. Files and directories are created on the first writable branch where the parent
+// directory exists (epff), or else on the first writable branch with space, onto which the parent is cloned. Files are
+// read from the first branch they exist on (ff), and changed or removed on all branches they exist on. Of the mergerfs
+// options, only minfreespace is taken. Branches can be read and changed through the same .mergerfs control file.
+package union
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	"github.com/moby/sys/mountinfo"
+	"go.uber.org/zap"
+)
+
+const (
+	Subtype = "casaos-union"
+	FSType  = "fuse." + Subtype
+
+	CreatePolicy = "epff"
+
+	defaultMinFreeSpace = 1 << 20
+
+	// short, as files are also moved between branches directly, e.g. by a rebalance
+	attrValid = time.Second
+)
+
+var (
+	ErrNotAvailable   = errors.New("the built-in union filesystem needs fusermount3 and /dev/fuse")
+	ErrAlreadyMounted = errors.New("already mounted by the built-in union filesystem")
+
+	mu      sync.Mutex
+	mounted = make(map[string]*FS) // by mount point
+)
+
+// Available tells if union filesystems can be mounted on this system.
+func Available() bool {
+	if _, err := exec.LookPath("fusermount3"); err != nil {
+		return false
+	}
+
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return false
+	}
+
+	return true
+}
+
+// Mount merges the branches in source at mountPoint, and serves them in the background until unmounted, e.g. with umount(8).
+//
+// source and options are as for mergerfs, e.g. /mnt/a:/mnt/b=NC and minfreespace=4G - options other than minfreespace are ignored.
+func Mount(mountPoint, source, options string) error {
+	if !Available() {
+		return ErrNotAvailable
+	}
+
+	branches, err := mergerfs.ParseBranches(source)
+	if err != nil {
+		return err
+	}
+
+	minFreeSpace := uint64(defaultMinFreeSpace)
+	for _, option := range strings.Split(options, ",") {
+		name, value, _ := strings.Cut(option, "=")
+		if name != mergerfs.OptionMinFreeSpace {
+			continue
+		}
+
+		if minFreeSpace, err = mergerfs.ParseSize(value); err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := mounted[mountPoint]; ok {
+		return ErrAlreadyMounted
+	}
+
+	if err := unmountStale(mountPoint); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(branches))
+	for _, branch := range branches {
+		paths = append(paths, branch.Path)
+	}
+
+	c, err := fuse.Mount(
+		mountPoint,
+		fuse.FSName(strings.Join(paths, ":")),
+		fuse.Subtype(Subtype),
+		fuse.AllowOther(),
+		fuse.DefaultPermissions(),
+		fuse.MaxReadahead(128*1024),
+	)
+	if err != nil {
+		return err
+	}
+
+	fsys := New(branches, minFreeSpace)
+	mounted[mountPoint] = fsys
+
+	go func() {
+		if err := fusefs.Serve(c, fsys); err != nil {
+			logger.Error("error when serving union filesystem", zap.Error(err), zap.String("mount point", mountPoint))
+		}
+
+		if err := c.Close(); err != nil {
+			logger.Error("error when closing union filesystem", zap.Error(err), zap.String("mount point", mountPoint))
+		}
+
+		mu.Lock()
+		if mounted[mountPoint] == fsys {
+			delete(mounted, mountPoint)
+		}
+		mu.Unlock()
+
+		logger.Info("union filesystem is unmounted", zap.String("mount point", mountPoint))
+	}()
+
+	logger.Info("union filesystem is mounted", zap.String("mount point", mountPoint), zap.Strings("branches", paths))
+
+	return nil
+}
+
+// UnmountAll unmounts the union filesystems served by this process - lazily, if busy - as they would be left as dead
+// mounts once it exits, failing everything using them with ENOTCONN.
+func UnmountAll() {
+	mu.Lock()
+	mountPoints := make([]string, 0, len(mounted))
+	for mountPoint := range mounted {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	mu.Unlock()
+
+	for _, mountPoint := range mountPoints {
+		if err := fuse.Unmount(mountPoint); err == nil {
+			logger.Info("union filesystem is unmounted on shutdown", zap.String("mount point", mountPoint))
+			continue
+		}
+
+		if err := unmountLazy(mountPoint); err != nil {
+			logger.Error("error when unmounting union filesystem on shutdown", zap.Error(err), zap.String("mount point", mountPoint))
+			continue
+		}
+
+		logger.Info("union filesystem is busy - detached on shutdown", zap.String("mount point", mountPoint))
+	}
+}
+
+// unmountStale lazily unmounts a union filesystem at mountPoint that no process serves any longer, e.g. as this one was
+// killed before it could unmount it.
+func unmountStale(mountPoint string) error {
+	mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(mountPoint))
+	if err != nil || len(mounts) == 0 || mounts[len(mounts)-1].FSType != FSType {
+		return err
+	}
+
+	logger.Info("unmounting stale union filesystem left behind by a previous run", zap.String("mount point", mountPoint))
+
+	return unmountLazy(mountPoint)
+}
+
+func unmountLazy(mountPoint string) error {
+	if out, err := exec.Command("fusermount3", "-u", "-z", mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// IsMounted tells if mountPoint is served by a union filesystem of this process.
+func IsMounted(mountPoint string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, ok := mounted[mountPoint]
+	return ok
+}
+
+// FS is a union of branches.
+type FS struct {
+	mu           sync.RWMutex
+	branches     []mergerfs.Branch
+	minFreeSpace uint64
+
+	nodesMu sync.Mutex
+	nodes   map[string]*node // by path in the union, "" being the root
+}
+
+var (
+	_ fusefs.FS         = (*FS)(nil)
+	_ fusefs.FSStatfser = (*FS)(nil)
+)
+
+// New returns a union of branches, which creates files only on branches with at least minFreeSpace bytes free, unless
+// a branch has its own minfreespace.
+func New(branches []mergerfs.Branch, minFreeSpace uint64) *FS {
+	return &FS{
+		branches:     branches,
+		minFreeSpace: minFreeSpace,
+		nodes:        make(map[string]*node),
+	}
+}
+
+func (f *FS) Root() (fusefs.Node, error) {
+	return f.node(""), nil
+}
+
+// Branches returns the branches of f, in order.
+func (f *FS) Branches() []mergerfs.Branch {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return append([]mergerfs.Branch(nil), f.branches...)
+}
+
+// SetBranches replaces the branches of f.
+func (f *FS) SetBranches(branches []mergerfs.Branch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.branches = branches
+}
+
+// Statfs sums up the space of the branches, counting a filesystem only once should it hold more than one branch.
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	seen := make(map[syscall.Fsid]bool)
+
+	for _, branch := range f.Branches() {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(branch.Path, &stat); err != nil {
+			continue
+		}
+
+		if seen[stat.Fsid] {
+			continue
+		}
+		seen[stat.Fsid] = true
+
+		if resp.Bsize == 0 {
+			resp.Bsize = uint32(stat.Bsize)
+			resp.Frsize = uint32(stat.Bsize)
+			resp.Namelen = uint32(stat.Namelen)
+		}
+
+		scale := func(blocks uint64) uint64 {
+			return blocks * uint64(stat.Bsize) / uint64(resp.Bsize)
+		}
+
+		resp.Blocks += scale(stat.Blocks)
+		resp.Bfree += scale(stat.Bfree)
+		resp.Bavail += scale(stat.Bavail)
+		resp.Files += stat.Files
+		resp.Ffree += stat.Ffree
+	}
+
+	return nil
+}
+
+// node returns the node for path, the same one as long as the kernel has not forgotten it.
+func (f *FS) node(path string) *node {
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+
+	if n, ok := f.nodes[path]; ok {
+		return n
+	}
+
+	n := &node{fs: f, path: path}
+	f.nodes[path] = n
+	return n
+}
+
+func (f *FS) forget(n *node) {
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+
+	if f.nodes[n.path] == n {
+		delete(f.nodes, n.path)
+	}
+}
+
+// renamed moves the nodes under oldPath to newPath, so that they keep working after a rename.
+func (f *FS) renamed(oldPath, newPath string) {
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+
+	moved := make([]*node, 0)
+	for path, n := range f.nodes {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			delete(f.nodes, path)
+			moved = append(moved, n)
+		}
+	}
+
+	for _, n := range moved {
+		n.path = newPath + strings.TrimPrefix(n.path, oldPath)
+		f.nodes[n.path] = n
+	}
+}
+
+// pathOf returns the path of n in the union, which changes when n or a directory above it is renamed.
+func (f *FS) pathOf(n *node) string {
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+
+	return n.path
+}
+
+// find returns the first branch path exists on, with its stat - ENOENT if none.
+func (f *FS) find(path string) (mergerfs.Branch, *syscall.Stat_t, error) {
+	for _, branch := range f.Branches() {
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(branch.Path, path), &stat); err == nil {
+			return branch, &stat, nil
+		}
+	}
+
+	return mergerfs.Branch{}, nil, syscall.ENOENT
+}
+
+// findAll returns all branches path exists on.
+func (f *FS) findAll(path string) []mergerfs.Branch {
+	results := make([]mergerfs.Branch, 0)
+	for _, branch := range f.Branches() {
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(branch.Path, path), &stat); err == nil {
+			results = append(results, branch)
+		}
+	}
+
+	return results
+}
+
+// createBranch returns the branch to create path on: the first writable branch with space where the parent directory
+// exists, or else the first writable branch with space, onto which the parent directory is cloned.
+func (f *FS) createBranch(path string) (mergerfs.Branch, error) {
+	dir := filepath.Dir(path)
+
+	candidates := make([]mergerfs.Branch, 0)
+	for _, branch := range f.Branches() {
+		if branch.Mode != "" && branch.Mode != mergerfs.BranchModeRW {
+			continue
+		}
+
+		if !f.hasSpace(branch) {
+			continue
+		}
+
+		var stat syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(branch.Path, dir), &stat); err == nil {
+			return branch, nil
+		}
+
+		candidates = append(candidates, branch)
+	}
+
+	if len(candidates) == 0 {
+		return mergerfs.Branch{}, syscall.ENOSPC
+	}
+
+	if err := f.clonePath(candidates[0], dir); err != nil {
+		return mergerfs.Branch{}, err
+	}
+
+	return candidates[0], nil
+}
+
+func (f *FS) hasSpace(branch mergerfs.Branch) bool {
+	minFreeSpace := f.minFreeSpace
+	if branch.MinFreeSpace != "" {
+		if size, err := mergerfs.ParseSize(branch.MinFreeSpace); err == nil {
+			minFreeSpace = size
+		}
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(branch.Path, &stat); err != nil {
+		return false
+	}
+
+	return stat.Bavail*uint64(stat.Bsize) >= minFreeSpace
+}
+
+// clonePath creates dir on branch, where missing, with the mode, owner and times of it on the first branch it exists on.
+func (f *FS) clonePath(branch mergerfs.Branch, dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+
+	target := filepath.Join(branch.Path, dir)
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(target, &stat); err == nil {
+		return nil
+	}
+
+	if err := f.clonePath(branch, filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	_, source, err := f.find(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mkdir(target, 0o700); err != nil && err != syscall.EEXIST {
+		return err
+	}
+
+	if err := syscall.Chmod(target, source.Mode&0o7777); err != nil {
+		return err
+	}
+
+	if err := syscall.Lchown(target, int(source.Uid), int(source.Gid)); err != nil {
+		return err
+	}
+
+	return syscall.UtimesNano(target, []syscall.Timespec{source.Atim, source.Mtim})
+}
+
+// errno returns the errno of err, as bazil.org/fuse does not unwrap e.g. *os.PathError
+func errno(err error) error {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return err
+}
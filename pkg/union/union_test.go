@@ -0,0 +1,99 @@
+package union
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	"gotest.tools/v3/assert"
+)
+
+func TestUnion(t *testing.T) {
+	ctx := context.Background()
+	header := fuse.Header{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+
+	a, b, archive := t.TempDir(), t.TempDir(), t.TempDir()
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(b, "Media", "Movies"), 0o755))
+	assert.NilError(t, os.MkdirAll(filepath.Join(a, "Media"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(a, "Media", "a.txt"), []byte("a"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(b, "Media", "a.txt"), []byte("b"), 0o644))
+	assert.NilError(t, os.MkdirAll(filepath.Join(archive, "Backup"), 0o750))
+
+	fsys := New([]mergerfs.Branch{{Path: a}, {Path: b}, {Path: archive, Mode: mergerfs.BranchModeRO}}, 0)
+
+	root := fsys.node("")
+
+	// entries of all branches, the first one winning
+	dirents, err := fsys.node("Media").ReadDirAll(ctx)
+	assert.NilError(t, err)
+	names := make([]string, 0, len(dirents))
+	for _, dirent := range dirents {
+		names = append(names, dirent.Name)
+	}
+	sort.Strings(names)
+	assert.DeepEqual(t, names, []string{"Movies", "a.txt"})
+
+	// created on the first branch where the parent exists
+	_, h, err := fsys.node("Media/Movies").Create(ctx, &fuse.CreateRequest{Header: header, Name: "movie.mkv", Flags: fuse.OpenFlags(os.O_RDWR), Mode: 0o644}, &fuse.CreateResponse{})
+	assert.NilError(t, err)
+	assert.NilError(t, h.(*handle).Release(ctx, &fuse.ReleaseRequest{}))
+	assert.Assert(t, fileExists(filepath.Join(b, "Media", "Movies", "movie.mkv")))
+
+	// or else on the first writable branch, onto which the parent is cloned
+	_, err = fsys.node("Backup").Mkdir(ctx, &fuse.MkdirRequest{Header: header, Name: "2024", Mode: os.ModeDir | 0o755})
+	assert.NilError(t, err)
+	assert.Assert(t, fileExists(filepath.Join(a, "Backup", "2024")))
+
+	info, err := os.Stat(filepath.Join(a, "Backup"))
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0o750))
+
+	// where a path lives, as with mergerfs
+	resp := &fuse.GetxattrResponse{}
+	assert.NilError(t, fsys.node("Media/a.txt").Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.mergerfs.allpaths"}, resp))
+	assert.DeepEqual(t, strings.Split(string(resp.Xattr), "\x00"), []string{filepath.Join(a, "Media", "a.txt"), filepath.Join(b, "Media", "a.txt")})
+
+	resp = &fuse.GetxattrResponse{}
+	assert.NilError(t, fsys.node("Media/a.txt").Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.mergerfs.basepath"}, resp))
+	assert.Equal(t, string(resp.Xattr), a)
+
+	// renamed on all branches
+	assert.NilError(t, fsys.node("Media").Rename(ctx, &fuse.RenameRequest{OldName: "a.txt", NewName: "c.txt"}, fsys.node("Media")))
+	assert.Assert(t, fileExists(filepath.Join(a, "Media", "c.txt")))
+	assert.Assert(t, fileExists(filepath.Join(b, "Media", "c.txt")))
+	assert.Equal(t, fsys.node("Media/c.txt").path, "Media/c.txt")
+
+	// removed from all branches
+	assert.NilError(t, fsys.node("Media").Remove(ctx, &fuse.RemoveRequest{Name: "c.txt"}))
+	assert.Assert(t, !fileExists(filepath.Join(a, "Media", "c.txt")))
+	assert.Assert(t, !fileExists(filepath.Join(b, "Media", "c.txt")))
+
+	// but not from read-only ones
+	assert.ErrorIs(t, root.Remove(ctx, &fuse.RemoveRequest{Name: "Backup", Dir: true}), syscall.EROFS)
+
+	// branches through the control file
+	node, err := root.Lookup(ctx, &fuse.LookupRequest{Name: ".mergerfs"}, &fuse.LookupResponse{})
+	assert.NilError(t, err)
+	control := node.(*controlFile)
+
+	assert.NilError(t, control.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.mergerfs.branches", Xattr: []byte("-" + b)}))
+	assert.NilError(t, control.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.mergerfs.branches", Xattr: []byte("+" + b + "=NC")}))
+
+	resp = &fuse.GetxattrResponse{}
+	assert.NilError(t, control.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.mergerfs.branches"}, resp))
+	assert.Equal(t, string(resp.Xattr), a+"=RW:"+archive+"=RO:"+b+"=NC")
+
+	assert.ErrorIs(t, control.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.mergerfs.category.create", Xattr: []byte("mfs")}), syscall.ENOTSUP)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
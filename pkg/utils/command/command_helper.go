@@ -1,6 +1,7 @@
 package command
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -68,3 +69,20 @@ func ExecuteCommand(name string, arg ...string) ([]byte, error) {
 
 	return out, nil
 }
+
+// ExecuteCommandWithStdin is ExecuteCommand with stdin fed from the given bytes, e.g. to pass a secret that should not show up in arguments.
+// Unlike ExecuteCommand, it prints nothing, as the command or its output may be about the secret.
+func ExecuteCommandWithStdin(stdin []byte, name string, arg ...string) ([]byte, error) {
+	cmd := exec2.Command(name, arg...)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			return nil, errors.New(string(exitError.Stderr))
+		}
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -192,8 +192,8 @@ func DeleteDisksUmount(ctx echo.Context) error {
 		diskInfo.Children = append(diskInfo.Children, t)
 	}
 	for _, v := range diskInfo.Children {
-		if err := service.MyService.Disk().UmountPointAndRemoveDir(v); err != nil {
-			return ctx.JSON(http.StatusInternalServerError, model.Result{Success: common_err.REMOVE_MOUNT_POINT_ERROR, Message: err.Error()})
+		if err := umountPointAndRemoveDir(v, js["stop_holders"] == "true"); err != nil {
+			return umountError(ctx, err)
 		}
 
 		// delete data
@@ -10,6 +10,7 @@
 package v1
 
 import (
+	"errors"
 	"net/http"
 	"path/filepath"
 	"reflect"
@@ -22,6 +23,8 @@ import (
 	"go.uber.org/zap"
 
 	model1 "github.com/IceWhaleTech/CasaOS-LocalStorage/model"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/luks"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
 	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
 
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
@@ -76,7 +79,17 @@ func GetStorageList(ctx echo.Context) error {
 					logger.Info("found system disk", zap.String("disk", blkChild.Path))
 				}
 			}
-			if blkChild.MountPoint == "" {
+			encrypted, locked := false, false
+			if blkChild.FsType == luks.FSType {
+				// the filesystem is in the opened container, e.g. /dev/mapper/luks-<uuid>, if unlocked
+				encrypted = true
+				if len(blkChild.Children) > 0 {
+					blkChild = blkChild.Children[0]
+				} else {
+					locked = true
+				}
+			}
+			if blkChild.MountPoint == "" && !locked {
 				continue
 			}
 			if !foundSystem {
@@ -105,8 +118,12 @@ func GetStorageList(ctx echo.Context) error {
 				Type:        blkChild.FsType,
 				DriveName:   blkChild.Name,
 				PersistedIn: service.MyService.Disk().GetPersistentTypeByUUID(blkChild.UUID),
+				Encrypted:   encrypted,
+				Locked:      locked,
 			}
-			if len(blkChild.Label) == 0 {
+			if locked {
+				stor.Label = blkChild.Name
+			} else if len(blkChild.Label) == 0 {
 				if stor.MountPoint == "/" {
 					stor.Label = "System"
 				} else {
@@ -168,10 +185,11 @@ func PostAddStorage(ctx echo.Context) error {
 	defer delete(diskMap, path)
 	currentDisk := service.MyService.Disk().GetDiskInfo(path)
 	if format {
+		stopHolders, _ := js["stop_holders"].(bool)
 
-		if err := service.MyService.Disk().UmountPointAndRemoveDir(currentDisk); err != nil {
+		if err := umountPointAndRemoveDir(currentDisk, stopHolders); err != nil {
 			logger.Error("error when trying to umount storage", zap.Error(err), zap.String("path", path))
-			return ctx.JSON(common_err.SERVICE_ERROR, model.Result{Success: common_err.REMOVE_MOUNT_POINT_ERROR, Message: err.Error()})
+			return umountError(ctx, err)
 		}
 
 		logger.Info("deleting storage...", zap.String("path", path))
@@ -188,7 +206,7 @@ func PostAddStorage(ctx echo.Context) error {
 	currentDisk = service.MyService.Disk().GetDiskInfo(path)
 	if len(currentDisk.Children) == 0 && service.IsDiskSupported(currentDisk) {
 		currentDisk.Children = append(currentDisk.Children, currentDisk)
-		// mountPoint := currentDisk.GetMountPoint(name)
+		// mountPoint := service.MyService.Disk().AssignMountPoint(currentDisk, currentDisk, name)
 
 		// // mount disk
 		// if output, err := service.MyService.Disk().MountDisk(currentDisk.Path, mountPoint); err != nil {
@@ -236,7 +254,7 @@ func PostAddStorage(ctx echo.Context) error {
 	message := ""
 	for _, blkChild := range currentDisk.Children {
 
-		mountPoint := blkChild.GetMountPoint(name)
+		mountPoint := service.MyService.Disk().AssignMountPoint(currentDisk, blkChild, name)
 		// mount disk
 		if output, err := service.MyService.Disk().MountDisk(blkChild.Path, mountPoint); err != nil {
 			logger.Error("err", zap.Error(err), zap.String("mountPoint", mountPoint), zap.String("output", output))
@@ -324,8 +342,8 @@ func PutFormatStorage(ctx echo.Context) error {
 	defer service.MyService.Disk().RemoveLSBLKCache()
 	defer delete(diskMap, path)
 	diskInfo := service.MyService.Disk().GetDiskInfo(path)
-	if err := service.MyService.Disk().UmountPointAndRemoveDir(diskInfo); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, model.Result{Success: common_err.REMOVE_MOUNT_POINT_ERROR, Message: err.Error()})
+	if err := umountPointAndRemoveDir(diskInfo, js["stop_holders"] == "true"); err != nil {
+		return umountError(ctx, err)
 	}
 
 	if err := service.MyService.Disk().FormatDisk(path); err != nil {
@@ -338,7 +356,7 @@ func PutFormatStorage(ctx echo.Context) error {
 		currentDisk = service.MyService.Disk().GetDiskInfo(path)
 	}
 	if mountPoint == "" {
-		mountPoint = currentDisk.GetMountPoint("")
+		mountPoint = service.MyService.Disk().AssignMountPoint(currentDisk, currentDisk, "")
 	}
 
 	if output, err := service.MyService.Disk().MountDisk(path, mountPoint); err != nil {
@@ -381,8 +399,8 @@ func DeleteStorage(ctx echo.Context) error {
 		return ctx.JSON(common_err.SERVICE_ERROR, model.Result{Success: common_err.DISK_BUSYING, Message: common_err.GetMsg(common_err.DISK_BUSYING)})
 	}
 	diskInfo := service.MyService.Disk().GetDiskInfo(path)
-	if err := service.MyService.Disk().UmountPointAndRemoveDir(diskInfo); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, model.Result{Success: common_err.REMOVE_MOUNT_POINT_ERROR, Message: err.Error()})
+	if err := umountPointAndRemoveDir(diskInfo, js["stop_holders"] == "true"); err != nil {
+		return umountError(ctx, err)
 	}
 
 	// delete data
@@ -412,3 +430,27 @@ func DeleteStorage(ctx echo.Context) error {
 
 	return ctx.JSON(http.StatusOK, model.Result{Success: common_err.SUCCESS, Message: common_err.GetMsg(common_err.SUCCESS)})
 }
+
+// umount the storage, optionally stopping the app containers holding it if it is busy
+func umountPointAndRemoveDir(m model1.LSBLKModel, stopHolders bool) error {
+	umount := func() error {
+		return service.MyService.Disk().UmountPointAndRemoveDir(m)
+	}
+
+	if stopHolders {
+		return mount.RetryStoppingHolders(umount)
+	}
+
+	return umount()
+}
+
+// umountError responds with 409 and the processes and app containers holding the mount point if that is why umount
+// failed, as v2 does, or with 500 otherwise.
+func umountError(ctx echo.Context, err error) error {
+	var busyErr *mount.BusyError
+	if errors.As(err, &busyErr) {
+		return ctx.JSON(http.StatusConflict, model.Result{Success: common_err.DISK_BUSYING, Message: err.Error(), Data: busyErr.Holders})
+	}
+
+	return ctx.JSON(http.StatusInternalServerError, model.Result{Success: common_err.REMOVE_MOUNT_POINT_ERROR, Message: err.Error()})
+}
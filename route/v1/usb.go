@@ -35,10 +35,10 @@ func PutSystemUSBAutoMount(ctx echo.Context) error {
 	status := js["state"]
 	if status == "on" {
 		service.MyService.USB().UpdateUSBAutoMount("True")
-		service.MyService.USB().ExecUSBAutoMountShell("True")
+		service.MyService.USB().ApplyUSBAutoMount("True")
 	} else {
 		service.MyService.USB().UpdateUSBAutoMount("False")
-		service.MyService.USB().ExecUSBAutoMountShell("False")
+		service.MyService.USB().ApplyUSBAutoMount("False")
 	}
 
 	go func() {
@@ -0,0 +1,117 @@
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/secret"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+func (s *LocalStorage) ExportConfig(ctx echo.Context) error {
+	var request codegen.ConfigExportRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	passphrase := ""
+	if request.Passphrase != nil {
+		passphrase = *request.Passphrase
+	}
+
+	bundle, err := service.MyService.ConfigBundle().Export(passphrase)
+	if err != nil {
+		logger.Error("error when exporting config", zap.Error(err))
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	ctx.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+common.ServiceName+`-config.json"`)
+	return ctx.JSON(http.StatusOK, bundle)
+}
+
+func (s *LocalStorage) ImportConfig(ctx echo.Context) error {
+	var request codegen.ConfigImportRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	bundle, err := ConfigBundleAdapterIn(request.Bundle)
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	passphrase := ""
+	if request.Passphrase != nil {
+		passphrase = *request.Passphrase
+	}
+
+	var items []service.ConfigItem
+	if request.DryRun != nil && *request.DryRun {
+		items, err = service.MyService.ConfigBundle().Plan(bundle, passphrase)
+	} else {
+		items, err = service.MyService.ConfigBundle().Import(bundle, passphrase)
+	}
+
+	if err != nil {
+		message := err.Error()
+
+		if errors.Is(err, service.ErrConfigBundleVersion) ||
+			errors.Is(err, service.ErrConfigPassphraseRequired) ||
+			errors.Is(err, secret.ErrWrongPassphrase) {
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		}
+
+		logger.Error("error when importing config", zap.Error(err))
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	data := make([]codegen.ConfigItem, 0, len(items))
+	for _, item := range items {
+		data = append(data, ConfigItemAdapterOut(item))
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ConfigImportResponseOK{Data: &data})
+}
+
+// ConfigBundleAdapterIn returns the bundle as exported, from the generic shape it is bound to.
+func ConfigBundleAdapterIn(bundle codegen.ConfigBundle) (*service.ConfigBundle, error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	var result service.ConfigBundle
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func ConfigItemAdapterOut(item service.ConfigItem) codegen.ConfigItem {
+	result := codegen.ConfigItem{
+		Type:   codegen.ConfigItemType(item.Type),
+		Name:   item.Name,
+		Action: codegen.ConfigItemAction(item.Action),
+	}
+
+	if item.Reason != "" {
+		result.Reason = &item.Reason
+	}
+
+	if item.Error != "" {
+		result.Error = &item.Error
+	}
+
+	return result
+}
@@ -0,0 +1,156 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetMergeConflicts(ctx echo.Context) error {
+	status, err := service.MyService.Conflict().Status()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	}
+
+	result := ConflictStatusAdapterOut(*status)
+	return ctx.JSON(http.StatusOK, codegen.ConflictScanResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) StartMergeConflictScan(ctx echo.Context) error {
+	var request codegen.ConflictScanRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	withHash := request.WithHash != nil && *request.WithHash
+
+	status, err := service.MyService.Conflict().Scan(request.MountPoint, withHash)
+	if err != nil {
+		message := err.Error()
+
+		switch {
+		case errors.Is(err, v2.ErrMergeMountPointDoesNotExist):
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		case errors.Is(err, service.ErrConflictScanRunning):
+			return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	result := ConflictStatusAdapterOut(*status)
+	return ctx.JSON(http.StatusOK, codegen.ConflictScanResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) CancelMergeConflictScan(ctx echo.Context) error {
+	status, err := service.MyService.Conflict().Cancel()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	}
+
+	result := ConflictStatusAdapterOut(*status)
+	return ctx.JSON(http.StatusOK, codegen.ConflictScanResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) ResolveMergeConflict(ctx echo.Context) error {
+	var request codegen.ConflictResolveRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	resolution, err := service.MyService.Conflict().Resolve(request.MountPoint, request.Path, string(request.Action))
+	if err != nil {
+		message := err.Error()
+
+		switch {
+		case errors.Is(err, mergerfs.ErrInvalidConflictAction):
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		case errors.Is(err, v2.ErrMergeMountPointDoesNotExist), errors.Is(err, mergerfs.ErrNoConflict):
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		case errors.Is(err, service.ErrRebalanceRunning),
+			errors.Is(err, service.ErrSnapRAIDRunning),
+			errors.Is(err, mergerfs.ErrFileOpen),
+			errors.Is(err, mergerfs.ErrFileChanged),
+			errors.Is(err, mergerfs.ErrBranchReadOnly):
+			return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	result := codegen.ConflictResolution{
+		Path:    resolution.Path,
+		Action:  resolution.Action,
+		Removed: resolution.Removed,
+		Renamed: resolution.Renamed,
+	}
+
+	if result.Removed == nil {
+		result.Removed = []string{}
+	}
+
+	if result.Renamed == nil {
+		result.Renamed = map[string]string{}
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ConflictResolutionResponseOK{Data: &result})
+}
+
+func ConflictStatusAdapterOut(status service.ConflictStatus) codegen.ConflictScanStatus {
+	result := codegen.ConflictScanStatus{
+		MountPoint:    status.MountPoint,
+		WithHash:      status.WithHash,
+		State:         codegen.ConflictScanStatusState(status.State),
+		ScannedFiles:  status.ScannedFiles,
+		ConflictCount: status.ConflictCount,
+		Conflicts:     make([]codegen.MergeConflict, 0, len(status.Conflicts)),
+	}
+
+	if !status.StartedAt.IsZero() {
+		result.StartedAt = &status.StartedAt
+	}
+
+	if !status.FinishedAt.IsZero() {
+		result.FinishedAt = &status.FinishedAt
+	}
+
+	if status.Error != "" {
+		result.Error = &status.Error
+	}
+
+	for _, conflict := range status.Conflicts {
+		files := make([]codegen.MergeConflictFile, 0, len(conflict.Files))
+		for _, file := range conflict.Files {
+			f := codegen.MergeConflictFile{
+				Branch:  file.Branch,
+				Mode:    file.Mode,
+				Size:    file.Size,
+				ModTime: file.ModTime,
+			}
+
+			if file.Hash != "" {
+				hash := file.Hash
+				f.Hash = &hash
+			}
+
+			files = append(files, f)
+		}
+
+		result.Conflicts = append(result.Conflicts, codegen.MergeConflict{
+			Path:      conflict.Path,
+			Identical: conflict.Identical,
+			Files:     files,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,158 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/luks"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetEncryptedVolumes(ctx echo.Context) error {
+	volumes, err := service.MyService.Encryption().GetEncryptedVolumes()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	results := make([]codegen.EncryptedVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		results = append(results, EncryptedVolumeAdapterOut(volume))
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.GetEncryptedVolumesResponseOK{Data: &results})
+}
+
+func (s *LocalStorage) CreateEncryptedVolume(ctx echo.Context) error {
+	var request codegen.CreateEncryptedVolumeRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	passphrase, name, autoUnlock := "", "", false
+	if request.Passphrase != nil {
+		passphrase = *request.Passphrase
+	}
+	if request.Name != nil {
+		name = *request.Name
+	}
+	if request.AutoUnlock != nil {
+		autoUnlock = *request.AutoUnlock
+	}
+
+	if passphrase == "" {
+		message := luks.ErrEmptyPassphrase.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	volume, err := service.MyService.Encryption().CreateEncryptedVolume(request.Path, passphrase, name, autoUnlock)
+	if err != nil {
+		return encryptionErrorResponse(ctx, err)
+	}
+
+	result := EncryptedVolumeAdapterOut(*volume)
+	return ctx.JSON(http.StatusOK, codegen.EncryptedVolumeResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) UnlockEncryptedVolume(ctx echo.Context, cryptUUID codegen.CryptUUID) error {
+	var request codegen.Passphrase
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	passphrase := ""
+	if request.Passphrase != nil {
+		passphrase = *request.Passphrase
+	}
+
+	volume, err := service.MyService.Encryption().Unlock(cryptUUID, passphrase)
+	if err != nil {
+		return encryptionErrorResponse(ctx, err)
+	}
+
+	result := EncryptedVolumeAdapterOut(*volume)
+	return ctx.JSON(http.StatusOK, codegen.EncryptedVolumeResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) LockEncryptedVolume(ctx echo.Context, cryptUUID codegen.CryptUUID) error {
+	volume, err := service.MyService.Encryption().Lock(cryptUUID)
+	if err != nil {
+		message := err.Error()
+
+		var busyErr *mount.BusyError
+		if errors.As(err, &busyErr) {
+			holders := make([]codegen.MountHolder, 0, len(busyErr.Holders))
+			for _, holder := range busyErr.Holders {
+				holders = append(holders, HolderAdapterOut(holder))
+			}
+			return ctx.JSON(http.StatusConflict, codegen.UmountResponseConflict{Message: &message, Data: &holders})
+		}
+
+		return encryptionErrorResponse(ctx, err)
+	}
+
+	result := EncryptedVolumeAdapterOut(*volume)
+	return ctx.JSON(http.StatusOK, codegen.EncryptedVolumeResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) SetEncryptedVolumeAutoUnlock(ctx echo.Context, cryptUUID codegen.CryptUUID) error {
+	var request codegen.AutoUnlockRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	passphrase := ""
+	if request.Passphrase != nil {
+		passphrase = *request.Passphrase
+	}
+
+	volume, err := service.MyService.Encryption().SetAutoUnlock(cryptUUID, passphrase, request.Enabled)
+	if err != nil {
+		return encryptionErrorResponse(ctx, err)
+	}
+
+	result := EncryptedVolumeAdapterOut(*volume)
+	return ctx.JSON(http.StatusOK, codegen.EncryptedVolumeResponseOK{Data: &result})
+}
+
+func encryptionErrorResponse(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	switch {
+	case errors.Is(err, service.ErrEncryptedVolumeNotFound):
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	case errors.Is(err, service.ErrPartitionIsMounted):
+		return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+	case errors.Is(err, luks.ErrEmptyPassphrase):
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+}
+
+func EncryptedVolumeAdapterOut(volume service.EncryptedVolume) codegen.EncryptedVolume {
+	result := codegen.EncryptedVolume{
+		CryptUuid:  volume.CryptUUID,
+		MountPoint: volume.MountPoint,
+		Locked:     volume.Locked,
+		Mounted:    volume.Mounted,
+		AutoUnlock: volume.AutoUnlock,
+		MapperPath: &volume.MapperPath,
+	}
+
+	if volume.UUID != "" {
+		result.Uuid = &volume.UUID
+	}
+
+	if volume.Path != "" {
+		result.Path = &volume.Path
+	}
+
+	return result
+}
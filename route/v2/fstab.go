@@ -0,0 +1,105 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/fstab"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetFStabEntries(ctx echo.Context) error {
+	entries, err := service.MyService.LocalStorage().GetFStabEntries()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.GetFStabEntriesResponseOK{Data: &entries})
+}
+
+func (s *LocalStorage) AddFStabEntry(ctx echo.Context, params codegen.AddFStabEntryParams) error {
+	var request codegen.FStabEntry
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	dryRun := params.DryRun != nil && *params.DryRun
+
+	if err := service.MyService.LocalStorage().AddToFStab(request, dryRun); err != nil {
+		return fstabErrorResponse(ctx, err)
+	}
+
+	if dryRun {
+		return ctx.JSON(http.StatusOK, codegen.FStabEntryResponseOK{Data: &request})
+	}
+
+	return fstabEntryResponse(ctx, request.MountPoint)
+}
+
+func (s *LocalStorage) UpdateFStabEntry(ctx echo.Context, params codegen.UpdateFStabEntryParams) error {
+	var request codegen.FStabEntry
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	dryRun := params.DryRun != nil && *params.DryRun
+
+	if err := service.MyService.LocalStorage().UpdateFStab(params.MountPoint, request, dryRun); err != nil {
+		return fstabErrorResponse(ctx, err)
+	}
+
+	if dryRun {
+		return ctx.JSON(http.StatusOK, codegen.FStabEntryResponseOK{Data: &request})
+	}
+
+	return fstabEntryResponse(ctx, request.MountPoint)
+}
+
+func (s *LocalStorage) RemoveFStabEntry(ctx echo.Context, params codegen.RemoveFStabEntryParams) error {
+	if _, err := service.MyService.LocalStorage().GetFStabEntry(params.MountPoint); err != nil {
+		return fstabErrorResponse(ctx, err)
+	}
+
+	var err error
+	if params.CommentOut != nil && *params.CommentOut {
+		err = service.MyService.LocalStorage().CommentOutFromFStab(params.MountPoint)
+	} else {
+		err = service.MyService.LocalStorage().RemoveFromFStab(params.MountPoint)
+	}
+
+	if err != nil {
+		return fstabErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{})
+}
+
+// respond with the entry as written, e.g. with its line number and default options
+func fstabEntryResponse(ctx echo.Context, mountPoint string) error {
+	entry, err := service.MyService.LocalStorage().GetFStabEntry(mountPoint)
+	if err != nil {
+		return fstabErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.FStabEntryResponseOK{Data: entry})
+}
+
+func fstabErrorResponse(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	switch {
+	case errors.Is(err, fstab.ErrFSTabEntryNotFound):
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	case errors.Is(err, fstab.ErrDifferentFSTabEntryWithSameMountPoint):
+		return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+	case errors.Is(err, fstab.ErrInvalidFSTabEntry), errors.Is(err, fstab.ErrVerificationFailed):
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+}
@@ -1,10 +1,12 @@
 package v2
 
 import (
+	"errors"
 	"fmt"
 
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/IceWhaleTech/CasaOS-Common/utils/constants"
@@ -13,9 +15,11 @@ import (
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
-	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/merge"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
 	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2/fs"
 	"go.uber.org/zap"
 
@@ -36,13 +40,73 @@ func (s *LocalStorage) GetMerges(ctx echo.Context, params codegen.GetMergesParam
 	}
 	data := make([]codegen.Merge, 0, len(merges))
 	for _, merge := range merges {
-		data = append(data, MergeAdapterOut(merge))
+		result := MergeAdapterOut(merge)
+
+		// only when mounted
+		if values, err := mergerfs.OptionValues(merge.MountPoint); err == nil {
+			result.RuntimeOptions = &values
+		}
+
+		withFiles := params.WithFiles != nil && *params.WithFiles
+		if withFiles || (params.WithUsage != nil && *params.WithUsage) {
+			branches, err := service.MyService.LocalStorage().GetMergeBranches(ctx.Request().Context(), merge, withFiles)
+			if err != nil {
+				logger.Error("error when getting branches of merge", zap.Error(err), zap.String("mount point", merge.MountPoint))
+			} else {
+				result.Branches = &branches
+			}
+		}
+
+		data = append(data, result)
 	}
 	message := "ok"
 	return ctx.JSON(http.StatusOK, codegen.GetMergesResponseOK{Data: &data, Message: &message})
 
 }
 
+func (s *LocalStorage) GetMergePath(ctx echo.Context, params codegen.GetMergePathParams) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	result, err := service.MyService.LocalStorage().LocateMergePath(params.Path)
+	if err != nil {
+		message := err.Error()
+
+		if errors.Is(err, v2.ErrPathNotInMerge) {
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		}
+
+		if errors.Is(err, os.ErrNotExist) {
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.MergePathResponseOK{Data: result})
+}
+
+func (s *LocalStorage) GetMergeRuntime(ctx echo.Context, params codegen.GetMergeRuntimeParams) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	merges, err := service.MyService.LocalStorage().GetMerges(params.MountPoint)
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	data := make([]codegen.MergeRuntime, 0, len(merges))
+	for _, merge := range merges {
+		data = append(data, service.MyService.LocalStorage().GetMergeRuntime(merge))
+	}
+
+	message := "ok"
+	return ctx.JSON(http.StatusOK, codegen.MergeRuntimeResponseOK{Data: &data, Message: &message})
+}
+
 func (s *LocalStorage) SetMerge(ctx echo.Context) error {
 	var m codegen.Merge
 	if err := ctx.Bind(&m); err != nil {
@@ -50,37 +114,9 @@ func (s *LocalStorage) SetMerge(ctx echo.Context) error {
 		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
 	}
 
-	// default to mergerfs if fstype is not specified
-	fstype := fs.MergerFSFullName
-	if m.Fstype != nil {
-		fstype = *m.Fstype
-	}
-	// expand source volume paths to source volumes
-	var sourceVolumes []*model2.Volume
-	if m.SourceVolumeUuids != nil {
-		volumesFromDB, err := service.MyService.Disk().GetSerialAllFromDB()
-		if err != nil {
-			logger.Error("failed to get serial disks from database", zap.Error(err))
-			message := err.Error()
-			return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
-		}
-
-		sourceVolumes = make([]*model2.Volume, 0, len(*m.SourceVolumeUuids))
-		for _, volumeUUID := range *m.SourceVolumeUuids {
-			volumeFound := false
-			for i := range volumesFromDB {
-				if volumeUUID == volumesFromDB[i].UUID {
-					volumeFound = true
-					sourceVolumes = append(sourceVolumes, &volumesFromDB[i])
-					break
-				}
-			}
-
-			if !volumeFound {
-				message := "volume " + volumeUUID + " not found, or it is not a CasaOS storage. Consider adding it to CasaOS first."
-				return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
-			}
-		}
+	sourceVolumeUUIDs, sourceVolumes, branches, err := mergeSourcesIn(m)
+	if err != nil {
+		return mergeSourcesError(ctx, err)
 	}
 
 	merge, err := service.MyService.LocalStorage().GetFirstMergeFromDB(m.MountPoint)
@@ -91,48 +127,215 @@ func (s *LocalStorage) SetMerge(ctx echo.Context) error {
 	}
 
 	if merge == nil {
-		merge = &model2.Merge{
-			FSType:         fstype,
-			MountPoint:     m.MountPoint,
-			SourceBasePath: m.SourceBasePath,
-			SourceVolumes:  sourceVolumes,
-		}
-
-		if err := service.MyService.LocalStorage().CreateMerge(merge); err != nil {
+		merge = newMerge(m, sourceVolumes, branches)
 
-			message := err.Error()
-			logger.Error("failed to create merge", zap.Error(err), zap.String("mount point", m.MountPoint))
-			return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+		if err := service.MyService.LocalStorage().ValidateMerge(merge); err != nil {
+			return validateMergeError(ctx, err)
 		}
 
-		if err := service.MyService.LocalStorage().CreateMergeInDB(merge); err != nil {
-			logger.Error("failed to create merge in database", zap.Error(err), zap.String("mount point", m.MountPoint))
-			message := err.Error()
-			return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+		if err := createMerge(merge); err != nil {
+			return createMergeError(ctx, err)
 		}
 	} else {
 		if m.SourceBasePath != nil {
 			merge.SourceBasePath = m.SourceBasePath
 		}
 
-		if m.SourceVolumeUuids != nil {
-			merge.SourceVolumes = sourceVolumes // which come from m.SourceVolumeUuids
+		if sourceVolumeUUIDs != nil {
+			merge.SourceVolumes = sourceVolumes // which come from m.SourceVolumeUuids or m.SourceVolumes
+		}
+
+		if m.SourceVolumes != nil {
+			merge.Branches = branches
+		} else if m.SourceVolumeUuids != nil {
+			// keep the modes of the volumes still in the merge
+			for uuid := range merge.Branches {
+				if !slices.Contains(*m.SourceVolumeUuids, uuid) {
+					delete(merge.Branches, uuid)
+				}
+			}
+		}
+
+		if m.Options != nil {
+			MergeOptionsAdapterIn(*m.Options, merge)
+		}
+
+		if err := service.MyService.LocalStorage().ValidateMerge(merge); err != nil {
+			return validateMergeError(ctx, err)
 		}
 
 		if err := service.MyService.LocalStorage().UpdateMerge(merge); err != nil {
 			message := err.Error()
 			logger.Error("failed to update merge", zap.Error(err), zap.String("mount point", m.MountPoint))
+			if errors.Is(err, mergerfs.ErrInvalidOption) {
+				return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+			}
 			return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
 		}
 
-		if err := service.MyService.LocalStorage().UpdateMergeSourcesInDB(merge); err != nil {
+		if err := service.MyService.LocalStorage().UpdateMergeInDB(merge); err != nil {
 			message := err.Error()
-			logger.Error("failed to update merge sources in database", zap.Error(err), zap.String("mount point", m.MountPoint))
+			logger.Error("failed to update merge in database", zap.Error(err), zap.String("mount point", m.MountPoint))
+
+			// the database still has the merge as it was, as the transaction is rolled back - so is the running mount
+			if previous, err := service.MyService.LocalStorage().GetFirstMergeFromDB(m.MountPoint); err != nil || previous == nil {
+				logger.Error("failed to get merge from database to undo the update", zap.Error(err), zap.String("mount point", m.MountPoint))
+			} else if err := service.MyService.LocalStorage().UpdateMerge(previous); err != nil {
+				logger.Error("failed to undo the update of merge", zap.Error(err), zap.String("mount point", m.MountPoint))
+			}
+
 			return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
 		}
 	}
-	const messageStatus = common.ServiceName + ":merge_status"
-	result := MergeAdapterOut(*merge)
+
+	return mergeResponse(ctx, *merge)
+}
+
+func (s *LocalStorage) CreateMerge(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	var m codegen.Merge
+	if err := ctx.Bind(&m); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	if id <= 0 || m.MountPoint == "" {
+		message := "id should be positive, and mount_point should not be empty"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	_, sourceVolumes, branches, err := mergeSourcesIn(m)
+	if err != nil {
+		return mergeSourcesError(ctx, err)
+	}
+
+	merge := newMerge(m, sourceVolumes, branches)
+	merge.ID = uint(id)
+
+	if err := service.MyService.LocalStorage().ValidateNewMerge(merge); err != nil {
+		return validateMergeError(ctx, err)
+	}
+
+	if err := createMerge(merge); err != nil {
+		return createMergeError(ctx, err)
+	}
+
+	return mergeResponse(ctx, *merge)
+}
+
+var errMergeSourceVolumeNotFound = errors.New("not found, or it is not a CasaOS storage. Consider adding it to CasaOS first")
+
+// mergeSourcesIn returns the UUIDs of the source volumes of m, nil if it sets none, the volumes themselves from the DB, and
+// their modes - source_volumes, with modes, takes precedence over source_volume_uuids.
+func mergeSourcesIn(m codegen.Merge) (*[]string, []*model2.Volume, map[string]model2.MergeBranch, error) {
+	sourceVolumeUUIDs := m.SourceVolumeUuids
+	var branches map[string]model2.MergeBranch
+	if m.SourceVolumes != nil {
+		uuids := make([]string, 0, len(*m.SourceVolumes))
+		branches = make(map[string]model2.MergeBranch)
+		for _, sourceVolume := range *m.SourceVolumes {
+			uuids = append(uuids, sourceVolume.Uuid)
+			if branch := MergeBranchAdapterIn(sourceVolume); branch != (model2.MergeBranch{}) {
+				branches[sourceVolume.Uuid] = branch
+			}
+		}
+		sourceVolumeUUIDs = &uuids
+	}
+
+	if sourceVolumeUUIDs == nil {
+		return nil, nil, branches, nil
+	}
+
+	// expand source volume paths to source volumes
+	volumesFromDB, err := service.MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		logger.Error("failed to get serial disks from database", zap.Error(err))
+		return nil, nil, nil, err
+	}
+
+	sourceVolumes := make([]*model2.Volume, 0, len(*sourceVolumeUUIDs))
+	for _, volumeUUID := range *sourceVolumeUUIDs {
+		volumeFound := false
+		for i := range volumesFromDB {
+			if volumeUUID == volumesFromDB[i].UUID {
+				volumeFound = true
+				sourceVolumes = append(sourceVolumes, &volumesFromDB[i])
+				break
+			}
+		}
+
+		if !volumeFound {
+			return nil, nil, nil, fmt.Errorf("volume %s %w", volumeUUID, errMergeSourceVolumeNotFound)
+		}
+	}
+
+	return sourceVolumeUUIDs, sourceVolumes, branches, nil
+}
+
+func mergeSourcesError(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	if errors.Is(err, errMergeSourceVolumeNotFound) {
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+}
+
+func newMerge(m codegen.Merge, sourceVolumes []*model2.Volume, branches map[string]model2.MergeBranch) *model2.Merge {
+	// default to mergerfs if fstype is not specified
+	fstype := fs.MergerFSFullName
+	if m.Fstype != nil {
+		fstype = *m.Fstype
+	}
+
+	merge := &model2.Merge{
+		FSType:         fstype,
+		MountPoint:     m.MountPoint,
+		SourceBasePath: m.SourceBasePath,
+		SourceVolumes:  sourceVolumes,
+		Branches:       branches,
+	}
+
+	if m.Options != nil {
+		MergeOptionsAdapterIn(*m.Options, merge)
+	}
+
+	return merge
+}
+
+// createMerge mounts merge, already validated, and saves it to the DB.
+func createMerge(merge *model2.Merge) error {
+	if err := service.MyService.LocalStorage().CreateMerge(merge); err != nil {
+		logger.Error("failed to create merge", zap.Error(err), zap.String("mount point", merge.MountPoint))
+		return err
+	}
+
+	if err := service.MyService.LocalStorage().CreateMergeInDB(merge); err != nil {
+		logger.Error("failed to create merge in database", zap.Error(err), zap.String("mount point", merge.MountPoint))
+		return err
+	}
+
+	return nil
+}
+
+func createMergeError(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	if errors.Is(err, mergerfs.ErrInvalidOption) {
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+}
+
+// mergeResponse notifies that merge is set, and responds with it.
+func mergeResponse(ctx echo.Context, merge model2.Merge) error {
+	const messageStatus = service.EventMergeStatus
+	result := MergeAdapterOut(merge)
 	msg := make(map[string]interface{})
 	msg["mount_point"] = result.MountPoint
 	msg["source_base_path"] = result.SourceBasePath
@@ -149,6 +352,85 @@ func (s *LocalStorage) SetMerge(ctx echo.Context) error {
 		Data: &result,
 	})
 }
+
+func validateMergeError(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	if errors.Is(err, v2.ErrMergeMountPointOverlap) ||
+		errors.Is(err, v2.ErrMergeSourceInUse) ||
+		errors.Is(err, v2.ErrMergeSourceIsParity) ||
+		errors.Is(err, v2.ErrMergeAlreadyExists) ||
+		errors.Is(err, v2.ErrMergeMountPointAlreadyExists) {
+		return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+	}
+
+	logger.Error("failed to validate merge", zap.Error(err))
+	return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+}
+
+func (s *LocalStorage) DeleteMerge(ctx echo.Context, id int, params codegen.DeleteMergeParams) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	merge, err := service.MyService.LocalStorage().GetMergeFromDB(uint(id))
+	if err != nil {
+		message := err.Error()
+		if errors.Is(err, v2.ErrMergeNotFound) {
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		}
+		return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+	}
+
+	// files would vanish from under a rebalance or drain
+	if status, err := service.MyService.Rebalance().Status(); err == nil && status.MountPoint == merge.MountPoint && status.Running() {
+		message := service.ErrRebalanceRunning.Error()
+		return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+	}
+
+	if run := service.MyService.SnapRAID().LastRun(merge.ID); run != nil && run.State == service.SnapRAIDStateRunning {
+		message := service.ErrSnapRAIDRunning.Error()
+		return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+	}
+
+	deleteMerge := func() error {
+		return service.MyService.LocalStorage().DeleteMerge(merge)
+	}
+
+	if params.StopHolders != nil && *params.StopHolders {
+		err = mount.RetryStoppingHolders(deleteMerge)
+	} else {
+		err = deleteMerge()
+	}
+
+	if err != nil {
+		message := err.Error()
+		logger.Error("failed to delete merge", zap.Error(err), zap.String("mount point", merge.MountPoint))
+
+		if errors.Is(err, v2.ErrMergeDefaultNotDeletable) {
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		}
+
+		var busyErr *mount.BusyError
+		if errors.As(err, &busyErr) {
+			holders := make([]codegen.MountHolder, 0, len(busyErr.Holders))
+			for _, holder := range busyErr.Holders {
+				holders = append(holders, HolderAdapterOut(holder))
+			}
+			return ctx.JSON(http.StatusConflict, codegen.UmountResponseConflict{Message: &message, Data: &holders})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+	}
+
+	if err := service.MyService.SnapRAID().Remove(merge.ID); err != nil && !errors.Is(err, v2.ErrSnapRAIDNotConfigured) {
+		logger.Error("failed to remove snapraid from deleted merge", zap.Error(err), zap.String("mount point", merge.MountPoint))
+	}
+
+	message := "ok"
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{Message: &message})
+}
+
 func (s *LocalStorage) GetMergeInitStatus(ctx echo.Context) error {
 	status := codegen.Uninitialized
 	mountPoint := common.DefaultMountPoint
@@ -202,9 +484,9 @@ func (s *LocalStorage) InitMerge(ctx echo.Context) error {
 			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
 		}
 
-		if !merge.IsMergerFSInstalled() {
+		if !fs.IsMergeSupported() {
 			config.ServerInfo.EnableMergerFS = "false"
-			message := "mergerfs is not installed"
+			message := "mergerfs is not installed, and neither is fuse3 for the built-in union filesystem"
 			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
 		}
 
@@ -214,7 +496,10 @@ func (s *LocalStorage) InitMerge(ctx echo.Context) error {
 			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
 		}
 
-		service.MyService.LocalStorage().CheckMergeMount()
+		if _, err := service.MyService.Reconciler().Apply(service.ManagedMountTypeMerge); err != nil {
+			message := err.Error()
+			return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
+		}
 
 		config.Cfg.Section("server").Key("EnableMergerFS").SetValue("true")
 		config.ServerInfo.EnableMergerFS = "true"
@@ -232,17 +517,109 @@ func MergeAdapterOut(m model2.Merge) codegen.Merge {
 	id := int(m.ID)
 
 	sourceVolumeUUIDs := make([]string, 0, len(m.SourceVolumes))
+	sourceVolumes := make([]codegen.MergeSourceVolume, 0, len(m.SourceVolumes))
 	for _, volume := range m.SourceVolumes {
 		sourceVolumeUUIDs = append(sourceVolumeUUIDs, volume.UUID)
+		sourceVolumes = append(sourceVolumes, MergeSourceVolumeAdapterOut(m, volume))
 	}
 
+	options := MergeOptionsAdapterOut(m)
+
 	return codegen.Merge{
 		Id:                &id,
 		Fstype:            &m.FSType,
 		MountPoint:        m.MountPoint,
 		SourceBasePath:    m.SourceBasePath,
 		SourceVolumeUuids: &sourceVolumeUUIDs,
+		SourceVolumes:     &sourceVolumes,
+		Options:           &options,
 		CreatedAt:         &m.CreatedAt,
 		UpdatedAt:         &m.UpdatedAt,
 	}
 }
+
+func MergeSourceVolumeAdapterOut(m model2.Merge, volume *model2.Volume) codegen.MergeSourceVolume {
+	mode := codegen.RW
+	result := codegen.MergeSourceVolume{
+		Uuid: volume.UUID,
+		Mode: &mode,
+	}
+
+	if branch, ok := m.Branches[volume.UUID]; ok {
+		if branch.Mode != "" {
+			mode = codegen.MergeSourceVolumeMode(branch.Mode)
+		}
+
+		if branch.MinFreeSpace != "" {
+			result.MinFreeSpace = &branch.MinFreeSpace
+		}
+	}
+
+	return result
+}
+
+// MergeBranchAdapterIn returns the mode and minfreespace of a source volume, or nothing if it is RW without minfreespace
+func MergeBranchAdapterIn(sourceVolume codegen.MergeSourceVolume) model2.MergeBranch {
+	var branch model2.MergeBranch
+
+	if sourceVolume.Mode != nil && *sourceVolume.Mode != codegen.RW {
+		branch.Mode = string(*sourceVolume.Mode)
+	}
+
+	if sourceVolume.MinFreeSpace != nil {
+		branch.MinFreeSpace = *sourceVolume.MinFreeSpace
+	}
+
+	return branch
+}
+
+func MergeOptionsAdapterOut(m model2.Merge) codegen.MergeOptions {
+	result := codegen.MergeOptions{
+		MoveOnEnospc: m.MoveOnENOSPC,
+	}
+
+	if m.CreatePolicy != "" {
+		createPolicy := codegen.MergeOptionsCategoryCreate(m.CreatePolicy)
+		result.CategoryCreate = &createPolicy
+	}
+
+	if m.MinFreeSpace != "" {
+		result.MinFreeSpace = &m.MinFreeSpace
+	}
+
+	if m.CacheFiles != "" {
+		cacheFiles := codegen.MergeOptionsCacheFiles(m.CacheFiles)
+		result.CacheFiles = &cacheFiles
+	}
+
+	if len(m.FuncPolicies) > 0 {
+		result.Func = &m.FuncPolicies
+	}
+
+	return result
+}
+
+// MergeOptionsAdapterIn sets the options of m with options - any option not given is unset, i.e. back to default
+func MergeOptionsAdapterIn(options codegen.MergeOptions, m *model2.Merge) {
+	m.CreatePolicy = ""
+	if options.CategoryCreate != nil {
+		m.CreatePolicy = string(*options.CategoryCreate)
+	}
+
+	m.MinFreeSpace = ""
+	if options.MinFreeSpace != nil {
+		m.MinFreeSpace = *options.MinFreeSpace
+	}
+
+	m.MoveOnENOSPC = options.MoveOnEnospc
+
+	m.CacheFiles = ""
+	if options.CacheFiles != nil {
+		m.CacheFiles = string(*options.CacheFiles)
+	}
+
+	m.FuncPolicies = nil
+	if options.Func != nil {
+		m.FuncPolicies = *options.Func
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
 	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
 
@@ -54,13 +55,33 @@ func (s *LocalStorage) Mount(ctx echo.Context) error {
 }
 
 func (s *LocalStorage) Umount(ctx echo.Context, params codegen.UmountParams) error {
-	if err := service.MyService.LocalStorage().Umount(params.MountPoint); err != nil {
+	umount := func() error {
+		return service.MyService.LocalStorage().Umount(params.MountPoint)
+	}
+
+	var err error
+	if params.StopHolders != nil && *params.StopHolders {
+		err = mount.RetryStoppingHolders(umount)
+	} else {
+		err = umount()
+	}
+
+	if err != nil {
 		message := err.Error()
 
 		if errors.Is(err, v2.ErrNotMounted) {
 			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
 		}
 
+		var busyErr *mount.BusyError
+		if errors.As(err, &busyErr) {
+			holders := make([]codegen.MountHolder, 0, len(busyErr.Holders))
+			for _, holder := range busyErr.Holders {
+				holders = append(holders, HolderAdapterOut(holder))
+			}
+			return ctx.JSON(http.StatusConflict, codegen.UmountResponseConflict{Message: &message, Data: &holders})
+		}
+
 		return ctx.JSON(http.StatusInternalServerError, codegen.BaseResponse{Message: &message})
 	}
 
@@ -95,3 +116,54 @@ func (s *LocalStorage) UpdateMount(ctx echo.Context, params codegen.UpdateMountP
 
 	return ctx.JSON(http.StatusOK, codegen.AddMountResponseOK{Data: mount})
 }
+
+func (s *LocalStorage) GetMountHealth(ctx echo.Context) error {
+	list := service.MyService.Watchdog().GetMountHealthList()
+
+	data := make([]codegen.MountHealth, 0, len(list))
+	for _, h := range list {
+		data = append(data, MountHealthAdapterOut(h))
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.MountHealthResponseOK{Data: &data})
+}
+
+func MountHealthAdapterOut(h service.MountHealth) codegen.MountHealth {
+	result := codegen.MountHealth{
+		Type:       codegen.MountHealthType(h.Type),
+		MountPoint: h.MountPoint,
+		State:      codegen.MountHealthState(h.State),
+		Failures:   h.Failures,
+		UpdatedAt:  h.UpdatedAt,
+	}
+
+	if h.Error != "" {
+		result.Error = &h.Error
+	}
+
+	if !h.NextAttempt.IsZero() {
+		result.NextAttempt = &h.NextAttempt
+	}
+
+	return result
+}
+
+func HolderAdapterOut(h mount.Holder) codegen.MountHolder {
+	references := make([]codegen.MountHolderReferences, 0, len(h.References))
+	for _, reference := range h.References {
+		references = append(references, codegen.MountHolderReferences(reference))
+	}
+
+	result := codegen.MountHolder{
+		Pid:        h.PID,
+		Command:    &h.Command,
+		References: references,
+	}
+
+	if h.ContainerID != "" {
+		result.ContainerId = &h.ContainerID
+		result.ContainerName = &h.ContainerName
+	}
+
+	return result
+}
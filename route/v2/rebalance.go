@@ -0,0 +1,174 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetMergeRebalance(ctx echo.Context) error {
+	status, err := service.MyService.Rebalance().Status()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	}
+
+	result := RebalanceStatusAdapterOut(*status)
+	return ctx.JSON(http.StatusOK, codegen.RebalanceResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) StartMergeRebalance(ctx echo.Context) error {
+	var request codegen.RebalanceRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	options := service.RebalanceOptions{}
+
+	if request.Spread != nil {
+		options.Spread = *request.Spread
+	}
+
+	if request.BytesPerSecond != nil {
+		options.BytesPerSecond = *request.BytesPerSecond
+	}
+
+	if request.DryRun != nil {
+		options.DryRun = *request.DryRun
+	}
+
+	if options.Spread < 0 || options.BytesPerSecond < 0 {
+		message := "spread and bytes_per_second should not be negative"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	status, err := service.MyService.Rebalance().Start(request.MountPoint, options)
+	if err != nil {
+		message := err.Error()
+
+		switch {
+		case errors.Is(err, v2.ErrMergeMountPointDoesNotExist):
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		case errors.Is(err, service.ErrRebalanceRunning), errors.Is(err, service.ErrSnapRAIDRunning):
+			return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	result := RebalanceStatusAdapterOut(*status)
+	return ctx.JSON(http.StatusOK, codegen.RebalanceResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) DrainMergeSource(ctx echo.Context) error {
+	var request codegen.DrainRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	var bytesPerSecond int64
+	if request.BytesPerSecond != nil {
+		bytesPerSecond = *request.BytesPerSecond
+	}
+
+	if bytesPerSecond < 0 {
+		message := "bytes_per_second should not be negative"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	status, err := service.MyService.Rebalance().Drain(request.MountPoint, request.VolumeUuid, bytesPerSecond)
+	if err != nil {
+		message := err.Error()
+
+		switch {
+		case errors.Is(err, v2.ErrMergeMountPointDoesNotExist), errors.Is(err, service.ErrVolumeNotInMerge):
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		case errors.Is(err, service.ErrRebalanceRunning), errors.Is(err, service.ErrSnapRAIDRunning):
+			return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	result := RebalanceStatusAdapterOut(*status)
+	return ctx.JSON(http.StatusOK, codegen.RebalanceResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) CancelMergeRebalance(ctx echo.Context) error {
+	status, err := service.MyService.Rebalance().Cancel()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	}
+
+	result := RebalanceStatusAdapterOut(*status)
+	return ctx.JSON(http.StatusOK, codegen.RebalanceResponseOK{Data: &result})
+}
+
+func RebalanceStatusAdapterOut(status service.RebalanceStatus) codegen.RebalanceStatus {
+	result := codegen.RebalanceStatus{
+		Operation:     codegen.RebalanceStatusOperation(status.Operation),
+		MountPoint:    status.MountPoint,
+		State:         codegen.RebalanceStatusState(status.State),
+		DryRun:        status.Options.DryRun,
+		Spread:        status.Options.Spread,
+		Branches:      make([]codegen.RebalanceBranch, 0, len(status.Branches)),
+		PlannedSpread: &status.PlannedSpread,
+		PlannedFiles:  status.PlannedFiles,
+		PlannedBytes:  status.PlannedBytes,
+		MovedFiles:    status.MovedFiles,
+		MovedBytes:    status.MovedBytes,
+		SkippedFiles:  status.SkippedFiles,
+	}
+
+	if !status.StartedAt.IsZero() {
+		result.StartedAt = &status.StartedAt
+	}
+
+	if !status.FinishedAt.IsZero() {
+		result.FinishedAt = &status.FinishedAt
+	}
+
+	if status.Error != "" {
+		result.Error = &status.Error
+	}
+
+	if status.VolumeUUID != "" {
+		result.VolumeUuid = &status.VolumeUUID
+	}
+
+	if status.CurrentPath != "" {
+		result.CurrentPath = &status.CurrentPath
+	}
+
+	for _, branch := range status.Branches {
+		result.Branches = append(result.Branches, codegen.RebalanceBranch{
+			Path:    branch.Path,
+			Mode:    branch.Mode,
+			Total:   branch.Total,
+			Used:    branch.Used,
+			Percent: branch.Percent,
+		})
+	}
+
+	if status.Moves != nil {
+		moves := make([]codegen.RebalanceMove, 0, len(status.Moves))
+		for _, move := range status.Moves {
+			moves = append(moves, codegen.RebalanceMove{
+				From:  move.From,
+				To:    move.To,
+				Paths: move.Paths,
+				Size:  move.Size,
+			})
+		}
+		result.Moves = &moves
+	}
+
+	return result
+}
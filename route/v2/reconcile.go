@@ -0,0 +1,117 @@
+package v2
+
+import (
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetReconcileDiff(ctx echo.Context) error {
+	items, err := service.MyService.Reconciler().Diff()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ReconcileResponseOK{Data: reconcileItemsAdapterOut(items)})
+}
+
+func (s *LocalStorage) ApplyReconcile(ctx echo.Context) error {
+	items, err := service.MyService.Reconciler().ApplyRequested()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ReconcileResponseOK{Data: reconcileItemsAdapterOut(items)})
+}
+
+func reconcileItemsAdapterOut(items []service.ReconcileItem) *[]codegen.ReconcileItem {
+	results := make([]codegen.ReconcileItem, 0, len(items))
+	for _, item := range items {
+		results = append(results, ReconcileItemAdapterOut(item))
+	}
+
+	return &results
+}
+
+func ReconcileItemAdapterOut(item service.ReconcileItem) codegen.ReconcileItem {
+	result := codegen.ReconcileItem{
+		Type:       codegen.ReconcileItemType(item.Type),
+		MountPoint: item.MountPoint,
+		Action:     codegen.ReconcileItemAction(item.Action),
+		Source:     &item.Source,
+	}
+
+	if item.Reason != "" {
+		result.Reason = &item.Reason
+	}
+
+	if item.Actual != "" {
+		result.Actual = &item.Actual
+	}
+
+	if len(item.DependsOn) > 0 {
+		result.DependsOn = &item.DependsOn
+	}
+
+	if item.Error != "" {
+		result.Error = &item.Error
+	}
+
+	return result
+}
+
+func (s *LocalStorage) GetRestoreStatus(ctx echo.Context) error {
+	status := service.MyService.Reconciler().RestoreStatus()
+
+	result := codegen.RestoreStatus{
+		State: codegen.RestoreStatusState(status.State),
+		Items: make([]codegen.RestoreItem, 0, len(status.Items)),
+	}
+
+	if !status.StartedAt.IsZero() {
+		result.StartedAt = &status.StartedAt
+		result.Deadline = &status.Deadline
+	}
+
+	if !status.FinishedAt.IsZero() {
+		result.FinishedAt = &status.FinishedAt
+	}
+
+	for _, item := range status.Items {
+		result.Items = append(result.Items, RestoreItemAdapterOut(item))
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.RestoreResponseOK{Data: &result})
+}
+
+func RestoreItemAdapterOut(item service.RestoreItem) codegen.RestoreItem {
+	result := codegen.RestoreItem{
+		Type:       codegen.RestoreItemType(item.Type),
+		MountPoint: item.MountPoint,
+		State:      codegen.RestoreItemState(item.State),
+		Attempts:   item.Attempts,
+		Source:     &item.Source,
+	}
+
+	if item.Reason != "" {
+		result.Reason = &item.Reason
+	}
+
+	if len(item.DependsOn) > 0 {
+		result.DependsOn = &item.DependsOn
+	}
+
+	if item.LastError != "" {
+		result.LastError = &item.LastError
+	}
+
+	if !item.NextAttemptAt.IsZero() {
+		result.NextAttemptAt = &item.NextAttemptAt
+	}
+
+	return result
+}
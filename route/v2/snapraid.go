@@ -0,0 +1,317 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/snapraid"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetMergeSnapRAID(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	if _, err := service.MyService.LocalStorage().GetMergeFromDB(uint(id)); err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	c, err := service.MyService.SnapRAID().Get(uint(id))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	result := SnapRAIDConfigAdapterOut(*c, service.MyService.SnapRAID().LastRun(uint(id)))
+	return ctx.JSON(http.StatusOK, codegen.SnapRAIDResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) SetMergeSnapRAID(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	var request codegen.SnapRAIDConfig
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	merge, err := service.MyService.LocalStorage().GetMergeFromDB(uint(id))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	c, err := service.MyService.SnapRAID().Configure(*merge, SnapRAIDConfigAdapterIn(request))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	result := SnapRAIDConfigAdapterOut(*c, service.MyService.SnapRAID().LastRun(uint(id)))
+	return ctx.JSON(http.StatusOK, codegen.SnapRAIDResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) DeleteMergeSnapRAID(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	if err := service.MyService.SnapRAID().Remove(uint(id)); err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	message := "ok"
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{Message: &message})
+}
+
+func (s *LocalStorage) GetMergeSnapRAIDStatus(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	merge, err := service.MyService.LocalStorage().GetMergeFromDB(uint(id))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	status, err := service.MyService.SnapRAID().Status(ctx.Request().Context(), uint(id))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	result := codegen.SnapRAIDStatus{
+		Disks:           make([]codegen.SnapRAIDDisk, 0, len(status.Disks)),
+		ScrubbedPercent: status.ScrubbedPercent,
+		Syncing:         status.Syncing,
+		Errors:          status.Errors,
+	}
+
+	if status.OldestScrubDays >= 0 {
+		result.OldestScrubDays = &status.OldestScrubDays
+		result.MedianScrubDays = &status.MedianScrubDays
+		result.NewestScrubDays = &status.NewestScrubDays
+	}
+
+	if status.Syncing {
+		result.SyncPercent = &status.SyncPercent
+	}
+
+	for _, disk := range status.Disks {
+		d := codegen.SnapRAIDDisk{
+			VolumeUuid:      disk.Name, // named by volume uuid
+			MountPoint:      volumeMountPointOf(*merge, disk.Name),
+			Files:           disk.Files,
+			FragmentedFiles: disk.FragmentedFiles,
+			ExcessFragments: disk.ExcessFragments,
+			UsedGb:          disk.UsedGB,
+			FreeGb:          disk.FreeGB,
+			Use:             disk.Use,
+		}
+
+		if disk.WastedGB != 0 {
+			wasted := disk.WastedGB
+			d.WastedGb = &wasted
+		}
+
+		result.Disks = append(result.Disks, d)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.SnapRAIDStatusResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) GetMergeSnapRAIDDiff(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	if _, err := service.MyService.LocalStorage().GetMergeFromDB(uint(id)); err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	diff, err := service.MyService.SnapRAID().Diff(ctx.Request().Context(), uint(id))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	result := codegen.SnapRAIDDiff{
+		Changes:    make([]codegen.SnapRAIDChange, 0, len(diff.Changes)),
+		Equal:      diff.Equal,
+		Added:      diff.Counts[snapraid.ChangeAdded],
+		Removed:    diff.Counts[snapraid.ChangeRemoved],
+		Updated:    diff.Counts[snapraid.ChangeUpdated],
+		Moved:      diff.Counts[snapraid.ChangeMoved],
+		Copied:     diff.Counts[snapraid.ChangeCopied],
+		Restored:   diff.Counts[snapraid.ChangeRestored],
+		SyncNeeded: diff.SyncNeeded(),
+	}
+
+	for _, change := range diff.Changes {
+		c := codegen.SnapRAIDChange{
+			Type: codegen.SnapRAIDChangeType(change.Type),
+			Path: change.Path,
+		}
+
+		if change.From != "" {
+			from := change.From
+			c.From = &from
+		}
+
+		result.Changes = append(result.Changes, c)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.SnapRAIDDiffResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) StartMergeSnapRAIDRun(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	var request codegen.SnapRAIDRunRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	if !snapraid.Installed() {
+		message := snapraid.ErrNotInstalled.Error()
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &message})
+	}
+
+	run, err := service.MyService.SnapRAID().Run(uint(id), string(request.Command))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	result := SnapRAIDRunAdapterOut(*run)
+	return ctx.JSON(http.StatusOK, codegen.SnapRAIDRunResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) CancelMergeSnapRAIDRun(ctx echo.Context, id int) error {
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &MessageMergerFSNotEnabled})
+	}
+
+	run, err := service.MyService.SnapRAID().Cancel(uint(id))
+	if err != nil {
+		return snapraidError(ctx, err)
+	}
+
+	result := SnapRAIDRunAdapterOut(*run)
+	return ctx.JSON(http.StatusOK, codegen.SnapRAIDRunResponseOK{Data: &result})
+}
+
+func snapraidError(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	switch {
+	case errors.Is(err, v2.ErrMergeNotFound),
+		errors.Is(err, v2.ErrSnapRAIDNotConfigured),
+		errors.Is(err, service.ErrSnapRAIDNotRunning),
+		errors.Is(err, service.ErrVolumeNotFound):
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	case errors.Is(err, service.ErrInvalidSnapRAIDConfig):
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	case errors.Is(err, service.ErrSnapRAIDRunning), errors.Is(err, service.ErrSnapRAIDNotMounted), errors.Is(err, service.ErrRebalanceRunning):
+		return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+	case errors.Is(err, snapraid.ErrNotInstalled):
+		return ctx.JSON(http.StatusServiceUnavailable, codegen.ResponseServiceUnavailable{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+}
+
+func SnapRAIDConfigAdapterIn(c codegen.SnapRAIDConfig) model2.SnapRAID {
+	result := model2.SnapRAID{
+		DataVolumes:   c.DataVolumes,
+		ParityVolumes: c.ParityVolumes,
+	}
+
+	if c.Excludes != nil {
+		result.Excludes = *c.Excludes
+	}
+
+	if c.SyncSchedule != nil {
+		result.SyncSchedule = *c.SyncSchedule
+	}
+
+	if c.ScrubSchedule != nil {
+		result.ScrubSchedule = *c.ScrubSchedule
+	}
+
+	if c.ScrubPercent != nil {
+		result.ScrubPercent = *c.ScrubPercent
+	}
+
+	return result
+}
+
+func SnapRAIDConfigAdapterOut(c model2.SnapRAID, lastRun *service.SnapRAIDRun) codegen.SnapRAIDConfig {
+	mergeID := int(c.MergeID)
+	installed := snapraid.Installed()
+
+	excludes := c.Excludes
+	if excludes == nil {
+		excludes = []string{}
+	}
+
+	result := codegen.SnapRAIDConfig{
+		MergeId:       &mergeID,
+		DataVolumes:   c.DataVolumes,
+		ParityVolumes: c.ParityVolumes,
+		Excludes:      &excludes,
+		SyncSchedule:  &c.SyncSchedule,
+		ScrubSchedule: &c.ScrubSchedule,
+		ScrubPercent:  &c.ScrubPercent,
+		Installed:     &installed,
+	}
+
+	if lastRun != nil {
+		run := SnapRAIDRunAdapterOut(*lastRun)
+		result.LastRun = &run
+	}
+
+	return result
+}
+
+func SnapRAIDRunAdapterOut(run service.SnapRAIDRun) codegen.SnapRAIDRun {
+	result := codegen.SnapRAIDRun{
+		Command:    codegen.SnapRAIDRunCommand(run.Command),
+		Scheduled:  run.Scheduled,
+		State:      codegen.SnapRAIDRunState(run.State),
+		FileErrors: run.FileErrors,
+		IoErrors:   run.IOErrors,
+		DataErrors: run.DataErrors,
+	}
+
+	if !run.StartedAt.IsZero() {
+		result.StartedAt = &run.StartedAt
+	}
+
+	if !run.FinishedAt.IsZero() {
+		result.FinishedAt = &run.FinishedAt
+	}
+
+	if run.Error != "" {
+		result.Error = &run.Error
+	}
+
+	return result
+}
+
+func volumeMountPointOf(merge model2.Merge, uuid string) *string {
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil && volume.UUID == uuid {
+			mountPoint := volume.MountPoint
+			return &mountPoint
+		}
+	}
+
+	return nil
+}
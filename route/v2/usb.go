@@ -0,0 +1,182 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetUSBRules(ctx echo.Context) error {
+	rules, err := service.MyService.USB().GetUSBRules()
+	if err != nil {
+		return usbRuleError(ctx, err)
+	}
+
+	data := make([]codegen.USBRule, 0, len(rules))
+	for _, rule := range rules {
+		data = append(data, USBRuleAdapterOut(rule))
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.USBRulesResponseOK{Data: &data})
+}
+
+func (s *LocalStorage) CreateUSBRule(ctx echo.Context) error {
+	var request codegen.USBRule
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	rule := USBRuleAdapterIn(request)
+	if err := service.MyService.USB().CreateUSBRule(&rule); err != nil {
+		return usbRuleError(ctx, err)
+	}
+
+	data := USBRuleAdapterOut(rule)
+	return ctx.JSON(http.StatusOK, codegen.USBRuleResponseOK{Data: &data})
+}
+
+func (s *LocalStorage) UpdateUSBRule(ctx echo.Context, id int) error {
+	var request codegen.USBRule
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	rule := USBRuleAdapterIn(request)
+	rule.ID = uint(id)
+
+	if err := service.MyService.USB().UpdateUSBRule(&rule); err != nil {
+		return usbRuleError(ctx, err)
+	}
+
+	data := USBRuleAdapterOut(rule)
+	return ctx.JSON(http.StatusOK, codegen.USBRuleResponseOK{Data: &data})
+}
+
+func (s *LocalStorage) DeleteUSBRule(ctx echo.Context, id int) error {
+	if err := service.MyService.USB().DeleteUSBRule(uint(id)); err != nil {
+		return usbRuleError(ctx, err)
+	}
+
+	message := "ok"
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{Message: &message})
+}
+
+func (s *LocalStorage) GetUSBPartitions(ctx echo.Context) error {
+	partitions, err := service.MyService.USB().GetUSBPartitions()
+	if err != nil {
+		return usbRuleError(ctx, err)
+	}
+
+	data := make([]codegen.USBPartition, 0, len(partitions))
+	for _, partition := range partitions {
+		data = append(data, USBPartitionAdapterOut(partition))
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.USBPartitionsResponseOK{Data: &data})
+}
+
+func usbRuleError(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	switch {
+	case errors.Is(err, service.ErrUSBRuleNotFound):
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	case errors.Is(err, service.ErrInvalidUSBRule):
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+}
+
+func USBRuleAdapterIn(r codegen.USBRule) model2.USBRule {
+	result := model2.USBRule{
+		Action: string(r.Action),
+		UID:    r.Uid,
+		GID:    r.Gid,
+	}
+
+	if r.Name != nil {
+		result.Name = *r.Name
+	}
+
+	if r.Priority != nil {
+		result.Priority = *r.Priority
+	}
+
+	if r.VendorId != nil {
+		result.VendorID = *r.VendorId
+	}
+
+	if r.ProductId != nil {
+		result.ProductID = *r.ProductId
+	}
+
+	if r.Serial != nil {
+		result.Serial = *r.Serial
+	}
+
+	if r.Fstype != nil {
+		result.FSType = *r.Fstype
+	}
+
+	if r.Label != nil {
+		result.Label = *r.Label
+	}
+
+	if r.MountPointTemplate != nil {
+		result.MountPointTemplate = *r.MountPointTemplate
+	}
+
+	return result
+}
+
+func USBRuleAdapterOut(r model2.USBRule) codegen.USBRule {
+	id := int(r.ID)
+
+	result := codegen.USBRule{
+		Id:                 &id,
+		Name:               &r.Name,
+		Priority:           &r.Priority,
+		VendorId:           &r.VendorID,
+		ProductId:          &r.ProductID,
+		Serial:             &r.Serial,
+		Fstype:             &r.FSType,
+		Label:              &r.Label,
+		Action:             codegen.USBRuleAction(r.Action),
+		MountPointTemplate: &r.MountPointTemplate,
+		Uid:                r.UID,
+		Gid:                r.GID,
+	}
+
+	// not for the default rule, which is not saved
+	if !r.CreatedAt.IsZero() {
+		result.CreatedAt = &r.CreatedAt
+		result.UpdatedAt = &r.UpdatedAt
+	}
+
+	return result
+}
+
+func USBPartitionAdapterOut(p service.USBPartition) codegen.USBPartition {
+	rule := USBRuleAdapterOut(p.Rule)
+
+	return codegen.USBPartition{
+		Path:       &p.Path,
+		VendorId:   &p.VendorID,
+		ProductId:  &p.ProductID,
+		Serial:     &p.Serial,
+		Vendor:     &p.Vendor,
+		Model:      &p.Model,
+		Fstype:     &p.FSType,
+		Label:      &p.Label,
+		Uuid:       &p.UUID,
+		Rule:       &rule,
+		MountPoint: &p.MountPoint,
+	}
+}
@@ -0,0 +1,252 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/fstab"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/systemd"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *LocalStorage) GetVolumes(ctx echo.Context) error {
+	volumes, err := service.MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	data := make([]codegen.Volume, 0, len(volumes))
+	for _, volume := range volumes {
+		data = append(data, VolumeAdapterOut(volume))
+	}
+
+	message := "ok"
+	return ctx.JSON(http.StatusOK, codegen.GetVolumesResponseOK{Data: &data, Message: &message})
+}
+
+func (s *LocalStorage) SetVolumeNotes(ctx echo.Context, uuid string) error {
+	var request codegen.VolumeNotes
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	volume, err := service.MyService.Disk().SetVolumeNotes(uuid, request.Notes)
+	if err != nil {
+		message := err.Error()
+
+		if errors.Is(err, service.ErrVolumeNotFound) {
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	result := VolumeAdapterOut(*volume)
+	return ctx.JSON(http.StatusOK, codegen.VolumeResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) GetOrphanedVolumes(ctx echo.Context, params codegen.GetOrphanedVolumesParams) error {
+	days := service.DefaultOrphanedVolumeDays
+	if params.Days != nil {
+		days = *params.Days
+	}
+
+	if days < 0 {
+		message := "days should not be negative"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	orphans, err := service.MyService.Disk().GetOrphanedVolumes(time.Duration(days) * 24 * time.Hour)
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.OrphanedVolumesResponseOK{Data: orphanedVolumesAdapterOut(orphans)})
+}
+
+func (s *LocalStorage) PruneOrphanedVolumes(ctx echo.Context) error {
+	var request codegen.PruneOrphanedVolumesRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	// a volume just unplugged should not be pruned by mistake
+	if request.Days < 1 {
+		message := "days should be at least 1"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	var uuids []string
+	if request.Uuids != nil {
+		uuids = *request.Uuids
+	}
+
+	results, err := service.MyService.Disk().PruneOrphanedVolumes(time.Duration(request.Days)*24*time.Hour, uuids)
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.OrphanedVolumesResponseOK{Data: orphanedVolumesAdapterOut(results)})
+}
+
+func orphanedVolumesAdapterOut(orphans []service.OrphanedVolume) *[]codegen.OrphanedVolume {
+	results := make([]codegen.OrphanedVolume, 0, len(orphans))
+	for _, orphan := range orphans {
+		results = append(results, OrphanedVolumeAdapterOut(orphan))
+	}
+
+	return &results
+}
+
+func OrphanedVolumeAdapterOut(orphan service.OrphanedVolume) codegen.OrphanedVolume {
+	result := codegen.OrphanedVolume{
+		Volume:   VolumeAdapterOut(orphan.Volume),
+		LastSeen: orphan.LastSeen,
+		Merges:   orphan.Merges,
+		Snapraid: orphan.SnapRAID,
+		Pruned:   orphan.Pruned,
+	}
+
+	if orphan.Reason != "" {
+		result.Reason = &orphan.Reason
+	}
+
+	return result
+}
+
+func (s *LocalStorage) SetVolumePersistence(ctx echo.Context, uuid string) error {
+	var request codegen.VolumePersistence
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	automount := request.Automount != nil && *request.Automount
+
+	if err := service.MyService.Disk().SetPersistentType(uuid, string(request.PersistedIn), automount); err != nil {
+		message := err.Error()
+
+		switch {
+		case errors.Is(err, service.ErrVolumeNotFound):
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		case errors.Is(err, service.ErrPersistentTypeNotSupported),
+			errors.Is(err, service.ErrSystemdNotSupportedForCrypt),
+			errors.Is(err, systemd.ErrUnitNotOwned):
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{})
+}
+
+func (s *LocalStorage) AdoptVolume(ctx echo.Context) error {
+	var request codegen.AdoptVolumeRequest
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	fstabAction := ""
+	if request.Fstab != nil {
+		fstabAction = string(*request.Fstab)
+	}
+
+	volume, err := service.MyService.Disk().AdoptMount(request.MountPoint, fstabAction)
+	if err != nil {
+		message := err.Error()
+
+		switch {
+		case errors.Is(err, service.ErrMountNotFound):
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		case errors.Is(err, service.ErrVolumeAlreadyManaged):
+			return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+		case errors.Is(err, service.ErrMountNotAdoptable), errors.Is(err, service.ErrFStabActionUnsupported):
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	result := VolumeAdapterOut(*volume)
+	return ctx.JSON(http.StatusOK, codegen.VolumeResponseOK{Data: &result})
+}
+
+func (s *LocalStorage) ReleaseVolume(ctx echo.Context, uuid string) error {
+	if err := service.MyService.Disk().ReleaseToFStab(uuid); err != nil {
+		message := err.Error()
+
+		switch {
+		case errors.Is(err, service.ErrVolumeNotFound):
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		case errors.Is(err, service.ErrVolumeInMerge),
+			errors.Is(err, fstab.ErrDifferentFSTabEntryWithSameMountPoint):
+			return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+		case errors.Is(err, service.ErrReleaseNotSupportedForCrypt),
+			errors.Is(err, fstab.ErrVerificationFailed):
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{})
+}
+
+func VolumeAdapterOut(volume model2.Volume) codegen.Volume {
+	id := int(volume.ID)
+	createdAt := time.Unix(volume.CreatedAt, 0)
+
+	result := codegen.Volume{
+		Id:         &id,
+		Uuid:       &volume.UUID,
+		MountPoint: volume.MountPoint,
+		CreatedAt:  &createdAt,
+	}
+
+	if path, err := partition.GetDevicePath(volume.UUID); err == nil {
+		result.Path = path
+	}
+
+	if volume.FSType != "" {
+		result.Fstype = &volume.FSType
+	}
+
+	if volume.Label != "" {
+		result.Label = &volume.Label
+	}
+
+	if volume.Size != 0 {
+		result.Size = &volume.Size
+	}
+
+	if volume.DiskID != "" {
+		result.DiskId = &volume.DiskID
+	}
+
+	if volume.MountOptions != "" {
+		result.MountOptions = &volume.MountOptions
+	}
+
+	if volume.LastSeenAt != 0 {
+		lastSeenAt := time.Unix(volume.LastSeenAt, 0)
+		result.LastSeenAt = &lastSeenAt
+	}
+
+	if volume.Notes != "" {
+		result.Notes = &volume.Notes
+	}
+
+	return result
+}
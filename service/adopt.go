@@ -0,0 +1,157 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/fstab"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/moby/sys/mountinfo"
+	"go.uber.org/zap"
+)
+
+const (
+	FStabActionKeep       = "keep"    // leave the fstab entry as is, so the volume is mounted by both
+	FStabActionCommentOut = "comment" // comment the fstab entry out, so it is easy to restore by hand
+	FStabActionRemove     = "remove"
+)
+
+var (
+	ErrMountNotFound               = errors.New("nothing is mounted at the mount point")
+	ErrMountNotAdoptable           = errors.New("only a mount of a block device with a filesystem UUID can be adopted")
+	ErrVolumeAlreadyManaged        = errors.New("volume is already managed by CasaOS")
+	ErrVolumeInMerge               = errors.New("volume is a source of a merge - remove it from the merge first")
+	ErrFStabActionUnsupported      = errors.New("fstab action should be keep, comment or remove")
+	ErrReleaseNotSupportedForCrypt = errors.New("encrypted volumes cannot be released to fstab")
+)
+
+// AdoptMount makes the block device mounted at mountPoint a volume managed by CasaOS, e.g. to be used in merges, and keeps,
+// comments out or removes its fstab entry, if any, as fstabAction says.
+func (d *diskService) AdoptMount(mountPoint, fstabAction string) (*model2.Volume, error) {
+	switch fstabAction {
+	case "":
+		fstabAction = FStabActionCommentOut
+	case FStabActionKeep, FStabActionCommentOut, FStabActionRemove:
+	default:
+		return nil, ErrFStabActionUnsupported
+	}
+
+	mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(mountPoint))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mounts) == 0 {
+		return nil, ErrMountNotFound
+	}
+
+	source := mounts[len(mounts)-1].Source
+	if !strings.HasPrefix(source, "/dev/") {
+		return nil, ErrMountNotAdoptable
+	}
+
+	uuid, err := partition.GetUUID(source)
+	if err != nil || uuid == "" {
+		logger.Error("error when getting uuid of mount source", zap.Error(err), zap.String("source", source), zap.String("mount point", mountPoint))
+		return nil, ErrMountNotAdoptable
+	}
+
+	var existing model2.Volume
+	if result := d.db.Where(&model2.Volume{UUID: uuid}).Limit(1).Find(&existing); result.Error != nil {
+		return nil, result.Error
+	} else if result.RowsAffected > 0 {
+		return nil, ErrVolumeAlreadyManaged
+	}
+
+	volume := model2.Volume{
+		UUID:       uuid,
+		MountPoint: mountPoint,
+		CreatedAt:  time.Now().Unix(),
+	}
+
+	logger.Info("adopting mount as volume...", zap.String("source", source), zap.String("mount point", mountPoint), zap.String("fstab action", fstabAction))
+
+	if err := d.SaveMountPointToDB(volume); err != nil {
+		return nil, err
+	}
+
+	if fstabAction != FStabActionKeep {
+		if entry, err := fstab.Get().GetEntryByMountPoint(mountPoint); err != nil {
+			logger.Error("error when finding the mount point in fstab", zap.Error(err), zap.String("mount point", mountPoint))
+		} else if entry != nil {
+			if err := fstab.Get().RemoveByMountPoint(mountPoint, fstabAction == FStabActionCommentOut); err != nil {
+				// the volume is then restored by both, which is harmless
+				logger.Error("error when removing fstab entry of adopted volume", zap.Error(err), zap.String("mount point", mountPoint))
+			}
+		}
+	}
+
+	if result := d.db.Where(&model2.Volume{UUID: uuid}).Limit(1).Find(&volume); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &volume, nil
+}
+
+// ReleaseToFStab hands the volume with uuid over to fstab, with nofail, and stops managing it. The volume stays mounted.
+func (d *diskService) ReleaseToFStab(uuid string) error {
+	var volume model2.Volume
+
+	result := d.db.Where(&model2.Volume{UUID: uuid}).Limit(1).Find(&volume)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrVolumeNotFound
+	}
+
+	if volume.CryptUUID != "" {
+		return ErrReleaseNotSupportedForCrypt
+	}
+
+	merges, err := MyService.LocalStorage().GetMergeAllFromDB(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, merge := range merges {
+		for _, source := range merge.SourceVolumes {
+			if source != nil && source.UUID == uuid {
+				return ErrVolumeInMerge
+			}
+		}
+	}
+
+	fsType := ""
+	if mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(volume.MountPoint)); err == nil && len(mounts) > 0 {
+		fsType = mounts[len(mounts)-1].FSType
+	} else if devicePath, err := partition.GetDevicePath(uuid); err == nil {
+		fsType = d.GetDiskInfo(devicePath).FsType
+	}
+
+	if fsType == "" {
+		fsType = "auto"
+	}
+
+	logger.Info("releasing volume to fstab...", zap.String("uuid", uuid), zap.String("mount point", volume.MountPoint))
+
+	if err := fstab.Get().Add(fstab.Entry{
+		Source:     "UUID=" + uuid,
+		MountPoint: volume.MountPoint,
+		FSType:     fsType,
+		Options:    "defaults,nofail",
+		Pass:       fstab.PassDoNotCheck,
+	}, false); err != nil {
+		return err
+	}
+
+	if err := d.uninstallMountUnit(volume.MountPoint); err != nil {
+		logger.Error("error when removing mount unit of released volume", zap.Error(err), zap.String("mount point", volume.MountPoint))
+	}
+
+	return d.db.Delete(&volume).Error
+}
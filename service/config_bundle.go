@@ -0,0 +1,1042 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/fstab"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mountpoint"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/secret"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"github.com/rclone/rclone/fs"
+	rconfig "github.com/rclone/rclone/fs/config"
+	"go.uber.org/zap"
+)
+
+const (
+	ConfigBundleVersion = 1
+
+	ConfigItemTypeSetting  = "setting"
+	ConfigItemTypeVolume   = "volume"
+	ConfigItemTypeFSTab    = "fstab"
+	ConfigItemTypeRemote   = "remote"
+	ConfigItemTypeMerge    = "merge"
+	ConfigItemTypeSnapRAID = "snapraid"
+
+	ConfigActionNone     = "none"     // already as in the bundle
+	ConfigActionCreate   = "create"   // not on this system
+	ConfigActionUpdate   = "update"   // on this system, but different
+	ConfigActionConflict = "conflict" // something else is in the way - left alone
+	ConfigActionMissing  = "missing"  // hardware is not present - nothing to do
+	ConfigActionInvalid  = "invalid"  // not valid on this system - nothing to do
+
+	// prefix of the values sealed with the passphrase in a bundle
+	sealedPrefix = "sealed:"
+
+	// sealed in each bundle with secrets, to tell a wrong passphrase before opening anything
+	passphraseCheck = common.ServiceName
+)
+
+var (
+	ErrConfigBundleVersion      = errors.New("unsupported config bundle version")
+	ErrConfigPassphraseRequired = errors.New("the bundle has sealed secrets - a passphrase is required")
+)
+
+type ConfigBundleService interface {
+	// Export returns the storage configuration of this system, i.e. volumes, merges and their SnapRAID, fstab entries
+	// added by this service, settings and rclone remotes. If passphrase is given, the secrets of remotes are sealed with it.
+	Export(passphrase string) (*ConfigBundle, error)
+	// Plan validates bundle against this system, and returns what Import would do with each item, in the order it would.
+	Plan(bundle *ConfigBundle, passphrase string) ([]ConfigItem, error)
+	// Import applies the plan of bundle, then mounts what it imported, and returns the plan with any error per item.
+	Import(bundle *ConfigBundle, passphrase string) ([]ConfigItem, error)
+}
+
+// ConfigBundle is the storage configuration of a system, as exported to be imported elsewhere, e.g. after reinstalling.
+type ConfigBundle struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	AppVersion string    `json:"app_version"`
+
+	Volumes  []model2.Volume          `json:"volumes"` // rows of o_disk
+	Merges   []ConfigBundleMerge      `json:"merges"`
+	SnapRAID []ConfigBundleSnapRAID   `json:"snapraid"`
+	FSTab    []ConfigBundleFSTabEntry `json:"fstab"`    // entries added by this service only
+	Settings map[string]string        `json:"settings"` // of the server section in local-storage.conf
+
+	// rclone config, by remote - a secret is sealed, if a passphrase was given at export
+	Remotes map[string]map[string]string `json:"remotes"`
+	Seal    *ConfigBundleSeal            `json:"seal,omitempty"`
+}
+
+// ConfigBundleMerge is a row of o_merge, with its source volumes by UUID.
+type ConfigBundleMerge struct {
+	FSType         string                        `json:"fstype"`
+	MountPoint     string                        `json:"mount_point"`
+	SourceBasePath *string                       `json:"source_base_path,omitempty"`
+	SourceVolumes  []string                      `json:"source_volumes"`
+	Branches       map[string]model2.MergeBranch `json:"branches,omitempty"`
+
+	CreatePolicy string            `json:"create_policy,omitempty"`
+	MinFreeSpace string            `json:"min_free_space,omitempty"`
+	MoveOnENOSPC *bool             `json:"move_on_enospc,omitempty"`
+	CacheFiles   string            `json:"cache_files,omitempty"`
+	FuncPolicies map[string]string `json:"func_policies,omitempty"`
+}
+
+// ConfigBundleSnapRAID is a row of o_snapraid, with its merge by mount point.
+type ConfigBundleSnapRAID struct {
+	MergeMountPoint string   `json:"merge_mount_point"`
+	DataVolumes     []string `json:"data_volumes"`
+	ParityVolumes   []string `json:"parity_volumes"`
+	Excludes        []string `json:"excludes,omitempty"`
+	SyncSchedule    string   `json:"sync_schedule,omitempty"`
+	ScrubSchedule   string   `json:"scrub_schedule,omitempty"`
+	ScrubPercent    int      `json:"scrub_percent,omitempty"`
+}
+
+type ConfigBundleFSTabEntry struct {
+	Source     string `json:"source"`
+	MountPoint string `json:"mount_point"`
+	FSType     string `json:"fstype"`
+	Options    string `json:"options"`
+	Dump       int    `json:"dump"`
+	Pass       int    `json:"pass"`
+}
+
+// ConfigBundleSeal tells how the secrets in a bundle are sealed.
+type ConfigBundleSeal struct {
+	Salt  string `json:"salt"`  // base64, for the key derived from the passphrase
+	Check string `json:"check"` // passphraseCheck, sealed
+}
+
+type ConfigItem struct {
+	Type   string `json:"type"` // setting, volume, fstab, remote, merge, snapraid
+	Name   string `json:"name"` // key of the setting, name of the remote, or mount point
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// an item of a bundle, along with how to import it
+type configStep struct {
+	ConfigItem
+	apply func() error
+}
+
+type configBundleService struct {
+	mu sync.Mutex
+}
+
+// settings in the server section of local-storage.conf that are part of the storage configuration
+func serverSettings() map[string]*string {
+	return map[string]*string{
+		"USBAutoMount":           &config.ServerInfo.USBAutoMount,
+		"MountPointTemplate":     &config.ServerInfo.MountPointTemplate,
+		"AutoMountPointTemplate": &config.ServerInfo.AutoMountPointTemplate,
+		"PersistentType":         &config.ServerInfo.PersistentType,
+	}
+}
+
+func (c *configBundleService) Export(passphrase string) (*ConfigBundle, error) {
+	bundle := &ConfigBundle{
+		Version:    ConfigBundleVersion,
+		ExportedAt: time.Now(),
+		AppVersion: common.Version,
+		Settings:   make(map[string]string),
+		Remotes:    make(map[string]map[string]string),
+	}
+
+	var sealer *secret.Sealer
+	if passphrase != "" {
+		salt, err := secret.NewSalt()
+		if err != nil {
+			return nil, err
+		}
+
+		if sealer, err = secret.NewSealer(passphrase, salt); err != nil {
+			return nil, err
+		}
+
+		check, err := sealer.Seal(passphraseCheck)
+		if err != nil {
+			return nil, err
+		}
+
+		bundle.Seal = &ConfigBundleSeal{Salt: base64.StdEncoding.EncodeToString(salt), Check: check}
+	}
+
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return nil, err
+	}
+	bundle.Volumes = volumes
+
+	merges, err := MyService.LocalStorage().GetMergeAllFromDB(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoints := make(map[uint]string, len(merges)) // of merges, by ID
+	for _, merge := range merges {
+		mountPoints[merge.ID] = merge.MountPoint
+		bundle.Merges = append(bundle.Merges, configBundleMergeOf(merge))
+	}
+
+	snapraids, err := MyService.LocalStorage().GetSnapRAIDAllFromDB()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range snapraids {
+		mountPoint, ok := mountPoints[s.MergeID]
+		if !ok {
+			continue
+		}
+
+		bundle.SnapRAID = append(bundle.SnapRAID, ConfigBundleSnapRAID{
+			MergeMountPoint: mountPoint,
+			DataVolumes:     s.DataVolumes,
+			ParityVolumes:   s.ParityVolumes,
+			Excludes:        s.Excludes,
+			SyncSchedule:    s.SyncSchedule,
+			ScrubSchedule:   s.ScrubSchedule,
+			ScrubPercent:    s.ScrubPercent,
+		})
+	}
+
+	entries, err := fstab.Get().GetEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Comment != fstab.DefaultComment {
+			continue
+		}
+
+		bundle.FSTab = append(bundle.FSTab, ConfigBundleFSTabEntry{
+			Source:     entry.Source,
+			MountPoint: entry.MountPoint,
+			FSType:     entry.FSType,
+			Options:    entry.Options,
+			Dump:       entry.Dump,
+			Pass:       entry.Pass,
+		})
+	}
+
+	for key, value := range serverSettings() {
+		bundle.Settings[key] = *value
+	}
+
+	for _, name := range rconfig.LoadedData().GetSectionList() {
+		remoteType, _ := rconfig.LoadedData().GetValue(name, "type")
+
+		values := make(map[string]string)
+		for _, key := range rconfig.LoadedData().GetKeyList(name) {
+			value, _ := rconfig.LoadedData().GetValue(name, key)
+
+			if sealer != nil && value != "" && isSecretKey(remoteType, key) {
+				sealed, err := sealer.Seal(value)
+				if err != nil {
+					return nil, err
+				}
+				value = sealedPrefix + sealed
+			}
+
+			values[key] = value
+		}
+
+		bundle.Remotes[name] = values
+	}
+
+	return bundle, nil
+}
+
+func (c *configBundleService) Plan(bundle *ConfigBundle, passphrase string) ([]ConfigItem, error) {
+	steps, _, err := c.steps(bundle, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ConfigItem, 0, len(steps))
+	for _, step := range steps {
+		items = append(items, step.ConfigItem)
+	}
+
+	return items, nil
+}
+
+func (c *configBundleService) Import(bundle *ConfigBundle, passphrase string) ([]ConfigItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	steps, updatedMerges, err := c.steps(bundle, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ConfigItem, 0, len(steps))
+	for _, step := range steps {
+		item := step.ConfigItem
+
+		if step.apply != nil {
+			logger.Info("importing config...", zap.Any("item", item))
+
+			if err := step.apply(); err != nil {
+				logger.Error("error when importing config", zap.Error(err), zap.Any("item", item))
+				item.Error = err.Error()
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	// mount what has been imported
+	reconciled, err := MyService.Reconciler().Apply()
+	if err != nil {
+		logger.Error("error when mounting imported config", zap.Error(err))
+	}
+
+	for _, item := range reconciled {
+		if item.Error != "" {
+			logger.Error("error when mounting imported config", zap.Any("item", item))
+		}
+	}
+
+	// the reconciler only updates the sources of merges that are mounted, not their options
+	for _, mountPoint := range updatedMerges {
+		merge, err := MyService.LocalStorage().GetFirstMergeFromDB(mountPoint)
+		if err != nil || merge == nil {
+			continue
+		}
+
+		if err := MyService.LocalStorage().UpdateMerge(merge); err != nil {
+			logger.Error("error when updating imported merge", zap.Error(err), zap.String("mount point", mountPoint))
+		}
+	}
+
+	return items, nil
+}
+
+// build the import steps in dependency order, i.e. settings, volumes, fstab entries and remotes, then the merges over
+// the volumes and their SnapRAID - along with the mount points of the merges to be updated
+func (c *configBundleService) steps(bundle *ConfigBundle, passphrase string) ([]configStep, []string, error) {
+	if bundle == nil {
+		return nil, nil, v2.ErrNilReference
+	}
+
+	if bundle.Version < 1 || bundle.Version > ConfigBundleVersion {
+		return nil, nil, fmt.Errorf("%w: %d, expected up to %d", ErrConfigBundleVersion, bundle.Version, ConfigBundleVersion)
+	}
+
+	sealer, err := openSeal(bundle.Seal, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	steps := settingSteps(bundle.Settings)
+
+	volumeSteps, present, err := volumeSteps(bundle.Volumes)
+	if err != nil {
+		return nil, nil, err
+	}
+	steps = append(steps, volumeSteps...)
+
+	fstabSteps, err := fstabSteps(bundle.FSTab)
+	if err != nil {
+		return nil, nil, err
+	}
+	steps = append(steps, fstabSteps...)
+
+	remoteSteps, err := remoteSteps(bundle.Remotes, sealer)
+	if err != nil {
+		return nil, nil, err
+	}
+	steps = append(steps, remoteSteps...)
+
+	mergeSteps, err := mergeSteps(bundle.Merges, present)
+	if err != nil {
+		return nil, nil, err
+	}
+	steps = append(steps, mergeSteps...)
+
+	updatedMerges := make([]string, 0)
+	imported := make(map[string]bool) // merges that will be in the database, by mount point
+	for _, step := range mergeSteps {
+		switch step.Action {
+		case ConfigActionNone, ConfigActionCreate:
+			imported[step.Name] = true
+		case ConfigActionUpdate:
+			imported[step.Name] = true
+			updatedMerges = append(updatedMerges, step.Name)
+		}
+	}
+
+	snapraidSteps, err := snapraidSteps(bundle.SnapRAID, present, imported)
+	if err != nil {
+		return nil, nil, err
+	}
+	steps = append(steps, snapraidSteps...)
+
+	return steps, updatedMerges, nil
+}
+
+// openSeal returns the sealer to open the secrets of a bundle with, or nil if they are not sealed.
+func openSeal(seal *ConfigBundleSeal, passphrase string) (*secret.Sealer, error) {
+	if seal == nil {
+		return nil, nil
+	}
+
+	if passphrase == "" {
+		return nil, ErrConfigPassphraseRequired
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(seal.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", secret.ErrWrongPassphrase, err.Error())
+	}
+
+	sealer, err := secret.NewSealer(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if check, err := sealer.Open(seal.Check); err != nil || check != passphraseCheck {
+		return nil, secret.ErrWrongPassphrase
+	}
+
+	return sealer, nil
+}
+
+func settingSteps(settings map[string]string) []configStep {
+	current := serverSettings()
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	steps := make([]configStep, 0, len(keys))
+	for _, key := range keys {
+		key, value := key, settings[key]
+
+		step := configStep{ConfigItem: ConfigItem{Type: ConfigItemTypeSetting, Name: key}}
+
+		setting, ok := current[key]
+		if !ok {
+			step.Action = ConfigActionInvalid
+			step.Reason = "unknown setting"
+			steps = append(steps, step)
+			continue
+		}
+
+		if err := validateSetting(key, value); err != nil {
+			step.Action = ConfigActionInvalid
+			step.Reason = err.Error()
+			steps = append(steps, step)
+			continue
+		}
+
+		if *setting == value || (key == "USBAutoMount" && strings.EqualFold(*setting, value)) {
+			step.Action = ConfigActionNone
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ConfigActionUpdate
+		step.Reason = "currently " + *setting
+		step.apply = func() error {
+			if key == "USBAutoMount" {
+				state := "False"
+				if strings.EqualFold(value, "true") {
+					state = "True"
+				}
+
+				MyService.USB().UpdateUSBAutoMount(state)
+				MyService.USB().ApplyUSBAutoMount(state)
+				return nil
+			}
+
+			*setting = value
+			config.Cfg.Section("server").Key(key).SetValue(value)
+			return config.Cfg.SaveTo(config.ConfigFilePath)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps
+}
+
+func validateSetting(key, value string) error {
+	switch key {
+	case "USBAutoMount":
+		if !strings.EqualFold(value, "true") && !strings.EqualFold(value, "false") {
+			return errors.New("should be True or False")
+		}
+	case "MountPointTemplate", "AutoMountPointTemplate":
+		return mountpoint.Validate(value)
+	case "PersistentType":
+		if value != PersistentTypeCasaOS && value != PersistentTypeSystemd {
+			return fmt.Errorf("should be %s or %s", PersistentTypeCasaOS, PersistentTypeSystemd)
+		}
+	}
+
+	return nil
+}
+
+// volumeSteps also returns the mount points of the volumes that are present on this system and imported, by UUID.
+func volumeSteps(volumes []model2.Volume) ([]configStep, map[string]string, error) {
+	existing, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := make(map[string]string)
+	steps := make([]configStep, 0, len(volumes))
+	for i := range volumes {
+		volume := volumes[i]
+
+		step := configStep{ConfigItem: ConfigItem{Type: ConfigItemTypeVolume, Name: volume.MountPoint}}
+
+		if volume.UUID == "" {
+			step.Action = ConfigActionInvalid
+			step.Reason = ErrVolumeWithEmptyUUID.Error()
+			steps = append(steps, step)
+			continue
+		}
+
+		// the filesystem of an encrypted volume is only there once it is unlocked
+		uuid := volume.UUID
+		if volume.CryptUUID != "" {
+			uuid = volume.CryptUUID
+		}
+
+		if devicePath, err := partition.GetDevicePath(uuid); err != nil || devicePath == "" {
+			step.Action = ConfigActionMissing
+			step.Reason = "device " + uuid + " is not present"
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ConfigActionCreate
+		for _, v := range existing {
+			if v.UUID == volume.UUID {
+				if v.MountPoint == volume.MountPoint {
+					step.Action = ConfigActionNone
+				} else {
+					step.Action = ConfigActionUpdate
+					step.Reason = "currently at " + v.MountPoint
+				}
+			} else if v.MountPoint == volume.MountPoint {
+				step.Action = ConfigActionConflict
+				step.Reason = "mount point is taken by volume " + v.UUID
+				break
+			}
+		}
+
+		if step.Action == ConfigActionConflict {
+			steps = append(steps, step)
+			continue
+		}
+
+		present[volume.UUID] = volume.MountPoint
+
+		if step.Action == ConfigActionNone {
+			steps = append(steps, step)
+			continue
+		}
+
+		if volume.CryptUUID != "" && volume.AutoUnlock {
+			// the key file is not in the bundle - it has to be enabled again with the passphrase
+			if step.Reason != "" {
+				step.Reason += ", "
+			}
+			step.Reason += "auto-unlock has to be enabled again"
+		}
+
+		step.apply = func() error {
+			return MyService.Disk().SaveMountPointToDB(model2.Volume{
+				UUID:       volume.UUID,
+				MountPoint: volume.MountPoint,
+				CreatedAt:  time.Now().Unix(),
+				CryptUUID:  volume.CryptUUID,
+				Notes:      volume.Notes,
+			})
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, present, nil
+}
+
+func fstabSteps(entries []ConfigBundleFSTabEntry) ([]configStep, error) {
+	steps := make([]configStep, 0, len(entries))
+	for _, e := range entries {
+		entry := fstab.Entry{
+			Source:     e.Source,
+			MountPoint: e.MountPoint,
+			FSType:     e.FSType,
+			Options:    e.Options,
+			Dump:       e.Dump,
+			Pass:       e.Pass,
+			Comment:    fstab.DefaultComment,
+		}
+
+		step := configStep{ConfigItem: ConfigItem{Type: ConfigItemTypeFSTab, Name: entry.MountPoint}}
+
+		if err := entry.Validate(); err != nil {
+			step.Action = ConfigActionInvalid
+			step.Reason = err.Error()
+			steps = append(steps, step)
+			continue
+		}
+
+		existing, err := fstab.Get().GetEntryByMountPoint(entry.MountPoint)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != nil {
+			if existing.Source == entry.Source && existing.FSType == entry.FSType && existing.Options == entry.Options &&
+				existing.Dump == entry.Dump && existing.Pass == entry.Pass {
+				step.Action = ConfigActionNone
+			} else {
+				step.Action = ConfigActionConflict
+				step.Reason = fstab.ErrDifferentFSTabEntryWithSameMountPoint.Error()
+			}
+
+			steps = append(steps, step)
+			continue
+		}
+
+		if isDeviceSource(entry.Source) && fstab.ResolveSource(entry.Source) == "" {
+			step.Action = ConfigActionMissing
+			step.Reason = "device " + entry.Source + " is not present"
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ConfigActionCreate
+		step.apply = func() error {
+			if err := os.MkdirAll(entry.MountPoint, 0o755); err != nil {
+				return err
+			}
+
+			return fstab.Get().Add(entry, false)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// isDeviceSource tells if source of an fstab entry is a block device, rather than e.g. a network share.
+func isDeviceSource(source string) bool {
+	if strings.HasPrefix(source, "/dev/") {
+		return true
+	}
+
+	tag, _, found := strings.Cut(source, "=")
+	return found && slices.Contains([]string{"UUID", "LABEL", "PARTUUID", "PARTLABEL"}, strings.ToUpper(tag))
+}
+
+func remoteSteps(remotes map[string]map[string]string, sealer *secret.Sealer) ([]configStep, error) {
+	names := make([]string, 0, len(remotes))
+	for name := range remotes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	steps := make([]configStep, 0, len(names))
+	for _, name := range names {
+		name := name
+
+		step := configStep{ConfigItem: ConfigItem{Type: ConfigItemTypeRemote, Name: name}}
+
+		values, err := openRemote(remotes[name], sealer)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := fs.Find(values["type"]); err != nil {
+			step.Action = ConfigActionInvalid
+			step.Reason = err.Error()
+			steps = append(steps, step)
+			continue
+		}
+
+		if rconfig.LoadedData().HasSection(name) {
+			// secrets, e.g. tokens, are refreshed over time - the rest tells if it is the same remote
+			step.Action = ConfigActionNone
+
+			keys := rconfig.LoadedData().GetKeyList(name)
+			for key := range values {
+				if !slices.Contains(keys, key) {
+					keys = append(keys, key)
+				}
+			}
+
+			for _, key := range keys {
+				if isSecretKey(values["type"], key) {
+					continue
+				}
+
+				if value, _ := rconfig.LoadedData().GetValue(name, key); value != values[key] {
+					step.Action = ConfigActionConflict
+					step.Reason = "a different remote with the same name exists"
+					break
+				}
+			}
+
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ConfigActionCreate
+		step.apply = func() error {
+			for key, value := range values {
+				rconfig.LoadedData().SetValue(name, key, value)
+			}
+
+			rconfig.SaveConfig()
+			return nil
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// openRemote returns the values of a remote in a bundle, with its secrets opened.
+func openRemote(values map[string]string, sealer *secret.Sealer) (map[string]string, error) {
+	opened := make(map[string]string, len(values))
+	for key, value := range values {
+		if sealed, ok := strings.CutPrefix(value, sealedPrefix); ok {
+			if sealer == nil {
+				return nil, ErrConfigPassphraseRequired
+			}
+
+			var err error
+			if value, err = sealer.Open(sealed); err != nil {
+				return nil, err
+			}
+		}
+
+		opened[key] = value
+	}
+
+	return opened, nil
+}
+
+// isSecretKey tells if key of a remote of remoteType is a password, token or the like.
+func isSecretKey(remoteType, key string) bool {
+	lower := strings.ToLower(key)
+	for _, word := range []string{"token", "secret", "pass"} {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+
+	info, err := fs.Find(remoteType)
+	if err != nil {
+		return false
+	}
+
+	for _, option := range info.Options {
+		if option.Name == key {
+			return option.IsPassword
+		}
+	}
+
+	return false
+}
+
+func mergeSteps(merges []ConfigBundleMerge, present map[string]string) ([]configStep, error) {
+	steps := make([]configStep, 0, len(merges))
+	for _, m := range merges {
+		m := m
+
+		step := configStep{ConfigItem: ConfigItem{Type: ConfigItemTypeMerge, Name: m.MountPoint}}
+
+		if strings.ToLower(config.ServerInfo.EnableMergerFS) != "true" {
+			step.Action = ConfigActionInvalid
+			step.Reason = "merges are not enabled on this system"
+			steps = append(steps, step)
+			continue
+		}
+
+		merge := mergeOf(m, nil)
+		if err := v2.MergeOptions(merge).Validate(); err != nil {
+			step.Action = ConfigActionInvalid
+			step.Reason = err.Error()
+			steps = append(steps, step)
+			continue
+		}
+
+		missing := make([]string, 0)
+		for _, uuid := range m.SourceVolumes {
+			if mountPoint, ok := present[uuid]; ok {
+				merge.SourceVolumes = append(merge.SourceVolumes, &model2.Volume{UUID: uuid, MountPoint: mountPoint})
+			} else {
+				missing = append(missing, uuid)
+			}
+		}
+
+		if len(merge.SourceVolumes) == 0 && (m.SourceBasePath == nil || *m.SourceBasePath == "") {
+			step.Action = ConfigActionMissing
+			step.Reason = "none of its source volumes is present"
+			steps = append(steps, step)
+			continue
+		}
+
+		if len(missing) > 0 {
+			step.Reason = "without source volumes not present: " + strings.Join(missing, ", ")
+		}
+
+		existing, err := MyService.LocalStorage().GetFirstMergeFromDB(m.MountPoint)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != nil {
+			merge.ID = existing.ID
+		}
+
+		if err := MyService.LocalStorage().ValidateMerge(&merge); err != nil {
+			step.Action = ConfigActionConflict
+			step.Reason = err.Error()
+			steps = append(steps, step)
+			continue
+		}
+
+		if existing != nil && sameMerge(*existing, merge) {
+			step.Action = ConfigActionNone
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ConfigActionCreate
+		if existing != nil {
+			step.Action = ConfigActionUpdate
+		}
+
+		step.apply = func() error {
+			return importMerge(m)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// importMerge creates or updates the merge in the database, with its source volumes as they are in the database by now.
+func importMerge(m ConfigBundleMerge) error {
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return err
+	}
+
+	merge := mergeOf(m, volumes)
+
+	existing, err := MyService.LocalStorage().GetFirstMergeFromDB(m.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		if err := MyService.LocalStorage().ValidateMerge(&merge); err != nil {
+			return err
+		}
+
+		return MyService.LocalStorage().CreateMergeInDB(&merge)
+	}
+
+	merge.ID = existing.ID
+	if err := MyService.LocalStorage().ValidateMerge(&merge); err != nil {
+		return err
+	}
+
+	return MyService.LocalStorage().UpdateMergeInDB(&merge)
+}
+
+// mergeOf returns m as a merge, with those of its source volumes found in volumes.
+func mergeOf(m ConfigBundleMerge, volumes []model2.Volume) model2.Merge {
+	merge := model2.Merge{
+		FSType:         m.FSType,
+		MountPoint:     m.MountPoint,
+		SourceBasePath: m.SourceBasePath,
+		Branches:       m.Branches,
+		CreatePolicy:   m.CreatePolicy,
+		MinFreeSpace:   m.MinFreeSpace,
+		MoveOnENOSPC:   m.MoveOnENOSPC,
+		CacheFiles:     m.CacheFiles,
+		FuncPolicies:   m.FuncPolicies,
+	}
+
+	for _, uuid := range m.SourceVolumes {
+		for i := range volumes {
+			if volumes[i].UUID == uuid {
+				merge.SourceVolumes = append(merge.SourceVolumes, &volumes[i])
+				break
+			}
+		}
+	}
+
+	return merge
+}
+
+func configBundleMergeOf(merge model2.Merge) ConfigBundleMerge {
+	m := ConfigBundleMerge{
+		FSType:         merge.FSType,
+		MountPoint:     merge.MountPoint,
+		SourceBasePath: merge.SourceBasePath,
+		SourceVolumes:  make([]string, 0, len(merge.SourceVolumes)),
+		Branches:       merge.Branches,
+		CreatePolicy:   merge.CreatePolicy,
+		MinFreeSpace:   merge.MinFreeSpace,
+		MoveOnENOSPC:   merge.MoveOnENOSPC,
+		CacheFiles:     merge.CacheFiles,
+		FuncPolicies:   merge.FuncPolicies,
+	}
+
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil {
+			m.SourceVolumes = append(m.SourceVolumes, volume.UUID)
+		}
+	}
+
+	return m
+}
+
+// sameMerge tells if the merge in the database is already as imported.
+func sameMerge(existing, imported model2.Merge) bool {
+	uuids := func(merge model2.Merge) []string {
+		result := make([]string, 0, len(merge.SourceVolumes))
+		for _, volume := range merge.SourceVolumes {
+			if volume != nil {
+				result = append(result, volume.UUID)
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	basePath := func(merge model2.Merge) string {
+		if merge.SourceBasePath == nil {
+			return ""
+		}
+		return *merge.SourceBasePath
+	}
+
+	return existing.FSType == imported.FSType &&
+		basePath(existing) == basePath(imported) &&
+		slices.Equal(uuids(existing), uuids(imported)) &&
+		maps.Equal(existing.Branches, imported.Branches) &&
+		maps.Equal(v2.MergeOptions(existing).Values(), v2.MergeOptions(imported).Values())
+}
+
+func snapraidSteps(snapraids []ConfigBundleSnapRAID, present map[string]string, imported map[string]bool) ([]configStep, error) {
+	steps := make([]configStep, 0, len(snapraids))
+	for _, s := range snapraids {
+		s := s
+
+		step := configStep{ConfigItem: ConfigItem{Type: ConfigItemTypeSnapRAID, Name: s.MergeMountPoint}}
+
+		if !imported[s.MergeMountPoint] {
+			step.Action = ConfigActionMissing
+			step.Reason = "merge is not imported"
+			steps = append(steps, step)
+			continue
+		}
+
+		missing := make([]string, 0)
+		for _, uuid := range append(slices.Clone(s.DataVolumes), s.ParityVolumes...) {
+			if _, ok := present[uuid]; !ok {
+				missing = append(missing, uuid)
+			}
+		}
+
+		if len(missing) > 0 {
+			step.Action = ConfigActionMissing
+			step.Reason = "volumes not present: " + strings.Join(missing, ", ")
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ConfigActionCreate
+
+		merge, err := MyService.LocalStorage().GetFirstMergeFromDB(s.MergeMountPoint)
+		if err != nil {
+			return nil, err
+		}
+
+		if merge != nil {
+			existing, err := MyService.SnapRAID().Get(merge.ID)
+			switch {
+			case errors.Is(err, v2.ErrSnapRAIDNotConfigured):
+			case err != nil:
+				return nil, err
+			case slices.Equal(existing.DataVolumes, s.DataVolumes) && slices.Equal(existing.ParityVolumes, s.ParityVolumes) &&
+				slices.Equal(existing.Excludes, s.Excludes) && existing.SyncSchedule == s.SyncSchedule &&
+				existing.ScrubSchedule == s.ScrubSchedule && existing.ScrubPercent == s.ScrubPercent:
+				step.Action = ConfigActionNone
+			default:
+				step.Action = ConfigActionUpdate
+			}
+		}
+
+		if step.Action == ConfigActionNone {
+			steps = append(steps, step)
+			continue
+		}
+
+		step.apply = func() error {
+			merge, err := MyService.LocalStorage().GetFirstMergeFromDB(s.MergeMountPoint)
+			if err != nil {
+				return err
+			}
+
+			if merge == nil {
+				return v2.ErrMergeNotFound
+			}
+
+			_, err = MyService.SnapRAID().Configure(*merge, model2.SnapRAID{
+				DataVolumes:   s.DataVolumes,
+				ParityVolumes: s.ParityVolumes,
+				Excludes:      s.Excludes,
+				SyncSchedule:  s.SyncSchedule,
+				ScrubSchedule: s.ScrubSchedule,
+				ScrubPercent:  s.ScrubPercent,
+			})
+			return err
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+func NewConfigBundleService() ConfigBundleService {
+	return &configBundleService{}
+}
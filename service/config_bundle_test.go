@@ -0,0 +1,75 @@
+package service
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/secret"
+	"gotest.tools/v3/assert"
+)
+
+func TestOpenSeal(t *testing.T) {
+	sealer, err := openSeal(nil, "")
+	assert.NilError(t, err)
+	assert.Assert(t, sealer == nil)
+
+	salt, err := secret.NewSalt()
+	assert.NilError(t, err)
+
+	exporter, err := secret.NewSealer("correct horse battery staple", salt)
+	assert.NilError(t, err)
+
+	check, err := exporter.Seal(passphraseCheck)
+	assert.NilError(t, err)
+
+	token, err := exporter.Seal(`{"access_token":"ya29.a0Af"}`)
+	assert.NilError(t, err)
+
+	seal := &ConfigBundleSeal{Salt: base64.StdEncoding.EncodeToString(salt), Check: check}
+	remote := map[string]string{"type": "drive", "token": sealedPrefix + token}
+
+	_, err = openSeal(seal, "")
+	assert.ErrorIs(t, err, ErrConfigPassphraseRequired)
+
+	_, err = openSeal(seal, "wrong")
+	assert.ErrorIs(t, err, secret.ErrWrongPassphrase)
+
+	sealer, err = openSeal(seal, "correct horse battery staple")
+	assert.NilError(t, err)
+
+	values, err := openRemote(remote, sealer)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, values, map[string]string{"type": "drive", "token": `{"access_token":"ya29.a0Af"}`})
+
+	_, err = openRemote(remote, nil)
+	assert.ErrorIs(t, err, ErrConfigPassphraseRequired)
+}
+
+func TestIsSecretKey(t *testing.T) {
+	assert.Assert(t, isSecretKey("drive", "token"))
+	assert.Assert(t, isSecretKey("drive", "client_secret"))
+	assert.Assert(t, isSecretKey("smb", "pass"))
+	assert.Assert(t, !isSecretKey("smb", "host"))
+	assert.Assert(t, !isSecretKey("drive", "mount_point"))
+}
+
+func TestIsDeviceSource(t *testing.T) {
+	assert.Assert(t, isDeviceSource("/dev/sdb1"))
+	assert.Assert(t, isDeviceSource("UUID=5c682e86-cec3-4761-9350-8e1a0c2d1ae9"))
+	assert.Assert(t, isDeviceSource("label=Backup"))
+	assert.Assert(t, !isDeviceSource("//nas/share"))
+	assert.Assert(t, !isDeviceSource("nas:/export"))
+	assert.Assert(t, !isDeviceSource("tmpfs"))
+}
+
+func TestValidateSetting(t *testing.T) {
+	assert.NilError(t, validateSetting("USBAutoMount", "True"))
+	assert.NilError(t, validateSetting("USBAutoMount", "false"))
+	assert.ErrorContains(t, validateSetting("USBAutoMount", "on"), "True or False")
+
+	assert.NilError(t, validateSetting("PersistentType", PersistentTypeSystemd))
+	assert.ErrorContains(t, validateSetting("PersistentType", PersistentTypeFStab), "casaos or systemd")
+
+	assert.NilError(t, validateSetting("MountPointTemplate", "/media/{name}"))
+	assert.Assert(t, validateSetting("AutoMountPointTemplate", "media/{label}") != nil)
+}
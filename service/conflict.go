@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	EventConflictStatus = common.ServiceName + ":conflict_status"
+
+	// conflicts kept in the status of a scan
+	maxConflicts = 1000
+)
+
+var (
+	ErrConflictScanRunning  = errors.New("a conflict scan is already running")
+	ErrConflictScanNotFound = errors.New("no conflict scan has been started")
+)
+
+type ConflictService interface {
+	// Scan starts looking for files at the same path on more than one branch of the merge at mountPoint, in the background.
+	// Only the copy on the first branch shows up in the merge. The copies are hashed if withHash, to tell identical ones.
+	Scan(mountPoint string, withHash bool) (*ConflictStatus, error)
+	// Status returns the status of the running conflict scan, or of the last one.
+	Status() (*ConflictStatus, error)
+	Cancel() (*ConflictStatus, error)
+	// Resolve resolves the conflict at path, relative to the merge at mountPoint, with action - one of mergerfs.ConflictActions.
+	Resolve(mountPoint, path, action string) (*ConflictResolution, error)
+}
+
+type ConflictStatus struct {
+	JobState
+	WithHash bool `json:"with_hash"`
+
+	ScannedFiles  int64      `json:"scanned_files"`
+	ConflictCount int        `json:"conflict_count"`
+	Conflicts     []Conflict `json:"conflicts"` // up to maxConflicts
+}
+
+type Conflict struct {
+	Path      string         `json:"path"` // relative to the merge
+	Identical bool           `json:"identical"`
+	Files     []ConflictFile `json:"files"`
+}
+
+type ConflictFile struct {
+	Branch  string    `json:"branch"`
+	Mode    string    `json:"mode"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+type ConflictResolution struct {
+	Path    string            `json:"path"`
+	Action  string            `json:"action"`
+	Removed []string          `json:"removed"`
+	Renamed map[string]string `json:"renamed"`
+}
+
+type conflictService struct {
+	job[ConflictStatus, *ConflictStatus]
+}
+
+func (c *conflictService) Scan(mountPoint string, withHash bool) (*ConflictStatus, error) {
+	branches, err := mergeBranches(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, status, err := c.begin(ConflictStatus{
+		JobState:  JobState{MountPoint: mountPoint},
+		WithHash:  withHash,
+		Conflicts: make([]Conflict, 0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("scanning merge for conflicts...", zap.String("mount point", mountPoint), zap.Bool("with hash", withHash))
+
+	go c.run(ctx, branches, withHash)
+
+	return status, nil
+}
+
+func (c *conflictService) Resolve(mountPoint, path, action string) (*ConflictResolution, error) {
+	branches, err := mergeBranches(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// files would be moved from under a rebalance or drain
+	if err := rebalanceRunning(mountPoint); err != nil {
+		return nil, err
+	}
+
+	if merge, err := MyService.LocalStorage().GetFirstMergeFromDB(mountPoint); err != nil {
+		return nil, err
+	} else if merge == nil {
+		return nil, v2.ErrMergeMountPointDoesNotExist
+	} else if err := snapraidRunning(*merge); err != nil {
+		return nil, err
+	}
+
+	conflict, err := mergerfs.GetConflict(branches, path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, renamed, err := mergerfs.ResolveConflict(branches, *conflict, action)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("conflict in merge is resolved", zap.String("mount point", mountPoint), zap.String("path", conflict.Path), zap.String("action", action), zap.Strings("removed", removed), zap.Any("renamed", renamed))
+
+	c.update(func(status *ConflictStatus) {
+		if status == nil || status.MountPoint != mountPoint {
+			return
+		}
+
+		for i, found := range status.Conflicts {
+			if found.Path == conflict.Path {
+				status.Conflicts = append(status.Conflicts[:i:i], status.Conflicts[i+1:]...)
+				status.ConflictCount--
+				break
+			}
+		}
+	})
+
+	return &ConflictResolution{
+		Path:    conflict.Path,
+		Action:  action,
+		Removed: removed,
+		Renamed: renamed,
+	}, nil
+}
+
+func (c *conflictService) run(ctx context.Context, branches []mergerfs.Branch, withHash bool) {
+	scanned, err := mergerfs.FindConflicts(ctx, branches, withHash, func(conflict mergerfs.Conflict) {
+		c.update(func(status *ConflictStatus) {
+			status.ConflictCount++
+			if len(status.Conflicts) < maxConflicts {
+				status.Conflicts = append(status.Conflicts, conflictOf(conflict))
+			}
+		})
+	})
+
+	c.update(func(status *ConflictStatus) {
+		status.ScannedFiles = scanned
+	})
+
+	c.finish(err)
+}
+
+func (c *conflictService) finish(err error) {
+	status := c.job.finish(err)
+
+	if status.State == JobStateFailed {
+		logger.Error("error when scanning merge for conflicts", zap.Error(err), zap.String("mount point", status.MountPoint))
+	} else {
+		logger.Info("conflict scan of merge is "+status.State, zap.String("mount point", status.MountPoint), zap.Int64("scanned files", status.ScannedFiles), zap.Int("conflicts", status.ConflictCount))
+	}
+}
+
+func notifyConflictStatus(status ConflictStatus) {
+	message := map[string]interface{}{
+		"mount_point":    status.MountPoint,
+		"state":          status.State,
+		"with_hash":      status.WithHash,
+		"scanned_files":  status.ScannedFiles,
+		"conflict_count": status.ConflictCount,
+		"error":          status.Error,
+	}
+
+	if err := MyService.Notify().SendNotify(EventConflictStatus, message); err != nil {
+		logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventConflictStatus), zap.Any("message", message))
+	}
+}
+
+// mergeBranches returns the branches of the merge at mountPoint, as mergerfs has them.
+func mergeBranches(mountPoint string) ([]mergerfs.Branch, error) {
+	merge, err := MyService.LocalStorage().GetFirstMergeFromDB(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if merge == nil {
+		return nil, v2.ErrMergeMountPointDoesNotExist
+	}
+
+	return mergerfs.GetBranches(mountPoint)
+}
+
+func conflictOf(conflict mergerfs.Conflict) Conflict {
+	result := Conflict{
+		Path:      conflict.Path,
+		Identical: conflict.Identical,
+		Files:     make([]ConflictFile, 0, len(conflict.Files)),
+	}
+
+	for _, file := range conflict.Files {
+		mode := file.Mode
+		if mode == "" {
+			mode = mergerfs.BranchModeRW
+		}
+
+		result.Files = append(result.Files, ConflictFile{
+			Branch:  file.Branch,
+			Mode:    mode,
+			Size:    file.Size,
+			ModTime: file.ModTime,
+			Hash:    file.Hash,
+		})
+	}
+
+	return result
+}
+
+func NewConflictService() ConflictService {
+	return &conflictService{
+		job: job[ConflictStatus, *ConflictStatus]{
+			name:        func(ConflictStatus) string { return "conflict scan" },
+			errRunning:  ErrConflictScanRunning,
+			errNotFound: ErrConflictScanNotFound,
+			notify:      notifyConflictStatus,
+		},
+	}
+}
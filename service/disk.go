@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -25,8 +24,11 @@ import (
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/model"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/fstab"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/luks"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mountpoint"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/systemd"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
 	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
 	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
@@ -40,11 +42,18 @@ import (
 type DiskService interface {
 	EnsureDefaultMergePoint() bool
 	AddPartition(path string) error
+	AssignMountPoint(disk, part model.LSBLKModel, name string) string
 	DeletePartition(path string) error
 	CheckSerialDiskMount()
 	FormatDisk(path string) error
 	GetDiskInfo(path string) model.LSBLKModel
 	GetPersistentTypeByUUID(uuid string) string
+	// SetPersistentType switches how the volume with uuid is restored after reboot, between casaos and systemd.
+	SetPersistentType(uuid, persistentType string, automount bool) error
+	// AdoptMount makes an existing mount of a block device, e.g. from fstab or by hand, a volume managed by CasaOS.
+	AdoptMount(mountPoint, fstabAction string) (*model2.Volume, error)
+	// ReleaseToFStab is the reverse of AdoptMount - the volume is persisted in fstab and no longer managed by CasaOS.
+	ReleaseToFStab(uuid string) error
 	GetUSBDriveStatusList() []model.USBDriveStatus
 	LSBLK(isUseCache bool) []model.LSBLKModel
 	MountDisk(path, volume string) (string, error)
@@ -57,6 +66,17 @@ type DiskService interface {
 	DeleteMountPointFromDB(path, mountPoint string) error
 	GetSerialAllFromDB() ([]model2.Volume, error)
 	SaveMountPointToDB(m model2.Volume) error
+	// RefreshVolumesInDB updates the filesystem, disk and mount options of the volumes that are present, and when they were last seen.
+	RefreshVolumesInDB()
+	// SetVolumeNotes sets the notes of the volume with uuid, e.g. where the disk is.
+	SetVolumeNotes(uuid, notes string) (*model2.Volume, error)
+	// GetOrphanedVolumes returns the volumes whose devices have not been seen for notSeenFor, with the merges they are in.
+	GetOrphanedVolumes(notSeenFor time.Duration) ([]OrphanedVolume, error)
+	// PruneOrphanedVolumes deletes the volumes not seen for notSeenFor from the database, and from their merges - only
+	// those with uuids if any are given. Volumes used by SnapRAID are left alone.
+	PruneOrphanedVolumes(notSeenFor time.Duration, uuids []string) ([]OrphanedVolume, error)
+	// AutoPruneOrphanedVolumes prunes the volumes not seen for OrphanedVolumePruneDays, if set, and sends an event.
+	AutoPruneOrphanedVolumes()
 	InitCheck()
 	GetSystemDf() (model.DFDiskSpace, error)
 }
@@ -66,14 +86,18 @@ type diskService struct {
 }
 
 const (
-	PersistentTypeNone   = "none"
-	PersistentTypeFStab  = "fstab"
-	PersistentTypeCasaOS = "casaos"
+	PersistentTypeNone    = "none"
+	PersistentTypeFStab   = "fstab"
+	PersistentTypeCasaOS  = "casaos"
+	PersistentTypeSystemd = "systemd"
 )
 
 var (
-	ErrVolumeWithEmptyUUID = errors.New("cannot save volume with empty uuid")
-	json2                  = jsoniter.ConfigCompatibleWithStandardLibrary
+	ErrVolumeWithEmptyUUID         = errors.New("cannot save volume with empty uuid")
+	ErrVolumeNotFound              = errors.New("volume not found")
+	ErrPersistentTypeNotSupported  = errors.New("persistent type should be either casaos or systemd")
+	ErrSystemdNotSupportedForCrypt = errors.New("systemd persistence is not supported for encrypted volumes")
+	json2                          = jsoniter.ConfigCompatibleWithStandardLibrary
 )
 
 func (d *diskService) EnsureDefaultMergePoint() bool {
@@ -82,7 +106,8 @@ func (d *diskService) EnsureDefaultMergePoint() bool {
 
 	existingMerges, err := MyService.LocalStorage().GetMergeAllFromDB(&mountPoint)
 	if err != nil {
-		panic(err)
+		logger.Error("error when getting default merge point from db", zap.Error(err), zap.String("mount point", mountPoint))
+		return false
 	}
 
 	// check if /DATA is already a merge point
@@ -106,7 +131,8 @@ func (d *diskService) EnsureDefaultMergePoint() bool {
 			logger.Error("Mount point "+mountPoint+" is not empty", zap.String("mount point", mountPoint))
 			return false
 		} else {
-			panic(err)
+			logger.Error("error when creating default merge point", zap.Error(err), zap.String("mount point", mountPoint))
+			return false
 		}
 	}
 
@@ -139,12 +165,87 @@ func (d *diskService) EnsureDefaultMergePoint() bool {
 	// }
 
 	if err := MyService.LocalStorage().CreateMergeInDB(merge); err != nil {
-		panic(err)
+		logger.Error("error when saving default merge point to db", zap.Error(err), zap.String("mount point", mountPoint))
+		return false
 	}
 	config.ServerInfo.EnableMergerFS = "true"
 	return true
 }
 
+// AssignMountPoint returns the mount point for partition part of disk, rendered from the mount point template, or the one already
+// assigned to it if it was mounted before, so that the path of a volume does not change once assigned.
+//
+// If name is given, MountPointTemplate is used, otherwise AutoMountPointTemplate.
+func (d *diskService) AssignMountPoint(disk, part model.LSBLKModel, name string) string {
+	volumes, err := d.GetSerialAllFromDB()
+	if err != nil {
+		logger.Error("error when getting all volumes from db", zap.Error(err))
+	}
+
+	if part.UUID != "" {
+		for _, volume := range volumes {
+			if volume.UUID == part.UUID && volume.MountPoint != "" {
+				return volume.MountPoint
+			}
+		}
+	}
+
+	template := config.ServerInfo.AutoMountPointTemplate
+	defaultTemplate := mountpoint.DefaultAutoTemplate
+	if name != "" {
+		template = config.ServerInfo.MountPointTemplate
+		defaultTemplate = mountpoint.DefaultTemplate
+	}
+
+	values := mountpoint.Values{
+		Name:   name,
+		Label:  part.Label,
+		Model:  part.Model,
+		Serial: part.Serial,
+		Vendor: part.Vendor,
+		UUID:   part.UUID,
+		Device: part.Name,
+	}
+
+	// model, serial and vendor are only reported for the disk
+	if values.Model == "" {
+		values.Model = disk.Model
+	}
+	if values.Serial == "" {
+		values.Serial = disk.Serial
+	}
+	if values.Vendor == "" {
+		values.Vendor = disk.Vendor
+	}
+
+	path, err := mountpoint.Render(template, values)
+	if err != nil {
+		logger.Error("error when rendering mount point template - using default template", zap.Error(err), zap.String("template", template))
+		if path, err = mountpoint.Render(defaultTemplate, values); err != nil {
+			path = filepath.Join("/media", part.Name)
+		}
+	}
+
+	return mountpoint.Resolve(path, part.UUID, func(path string) bool {
+		for _, volume := range volumes {
+			if volume.MountPoint == path && volume.UUID != part.UUID {
+				return true
+			}
+		}
+
+		if mounted, err := mountinfo.Mounted(path); err == nil && mounted {
+			return true
+		}
+
+		if file.Exists(path) {
+			empty, err := file.IsDirEmpty(path)
+			return err != nil || !empty
+		}
+
+		return false
+	})
+}
+
 func (d *diskService) RemoveLSBLKCache() {
 	key := "system_lsblk"
 	Cache.Delete(key)
@@ -215,9 +316,9 @@ func (d *diskService) FormatDisk(path string) error {
 	return nil
 }
 
-// 移除挂载点,删除目录
+// 移除挂载点,删除目录 - those not mounted anymore are left alone, so that this can be retried once some are umounted
 func (d *diskService) UmountPointAndRemoveDir(m model.LSBLKModel) error {
-	if len(m.MountPoint) > 0 {
+	if len(m.MountPoint) > 0 && stillMounted(m.MountPoint) {
 		if err := mount.UmountByMountPoint(m.MountPoint); err != nil {
 			logger.Error("error when umounting partition", zap.Error(err), zap.String("path", m.Path), zap.String("mount point", m.MountPoint))
 			return err
@@ -228,8 +329,7 @@ func (d *diskService) UmountPointAndRemoveDir(m model.LSBLKModel) error {
 		}
 	}
 	for _, p := range m.Children {
-		if len(p.MountPoint) > 0 {
-
+		if len(p.MountPoint) > 0 && stillMounted(p.MountPoint) {
 			if err := mount.UmountByMountPoint(p.MountPoint); err != nil {
 				logger.Error("error when umounting partition", zap.Error(err), zap.String("path", p.Path), zap.String("mount point", p.MountPoint))
 				return err
@@ -239,11 +339,54 @@ func (d *diskService) UmountPointAndRemoveDir(m model.LSBLKModel) error {
 				return err
 			}
 		}
+
+		if p.FsType == luks.FSType {
+			if err := d.umountAndCloseLUKS(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.FsType == luks.FSType {
+		return d.umountAndCloseLUKS(m)
+	}
+
+	return nil
+}
+
+// umount the opened container of a LUKS partition, if any, and close it
+func (d *diskService) umountAndCloseLUKS(m model.LSBLKModel) error {
+	for _, c := range m.Children {
+		if len(c.MountPoint) > 0 && stillMounted(c.MountPoint) {
+			if err := mount.UmountByMountPoint(c.MountPoint); err != nil {
+				logger.Error("error when umounting encrypted volume", zap.Error(err), zap.String("path", c.Path), zap.String("mount point", c.MountPoint))
+				return err
+			}
+		}
+
+		if !luks.IsOpen(c.Name) {
+			continue
+		}
+
+		if err := luks.Close(c.Name); err != nil {
+			logger.Error("error when closing LUKS2 container", zap.Error(err), zap.String("path", m.Path), zap.String("mapper name", c.Name))
+			return err
+		}
 	}
 
 	return nil
 }
 
+// stillMounted tells if mountPoint, as listed by lsblk, is mounted yet - it is, as far as umounting goes, if that cannot be told.
+func stillMounted(mountPoint string) bool {
+	mounted, err := mountinfo.Mounted(mountPoint)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+
+	return err != nil || mounted
+}
+
 // part
 func (d *diskService) AddPartition(path string) error {
 	logger.Info("creating partition table...", zap.String("path", path))
@@ -442,6 +585,12 @@ func (d *diskService) MountDisk(path, mountPoint string) (string, error) {
 		return out, err
 	}
 
+	if propagates, err := mount.IsPropagatingToBindMounts(mountPoint); err != nil {
+		logger.Error("error when checking if mount propagates to bind mounts", zap.Error(err), zap.String("mount point", mountPoint))
+	} else if !propagates {
+		logger.Info("mounted, but parent mount is not shared - bind mounts of it made earlier, e.g. by app containers, will not see it until made again", zap.String("mount point", mountPoint))
+	}
+
 	// return "", partition.ProbePartition(path)
 	return "", nil
 }
@@ -462,16 +611,126 @@ func (d *diskService) SaveMountPointToDB(m model2.Volume) error {
 
 	if result.RowsAffected > 0 {
 		m.ID = existing.ID
+		keepVolumeFields(&m, existing)
 	}
 
+	describeVolume(&m)
+
 	if result := d.db.Save(&m); result.Error != nil {
 		logger.Error("error when saving volume to db", zap.Error(result.Error), zap.Any("volume", m))
 		return result.Error
 	}
 
+	if config.ServerInfo.PersistentType == PersistentTypeSystemd && m.CryptUUID == "" {
+		// the volume is still restored by this service if this fails
+		if err := d.SetPersistentType(m.UUID, PersistentTypeSystemd, false); err != nil {
+			logger.Error("error when persisting volume with systemd", zap.Error(err), zap.Any("volume", m))
+		}
+	}
+
 	return nil
 }
 
+// keepVolumeFields fills in the fields of m left unset by its caller, which builds the volume from scratch, from
+// existing - or they would be lost whenever the device is absent, as describeVolume then leaves them as they are.
+func keepVolumeFields(m *model2.Volume, existing model2.Volume) {
+	if m.CryptUUID == "" {
+		m.CryptUUID = existing.CryptUUID
+		m.AutoUnlock = existing.AutoUnlock
+	}
+
+	keep(&m.CreatedAt, existing.CreatedAt)
+	keep(&m.FSType, existing.FSType)
+	keep(&m.Label, existing.Label)
+	keep(&m.Size, existing.Size)
+	keep(&m.DiskID, existing.DiskID)
+	keep(&m.MountOptions, existing.MountOptions)
+	keep(&m.LastSeenAt, existing.LastSeenAt)
+	keep(&m.Notes, existing.Notes)
+}
+
+func keep[T comparable](value *T, existing T) {
+	var zero T
+	if *value == zero {
+		*value = existing
+	}
+}
+
+// describeVolume fills in what is on the system about m, as it is seen now - whatever cannot be found is left as it was.
+func describeVolume(m *model2.Volume) {
+	if !volumePresent(*m) {
+		return
+	}
+
+	m.LastSeenAt = time.Now().Unix()
+
+	// the filesystem of an encrypted volume is not there until it is unlocked
+	devicePath, err := partition.GetDevicePath(m.UUID)
+	if err != nil || devicePath == "" {
+		return
+	}
+
+	if filesystem, err := partition.GetFilesystem(devicePath); err != nil {
+		logger.Error("error when getting filesystem of volume", zap.Error(err), zap.String("uuid", m.UUID), zap.String("path", devicePath))
+	} else if filesystem != nil {
+		m.FSType = filesystem.Type
+		m.Label = filesystem.Label
+		m.Size = filesystem.Size
+	}
+
+	if disk, err := partition.GetDiskOf(devicePath); err != nil {
+		logger.Error("error when getting disk of volume", zap.Error(err), zap.String("uuid", m.UUID), zap.String("path", devicePath))
+	} else if disk != nil && disk.ID != "" {
+		m.DiskID = disk.ID
+	}
+
+	if mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(m.MountPoint)); err == nil && len(mounts) > 0 {
+		m.MountOptions = mounts[len(mounts)-1].Options
+	}
+}
+
+func (d *diskService) RefreshVolumesInDB() {
+	volumes, err := d.GetSerialAllFromDB()
+	if err != nil {
+		return
+	}
+
+	for _, volume := range volumes {
+		lastSeenAt := volume.LastSeenAt
+
+		describeVolume(&volume)
+		if volume.LastSeenAt == lastSeenAt {
+			continue // not present
+		}
+
+		if result := d.db.Save(&volume); result.Error != nil {
+			logger.Error("error when refreshing volume in db", zap.Error(result.Error), zap.Any("volume", volume))
+		}
+	}
+}
+
+func (d *diskService) SetVolumeNotes(uuid, notes string) (*model2.Volume, error) {
+	var volume model2.Volume
+
+	result := d.db.Where(&model2.Volume{UUID: uuid}).Limit(1).Find(&volume)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, ErrVolumeNotFound
+	}
+
+	if result := d.db.Model(&volume).Update("notes", notes); result.Error != nil {
+		logger.Error("error when updating notes of volume in db", zap.Error(result.Error), zap.String("uuid", uuid))
+		return nil, result.Error
+	}
+
+	volume.Notes = notes
+
+	return &volume, nil
+}
+
 func (d *diskService) UpdateMountPointInDB(m model2.Volume) error {
 	result := d.db.Model(&model2.Volume{}).Where(&model2.Volume{UUID: m.UUID}).Update("mount_point", m.MountPoint)
 	if result.Error != nil {
@@ -518,6 +777,12 @@ func (d *diskService) DeleteMountPointFromDB(path, mountPoint string) error {
 		return result.Error
 	}
 
+	for _, volume := range existingVolumes {
+		if err := d.uninstallMountUnit(volume.MountPoint); err != nil {
+			logger.Error("error when removing mount unit of volume", zap.Error(err), zap.Any("volume", volume))
+		}
+	}
+
 	return nil
 }
 
@@ -534,10 +799,22 @@ func (d *diskService) GetSerialAllFromDB() ([]model2.Volume, error) {
 }
 
 func (d *diskService) GetPersistentTypeByUUID(uuid string) string {
+	// check if there is a mount unit for it, before database, as the volume is in database either way
+	if units, err := systemd.List(); err != nil {
+		logger.Error("error when listing mount units", zap.Error(err))
+	} else {
+		for _, u := range units {
+			if u.What == mountUnitWhat(uuid) {
+				return PersistentTypeSystemd
+			}
+		}
+	}
+
 	// check if path is in database
 	var m model2.Volume
 
-	if result := d.db.Where(&model2.Volume{UUID: uuid}).Limit(1).Find(&m); result.Error != nil {
+	// for an encrypted volume, uuid could be either of the filesystem or of the LUKS container
+	if result := d.db.Where(&model2.Volume{UUID: uuid}).Or(&model2.Volume{CryptUUID: uuid}).Limit(1).Find(&m); result.Error != nil {
 		logger.Error("error when finding the volume by uuid in database", zap.Error(result.Error), zap.String("uuid", uuid))
 	} else if result.RowsAffected > 0 {
 		return PersistentTypeCasaOS
@@ -554,27 +831,89 @@ func (d *diskService) GetPersistentTypeByUUID(uuid string) string {
 	return PersistentTypeNone
 }
 
-func (d *diskService) CheckSerialDiskMount() {
-	logger.Info("Checking serial disk mount...")
+func (d *diskService) SetPersistentType(uuid, persistentType string, automount bool) error {
+	var volume model2.Volume
+
+	result := d.db.Where(&model2.Volume{UUID: uuid}).Limit(1).Find(&volume)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrVolumeNotFound
+	}
+
+	switch persistentType {
+	case PersistentTypeCasaOS:
+		return d.uninstallMountUnit(volume.MountPoint)
+
+	case PersistentTypeSystemd:
+		if volume.CryptUUID != "" {
+			return ErrSystemdNotSupportedForCrypt
+		}
+
+		devicePath, err := partition.GetDevicePath(uuid)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), systemd.DefaultDeviceTimeout)
+		defer cancel()
+
+		logger.Info("persisting volume with systemd...", zap.String("uuid", uuid), zap.String("mount point", volume.MountPoint), zap.Bool("automount", automount))
+		return systemd.Install(ctx, systemd.MountUnit{
+			What:      mountUnitWhat(uuid),
+			Where:     volume.MountPoint,
+			Type:      d.GetDiskInfo(devicePath).FsType,
+			Automount: automount,
+		})
+	}
+
+	return ErrPersistentTypeNotSupported
+}
 
-	// check mount point
-	dbList, err := d.GetSerialAllFromDB()
+func (d *diskService) uninstallMountUnit(mountPoint string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), systemd.DefaultDeviceTimeout)
+	defer cancel()
+
+	if err := systemd.Uninstall(ctx, mountPoint); err != nil && !errors.Is(err, systemd.ErrUnitNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// systemdVolumes returns the UUIDs of the volumes persisted with a systemd mount unit, which are mounted by systemd rather
+// than by this service.
+func systemdVolumes() map[string]bool {
+	units, err := systemd.List()
 	if err != nil {
-		logger.Error("error when getting all volumes from db", zap.Error(err))
-		return
+		logger.Error("error when listing mount units", zap.Error(err))
+		return nil
+	}
+
+	uuids := make(map[string]bool, len(units))
+	for _, u := range units {
+		if uuid, found := strings.CutPrefix(u.What, mountUnitWhat("")); found {
+			uuids[uuid] = true
+		}
 	}
 
+	return uuids
+}
+
+// by UUID, so that the unit does not depend on device names, which may change between boots
+func mountUnitWhat(uuid string) string {
+	return "/dev/disk/by-uuid/" + uuid
+}
+
+func (d *diskService) CheckSerialDiskMount() {
+	logger.Info("Checking serial disk mount...")
+
 	list := d.LSBLK(true)
-	mountPointMap := make(map[string]string, len(dbList))
 
 	defer d.RemoveLSBLKCache()
 
-	// remount
-	for _, v := range dbList {
-		logger.Info("previously persisted mount point", zap.Any("volume", v))
-		mountPointMap[v.UUID] = v.MountPoint
-	}
-
 	for _, currentDisk := range list {
 		output, err := command.ExecEnabledSMART(currentDisk.Path)
 		if err != nil {
@@ -584,56 +923,14 @@ func (d *diskService) CheckSerialDiskMount() {
 				logger.Error("failed to enable S.M.A.R.T", zap.Error(err), zap.String("path", currentDisk.Path))
 			}
 		}
+	}
 
-		for _, blkChild := range currentDisk.Children {
-			m, ok := mountPointMap[blkChild.UUID]
-			if !ok {
-				continue
-			}
-			if blkChild.MountPoint == m {
-				continue
-			}
-			logger.Info("trying to re-mount...", zap.String("path", blkChild.Path), zap.String("mount point", m))
-			// mount point check
-			mountPoint := m
-			mount.UmountByMountPoint(m)
-			dir, _ := ioutil.ReadDir(m)
-			if len(dir) > 0 {
-				i := 1
-				for {
-					mountPoint = m + "-" + strconv.Itoa(i)
-					if file.CheckNotExist(mountPoint) {
-						break
-					}
-					i++
-				}
-				logger.Info("mount point already exists, using new mount point", zap.String("path", blkChild.Path), zap.String("mount point", mountPoint))
-			}
-
-			if output, err := d.MountDisk(blkChild.Path, mountPoint); err != nil {
-				logger.Error(output, zap.Error(err), zap.String("path", blkChild.Path), zap.String("volume", mountPoint))
-			}
-
-			// obtain the actual mount path (just in case)
-			partitions, err := partition.GetPartitions(blkChild.Path)
-			if err != nil {
-				logger.Error("error when getting partitions by path", zap.Error(err), zap.String("path", blkChild.Path))
-				continue
-			}
-
-			mountPoint = partitions[0].LSBLKProperties["MOUNTPOINT"]
-
-			if mountPoint != m {
-				v := model2.Volume{
-					UUID:       blkChild.UUID,
-					MountPoint: mountPoint,
-				}
-				if err := d.UpdateMountPointInDB(v); err != nil {
-					logger.Error("error when updating mount point in db", zap.Error(err), zap.Any("volume", v))
-				}
-			}
-		}
+	// remount previously persisted volumes
+	if _, err := MyService.Reconciler().Apply(ManagedMountTypeVolume); err != nil {
+		logger.Error("error when reconciling volumes", zap.Error(err))
 	}
+
+	d.RefreshVolumesInDB()
 }
 
 func (d *diskService) GetUSBDriveStatusList() []model.USBDriveStatus {
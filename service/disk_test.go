@@ -2,9 +2,13 @@ package service
 
 import (
 	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/model"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
 	"gotest.tools/v3/assert"
 )
 
@@ -39,3 +43,81 @@ func TestParseBlockDevices(t *testing.T) {
 	assert.Equal(t, blkList[0].FSAvail.String(), "965102444544")
 	assert.Equal(t, blkList[0].FSUsed.String(), "8229834752")
 }
+
+func TestSaveMountPointToDBAbsent(t *testing.T) {
+	db := newTestDB(t)
+	disk := NewDiskService(db)
+
+	// no such device, as far as this system is concerned
+	existing := model2.Volume{
+		UUID:         "0c1d2e3f-4a5b-4c6d-8e7f-8091a2b3c4d5",
+		MountPoint:   "/media/Backup",
+		CreatedAt:    1700000000,
+		FSType:       "ext4",
+		Label:        "Backup",
+		Size:         4000787030016,
+		DiskID:       "ata-WDC_WD40EFRX-68N32N0_WD-WCC7K0000000",
+		MountOptions: "rw,relatime",
+		LastSeenAt:   1710000000,
+		Notes:        "top shelf",
+	}
+	assert.NilError(t, db.Create(&existing).Error)
+
+	// as the callers build it
+	assert.NilError(t, disk.SaveMountPointToDB(model2.Volume{UUID: existing.UUID, MountPoint: "/media/Backup-1"}))
+
+	var saved model2.Volume
+	assert.NilError(t, db.First(&saved, existing.ID).Error)
+
+	expected := existing
+	expected.MountPoint = "/media/Backup-1"
+	assert.DeepEqual(t, saved, expected)
+}
+
+func TestUmountPointAndRemoveDirNotMounted(t *testing.T) {
+	logger.LogInitConsoleOnly()
+
+	// e.g. umounted before a sibling was found busy, and umount is retried
+	mountPoint := t.TempDir()
+
+	m := model.LSBLKModel{
+		Path: "/dev/sdz",
+		Children: []model.LSBLKModel{
+			{Path: "/dev/sdz1", MountPoint: mountPoint},
+			{Path: "/dev/sdz2", MountPoint: filepath.Join(mountPoint, "gone")},
+		},
+	}
+
+	assert.NilError(t, (&diskService{}).UmountPointAndRemoveDir(m))
+
+	// not removed either, as whatever is there is not on the partition
+	_, err := os.Stat(mountPoint)
+	assert.NilError(t, err)
+}
+
+func TestRefreshVolumesInDBLocked(t *testing.T) {
+	db := newTestDB(t)
+	disk := NewDiskService(db)
+
+	locked := model2.Volume{
+		UUID:       "6a7b8c9d-0e1f-4a2b-8c3d-4e5f6a7b8c9d",
+		CryptUUID:  "6a7b8c9d-0e1f-4a2b-8c3d-4e5f6a7b8c9e",
+		MountPoint: "/media/Vault",
+		LastSeenAt: 1710000000,
+	}
+	assert.NilError(t, db.Create(&locked).Error)
+
+	// only the LUKS container is there, as its filesystem is not until it is unlocked
+	bin := t.TempDir()
+	blkid := "#!/bin/sh\n" +
+		"[ \"$2\" = \"" + locked.CryptUUID + "\" ] && echo /dev/sdz1 && exit 0\n" +
+		"exit 2\n"
+	assert.NilError(t, os.WriteFile(filepath.Join(bin, "blkid"), []byte(blkid), 0o755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	disk.RefreshVolumesInDB()
+
+	var refreshed model2.Volume
+	assert.NilError(t, db.First(&refreshed, locked.ID).Error)
+	assert.Assert(t, refreshed.LastSeenAt > locked.LastSeenAt)
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"go.uber.org/zap"
+)
+
+const EventMergeStatus = common.ServiceName + ":merge_status"
+
+var (
+	ErrVolumeNotInMerge = errors.New("volume is not a source of the merge")
+	ErrBranchNotEmpty   = errors.New("files are left on the volume")
+)
+
+func (r *rebalanceService) Drain(mountPoint, uuid string, bytesPerSecond int64) (*RebalanceStatus, error) {
+	merge, err := MyService.LocalStorage().GetFirstMergeFromDB(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if merge == nil {
+		return nil, v2.ErrMergeMountPointDoesNotExist
+	}
+
+	if err := snapraidRunning(*merge); err != nil {
+		return nil, err
+	}
+
+	volume := drainVolume(merge, uuid)
+	if volume == nil {
+		return nil, ErrVolumeNotInMerge
+	}
+
+	branches, err := mergerfs.GetBranches(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, branch := range branches {
+		found = found || branch.Path == volume.MountPoint
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%w: %s is not mounted in the merge", ErrVolumeNotInMerge, volume.MountPoint)
+	}
+
+	ctx, status, err := r.begin(RebalanceStatus{
+		JobState:   JobState{MountPoint: mountPoint},
+		Operation:  RebalanceOperationDrain,
+		VolumeUUID: uuid,
+		Options:    RebalanceOptions{BytesPerSecond: bytesPerSecond},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("draining volume of merge...", zap.String("mount point", mountPoint), zap.String("uuid", uuid), zap.String("volume mount point", volume.MountPoint))
+
+	go r.drain(ctx, mountPoint, uuid, volume.MountPoint, branches, bytesPerSecond)
+
+	return status, nil
+}
+
+func (r *rebalanceService) drain(ctx context.Context, mountPoint, uuid, from string, branches []mergerfs.Branch, bytesPerSecond int64) {
+	usages, err := mergerfs.GetBranchUsages(branches)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+
+	r.update(func(status *RebalanceStatus) {
+		status.Branches = rebalanceBranches(usages)
+	})
+
+	scan, err := mergerfs.ScanBranch(ctx, from)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+
+	minFreeSpace, err := mergerfs.GetMinFreeSpace(mountPoint)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+
+	// check the free space up front, before anything is changed
+	moves, err := mergerfs.PlanDrain(from, usages, scan.Files, minFreeSpace)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+
+	if len(scan.Others) > 0 {
+		r.finish(fmt.Errorf("%w: %d special files, e.g. %s, cannot be moved", ErrBranchNotEmpty, len(scan.Others), scan.Others[0]))
+		return
+	}
+
+	r.update(func(status *RebalanceStatus) {
+		status.State = RebalanceStateMoving
+		status.PlannedFiles = len(moves)
+		for _, move := range moves {
+			status.PlannedBytes += move.Size
+		}
+	})
+
+	// no new file is created on the volume from now on, while existing ones can still be changed until they are moved
+	if err := r.updateDrainedMerge(mountPoint, uuid, false); err != nil {
+		r.finish(err)
+		return
+	}
+
+	if to := drainDirDestination(usages, from); to != "" {
+		if err := mergerfs.CopyDirs(from, to, scan.Dirs); err != nil {
+			r.finish(err)
+			return
+		}
+	}
+
+	skipped, err := r.move(ctx, mountPoint, moves, bytesPerSecond)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+
+	// once more for files that were open - they could have been closed by now
+	if len(skipped) > 0 {
+		r.update(func(status *RebalanceStatus) {
+			status.SkippedFiles -= len(skipped)
+		})
+
+		if _, err := r.move(ctx, mountPoint, skipped, bytesPerSecond); err != nil {
+			r.finish(err)
+			return
+		}
+	}
+
+	// anything could have been added meanwhile through the branch path
+	scan, err = mergerfs.ScanBranch(ctx, from)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+
+	if left := len(scan.Files) + len(scan.Others); left > 0 {
+		r.finish(fmt.Errorf("%w: %d files - the volume stays in the merge as NC", ErrBranchNotEmpty, left))
+		return
+	}
+
+	if err := r.updateDrainedMerge(mountPoint, uuid, true); err != nil {
+		r.finish(err)
+		return
+	}
+
+	r.finish(nil)
+}
+
+// updateDrainedMerge sets the drained volume with uuid to NC, or removes it from the merge if it is done, and publishes
+// the merge status.
+func (r *rebalanceService) updateDrainedMerge(mountPoint, uuid string, done bool) error {
+	// again from database, in case it is changed meanwhile
+	merge, err := MyService.LocalStorage().GetFirstMergeFromDB(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	if merge == nil {
+		return v2.ErrMergeMountPointDoesNotExist
+	}
+
+	if done {
+		volumes := make([]*model2.Volume, 0, len(merge.SourceVolumes))
+		for _, volume := range merge.SourceVolumes {
+			if volume != nil && volume.UUID != uuid {
+				volumes = append(volumes, volume)
+			}
+		}
+		merge.SourceVolumes = volumes
+		delete(merge.Branches, uuid)
+	} else {
+		if merge.Branches == nil {
+			merge.Branches = make(map[string]model2.MergeBranch)
+		}
+
+		branch := merge.Branches[uuid]
+		branch.Mode = mergerfs.BranchModeNC
+		merge.Branches[uuid] = branch
+	}
+
+	if err := MyService.LocalStorage().UpdateMerge(merge); err != nil {
+		logger.Error("failed to update merge", zap.Error(err), zap.String("mount point", mountPoint))
+		return err
+	}
+
+	if err := MyService.LocalStorage().UpdateMergeSourcesInDB(merge); err != nil {
+		logger.Error("failed to update merge sources in database", zap.Error(err), zap.String("mount point", mountPoint))
+		return err
+	}
+
+	notifyMergeStatus(*merge)
+
+	return nil
+}
+
+func drainVolume(merge *model2.Merge, uuid string) *model2.Volume {
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil && volume.UUID == uuid {
+			return volume
+		}
+	}
+	return nil
+}
+
+// another RW branch, for the directories of the drained one, so that empty ones are kept
+func drainDirDestination(usages []mergerfs.BranchUsage, from string) string {
+	for _, usage := range usages {
+		if usage.Path != from && (usage.Mode == "" || usage.Mode == mergerfs.BranchModeRW) {
+			return usage.Path
+		}
+	}
+	return ""
+}
+
+func notifyMergeStatus(merge model2.Merge) {
+	sourceVolumeUUIDs := make([]string, 0, len(merge.SourceVolumes))
+	for _, volume := range merge.SourceVolumes {
+		sourceVolumeUUIDs = append(sourceVolumeUUIDs, volume.UUID)
+	}
+
+	message := map[string]interface{}{
+		"mount_point":         merge.MountPoint,
+		"source_base_path":    merge.SourceBasePath,
+		"source_volume_uuids": sourceVolumeUUIDs,
+		"fs_type":             merge.FSType,
+		"created_at":          merge.CreatedAt,
+		"updated_at":          merge.UpdatedAt,
+	}
+
+	if err := MyService.Notify().SendNotify(EventMergeStatus, message); err != nil {
+		logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventMergeStatus), zap.Any("message", message))
+	}
+}
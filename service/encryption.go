@@ -0,0 +1,327 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/model"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/luks"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/moby/sys/mountinfo"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	EventCryptStatus = common.ServiceName + ":crypt_status"
+
+	CryptStateLocked   = "locked"
+	CryptStateUnlocked = "unlocked"
+)
+
+var (
+	ErrEncryptedVolumeNotFound = errors.New("encrypted volume not found")
+	ErrPartitionIsMounted      = errors.New("partition is mounted - umount it first")
+)
+
+type EncryptionService interface {
+	// CreateEncryptedVolume formats the partition at path as a LUKS2 container with passphrase, makes a filesystem in it and mounts it
+	// as a volume. Anything on the partition is lost.
+	CreateEncryptedVolume(path, passphrase, name string, autoUnlock bool) (*EncryptedVolume, error)
+	GetEncryptedVolumes() ([]EncryptedVolume, error)
+	Unlock(cryptUUID, passphrase string) (*EncryptedVolume, error)
+	// UnlockWithKeyFile unlocks an encrypted volume with its key file, e.g. at boot, if auto-unlock is enabled for it.
+	UnlockWithKeyFile(cryptUUID string) (*EncryptedVolume, error)
+	Lock(cryptUUID string) (*EncryptedVolume, error)
+	SetAutoUnlock(cryptUUID, passphrase string, enabled bool) (*EncryptedVolume, error)
+}
+
+type EncryptedVolume struct {
+	CryptUUID  string `json:"crypt_uuid"`
+	UUID       string `json:"uuid"` // of the filesystem inside the container
+	Path       string `json:"path"` // of the container, e.g. /dev/sdb1
+	MapperPath string `json:"mapper_path"`
+	MountPoint string `json:"mount_point"`
+	Locked     bool   `json:"locked"`
+	Mounted    bool   `json:"mounted"`
+	AutoUnlock bool   `json:"auto_unlock"`
+}
+
+type encryptionService struct {
+	db *gorm.DB
+}
+
+func (e *encryptionService) CreateEncryptedVolume(path, passphrase, name string, autoUnlock bool) (*EncryptedVolume, error) {
+	part := MyService.Disk().GetDiskInfo(path)
+	if part.MountPoint != "" {
+		return nil, ErrPartitionIsMounted
+	}
+
+	logger.Info("formatting partition as LUKS2 container...", zap.String("path", path))
+	if err := luks.Format(path, passphrase); err != nil {
+		logger.Error("error when formatting partition as LUKS2 container", zap.Error(err), zap.String("path", path))
+		return nil, err
+	}
+
+	cryptUUID, err := luks.GetUUID(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mapperName := luks.MapperName(cryptUUID)
+	if err := luks.Open(path, mapperName, passphrase); err != nil {
+		logger.Error("error when opening LUKS2 container", zap.Error(err), zap.String("path", path))
+		return nil, err
+	}
+
+	volume, err := e.setupVolume(cryptUUID, name, part)
+	if err != nil {
+		e.discardVolume(cryptUUID, nil)
+		return nil, err
+	}
+
+	if autoUnlock {
+		if err := luks.AddKeyFile(path, passphrase, luks.KeyFilePath(cryptUUID)); err != nil {
+			logger.Error("error when adding key file to LUKS2 container", zap.Error(err), zap.String("path", path))
+			e.discardVolume(cryptUUID, volume)
+			return nil, err
+		}
+
+		volume.AutoUnlock = true
+	}
+
+	if err := MyService.Disk().SaveMountPointToDB(*volume); err != nil {
+		e.discardVolume(cryptUUID, volume)
+		return nil, err
+	}
+
+	e.notify(path, *volume, CryptStateUnlocked)
+
+	return e.encryptedVolume(*volume), nil
+}
+
+// discardVolume umounts volume, if it is mounted yet, closes the container with cryptUUID and removes its key file,
+// once creating the encrypted volume fails - so that nothing is left open for a container that is not saved.
+func (e *encryptionService) discardVolume(cryptUUID string, volume *model2.Volume) {
+	if volume != nil {
+		if err := mount.UmountByMountPoint(volume.MountPoint); err != nil {
+			logger.Error("error when umounting encrypted volume", zap.Error(err), zap.String("mount point", volume.MountPoint))
+		} else if err := os.Remove(volume.MountPoint); err != nil {
+			logger.Error("error when removing mount point", zap.Error(err), zap.String("mount point", volume.MountPoint))
+		}
+	}
+
+	mapperName := luks.MapperName(cryptUUID)
+	if err := luks.Close(mapperName); err != nil {
+		logger.Error("error when closing LUKS2 container", zap.Error(err), zap.String("mapper name", mapperName))
+	}
+
+	keyFile := luks.KeyFilePath(cryptUUID)
+	if err := os.Remove(keyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("error when removing key file", zap.Error(err), zap.String("key file", keyFile))
+	}
+}
+
+// make a filesystem in the opened container, and mount it as a volume
+func (e *encryptionService) setupVolume(cryptUUID, name string, part model.LSBLKModel) (*model2.Volume, error) {
+	mapperPath := luks.MapperPath(luks.MapperName(cryptUUID))
+
+	if err := partition.FormatPartition(mapperPath); err != nil {
+		logger.Error("error when making filesystem in LUKS2 container", zap.Error(err), zap.String("path", mapperPath))
+		return nil, err
+	}
+
+	uuid, err := partition.GetUUID(mapperPath)
+	if err != nil {
+		return nil, err
+	}
+
+	part.UUID = uuid
+	part.Label = ""
+
+	mountPoint := MyService.Disk().AssignMountPoint(part, part, name)
+	if output, err := MyService.Disk().MountDisk(mapperPath, mountPoint); err != nil {
+		logger.Error(output, zap.Error(err), zap.String("path", mapperPath), zap.String("mount point", mountPoint))
+		return nil, err
+	}
+
+	return &model2.Volume{
+		UUID:       uuid,
+		MountPoint: mountPoint,
+		CreatedAt:  time.Now().Unix(),
+		CryptUUID:  cryptUUID,
+	}, nil
+}
+
+func (e *encryptionService) GetEncryptedVolumes() ([]EncryptedVolume, error) {
+	var volumes []model2.Volume
+	if err := e.db.Where("crypt_uuid <> ''").Find(&volumes).Error; err != nil {
+		return nil, err
+	}
+
+	results := make([]EncryptedVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		results = append(results, *e.encryptedVolume(volume))
+	}
+
+	return results, nil
+}
+
+func (e *encryptionService) Unlock(cryptUUID, passphrase string) (*EncryptedVolume, error) {
+	return e.unlock(cryptUUID, func(device, mapperName string) error {
+		return luks.Open(device, mapperName, passphrase)
+	})
+}
+
+func (e *encryptionService) UnlockWithKeyFile(cryptUUID string) (*EncryptedVolume, error) {
+	return e.unlock(cryptUUID, func(device, mapperName string) error {
+		return luks.OpenWithKeyFile(device, mapperName, luks.KeyFilePath(cryptUUID))
+	})
+}
+
+func (e *encryptionService) unlock(cryptUUID string, open func(device, mapperName string) error) (*EncryptedVolume, error) {
+	volume, err := e.getVolume(cryptUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := partition.GetDevicePath(cryptUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	mapperName := luks.MapperName(cryptUUID)
+	if !luks.IsOpen(mapperName) {
+		if err := open(device, mapperName); err != nil {
+			logger.Error("error when opening LUKS2 container", zap.Error(err), zap.String("path", device))
+			return nil, err
+		}
+	}
+
+	if output, err := MyService.Disk().MountDisk(luks.MapperPath(mapperName), volume.MountPoint); err != nil {
+		logger.Error(output, zap.Error(err), zap.String("path", luks.MapperPath(mapperName)), zap.String("mount point", volume.MountPoint))
+		return nil, err
+	}
+
+	e.notify(device, *volume, CryptStateUnlocked)
+
+	return e.encryptedVolume(*volume), nil
+}
+
+func (e *encryptionService) Lock(cryptUUID string) (*EncryptedVolume, error) {
+	volume, err := e.getVolume(cryptUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if mounted, err := mountinfo.Mounted(volume.MountPoint); err == nil && mounted {
+		if err := mount.UmountByMountPoint(volume.MountPoint); err != nil {
+			logger.Error("error when umounting encrypted volume", zap.Error(err), zap.String("mount point", volume.MountPoint))
+			return nil, err
+		}
+	}
+
+	mapperName := luks.MapperName(cryptUUID)
+	if luks.IsOpen(mapperName) {
+		if err := luks.Close(mapperName); err != nil {
+			logger.Error("error when closing LUKS2 container", zap.Error(err), zap.String("mapper name", mapperName))
+			return nil, err
+		}
+	}
+
+	device, _ := partition.GetDevicePath(cryptUUID)
+	e.notify(device, *volume, CryptStateLocked)
+
+	return e.encryptedVolume(*volume), nil
+}
+
+func (e *encryptionService) SetAutoUnlock(cryptUUID, passphrase string, enabled bool) (*EncryptedVolume, error) {
+	volume, err := e.getVolume(cryptUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := partition.GetDevicePath(cryptUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		err = luks.AddKeyFile(device, passphrase, luks.KeyFilePath(cryptUUID))
+	} else {
+		err = luks.RemoveKeyFile(device, luks.KeyFilePath(cryptUUID))
+	}
+
+	if err != nil {
+		logger.Error("error when updating key file of LUKS2 container", zap.Error(err), zap.String("path", device), zap.Bool("enabled", enabled))
+		return nil, err
+	}
+
+	if err := e.db.Model(volume).Update("auto_unlock", enabled).Error; err != nil {
+		return nil, err
+	}
+
+	volume.AutoUnlock = enabled
+
+	return e.encryptedVolume(*volume), nil
+}
+
+func (e *encryptionService) getVolume(cryptUUID string) (*model2.Volume, error) {
+	var volume model2.Volume
+
+	result := e.db.Where(&model2.Volume{CryptUUID: cryptUUID}).Limit(1).Find(&volume)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, ErrEncryptedVolumeNotFound
+	}
+
+	return &volume, nil
+}
+
+func (e *encryptionService) encryptedVolume(volume model2.Volume) *EncryptedVolume {
+	mapperName := luks.MapperName(volume.CryptUUID)
+
+	result := &EncryptedVolume{
+		CryptUUID:  volume.CryptUUID,
+		UUID:       volume.UUID,
+		MapperPath: luks.MapperPath(mapperName),
+		MountPoint: volume.MountPoint,
+		Locked:     !luks.IsOpen(mapperName),
+		AutoUnlock: volume.AutoUnlock,
+	}
+
+	if device, err := partition.GetDevicePath(volume.CryptUUID); err == nil {
+		result.Path = device
+	}
+
+	if mounted, err := mountinfo.Mounted(volume.MountPoint); err == nil {
+		result.Mounted = mounted && !result.Locked
+	}
+
+	return result
+}
+
+func (e *encryptionService) notify(path string, volume model2.Volume, state string) {
+	message := map[string]interface{}{
+		"crypt_uuid":  volume.CryptUUID,
+		"path":        path,
+		"mount_point": volume.MountPoint,
+		"state":       state,
+	}
+
+	if err := MyService.Notify().SendNotify(EventCryptStatus, message); err != nil {
+		logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventCryptStatus), zap.Any("message", message))
+	}
+}
+
+func NewEncryptionService(db *gorm.DB) EncryptionService {
+	return &encryptionService{db: db}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	JobStateScanning  = "scanning"
+	JobStateDone      = "done"
+	JobStateCancelled = "cancelled"
+	JobStateFailed    = "failed"
+)
+
+// JobState is the state of a background job on a merge, e.g. a rebalance or a conflict scan, as part of its status.
+type JobState struct {
+	MountPoint string    `json:"mount_point"`
+	State      string    `json:"state"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (s *JobState) jobState() *JobState {
+	return s
+}
+
+// jobStatus is a pointer to the status of a background job, which has its JobState.
+type jobStatus[S any] interface {
+	*S
+	jobState() *JobState
+}
+
+// job runs one background job at a time, and keeps the status of the running one, or of the last one.
+type job[S any, P jobStatus[S]] struct {
+	mu     sync.Mutex
+	status *S
+	cancel context.CancelFunc
+
+	name        func(status S) string // e.g. rebalance, for logging
+	errRunning  error                 // returned by begin while a job is running
+	errNotFound error                 // returned by Status and Cancel until a job is begun
+	notify      func(status S)
+}
+
+// begin records status as the status of a new job, unless a job is running, and returns the context the job is to run with.
+func (j *job[S, P]) begin(status S) (context.Context, *S, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status != nil && j.cancel != nil {
+		return nil, nil, j.errRunning
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	state := P(&status).jobState()
+	state.State = JobStateScanning
+	state.StartedAt = time.Now()
+	j.status = &status
+
+	j.notify(status)
+
+	result := status
+	return ctx, &result, nil
+}
+
+func (j *job[S, P]) Status() (*S, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status == nil {
+		return nil, j.errNotFound
+	}
+
+	status := *j.status
+	return &status, nil
+}
+
+func (j *job[S, P]) Cancel() (*S, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status == nil {
+		return nil, j.errNotFound
+	}
+
+	if j.cancel != nil {
+		logger.Info("cancelling "+j.name(*j.status)+"...", zap.String("mount point", P(j.status).jobState().MountPoint))
+		j.cancel()
+	}
+
+	status := *j.status
+	return &status, nil
+}
+
+func (j *job[S, P]) update(f func(status *S)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f(j.status)
+}
+
+// finish records the outcome of the job, as of err, and returns its final status once notified.
+func (j *job[S, P]) finish(err error) S {
+	j.mu.Lock()
+
+	state := P(j.status).jobState()
+	state.State = JobStateDone
+	state.FinishedAt = time.Now()
+
+	if errors.Is(err, context.Canceled) {
+		state.State = JobStateCancelled
+	} else if err != nil {
+		state.State = JobStateFailed
+		state.Error = err.Error()
+	}
+
+	j.cancel = nil
+	status := *j.status
+
+	j.mu.Unlock()
+
+	j.notify(status)
+
+	return status
+}
+
+// Running tells if the job is running, as of its state.
+func (state JobState) Running() bool {
+	return state.State != JobStateDone && state.State != JobStateCancelled && state.State != JobStateFailed
+}
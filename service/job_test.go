@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestJob(t *testing.T) {
+	notified := make([]string, 0)
+
+	j := job[ConflictStatus, *ConflictStatus]{
+		name:        func(ConflictStatus) string { return "test" },
+		errRunning:  ErrConflictScanRunning,
+		errNotFound: ErrConflictScanNotFound,
+		notify:      func(status ConflictStatus) { notified = append(notified, status.State) },
+	}
+
+	_, err := j.Status()
+	assert.ErrorIs(t, err, ErrConflictScanNotFound)
+
+	ctx, status, err := j.begin(ConflictStatus{JobState: JobState{MountPoint: "/mnt/merge"}})
+	assert.NilError(t, err)
+	assert.Equal(t, status.State, JobStateScanning)
+	assert.Assert(t, status.Running())
+
+	_, _, err = j.begin(ConflictStatus{JobState: JobState{MountPoint: "/mnt/merge"}})
+	assert.ErrorIs(t, err, ErrConflictScanRunning)
+
+	_, err = j.Cancel()
+	assert.NilError(t, err)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	final := j.finish(ctx.Err())
+	assert.Equal(t, final.State, JobStateCancelled)
+	assert.Assert(t, !final.Running())
+
+	// a new job can begin once the last one is finished
+	_, _, err = j.begin(ConflictStatus{JobState: JobState{MountPoint: "/mnt/merge"}})
+	assert.NilError(t, err)
+
+	final = j.finish(errors.New("failed"))
+	assert.Equal(t, final.State, JobStateFailed)
+	assert.Equal(t, final.Error, "failed")
+
+	assert.DeepEqual(t, notified, []string{JobStateScanning, JobStateCancelled, JobStateScanning, JobStateFailed})
+}
@@ -5,8 +5,12 @@ import "time"
 const (
 	MergeSourceBasePath = "SourceBasePath"
 	MergeSourceVolumes  = "SourceVolumes"
+	MergeBranches       = "Branches"
 )
 
+// columns of the mergerfs options of a merge
+var MergeOptionColumns = []string{"CreatePolicy", "MinFreeSpace", "MoveOnENOSPC", "CacheFiles", "FuncPolicies"}
+
 // Merge
 type Merge struct {
 	ID             uint      `gorm:"primarykey"`
@@ -14,8 +18,25 @@ type Merge struct {
 	MountPoint     string    `json:"mount_point" gorm:"uniqueIndex,check:mount_point<>''"`
 	SourceBasePath *string   `json:"source_base_path"`
 	SourceVolumes  []*Volume `json:"source_volumes" gorm:"many2many:o_merge_disk;"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+
+	// how each source volume is used, by UUID - a volume not in it is RW
+	Branches map[string]MergeBranch `json:"branches" gorm:"serializer:json"`
+
+	// mergerfs policies and options - empty means the default
+	CreatePolicy string            `json:"create_policy"` // category.create
+	MinFreeSpace string            `json:"min_free_space"`
+	MoveOnENOSPC *bool             `json:"move_on_enospc" gorm:"column:move_on_enospc"`
+	CacheFiles   string            `json:"cache_files"`
+	FuncPolicies map[string]string `json:"func_policies" gorm:"serializer:json"` // func.<function>, e.g. getattr -> newest
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// MergeBranch is the mode and minfreespace of a source volume in a merge
+type MergeBranch struct {
+	Mode         string `json:"mode,omitempty"` // RW, RO or NC
+	MinFreeSpace string `json:"min_free_space,omitempty"`
 }
 
 func (p *Merge) TableName() string {
@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// SnapRAID is the parity of a merge, kept by SnapRAID on dedicated parity volumes
+type SnapRAID struct {
+	ID            uint     `gorm:"primarykey"`
+	MergeID       uint     `json:"merge_id" gorm:"uniqueIndex"`
+	DataVolumes   []string `json:"data_volumes" gorm:"serializer:json"`   // UUIDs of source volumes of the merge
+	ParityVolumes []string `json:"parity_volumes" gorm:"serializer:json"` // UUIDs of volumes in no merge, one per parity level
+	Excludes      []string `json:"excludes" gorm:"serializer:json"`       // on top of the default ones
+
+	// cron specs, e.g. 0 3 * * * - empty means never
+	SyncSchedule  string `json:"sync_schedule"`
+	ScrubSchedule string `json:"scrub_schedule"`
+	ScrubPercent  int    `json:"scrub_percent"` // of the array to scrub each time - 0 means the SnapRAID default
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (p *SnapRAID) TableName() string {
+	return "o_snapraid"
+}
@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+// USBRule is what to do with a USB partition as it is plugged in, when it matches
+type USBRule struct {
+	ID       uint   `gorm:"primarykey" json:"id"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"` // rules are evaluated in ascending order of priority, the first one to match wins
+
+	// globs matched case-insensitively against the udev properties of the partition, e.g. Backup* - empty matches anything
+	VendorID  string `json:"vendor_id"`  // ID_VENDOR_ID, e.g. 0781
+	ProductID string `json:"product_id"` // ID_MODEL_ID, e.g. 5581
+	Serial    string `json:"serial"`     // ID_SERIAL_SHORT
+	FSType    string `json:"fstype"`     // ID_FS_TYPE
+	Label     string `json:"label"`      // ID_FS_LABEL
+
+	Action             string `json:"action"`               // mount, readonly or ignore
+	MountPointTemplate string `json:"mount_point_template"` // empty means the AutoMountPointTemplate of the config
+
+	// owner of the files, for filesystems without permissions of their own, e.g. vfat or exfat
+	UID *int `json:"uid"`
+	GID *int `json:"gid"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (p *USBRule) TableName() string {
+	return "o_usb_rule"
+}
@@ -14,6 +14,18 @@ type Volume struct {
 	UUID       string `json:"uuid"`
 	MountPoint string `json:"mount_point"`
 	CreatedAt  int64  `json:"created_at"`
+	CryptUUID  string `json:"crypt_uuid,omitempty"` // UUID of the LUKS container the filesystem is in, if encrypted
+	AutoUnlock bool   `json:"auto_unlock"`          // unlock at boot with the key file, if encrypted
+
+	// as last seen on the system - refreshed whenever the volume is saved, and at startup if it is present
+	FSType       string `json:"fstype,omitempty"`
+	Label        string `json:"label,omitempty"`
+	Size         uint64 `json:"size,omitempty"`    // of the filesystem, in bytes
+	DiskID       string `json:"disk_id,omitempty"` // name of the disk under /dev/disk/by-id, which stays the same across device names
+	MountOptions string `json:"mount_options,omitempty"`
+	LastSeenAt   int64  `json:"last_seen_at"`
+
+	Notes string `json:"notes,omitempty"` // set by the user, e.g. where the disk is
 }
 
 func (p *Volume) TableName() string {
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"slices"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"go.uber.org/zap"
+)
+
+const (
+	EventVolumeOrphansPruned = common.ServiceName + ":volume_orphans_pruned"
+
+	// volumes not seen for that many days are listed as orphaned, unless asked otherwise
+	DefaultOrphanedVolumeDays = 30
+)
+
+// OrphanedVolume is a volume whose device has not been seen for a while, along with what it is still used by.
+type OrphanedVolume struct {
+	model2.Volume
+
+	LastSeen time.Time `json:"last_seen"`
+	Merges   []string  `json:"merges"`   // mount points of the merges it is a source of
+	SnapRAID []string  `json:"snapraid"` // mount points of the merges whose SnapRAID it is a data or parity volume of
+
+	Pruned bool   `json:"pruned"`
+	Reason string `json:"reason,omitempty"` // why it is not pruned
+}
+
+func (d *diskService) GetOrphanedVolumes(notSeenFor time.Duration) ([]OrphanedVolume, error) {
+	volumes, err := d.GetSerialAllFromDB()
+	if err != nil {
+		return nil, err
+	}
+
+	merges, err := MyService.LocalStorage().GetMergeAllFromDB(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	snapraids, err := MyService.LocalStorage().GetSnapRAIDAllFromDB()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	orphans := make([]OrphanedVolume, 0)
+	for _, volume := range volumes {
+		if volumePresent(volume) {
+			continue
+		}
+
+		orphan := OrphanedVolume{Volume: volume, Merges: []string{}, SnapRAID: []string{}}
+
+		// not seen since it was saved, e.g. before last seen times were kept
+		orphan.LastSeen = time.Unix(volume.LastSeenAt, 0)
+		if volume.LastSeenAt == 0 {
+			orphan.LastSeen = time.Unix(volume.CreatedAt, 0)
+		}
+
+		if now.Sub(orphan.LastSeen) < notSeenFor {
+			continue
+		}
+
+		for _, merge := range merges {
+			for _, source := range merge.SourceVolumes {
+				if source != nil && source.UUID == volume.UUID {
+					orphan.Merges = append(orphan.Merges, merge.MountPoint)
+					break
+				}
+			}
+
+			for _, s := range snapraids {
+				if s.MergeID == merge.ID && (slices.Contains(s.DataVolumes, volume.UUID) || slices.Contains(s.ParityVolumes, volume.UUID)) {
+					orphan.SnapRAID = append(orphan.SnapRAID, merge.MountPoint)
+				}
+			}
+		}
+
+		orphans = append(orphans, orphan)
+	}
+
+	return orphans, nil
+}
+
+func (d *diskService) PruneOrphanedVolumes(notSeenFor time.Duration, uuids []string) ([]OrphanedVolume, error) {
+	// last seen is otherwise only as recent as the last start or partition added, however long ago that was
+	d.RefreshVolumesInDB()
+
+	orphans, err := d.GetOrphanedVolumes(notSeenFor)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]OrphanedVolume, 0, len(orphans))
+	for _, orphan := range orphans {
+		if len(uuids) > 0 && !slices.Contains(uuids, orphan.UUID) {
+			continue
+		}
+
+		// its parity, or the parity of the others, cannot be computed without it - which is up to the user to sort out
+		if len(orphan.SnapRAID) > 0 {
+			orphan.Reason = "used by the snapraid of a merge - remove it from the snapraid config first"
+			results = append(results, orphan)
+			continue
+		}
+
+		logger.Info("pruning orphaned volume...", zap.String("uuid", orphan.UUID), zap.String("mount point", orphan.MountPoint), zap.Time("last seen", orphan.LastSeen))
+
+		if err := d.uninstallMountUnit(orphan.MountPoint); err != nil {
+			logger.Error("error when removing mount unit of orphaned volume", zap.Error(err), zap.String("mount point", orphan.MountPoint))
+		}
+
+		// the volume is removed from its merges by hookAfterDeleteVolume
+		volume := orphan.Volume
+		if err := d.db.Delete(&volume).Error; err != nil {
+			logger.Error("error when pruning orphaned volume", zap.Error(err), zap.String("uuid", orphan.UUID))
+			orphan.Reason = err.Error()
+			results = append(results, orphan)
+			continue
+		}
+
+		orphan.Pruned = true
+		results = append(results, orphan)
+	}
+
+	return results, nil
+}
+
+func (d *diskService) AutoPruneOrphanedVolumes() {
+	if config.ServerInfo.OrphanedVolumePruneDays <= 0 {
+		return
+	}
+
+	results, err := d.PruneOrphanedVolumes(time.Duration(config.ServerInfo.OrphanedVolumePruneDays)*24*time.Hour, nil)
+	if err != nil {
+		logger.Error("error when pruning orphaned volumes", zap.Error(err))
+		return
+	}
+
+	pruned := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		if !result.Pruned {
+			continue
+		}
+
+		pruned = append(pruned, map[string]interface{}{
+			"uuid":        result.UUID,
+			"mount_point": result.MountPoint,
+			"last_seen":   result.LastSeen,
+			"merges":      result.Merges,
+		})
+	}
+
+	if len(pruned) == 0 {
+		return
+	}
+
+	message := map[string]interface{}{
+		"grace_period_days": config.ServerInfo.OrphanedVolumePruneDays,
+		"volumes":           pruned,
+	}
+
+	if err := MyService.Notify().SendNotify(EventVolumeOrphansPruned, message); err != nil {
+		logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventVolumeOrphansPruned), zap.Any("message", message))
+	}
+}
+
+// volumePresent tells if the device of volume is on the system - for an encrypted one, even if it is locked.
+func volumePresent(volume model2.Volume) bool {
+	uuid := volume.UUID
+	if volume.CryptUUID != "" {
+		uuid = volume.CryptUUID
+	}
+
+	devicePath, err := partition.GetDevicePath(uuid)
+	return err == nil && devicePath != ""
+}
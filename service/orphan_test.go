@@ -0,0 +1,97 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestPruneOrphanedVolumes(t *testing.T) {
+	db := newTestDB(t)
+
+	useStore(t, &store{
+		disk:         NewDiskService(db),
+		localStorage: v2.NewLocalStorageService(db, nil),
+	})
+
+	now := time.Now()
+
+	// no such devices, as far as this system is concerned
+	gone := model2.Volume{UUID: "85022acb-b5a2-424e-bfa9-6acb67d17cb8", MountPoint: "/media/gone", LastSeenAt: now.Add(-60 * 24 * time.Hour).Unix()}
+	recent := model2.Volume{UUID: "36c94c85-debf-49b6-9f19-866c14b3a0c6", MountPoint: "/media/recent", LastSeenAt: now.Add(-time.Hour).Unix()}
+	parity := model2.Volume{UUID: "5c682e86-cec3-4761-9350-8e1a0c2d1ae9", MountPoint: "/media/parity", CreatedAt: now.Add(-90 * 24 * time.Hour).Unix()}
+
+	for _, volume := range []*model2.Volume{&gone, &recent, &parity} {
+		assert.NilError(t, db.Create(volume).Error)
+	}
+
+	merge := model2.Merge{MountPoint: "/var/lib/casaos/files", SourceVolumes: []*model2.Volume{&gone, &recent}}
+	assert.NilError(t, db.Create(&merge).Error)
+
+	assert.NilError(t, MyService.LocalStorage().SaveSnapRAIDInDB(&model2.SnapRAID{
+		MergeID:       merge.ID,
+		DataVolumes:   []string{recent.UUID},
+		ParityVolumes: []string{parity.UUID},
+	}))
+
+	orphans, err := MyService.Disk().GetOrphanedVolumes(30 * 24 * time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, len(orphans), 2)
+
+	assert.Equal(t, orphans[0].UUID, gone.UUID)
+	assert.DeepEqual(t, orphans[0].Merges, []string{merge.MountPoint})
+	assert.DeepEqual(t, orphans[0].SnapRAID, []string{})
+
+	// not seen since it was saved
+	assert.Equal(t, orphans[1].UUID, parity.UUID)
+	assert.Equal(t, orphans[1].LastSeen.Unix(), parity.CreatedAt)
+	assert.DeepEqual(t, orphans[1].SnapRAID, []string{merge.MountPoint})
+
+	results, err := MyService.Disk().PruneOrphanedVolumes(30*24*time.Hour, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(results), 2)
+	assert.Assert(t, results[0].Pruned)
+	assert.Assert(t, !results[1].Pruned)
+	assert.Assert(t, results[1].Reason != "")
+
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	assert.NilError(t, err)
+	assert.Equal(t, len(volumes), 2)
+
+	merges, err := MyService.LocalStorage().GetMergeAllFromDB(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(merges[0].SourceVolumes), 1)
+	assert.Equal(t, merges[0].SourceVolumes[0].UUID, recent.UUID)
+}
+
+func TestPruneOrphanedVolumesPresent(t *testing.T) {
+	db := newTestDB(t)
+
+	useStore(t, &store{
+		disk:         NewDiskService(db),
+		localStorage: v2.NewLocalStorageService(db, nil),
+	})
+
+	// present, as far as blkid is concerned, though last seen long ago - e.g. with the system up since
+	present := model2.Volume{UUID: "0b4d2c1e-1f33-4d0e-9c1a-7d0c8c2b1a11", MountPoint: "/media/present", LastSeenAt: time.Now().Add(-60 * 24 * time.Hour).Unix()}
+	assert.NilError(t, db.Create(&present).Error)
+
+	bin := t.TempDir()
+	blkid := "#!/bin/sh\n[ \"$2\" = \"" + present.UUID + "\" ] && echo /dev/sdz1 && exit 0\nexit 2\n"
+	assert.NilError(t, os.WriteFile(filepath.Join(bin, "blkid"), []byte(blkid), 0o755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	results, err := MyService.Disk().PruneOrphanedVolumes(30*24*time.Hour, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(results), 0)
+
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	assert.NilError(t, err)
+	assert.Equal(t, len(volumes), 1)
+	assert.Assert(t, time.Since(time.Unix(volumes[0].LastSeenAt, 0)) < time.Minute)
+}
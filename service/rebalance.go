@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	EventRebalanceStatus = common.ServiceName + ":rebalance_status"
+
+	// after JobStateScanning, once the moves are planned
+	RebalanceStateMoving = "moving"
+
+	RebalanceOperationRebalance = "rebalance"
+	RebalanceOperationDrain     = "drain"
+
+	DefaultRebalanceSpread = 5.0
+
+	// planned moves kept in the status of a dry run
+	maxRebalanceMoves = 1000
+)
+
+var (
+	ErrRebalanceRunning  = errors.New("a rebalance is already running")
+	ErrRebalanceNotFound = errors.New("no rebalance has been started")
+)
+
+type RebalanceService interface {
+	// Start starts moving files between the branches of the merge at mountPoint, until their usage is within the spread
+	// of options, in the background - or only plans the moves, if it is a dry run.
+	Start(mountPoint string, options RebalanceOptions) (*RebalanceStatus, error)
+	// Drain moves all files off the source volume with uuid of the merge at mountPoint to its other sources, in the background,
+	// then removes the volume from the merge. The volume is set to NC first, so that no new file is created on it meanwhile.
+	Drain(mountPoint, uuid string, bytesPerSecond int64) (*RebalanceStatus, error)
+	// Status returns the status of the running rebalance or drain, or of the last one.
+	Status() (*RebalanceStatus, error)
+	Cancel() (*RebalanceStatus, error)
+}
+
+type RebalanceOptions struct {
+	Spread         float64 `json:"spread"`           // in percentage points
+	BytesPerSecond int64   `json:"bytes_per_second"` // 0 for no limit
+	DryRun         bool    `json:"dry_run"`
+}
+
+type RebalanceStatus struct {
+	JobState
+	Operation  string           `json:"operation"` // rebalance or drain
+	VolumeUUID string           `json:"volume_uuid,omitempty"`
+	Options    RebalanceOptions `json:"options"`
+
+	Branches      []RebalanceBranch `json:"branches"` // usage before
+	PlannedSpread float64           `json:"planned_spread"`
+	PlannedFiles  int               `json:"planned_files"`
+	PlannedBytes  int64             `json:"planned_bytes"`
+	Moves         []RebalanceMove   `json:"moves,omitempty"` // for dry run only
+
+	MovedFiles   int    `json:"moved_files"`
+	MovedBytes   int64  `json:"moved_bytes"`
+	SkippedFiles int    `json:"skipped_files"` // e.g. open, or changed while being moved
+	CurrentPath  string `json:"current_path,omitempty"`
+}
+
+type RebalanceBranch struct {
+	Path    string  `json:"path"`
+	Mode    string  `json:"mode"`
+	Total   uint64  `json:"total"`
+	Used    uint64  `json:"used"`
+	Percent float64 `json:"percent"`
+}
+
+type RebalanceMove struct {
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+	Paths []string `json:"paths"`
+	Size  int64    `json:"size"`
+}
+
+type rebalanceService struct {
+	job[RebalanceStatus, *RebalanceStatus]
+}
+
+func (r *rebalanceService) Start(mountPoint string, options RebalanceOptions) (*RebalanceStatus, error) {
+	merge, err := MyService.LocalStorage().GetFirstMergeFromDB(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if merge == nil {
+		return nil, v2.ErrMergeMountPointDoesNotExist
+	}
+
+	if err := snapraidRunning(*merge); err != nil {
+		return nil, err
+	}
+
+	if options.Spread <= 0 {
+		options.Spread = DefaultRebalanceSpread
+	}
+
+	// through the branches, as mergerfs has them, rather than the merged view
+	branches, err := mergerfs.GetBranches(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, status, err := r.begin(RebalanceStatus{
+		JobState:  JobState{MountPoint: mountPoint},
+		Operation: RebalanceOperationRebalance,
+		Options:   options,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("rebalancing merge...", zap.String("mount point", mountPoint), zap.Any("options", options))
+
+	go r.run(ctx, mountPoint, branches, options)
+
+	return status, nil
+}
+
+// rebalanceRunning returns ErrRebalanceRunning if a rebalance or drain of the merge at mountPoint is running.
+func rebalanceRunning(mountPoint string) error {
+	if status, err := MyService.Rebalance().Status(); err == nil && status.MountPoint == mountPoint && status.Running() {
+		return fmt.Errorf("%w: %s of %s", ErrRebalanceRunning, status.Operation, mountPoint)
+	}
+
+	return nil
+}
+
+func (r *rebalanceService) run(ctx context.Context, mountPoint string, branches []mergerfs.Branch, options RebalanceOptions) {
+	usages, err := mergerfs.GetBranchUsages(branches)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+
+	r.update(func(status *RebalanceStatus) {
+		status.Branches = rebalanceBranches(usages)
+	})
+
+	files := make(map[string][]mergerfs.FileGroup)
+	for _, branch := range branches {
+		if branch.Mode == mergerfs.BranchModeRO {
+			continue
+		}
+
+		scan, err := mergerfs.ScanBranch(ctx, branch.Path)
+		if err != nil {
+			r.finish(err)
+			return
+		}
+		files[branch.Path] = scan.Files
+	}
+
+	moves := mergerfs.PlanRebalance(usages, files, options.Spread)
+
+	r.update(func(status *RebalanceStatus) {
+		status.State = RebalanceStateMoving
+		status.PlannedSpread = mergerfs.Spread(usages)
+		status.PlannedFiles = len(moves)
+		for _, move := range moves {
+			status.PlannedBytes += move.Size
+
+			if options.DryRun && len(status.Moves) < maxRebalanceMoves {
+				status.Moves = append(status.Moves, RebalanceMove{From: move.From, To: move.To, Paths: move.Paths, Size: move.Size})
+			}
+		}
+	})
+
+	if options.DryRun {
+		r.finish(nil)
+		return
+	}
+
+	if _, err := r.move(ctx, mountPoint, moves, options.BytesPerSecond); err != nil {
+		r.finish(err)
+		return
+	}
+
+	r.finish(nil)
+}
+
+// move moves the files of moves one by one, and returns those skipped, e.g. as they are open. It stops when ctx is done.
+func (r *rebalanceService) move(ctx context.Context, mountPoint string, moves []mergerfs.Move, bytesPerSecond int64) ([]mergerfs.Move, error) {
+	var limiter *rate.Limiter
+	if bytesPerSecond > 0 {
+		// a burst of less than a chunk would never let a chunk through
+		burst := int(bytesPerSecond)
+		if burst < 1<<20 {
+			burst = 1 << 20
+		}
+		limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+	}
+
+	// once per pass, as each file is checked again right before it is moved
+	open, err := mergerfs.OpenFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := make([]mergerfs.Move, 0)
+	for _, move := range moves {
+		r.update(func(status *RebalanceStatus) {
+			status.CurrentPath = move.Paths[0]
+		})
+
+		err := mergerfs.MoveFiles(ctx, mountPoint, move, open, limiter, func(n int64) {
+			r.update(func(status *RebalanceStatus) {
+				status.MovedBytes += n
+			})
+		})
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err != nil {
+			logger.Error("error when moving file between branches - skipped", zap.Error(err), zap.String("from", move.From), zap.String("to", move.To), zap.Strings("paths", move.Paths))
+			r.update(func(status *RebalanceStatus) {
+				status.SkippedFiles++
+			})
+			skipped = append(skipped, move)
+			continue
+		}
+
+		r.update(func(status *RebalanceStatus) {
+			status.MovedFiles++
+		})
+	}
+
+	return skipped, nil
+}
+
+func (r *rebalanceService) finish(err error) {
+	r.update(func(status *RebalanceStatus) {
+		status.CurrentPath = ""
+	})
+
+	status := r.job.finish(err)
+
+	if status.State == JobStateFailed {
+		logger.Error("error when running "+status.Operation+" of merge", zap.Error(err), zap.String("mount point", status.MountPoint))
+	} else {
+		logger.Info(status.Operation+" of merge is "+status.State, zap.String("mount point", status.MountPoint), zap.Int("moved files", status.MovedFiles), zap.Int64("moved bytes", status.MovedBytes), zap.Int("skipped files", status.SkippedFiles))
+	}
+}
+
+func notifyRebalanceStatus(status RebalanceStatus) {
+	message := map[string]interface{}{
+		"operation":     status.Operation,
+		"volume_uuid":   status.VolumeUUID,
+		"mount_point":   status.MountPoint,
+		"state":         status.State,
+		"dry_run":       status.Options.DryRun,
+		"planned_files": status.PlannedFiles,
+		"planned_bytes": status.PlannedBytes,
+		"moved_files":   status.MovedFiles,
+		"moved_bytes":   status.MovedBytes,
+		"skipped_files": status.SkippedFiles,
+		"error":         status.Error,
+	}
+
+	if err := MyService.Notify().SendNotify(EventRebalanceStatus, message); err != nil {
+		logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventRebalanceStatus), zap.Any("message", message))
+	}
+}
+
+func rebalanceBranches(usages []mergerfs.BranchUsage) []RebalanceBranch {
+	branches := make([]RebalanceBranch, 0, len(usages))
+	for _, usage := range usages {
+		mode := usage.Mode
+		if mode == "" {
+			mode = mergerfs.BranchModeRW
+		}
+
+		branches = append(branches, RebalanceBranch{
+			Path:    usage.Path,
+			Mode:    mode,
+			Total:   usage.Total,
+			Used:    usage.Used,
+			Percent: usage.Percent(),
+		})
+	}
+
+	return branches
+}
+
+func NewRebalanceService() RebalanceService {
+	return &rebalanceService{
+		job: job[RebalanceStatus, *RebalanceStatus]{
+			name:        func(status RebalanceStatus) string { return status.Operation },
+			errRunning:  ErrRebalanceRunning,
+			errNotFound: ErrRebalanceNotFound,
+			notify:      notifyRebalanceStatus,
+		},
+	}
+}
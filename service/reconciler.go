@@ -0,0 +1,558 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/file"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/luks"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2/fs"
+	"github.com/moby/sys/mountinfo"
+	rconfig "github.com/rclone/rclone/fs/config"
+	"go.uber.org/zap"
+)
+
+const (
+	ManagedMountTypeNetwork = "network"
+
+	ReconcileActionNone     = "none"     // already mounted as desired
+	ReconcileActionMount    = "mount"    // not mounted
+	ReconcileActionRemount  = "remount"  // mounted elsewhere, or stale
+	ReconcileActionUpdate   = "update"   // mounted, but with different sources
+	ReconcileActionConflict = "conflict" // mount point is taken by something else, or device is mounted elsewhere - left alone
+	ReconcileActionMissing  = "missing"  // device is not present - nothing to do
+	ReconcileActionLocked   = "locked"   // encrypted, and waiting to be unlocked - nothing to do
+	ReconcileActionSystemd  = "systemd"  // persisted with a systemd mount unit, which mounts it - nothing to do
+)
+
+// rclone backends that are network shares rather than cloud storage
+var networkRemoteTypes = map[string]bool{
+	"ftp":    true,
+	"sftp":   true,
+	"smb":    true,
+	"webdav": true,
+	"http":   true,
+}
+
+type ReconcilerService interface {
+	// Diff compares the desired mounts, persisted in database and rclone config, with the actual mounts, in the order they would be applied
+	// by ApplyRequested. If types are given, only mounts of these types are compared.
+	Diff(types ...string) ([]ReconcileItem, error)
+	// Apply brings the actual mounts in line with the desired ones, and returns the diff it acted on, with any error per mount.
+	// If types are given, only mounts of these types are reconciled.
+	//
+	// A volume whose device is mounted elsewhere, maybe by the user, is reported as a conflict and left alone.
+	Apply(types ...string) ([]ReconcileItem, error)
+	// ApplyRequested is Apply as requested by the user, which also umounts a volume whose device is mounted elsewhere, and
+	// mounts it at its mount point.
+	ApplyRequested(types ...string) ([]ReconcileItem, error)
+	// Restore brings up the desired mounts at boot, in dependency order, retrying each with backoff until it is done or timeout is reached.
+	// A merge waits for its source volumes, and network and cloud mounts wait for the network, until then.
+	Restore(ctx context.Context, timeout time.Duration)
+	// RestoreStatus tells what Restore has done, and what is still pending or failed.
+	RestoreStatus() RestoreStatus
+}
+
+type ReconcileItem struct {
+	Type       string   `json:"type"` // volume, merge, network, cloud
+	MountPoint string   `json:"mount_point"`
+	Source     string   `json:"source"`
+	Action     string   `json:"action"`
+	Reason     string   `json:"reason,omitempty"`
+	Actual     string   `json:"actual,omitempty"`     // what is currently mounted at the mount point, or where the source is currently mounted
+	DependsOn  []string `json:"depends_on,omitempty"` // mount points that should be reconciled first
+	Error      string   `json:"error,omitempty"`
+}
+
+// a desired mount, along with how to bring it in line
+type reconcileStep struct {
+	ReconcileItem
+	apply func() error
+}
+
+type reconcilerService struct {
+	mu sync.Mutex
+
+	restoreMu sync.Mutex
+	restore   RestoreStatus
+}
+
+func (r *reconcilerService) Diff(types ...string) ([]ReconcileItem, error) {
+	steps, err := r.steps(types, true)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ReconcileItem, 0, len(steps))
+	for _, step := range steps {
+		items = append(items, step.ReconcileItem)
+	}
+
+	return items, nil
+}
+
+func (r *reconcilerService) Apply(types ...string) ([]ReconcileItem, error) {
+	return r.apply(types, false)
+}
+
+func (r *reconcilerService) ApplyRequested(types ...string) ([]ReconcileItem, error) {
+	return r.apply(types, true)
+}
+
+func (r *reconcilerService) apply(types []string, remountElsewhere bool) ([]ReconcileItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	steps, err := r.steps(types, remountElsewhere)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ReconcileItem, 0, len(steps))
+	for _, step := range steps {
+		item := step.ReconcileItem
+
+		if step.apply != nil {
+			logger.Info("reconciling mount...", zap.Any("item", item))
+
+			if err := step.apply(); err != nil {
+				logger.Error("error when reconciling mount", zap.Error(err), zap.Any("item", item))
+				item.Error = err.Error()
+			}
+		} else if item.Action == ReconcileActionConflict {
+			logger.Error("mount point is taken by something else - leaving it alone", zap.Any("item", item))
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// build the reconcile steps in dependency order, i.e. volumes, then network and cloud mounts, then the merges over them - with
+// remountElsewhere telling if a volume whose device is mounted elsewhere is to be moved to its mount point, or left alone.
+func (r *reconcilerService) steps(types []string, remountElsewhere bool) ([]reconcileStep, error) {
+	mounts, err := mountinfo.GetMounts(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := func(t string) bool {
+		if len(types) == 0 {
+			return true
+		}
+
+		for _, v := range types {
+			if v == t {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	steps := make([]reconcileStep, 0)
+
+	// volumes are always evaluated, as merges need to know which of their source volumes are present
+	volumeSteps, err := r.volumeSteps(mounts, remountElsewhere)
+	if err != nil {
+		return nil, err
+	}
+
+	if wanted(ManagedMountTypeVolume) {
+		steps = append(steps, volumeSteps...)
+	}
+
+	if wanted(ManagedMountTypeNetwork) || wanted(ManagedMountTypeCloud) {
+		for _, step := range r.remoteSteps(mounts) {
+			if wanted(step.Type) {
+				steps = append(steps, step)
+			}
+		}
+	}
+
+	if wanted(ManagedMountTypeMerge) && strings.ToLower(config.ServerInfo.EnableMergerFS) == "true" {
+		missing := make(map[string]bool)
+		for _, step := range volumeSteps {
+			// or whatever is at the mount point instead, e.g. an empty directory on the system disk, would be merged
+			if step.Action == ReconcileActionMissing || step.Action == ReconcileActionConflict {
+				missing[step.MountPoint] = true
+			}
+		}
+
+		mergeSteps, err := r.mergeSteps(mounts, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, mergeSteps...)
+	}
+
+	return steps, nil
+}
+
+func (r *reconcilerService) volumeSteps(mounts []*mountinfo.Info, remountElsewhere bool) ([]reconcileStep, error) {
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return nil, err
+	}
+
+	persistedWithSystemd := systemdVolumes()
+
+	// parents first, in case a volume is mounted below another one
+	sort.SliceStable(volumes, func(i, j int) bool {
+		return depth(volumes[i].MountPoint) < depth(volumes[j].MountPoint)
+	})
+
+	steps := make([]reconcileStep, 0, len(volumes))
+	for i := range volumes {
+		volume := volumes[i]
+
+		step := reconcileStep{
+			ReconcileItem: ReconcileItem{
+				Type:       ManagedMountTypeVolume,
+				MountPoint: volume.MountPoint,
+				Source:     "UUID=" + volume.UUID,
+			},
+		}
+
+		if volume.CryptUUID != "" {
+			if _, err := partition.GetDevicePath(volume.CryptUUID); err != nil {
+				step.Action = ReconcileActionMissing
+				step.Reason = "device is not present"
+				steps = append(steps, step)
+				continue
+			}
+
+			if !luks.IsOpen(luks.MapperName(volume.CryptUUID)) {
+				if volume.AutoUnlock {
+					step.Action = ReconcileActionMount
+					step.Reason = "unlocking with key file"
+					step.apply = func() error {
+						_, err := MyService.Encryption().UnlockWithKeyFile(volume.CryptUUID)
+						return err
+					}
+				} else {
+					step.Action = ReconcileActionLocked
+					step.Reason = "waiting to be unlocked"
+				}
+
+				steps = append(steps, step)
+				continue
+			}
+		}
+
+		devicePath, err := partition.GetDevicePath(volume.UUID)
+		if err != nil || devicePath == "" {
+			step.Action = ReconcileActionMissing
+			step.Reason = "device is not present"
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Source = devicePath
+
+		// not even the mount point is looked into, as that would trigger an automount
+		if persistedWithSystemd[volume.UUID] {
+			step.Action = ReconcileActionSystemd
+			step.Reason = "not mounted by its systemd unit"
+
+			if m := topMount(mounts, volume.MountPoint); m != nil {
+				step.Reason = "mounted by its systemd unit"
+				step.Actual = m.Source
+
+				if m.FSType == "autofs" {
+					step.Reason = "to be mounted by its systemd unit on first access"
+				}
+			}
+
+			steps = append(steps, step)
+			continue
+		}
+
+		// the kernel may report the resolved device path or not, e.g. /dev/dm-0 or /dev/mapper/luks-<uuid>
+		resolvedPath := devicePath
+		if resolved, err := filepath.EvalSymlinks(devicePath); err == nil {
+			resolvedPath = resolved
+		}
+
+		mountedAt := ""
+		for _, m := range mounts {
+			if m.Source != devicePath && m.Source != resolvedPath {
+				continue
+			}
+
+			if m.Mountpoint == volume.MountPoint {
+				mountedAt = m.Mountpoint
+				break
+			}
+
+			if mountedAt == "" {
+				mountedAt = m.Mountpoint
+			}
+		}
+
+		if mountedAt == volume.MountPoint {
+			step.Action = ReconcileActionNone
+			steps = append(steps, step)
+			continue
+		}
+
+		if r.conflict(&step.ReconcileItem, mounts) {
+			steps = append(steps, step)
+			continue
+		}
+
+		if mountedAt == "" {
+			step.Action = ReconcileActionMount
+			step.apply = func() error {
+				return r.mountVolume(devicePath, volume.MountPoint)
+			}
+		} else if !remountElsewhere {
+			// maybe mounted there by the user, which is not undone unless requested
+			step.Action = ReconcileActionConflict
+			step.Reason = "device is mounted elsewhere"
+			step.Actual = mountedAt
+		} else {
+			step.Action = ReconcileActionRemount
+			step.Reason = "device is mounted elsewhere"
+			step.Actual = mountedAt
+			step.apply = func() error {
+				if err := mount.UmountByMountPoint(mountedAt); err != nil {
+					return err
+				}
+
+				return r.mountVolume(devicePath, volume.MountPoint)
+			}
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+func (r *reconcilerService) mountVolume(devicePath, mountPoint string) error {
+	if output, err := MyService.Disk().MountDisk(devicePath, mountPoint); err != nil {
+		logger.Error(output, zap.Error(err), zap.String("path", devicePath), zap.String("mount point", mountPoint))
+		return err
+	}
+
+	return nil
+}
+
+func (r *reconcilerService) remoteSteps(mounts []*mountinfo.Info) []reconcileStep {
+	mountMu.Lock()
+	mounted := make(map[string]string, len(MountLists))
+	for mountPoint, mnt := range MountLists {
+		mounted[mountPoint] = mnt.Fs.Name()
+	}
+	mountMu.Unlock()
+
+	steps := make([]reconcileStep, 0)
+	for _, name := range rconfig.LoadedData().GetSectionList() {
+		name := name
+
+		mountPoint, found := rconfig.LoadedData().GetValue(name, "mount_point")
+		if !found || mountPoint == "" {
+			continue
+		}
+
+		remoteType, _ := rconfig.LoadedData().GetValue(name, "type")
+
+		step := reconcileStep{
+			ReconcileItem: ReconcileItem{
+				Type:       ManagedMountTypeCloud,
+				MountPoint: mountPoint,
+				Source:     name + ":",
+			},
+		}
+
+		if networkRemoteTypes[remoteType] {
+			step.Type = ManagedMountTypeNetwork
+		}
+
+		if mounted[mountPoint] == name {
+			step.Action = ReconcileActionNone
+			steps = append(steps, step)
+			continue
+		}
+
+		if _, ok := mounted[mountPoint]; !ok {
+			if m := topMount(mounts, mountPoint); m != nil && strings.HasPrefix(m.FSType, "fuse") {
+				// left behind by a previous run of this service
+				step.Action = ReconcileActionRemount
+				step.Reason = "mount is not served by this service"
+				step.Actual = m.Source
+				step.apply = func() error {
+					if err := mount.UmountLazy(mountPoint); err != nil {
+						return err
+					}
+
+					return MyService.Storage().MountStorage(mountPoint, name)
+				}
+
+				steps = append(steps, step)
+				continue
+			}
+		}
+
+		if r.conflict(&step.ReconcileItem, mounts) {
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ReconcileActionMount
+		step.apply = func() error {
+			return MyService.Storage().MountStorage(mountPoint, name)
+		}
+
+		steps = append(steps, step)
+	}
+
+	sort.SliceStable(steps, func(i, j int) bool {
+		return depth(steps[i].MountPoint) < depth(steps[j].MountPoint)
+	})
+
+	return steps
+}
+
+func (r *reconcilerService) mergeSteps(mounts []*mountinfo.Info, missingVolumes map[string]bool) ([]reconcileStep, error) {
+	merges, err := MyService.LocalStorage().GetMergeAllFromDB(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]reconcileStep, 0, len(merges))
+	for i := range merges {
+		merge := merges[i]
+
+		sources := make([]string, 0, len(merge.SourceVolumes)+1)
+		if merge.SourceBasePath != nil && *merge.SourceBasePath != "" {
+			sources = append(sources, *merge.SourceBasePath)
+		}
+
+		dependsOn := make([]string, 0, len(merge.SourceVolumes))
+		for _, volume := range merge.SourceVolumes {
+			if volume == nil {
+				continue
+			}
+
+			dependsOn = append(dependsOn, volume.MountPoint)
+
+			if !missingVolumes[volume.MountPoint] {
+				sources = append(sources, v2.MergeBranchOf(&merge, volume).String())
+			}
+		}
+
+		step := reconcileStep{
+			ReconcileItem: ReconcileItem{
+				Type:       ManagedMountTypeMerge,
+				MountPoint: merge.MountPoint,
+				Source:     strings.Join(sources, ":"),
+				DependsOn:  dependsOn,
+			},
+		}
+
+		if m := topMount(mounts, merge.MountPoint); m != nil && m.FSType == fs.MergeFSType(merge.FSType) {
+			existingSources, err := mergerfs.GetSource(merge.MountPoint)
+			if err != nil {
+				step.Action = ReconcileActionRemount
+				step.Reason = "mergerfs is not responding: " + err.Error()
+				step.apply = func() error {
+					if err := mount.UmountLazy(merge.MountPoint); err != nil {
+						return err
+					}
+
+					return MyService.LocalStorage().CreateMerge(&merge)
+				}
+			} else if !utils.CompareStringSlices(sources, existingSources) {
+				step.Action = ReconcileActionUpdate
+				step.Actual = strings.Join(existingSources, ":")
+				step.apply = func() error {
+					return MyService.LocalStorage().UpdateMerge(&merge)
+				}
+			} else {
+				step.Action = ReconcileActionNone
+			}
+
+			steps = append(steps, step)
+			continue
+		}
+
+		if r.conflict(&step.ReconcileItem, mounts) {
+			steps = append(steps, step)
+			continue
+		}
+
+		step.Action = ReconcileActionMount
+		step.apply = func() error {
+			return MyService.LocalStorage().CreateMerge(&merge)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// conflict tells if the mount point of item is taken by something else, i.e. a non-empty directory, and records why.
+//
+// A bind mount of the mount point onto itself, e.g. for shared propagation, is not a conflict as long as it is empty.
+func (r *reconcilerService) conflict(item *ReconcileItem, mounts []*mountinfo.Info) bool {
+	if !file.Exists(item.MountPoint) {
+		return false
+	}
+
+	empty, err := file.IsDirEmpty(item.MountPoint)
+	if err != nil {
+		item.Action = ReconcileActionConflict
+		item.Reason = err.Error()
+		return true
+	}
+
+	if empty {
+		return false
+	}
+
+	item.Action = ReconcileActionConflict
+	item.Reason = "mount point is not empty"
+
+	if m := topMount(mounts, item.MountPoint); m != nil && item.Type != ManagedMountTypeMerge {
+		item.Reason = "mount point is taken by another mount"
+		item.Actual = m.Source
+	}
+
+	return true
+}
+
+// the most recent mount at mountPoint, which is the one visible
+func topMount(mounts []*mountinfo.Info, mountPoint string) *mountinfo.Info {
+	var top *mountinfo.Info
+	for _, m := range mounts {
+		if m.Mountpoint == mountPoint {
+			top = m
+		}
+	}
+
+	return top
+}
+
+func depth(path string) int {
+	return strings.Count(filepath.Clean(path), "/")
+}
+
+func NewReconcilerService() ReconcilerService {
+	return &reconcilerService{}
+}
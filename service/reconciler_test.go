@@ -0,0 +1,105 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/systemd"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/moby/sys/mountinfo"
+	"gotest.tools/v3/assert"
+)
+
+func TestVolumeStepsSystemd(t *testing.T) {
+	db := newTestDB(t)
+
+	useStore(t, &store{
+		disk: NewDiskService(db),
+	})
+
+	// not empty, which would be a conflict if it were up to this service
+	unmounted := model2.Volume{UUID: "2f6b1d3e-8a4c-4b7e-9d2f-3c5a6b7d8e01", MountPoint: t.TempDir()}
+	assert.NilError(t, os.WriteFile(filepath.Join(unmounted.MountPoint, "file"), nil, 0o600))
+
+	// the root filesystem is always mounted
+	mounted := model2.Volume{UUID: "2f6b1d3e-8a4c-4b7e-9d2f-3c5a6b7d8e02", MountPoint: "/"}
+
+	for _, volume := range []*model2.Volume{&unmounted, &mounted} {
+		assert.NilError(t, db.Create(volume).Error)
+	}
+
+	bin := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(bin, "blkid"), []byte("#!/bin/sh\necho /dev/sdz1\n"), 0o755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	unitDir := systemd.UnitDir
+	systemd.UnitDir = t.TempDir()
+	t.Cleanup(func() { systemd.UnitDir = unitDir })
+
+	for _, volume := range []model2.Volume{unmounted, mounted} {
+		u := systemd.MountUnit{What: mountUnitWhat(volume.UUID), Where: volume.MountPoint, Type: "ext4"}
+		assert.NilError(t, os.WriteFile(filepath.Join(systemd.UnitDir, systemd.MountUnitName(u.Where)), []byte(u.RenderMount()), 0o600))
+	}
+
+	mounts, err := mountinfo.GetMounts(nil)
+	assert.NilError(t, err)
+
+	r := &reconcilerService{}
+
+	steps, err := r.volumeSteps(mounts, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(steps), 2)
+
+	for _, step := range steps {
+		assert.Equal(t, step.Action, ReconcileActionSystemd)
+		assert.Assert(t, step.apply == nil)
+	}
+
+	assert.Equal(t, steps[0].MountPoint, mounted.MountPoint)
+	assert.Equal(t, steps[0].Reason, "mounted by its systemd unit")
+	assert.Equal(t, steps[1].Reason, "not mounted by its systemd unit")
+
+	// done as far as the restore is concerned, as it is up to systemd
+	var item RestoreItem
+	r.restoreItem(steps[1], &item, map[string]string{}, true, false, false)
+	assert.Equal(t, item.State, RestoreItemStateDone)
+}
+
+func TestVolumeStepsMountedElsewhere(t *testing.T) {
+	db := newTestDB(t)
+
+	useStore(t, &store{
+		disk: NewDiskService(db),
+	})
+
+	volume := model2.Volume{UUID: "2f6b1d3e-8a4c-4b7e-9d2f-3c5a6b7d8e03", MountPoint: t.TempDir()}
+	assert.NilError(t, db.Create(&volume).Error)
+
+	bin := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(bin, "blkid"), []byte("#!/bin/sh\necho /dev/sdz1\n"), 0o755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	unitDir := systemd.UnitDir
+	systemd.UnitDir = t.TempDir()
+	t.Cleanup(func() { systemd.UnitDir = unitDir })
+
+	// e.g. by the user
+	mounts := []*mountinfo.Info{{Source: "/dev/sdz1", Mountpoint: "/mnt/usb", FSType: "ext4"}}
+
+	r := &reconcilerService{}
+
+	// as when a disk is plugged in
+	steps, err := r.volumeSteps(mounts, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(steps), 1)
+	assert.Equal(t, steps[0].Action, ReconcileActionConflict)
+	assert.Equal(t, steps[0].Actual, "/mnt/usb")
+	assert.Assert(t, steps[0].apply == nil)
+
+	// as requested
+	steps, err = r.volumeSteps(mounts, true)
+	assert.NilError(t, err)
+	assert.Equal(t, steps[0].Action, ReconcileActionRemount)
+	assert.Assert(t, steps[0].apply != nil)
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRestoreTimeout = 3 * time.Minute
+
+	RestoreStateIdle    = "idle"
+	RestoreStateRunning = "running"
+	RestoreStateDone    = "done"
+
+	RestoreItemStatePending = "pending" // waiting for a device, the network, its dependencies, or the next retry
+	RestoreItemStateDone    = "done"
+	RestoreItemStateFailed  = "failed"  // still not done when the restore timed out
+	RestoreItemStateLocked  = "locked"  // encrypted, and waiting to be unlocked via API - not waited for
+	RestoreItemStateMissing = "missing" // device is still not present once devices have had time to show up - not waited for
+
+	restoreInterval   = 2 * time.Second
+	restoreMaxBackoff = 1 * time.Minute
+
+	// for slow disks, e.g. USB ones, to show up - merges are mounted without the volumes still missing by then, which are
+	// added to them once present
+	restoreDeviceWait = 30 * time.Second
+)
+
+type RestoreStatus struct {
+	State      string        `json:"state"`
+	StartedAt  time.Time     `json:"started_at"`
+	Deadline   time.Time     `json:"deadline"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Items      []RestoreItem `json:"items"`
+}
+
+type RestoreItem struct {
+	Type          string    `json:"type"` // volume, merge, network, cloud
+	MountPoint    string    `json:"mount_point"`
+	Source        string    `json:"source"`
+	State         string    `json:"state"`
+	Reason        string    `json:"reason,omitempty"`
+	DependsOn     []string  `json:"depends_on,omitempty"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+func (r *reconcilerService) Restore(ctx context.Context, timeout time.Duration) {
+	now := time.Now()
+	deadline := now.Add(timeout)
+
+	r.restoreMu.Lock()
+	r.restore = RestoreStatus{
+		State:     RestoreStateRunning,
+		StartedAt: now,
+		Deadline:  deadline,
+	}
+	r.restoreMu.Unlock()
+
+	logger.Info("restoring mounts...", zap.Duration("timeout", timeout))
+
+	ticker := time.NewTicker(restoreInterval)
+	defer ticker.Stop()
+
+	for {
+		final := !time.Now().Before(deadline)
+
+		if finished := r.restoreRound(final); finished || final {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("restoring mounts is cancelled")
+			r.finishRestore(false)
+			return
+		case <-ticker.C:
+		}
+	}
+
+	r.finishRestore(true)
+}
+
+func (r *reconcilerService) RestoreStatus() RestoreStatus {
+	r.restoreMu.Lock()
+	defer r.restoreMu.Unlock()
+
+	status := r.restore
+	status.Items = append([]RestoreItem{}, r.restore.Items...)
+
+	if status.State == "" {
+		status.State = RestoreStateIdle
+	}
+
+	return status
+}
+
+// restoreRound goes through the steps once, in dependency order, and tells if every item is settled.
+//
+// In the final round, merges are mounted with whatever branches are present, and retries are not waited for.
+func (r *reconcilerService) restoreRound(final bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	steps, err := r.steps(nil, false)
+	if err != nil {
+		logger.Error("error when building reconcile steps", zap.Error(err))
+		return false
+	}
+
+	r.restoreMu.Lock()
+	items := make(map[string]*RestoreItem, len(r.restore.Items))
+	for i := range r.restore.Items {
+		item := r.restore.Items[i]
+		items[item.Type+":"+item.MountPoint] = &item
+	}
+	settled := time.Since(r.restore.StartedAt) >= restoreDeviceWait
+	r.restoreMu.Unlock()
+
+	states := make(map[string]string)
+	online := networkOnline()
+
+	result := make([]RestoreItem, 0, len(steps))
+	finished := true
+
+	for _, step := range steps {
+		item, ok := items[step.Type+":"+step.MountPoint]
+		if !ok {
+			item = &RestoreItem{Type: step.Type, MountPoint: step.MountPoint}
+		}
+
+		r.restoreItem(step, item, states, online, final, settled)
+
+		if item.State == RestoreItemStatePending {
+			finished = false
+		}
+
+		states[item.MountPoint] = item.State
+
+		result = append(result, *item)
+	}
+
+	r.restoreMu.Lock()
+	r.restore.Items = result
+	r.restoreMu.Unlock()
+
+	return finished
+}
+
+// restoreItem sets the state of item as of step, applying it unless it has to wait - with settled telling if devices have
+// had time to show up.
+func (r *reconcilerService) restoreItem(step reconcileStep, item *RestoreItem, states map[string]string, online, final, settled bool) {
+	item.Source = step.Source
+	item.DependsOn = step.DependsOn
+	item.State = RestoreItemStatePending
+	item.Reason = step.Reason
+
+	switch step.Action {
+	case ReconcileActionNone, ReconcileActionSystemd:
+		item.State = RestoreItemStateDone
+	case ReconcileActionLocked:
+		item.State = RestoreItemStateLocked
+	case ReconcileActionMissing:
+		item.Reason = "waiting for device"
+		if settled {
+			item.State = RestoreItemStateMissing
+			item.Reason = "device is not present"
+		}
+	case ReconcileActionConflict:
+		// might be resolved by another item, e.g. a parent mount that is not there yet
+	default:
+		r.restoreStep(step, item, states, online, final)
+	}
+}
+
+// restoreStep applies step unless it has to wait, with states holding the state of each item so far by mount point.
+func (r *reconcilerService) restoreStep(step reconcileStep, item *RestoreItem, states map[string]string, online, final bool) {
+	if step.Type == ManagedMountTypeMerge {
+		waitingFor := make([]string, 0, len(step.DependsOn))
+		for _, dependency := range step.DependsOn {
+			// a locked or missing volume is not waited for, as it may never be unlocked or plugged in
+			if state := states[dependency]; state != RestoreItemStateDone && state != RestoreItemStateLocked && state != RestoreItemStateMissing {
+				waitingFor = append(waitingFor, dependency)
+			}
+		}
+
+		if len(waitingFor) > 0 {
+			if !final {
+				item.Reason = "waiting for branches " + strings.Join(waitingFor, ", ")
+				return
+			}
+
+			logger.Info("mounting merge without missing branches - they will be added once present", zap.String("mount point", step.MountPoint), zap.Strings("missing branches", waitingFor))
+		}
+	}
+
+	if (step.Type == ManagedMountTypeNetwork || step.Type == ManagedMountTypeCloud) && !online {
+		item.Reason = "waiting for network"
+		return
+	}
+
+	if !final && time.Now().Before(item.NextAttemptAt) {
+		return
+	}
+
+	logger.Info("restoring mount...", zap.Any("item", step.ReconcileItem), zap.Int("attempt", item.Attempts+1))
+
+	item.Attempts++
+	if err := step.apply(); err != nil {
+		logger.Error("error when restoring mount", zap.Error(err), zap.Any("item", step.ReconcileItem), zap.Int("attempt", item.Attempts))
+
+		item.LastError = err.Error()
+		item.NextAttemptAt = time.Now().Add(restoreBackoff(item.Attempts))
+		return
+	}
+
+	item.State = RestoreItemStateDone
+	item.Reason = ""
+	item.NextAttemptAt = time.Time{}
+}
+
+func (r *reconcilerService) finishRestore(timedOut bool) {
+	r.restoreMu.Lock()
+	defer r.restoreMu.Unlock()
+
+	failed := make([]string, 0)
+	for i := range r.restore.Items {
+		if r.restore.Items[i].State != RestoreItemStatePending {
+			continue
+		}
+
+		if timedOut {
+			r.restore.Items[i].State = RestoreItemStateFailed
+		}
+
+		failed = append(failed, r.restore.Items[i].MountPoint)
+	}
+
+	r.restore.State = RestoreStateDone
+	r.restore.FinishedAt = time.Now()
+
+	if len(failed) > 0 {
+		logger.Error("some mounts are not restored", zap.Strings("mount points", failed))
+		return
+	}
+
+	logger.Info("all mounts are restored", zap.Duration("elapsed", r.restore.FinishedAt.Sub(r.restore.StartedAt)))
+}
+
+// 2s, 4s, 8s, ... up to restoreMaxBackoff
+func restoreBackoff(attempts int) time.Duration {
+	backoff := restoreInterval
+	for i := 1; i < attempts && backoff < restoreMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > restoreMaxBackoff {
+		return restoreMaxBackoff
+	}
+
+	return backoff
+}
+
+// tells if any interface other than loopback is up with a routable address
+func networkOnline() bool {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if ipNet.IP.IsGlobalUnicast() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRestoreBackoff(t *testing.T) {
+	assert.Equal(t, restoreBackoff(1), 2*time.Second)
+	assert.Equal(t, restoreBackoff(2), 4*time.Second)
+	assert.Equal(t, restoreBackoff(3), 8*time.Second)
+	assert.Equal(t, restoreBackoff(6), restoreMaxBackoff)
+	assert.Equal(t, restoreBackoff(100), restoreMaxBackoff)
+}
+
+func TestRestoreItemMissing(t *testing.T) {
+	r := &reconcilerService{}
+
+	volume := reconcileStep{ReconcileItem: ReconcileItem{Type: ManagedMountTypeVolume, MountPoint: "/media/gone", Action: ReconcileActionMissing}}
+	present := reconcileStep{ReconcileItem: ReconcileItem{Type: ManagedMountTypeVolume, MountPoint: "/media/present", Action: ReconcileActionNone}}
+
+	mounted := false
+	merge := reconcileStep{
+		ReconcileItem: ReconcileItem{Type: ManagedMountTypeMerge, MountPoint: "/DATA", Action: ReconcileActionMount, DependsOn: []string{"/media/gone", "/media/present"}},
+		apply: func() error {
+			mounted = true
+			return nil
+		},
+	}
+
+	restore := func(settled bool) (RestoreItem, RestoreItem) {
+		states := make(map[string]string)
+
+		var volumeItem, presentItem, mergeItem RestoreItem
+		for _, step := range []struct {
+			step reconcileStep
+			item *RestoreItem
+		}{{volume, &volumeItem}, {present, &presentItem}, {merge, &mergeItem}} {
+			r.restoreItem(step.step, step.item, states, true, false, settled)
+			states[step.step.MountPoint] = step.item.State
+		}
+
+		return volumeItem, mergeItem
+	}
+
+	// devices may still show up
+	volumeItem, mergeItem := restore(false)
+	assert.Equal(t, volumeItem.State, RestoreItemStatePending)
+	assert.Equal(t, mergeItem.State, RestoreItemStatePending)
+	assert.Assert(t, !mounted)
+
+	// not waited for any longer, so that the restore is over once the merge is mounted
+	volumeItem, mergeItem = restore(true)
+	assert.Equal(t, volumeItem.State, RestoreItemStateMissing)
+	assert.Equal(t, mergeItem.State, RestoreItemStateDone)
+	assert.Assert(t, mounted)
+}
@@ -24,6 +24,13 @@ type Services interface {
 	Shares() external.ShareService
 	MessageBus() *message_bus.ClientWithResponses
 	Storage() StorageService
+	Watchdog() WatchdogService
+	Reconciler() ReconcilerService
+	Encryption() EncryptionService
+	Rebalance() RebalanceService
+	Conflict() ConflictService
+	SnapRAID() SnapRAIDService
+	ConfigBundle() ConfigBundleService
 }
 
 func NewService(db *gorm.DB) Services {
@@ -36,7 +43,7 @@ func NewService(db *gorm.DB) Services {
 	sharesService := external.NewShareService(config.CommonInfo.RuntimePath)
 
 	return &store{
-		usb:          NewUSBService(),
+		usb:          NewUSBService(db),
 		disk:         NewDiskService(db),
 		localStorage: v2.NewLocalStorageService(db, wrapper.NewMountInfo()),
 		gateway:      gatewayManagement,
@@ -44,6 +51,13 @@ func NewService(db *gorm.DB) Services {
 		notifySystem: notifySystem,
 		shares:       sharesService,
 		storage:      NewStorageService(),
+		watchdog:     NewWatchdogService(),
+		reconciler:   NewReconcilerService(),
+		encryption:   NewEncryptionService(db),
+		rebalance:    NewRebalanceService(),
+		conflict:     NewConflictService(),
+		snapraid:     NewSnapRAIDService(),
+		configBundle: NewConfigBundleService(),
 	}
 }
 
@@ -56,6 +70,13 @@ type store struct {
 	notifySystem external.NotifyService
 	shares       external.ShareService
 	storage      StorageService
+	watchdog     WatchdogService
+	reconciler   ReconcilerService
+	encryption   EncryptionService
+	rebalance    RebalanceService
+	conflict     ConflictService
+	snapraid     SnapRAIDService
+	configBundle ConfigBundleService
 }
 
 func (c *store) NotifySystem() external.NotifyService {
@@ -66,6 +87,34 @@ func (c *store) Storage() StorageService {
 	return c.storage
 }
 
+func (c *store) Watchdog() WatchdogService {
+	return c.watchdog
+}
+
+func (c *store) Reconciler() ReconcilerService {
+	return c.reconciler
+}
+
+func (c *store) Encryption() EncryptionService {
+	return c.encryption
+}
+
+func (c *store) Rebalance() RebalanceService {
+	return c.rebalance
+}
+
+func (c *store) Conflict() ConflictService {
+	return c.conflict
+}
+
+func (c *store) SnapRAID() SnapRAIDService {
+	return c.snapraid
+}
+
+func (c *store) ConfigBundle() ConfigBundleService {
+	return c.configBundle
+}
+
 func (c *store) Gateway() external.ManagementService {
 	return c.gateway
 }
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestDB returns a database of its own for the test, which is removed along with its directory once the test is done.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	logger.LogInitConsoleOnly()
+
+	return sqlite.GetDBByFile(filepath.Join(t.TempDir(), "local-storage.db"))
+}
+
+// useStore sets MyService to s for the test, and restores the previous one once the test is done.
+func useStore(t *testing.T, s *store) {
+	t.Helper()
+
+	previous := MyService
+	t.Cleanup(func() { MyService = previous })
+
+	MyService = s
+}
@@ -0,0 +1,611 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/snapraid"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/moby/sys/mountinfo"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	EventSnapRAIDStatus = common.ServiceName + ":snapraid_status"
+	EventSnapRAIDError  = common.ServiceName + ":snapraid_error"
+
+	SnapRAIDStateRunning   = "running"
+	SnapRAIDStateDone      = "done"
+	SnapRAIDStateCancelled = "cancelled"
+	SnapRAIDStateFailed    = "failed"
+
+	// on each parity volume - the content file, with the state of the array, is kept there too in case the system disk is lost
+	snapraidParityFile  = "snapraid.parity"
+	snapraidContentFile = "snapraid.content"
+
+	// changes kept in the result of a diff
+	maxSnapRAIDChanges = 1000
+)
+
+var (
+	ErrSnapRAIDRunning       = errors.New("snapraid is already running for the merge")
+	ErrSnapRAIDNotRunning    = errors.New("snapraid is not running for the merge")
+	ErrInvalidSnapRAIDConfig = errors.New("invalid snapraid config")
+	ErrSnapRAIDNotMounted    = errors.New("a data or parity volume of the snapraid array is not mounted")
+)
+
+type SnapRAIDService interface {
+	// Start writes the snapraid.conf of each merge with SnapRAID configured, and schedules their syncs and scrubs.
+	Start()
+	Get(mergeID uint) (*model2.SnapRAID, error)
+	// Configure validates and saves s as the SnapRAID config of merge, writes its snapraid.conf and schedules its syncs
+	// and scrubs. The parity is only computed by the next sync.
+	Configure(merge model2.Merge, s model2.SnapRAID) (*model2.SnapRAID, error)
+	// Remove removes the SnapRAID config of the merge with mergeID. The parity and content files are left as they are.
+	Remove(mergeID uint) error
+
+	// Run starts a sync or scrub of the merge with mergeID in the background.
+	Run(mergeID uint, command string) (*SnapRAIDRun, error)
+	// LastRun returns the running sync or scrub of the merge with mergeID, or the last one - nil if none.
+	LastRun(mergeID uint) *SnapRAIDRun
+	Cancel(mergeID uint) (*SnapRAIDRun, error)
+
+	Status(ctx context.Context, mergeID uint) (*snapraid.Status, error)
+	// Diff returns the files changed since the last sync - up to maxSnapRAIDChanges of them, while the counts are of all.
+	Diff(ctx context.Context, mergeID uint) (*snapraid.Diff, error)
+}
+
+type SnapRAIDRun struct {
+	MergeID    uint      `json:"merge_id"`
+	Command    string    `json:"command"` // sync or scrub
+	Scheduled  bool      `json:"scheduled"`
+	State      string    `json:"state"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+
+	snapraid.Result
+}
+
+type snapraidService struct {
+	mu      sync.Mutex
+	runs    map[uint]*SnapRAIDRun // last run, by merge
+	cancels map[uint]context.CancelFunc
+	entries map[uint][]cron.EntryID // scheduled runs, by merge
+	cron    *cron.Cron
+}
+
+func (s *snapraidService) Start() {
+	configs, err := MyService.LocalStorage().GetSnapRAIDAllFromDB()
+	if err != nil {
+		logger.Error("error when getting snapraid configs from db", zap.Error(err))
+		return
+	}
+
+	for _, c := range configs {
+		if _, err := s.writeConfig(c); err != nil {
+			logger.Error("error when writing snapraid config - runs will fail until it is fixed", zap.Error(err), zap.Uint("merge id", c.MergeID))
+		}
+
+		if err := s.schedule(c); err != nil {
+			logger.Error("error when scheduling snapraid runs", zap.Error(err), zap.Uint("merge id", c.MergeID))
+		}
+	}
+
+	s.cron.Start()
+
+	if len(configs) > 0 && !snapraid.Installed() {
+		logger.Error("snapraid is configured for merges, but not installed - the parity is not kept up to date", zap.Int("merges", len(configs)))
+	}
+}
+
+func (s *snapraidService) Get(mergeID uint) (*model2.SnapRAID, error) {
+	return MyService.LocalStorage().GetSnapRAIDFromDB(mergeID)
+}
+
+func (s *snapraidService) Configure(merge model2.Merge, c model2.SnapRAID) (*model2.SnapRAID, error) {
+	c.MergeID = merge.ID
+
+	if err := s.validate(merge, c); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.writeConfig(c); err != nil {
+		return nil, err
+	}
+
+	if err := MyService.LocalStorage().SaveSnapRAIDInDB(&c); err != nil {
+		return nil, err
+	}
+
+	if err := s.schedule(c); err != nil {
+		return nil, err
+	}
+
+	logger.Info("snapraid is configured for merge", zap.String("mount point", merge.MountPoint), zap.Strings("data volumes", c.DataVolumes), zap.Strings("parity volumes", c.ParityVolumes))
+
+	return &c, nil
+}
+
+func (s *snapraidService) Remove(mergeID uint) error {
+	if _, err := s.Get(mergeID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.cancels[mergeID] != nil {
+		s.mu.Unlock()
+		return ErrSnapRAIDRunning
+	}
+
+	for _, entry := range s.entries[mergeID] {
+		s.cron.Remove(entry)
+	}
+	delete(s.entries, mergeID)
+	s.mu.Unlock()
+
+	if err := MyService.LocalStorage().DeleteSnapRAIDInDB(mergeID); err != nil {
+		return err
+	}
+
+	if err := os.Remove(snapraidConfigPath(mergeID)); err != nil && !os.IsNotExist(err) {
+		logger.Error("error when removing snapraid config", zap.Error(err), zap.String("path", snapraidConfigPath(mergeID)))
+	}
+
+	logger.Info("snapraid is removed from merge", zap.Uint("merge id", mergeID))
+
+	return nil
+}
+
+func (s *snapraidService) Run(mergeID uint, command string) (*SnapRAIDRun, error) {
+	return s.start(mergeID, command, false)
+}
+
+func (s *snapraidService) start(mergeID uint, command string, scheduled bool) (*SnapRAIDRun, error) {
+	if command != snapraid.CommandSync && command != snapraid.CommandScrub {
+		return nil, fmt.Errorf("%w: command should be %s or %s, not %s", ErrInvalidSnapRAIDConfig, snapraid.CommandSync, snapraid.CommandScrub, command)
+	}
+
+	c, err := s.Get(mergeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// or the parity of a missing disk would be written to, and its data read from, the system disk under its mount point
+	if err := s.checkMounted(*c); err != nil {
+		return nil, err
+	}
+
+	// files moved meanwhile would be reported as errors, or left out of the parity
+	merge, err := MyService.LocalStorage().GetMergeFromDB(mergeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rebalanceRunning(merge.MountPoint); err != nil {
+		return nil, err
+	}
+
+	path, err := s.writeConfig(*c)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancels[mergeID] != nil {
+		return nil, ErrSnapRAIDRunning
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels[mergeID] = cancel
+
+	run := &SnapRAIDRun{
+		MergeID:   mergeID,
+		Command:   command,
+		Scheduled: scheduled,
+		State:     SnapRAIDStateRunning,
+		StartedAt: time.Now(),
+	}
+	s.runs[mergeID] = run
+
+	args := make([]string, 0)
+	if command == snapraid.CommandScrub && c.ScrubPercent > 0 {
+		args = append(args, "-p", strconv.Itoa(c.ScrubPercent))
+	}
+
+	logger.Info("running snapraid "+command+"...", zap.Uint("merge id", mergeID), zap.Bool("scheduled", scheduled))
+
+	result := *run
+	s.notify(result)
+
+	go func() {
+		output, err := snapraid.Run(ctx, path, command, args...)
+		s.finish(mergeID, snapraid.ParseResult(output), err)
+	}()
+
+	return &result, nil
+}
+
+func (s *snapraidService) LastRun(mergeID uint) *SnapRAIDRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run, ok := s.runs[mergeID]
+	if !ok {
+		return nil
+	}
+
+	result := *run
+	return &result
+}
+
+func (s *snapraidService) Cancel(mergeID uint) (*SnapRAIDRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cancel := s.cancels[mergeID]
+	if cancel == nil {
+		return nil, ErrSnapRAIDNotRunning
+	}
+
+	logger.Info("cancelling snapraid "+s.runs[mergeID].Command+"...", zap.Uint("merge id", mergeID))
+	cancel()
+
+	result := *s.runs[mergeID]
+	return &result, nil
+}
+
+func (s *snapraidService) finish(mergeID uint, result snapraid.Result, err error) {
+	s.mu.Lock()
+
+	run := s.runs[mergeID]
+	run.Result = result
+	run.State = SnapRAIDStateDone
+	run.FinishedAt = time.Now()
+
+	if errors.Is(err, context.Canceled) {
+		run.State = SnapRAIDStateCancelled
+	} else if err != nil {
+		run.State = SnapRAIDStateFailed
+		run.Error = err.Error()
+	}
+
+	delete(s.cancels, mergeID)
+	finished := *run
+
+	s.mu.Unlock()
+
+	if finished.State == SnapRAIDStateFailed {
+		logger.Error("error when running snapraid "+finished.Command, zap.Error(err), zap.Uint("merge id", mergeID), zap.Int64("errors", finished.Errors()))
+	} else {
+		logger.Info("snapraid "+finished.Command+" is "+finished.State, zap.Uint("merge id", mergeID), zap.Int64("errors", finished.Errors()))
+	}
+
+	s.notify(finished)
+}
+
+func (s *snapraidService) Status(ctx context.Context, mergeID uint) (*snapraid.Status, error) {
+	output, err := s.runNow(ctx, mergeID, snapraid.CommandStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	status := snapraid.ParseStatus(output)
+	return &status, nil
+}
+
+func (s *snapraidService) Diff(ctx context.Context, mergeID uint) (*snapraid.Diff, error) {
+	output, err := s.runNow(ctx, mergeID, snapraid.CommandDiff)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := snapraid.ParseDiff(output)
+	if len(diff.Changes) > maxSnapRAIDChanges {
+		diff.Changes = diff.Changes[:maxSnapRAIDChanges]
+	}
+
+	return &diff, nil
+}
+
+// runNow runs command, which only reads the state of the array, and returns its output.
+func (s *snapraidService) runNow(ctx context.Context, mergeID uint, command string) (string, error) {
+	c, err := s.Get(mergeID)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := s.writeConfig(*c)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := snapraid.Run(ctx, path, command)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, output)
+	}
+
+	return output, nil
+}
+
+// schedule replaces the scheduled runs of the merge of c with those of c.
+func (s *snapraidService) schedule(c model2.SnapRAID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range s.entries[c.MergeID] {
+		s.cron.Remove(entry)
+	}
+	delete(s.entries, c.MergeID)
+
+	for command, spec := range map[string]string{snapraid.CommandSync: c.SyncSchedule, snapraid.CommandScrub: c.ScrubSchedule} {
+		if spec == "" {
+			continue
+		}
+
+		command := command
+		entry, err := s.cron.AddFunc(spec, func() {
+			if _, err := s.start(c.MergeID, command, true); err != nil {
+				logger.Error("error when starting scheduled snapraid "+command+" - skipped", zap.Error(err), zap.Uint("merge id", c.MergeID))
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		s.entries[c.MergeID] = append(s.entries[c.MergeID], entry)
+	}
+
+	return nil
+}
+
+// validate tells if c can be the SnapRAID config of merge: data volumes should be sources of merge, and parity volumes
+// should be in no merge, and used as parity for no other merge.
+func (s *snapraidService) validate(merge model2.Merge, c model2.SnapRAID) error {
+	if len(c.DataVolumes) == 0 {
+		return fmt.Errorf("%w: there should be at least one data volume", ErrInvalidSnapRAIDConfig)
+	}
+
+	if len(c.ParityVolumes) == 0 || len(c.ParityVolumes) > snapraid.MaxParityLevels {
+		return fmt.Errorf("%w: there should be 1 to %d parity volumes", ErrInvalidSnapRAIDConfig, snapraid.MaxParityLevels)
+	}
+
+	if c.ScrubPercent < 0 || c.ScrubPercent > 100 {
+		return fmt.Errorf("%w: scrub percent should be between 0 and 100", ErrInvalidSnapRAIDConfig)
+	}
+
+	for _, spec := range []string{c.SyncSchedule, c.ScrubSchedule} {
+		if spec == "" {
+			continue
+		}
+
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return fmt.Errorf("%w: schedule %s - %s", ErrInvalidSnapRAIDConfig, spec, err.Error())
+		}
+	}
+
+	sources := make(map[string]string) // mount point by uuid
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil {
+			sources[volume.UUID] = volume.MountPoint
+		}
+	}
+
+	var largestData uint64
+	for _, uuid := range c.DataVolumes {
+		mountPoint, ok := sources[uuid]
+		if !ok {
+			return fmt.Errorf("%w: data volume %s is not a source of the merge", ErrInvalidSnapRAIDConfig, uuid)
+		}
+
+		if used, _, err := volumeSpace(mountPoint); err == nil && used > largestData {
+			largestData = used
+		}
+	}
+
+	merges, err := MyService.LocalStorage().GetMergeAllFromDB(nil)
+	if err != nil {
+		return err
+	}
+
+	configs, err := MyService.LocalStorage().GetSnapRAIDAllFromDB()
+	if err != nil {
+		return err
+	}
+
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return err
+	}
+
+	for i, uuid := range c.ParityVolumes {
+		if slices.Contains(c.ParityVolumes[:i], uuid) {
+			return fmt.Errorf("%w: parity volume %s is given more than once", ErrInvalidSnapRAIDConfig, uuid)
+		}
+
+		index := slices.IndexFunc(volumes, func(volume model2.Volume) bool { return volume.UUID == uuid })
+		if index < 0 {
+			return fmt.Errorf("%w: parity volume %s", ErrVolumeNotFound, uuid)
+		}
+
+		for _, m := range merges {
+			if volumeUUIDInMerge(m, uuid) {
+				return fmt.Errorf("%w: parity volume %s is a source of the merge at %s", ErrInvalidSnapRAIDConfig, uuid, m.MountPoint)
+			}
+		}
+
+		for _, other := range configs {
+			if other.MergeID != merge.ID && slices.Contains(other.ParityVolumes, uuid) {
+				return fmt.Errorf("%w: parity volume %s is already used for another merge", ErrInvalidSnapRAIDConfig, uuid)
+			}
+		}
+
+		// the parity is as large as the data on the largest data volume
+		_, total, err := volumeSpace(volumes[index].MountPoint)
+		if err != nil {
+			return fmt.Errorf("%w: parity volume %s at %s - %s", ErrInvalidSnapRAIDConfig, uuid, volumes[index].MountPoint, err.Error())
+		}
+
+		if total < largestData {
+			return fmt.Errorf("%w: parity volume %s is smaller than the data on the largest data volume", ErrInvalidSnapRAIDConfig, uuid)
+		}
+	}
+
+	return nil
+}
+
+// checkMounted returns ErrSnapRAIDNotMounted unless each data and parity volume of c is mounted at its mount point.
+func (s *snapraidService) checkMounted(c model2.SnapRAID) error {
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return err
+	}
+
+	mountPoints := make(map[string]string)
+	for _, volume := range volumes {
+		mountPoints[volume.UUID] = volume.MountPoint
+	}
+
+	for _, uuid := range append(slices.Clone(c.ParityVolumes), c.DataVolumes...) {
+		mountPoint, ok := mountPoints[uuid]
+		if !ok {
+			return fmt.Errorf("%w: volume %s", ErrVolumeNotFound, uuid)
+		}
+
+		if mounted, err := mountinfo.Mounted(mountPoint); err != nil || !mounted {
+			return fmt.Errorf("%w: volume %s at %s", ErrSnapRAIDNotMounted, uuid, mountPoint)
+		}
+	}
+
+	return nil
+}
+
+// writeConfig writes the snapraid.conf of c, from the current mount points of its volumes, and returns its path.
+func (s *snapraidService) writeConfig(c model2.SnapRAID) (string, error) {
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return "", err
+	}
+
+	mountPoints := make(map[string]string)
+	for _, volume := range volumes {
+		mountPoints[volume.UUID] = volume.MountPoint
+	}
+
+	path := snapraidConfigPath(c.MergeID)
+
+	sc := snapraid.Config{
+		Content:  []string{strings.TrimSuffix(path, ".conf") + ".content"},
+		Excludes: append(slices.Clone(snapraid.DefaultExcludes), c.Excludes...),
+	}
+
+	for _, uuid := range c.ParityVolumes {
+		mountPoint, ok := mountPoints[uuid]
+		if !ok {
+			return "", fmt.Errorf("%w: parity volume %s", ErrVolumeNotFound, uuid)
+		}
+
+		sc.Parity = append(sc.Parity, filepath.Join(mountPoint, snapraidParityFile))
+		sc.Content = append(sc.Content, filepath.Join(mountPoint, snapraidContentFile))
+	}
+
+	for _, uuid := range c.DataVolumes {
+		mountPoint, ok := mountPoints[uuid]
+		if !ok {
+			return "", fmt.Errorf("%w: data volume %s", ErrVolumeNotFound, uuid)
+		}
+
+		// by uuid, as SnapRAID tracks files by the name of their disk, which should not change with the mount point
+		sc.Data = append(sc.Data, snapraid.Disk{Name: uuid, Path: mountPoint})
+	}
+
+	if err := snapraid.WriteConfig(path, sc); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (s *snapraidService) notify(run SnapRAIDRun) {
+	message := map[string]interface{}{
+		"merge_id":    run.MergeID,
+		"command":     run.Command,
+		"scheduled":   run.Scheduled,
+		"state":       run.State,
+		"file_errors": run.FileErrors,
+		"io_errors":   run.IOErrors,
+		"data_errors": run.DataErrors,
+		"error":       run.Error,
+	}
+
+	if err := MyService.Notify().SendNotify(EventSnapRAIDStatus, message); err != nil {
+		logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventSnapRAIDStatus), zap.Any("message", message))
+	}
+
+	if run.Errors() == 0 && run.State != SnapRAIDStateFailed {
+		return
+	}
+
+	if err := MyService.Notify().SendNotify(EventSnapRAIDError, message); err != nil {
+		logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventSnapRAIDError), zap.Any("message", message))
+	}
+}
+
+// snapraidRunning returns ErrSnapRAIDRunning if a sync or scrub of merge is running - files moved under it would be
+// reported as errors, or left out of the parity.
+func snapraidRunning(merge model2.Merge) error {
+	if run := MyService.SnapRAID().LastRun(merge.ID); run != nil && run.State == SnapRAIDStateRunning {
+		return fmt.Errorf("%w: snapraid %s at %s", ErrSnapRAIDRunning, run.Command, merge.MountPoint)
+	}
+
+	return nil
+}
+
+func snapraidConfigPath(mergeID uint) string {
+	return filepath.Join(config.AppInfo.DBPath, "snapraid", fmt.Sprintf("merge-%d.conf", mergeID))
+}
+
+func volumeUUIDInMerge(merge model2.Merge, uuid string) bool {
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil && volume.UUID == uuid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// volumeSpace returns the used and total space of the filesystem at mountPoint.
+func volumeSpace(mountPoint string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	total := stat.Blocks * uint64(stat.Bsize)
+	return total - stat.Bfree*uint64(stat.Bsize), total, nil
+}
+
+func NewSnapRAIDService() SnapRAIDService {
+	return &snapraidService{
+		runs:    make(map[uint]*SnapRAIDRun),
+		cancels: make(map[uint]context.CancelFunc),
+		entries: make(map[uint][]cron.EntryID),
+		cron:    cron.New(),
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/snapraid"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	v2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestSnapRAIDNotMounted(t *testing.T) {
+	db := newTestDB(t)
+
+	useStore(t, &store{
+		disk:         NewDiskService(db),
+		localStorage: v2.NewLocalStorageService(db, nil),
+		snapraid:     NewSnapRAIDService(),
+	})
+
+	// the root filesystem is always mounted, unlike a directory on it
+	data := model2.Volume{UUID: "e1b7c7a4-3c2d-4f0e-9a8b-6d5c4b3a2f01", MountPoint: "/"}
+	parity := model2.Volume{UUID: "e1b7c7a4-3c2d-4f0e-9a8b-6d5c4b3a2f02", MountPoint: t.TempDir()}
+
+	for _, volume := range []*model2.Volume{&data, &parity} {
+		assert.NilError(t, db.Create(volume).Error)
+	}
+
+	merge := model2.Merge{MountPoint: "/var/lib/casaos/files", SourceVolumes: []*model2.Volume{&data}}
+	assert.NilError(t, db.Create(&merge).Error)
+
+	assert.NilError(t, MyService.LocalStorage().SaveSnapRAIDInDB(&model2.SnapRAID{
+		MergeID:       merge.ID,
+		DataVolumes:   []string{data.UUID},
+		ParityVolumes: []string{parity.UUID},
+	}))
+
+	_, err := MyService.SnapRAID().Run(merge.ID, snapraid.CommandSync)
+	assert.ErrorIs(t, err, ErrSnapRAIDNotMounted)
+	assert.Assert(t, MyService.SnapRAID().LastRun(merge.ID) == nil)
+}
+
+func TestSnapRAIDRunning(t *testing.T) {
+	db := newTestDB(t)
+
+	runs := NewSnapRAIDService().(*snapraidService)
+
+	useStore(t, &store{
+		disk:         NewDiskService(db),
+		localStorage: v2.NewLocalStorageService(db, nil),
+		snapraid:     runs,
+		rebalance:    NewRebalanceService(),
+	})
+
+	merge := model2.Merge{MountPoint: "/var/lib/casaos/files"}
+	assert.NilError(t, db.Create(&merge).Error)
+
+	assert.NilError(t, snapraidRunning(merge))
+
+	runs.runs[merge.ID] = &SnapRAIDRun{MergeID: merge.ID, Command: snapraid.CommandSync, State: SnapRAIDStateRunning}
+	assert.ErrorIs(t, snapraidRunning(merge), ErrSnapRAIDRunning)
+
+	_, err := MyService.Rebalance().Start(merge.MountPoint, RebalanceOptions{})
+	assert.ErrorIs(t, err, ErrSnapRAIDRunning)
+
+	_, err = MyService.Rebalance().Drain(merge.MountPoint, "e1b7c7a4-3c2d-4f0e-9a8b-6d5c4b3a2f01", 0)
+	assert.ErrorIs(t, err, ErrSnapRAIDRunning)
+
+	runs.runs[merge.ID].State = SnapRAIDStateDone
+	assert.NilError(t, snapraidRunning(merge))
+}
+
+func TestSnapRAIDRebalanceRunning(t *testing.T) {
+	db := newTestDB(t)
+
+	rebalance := NewRebalanceService().(*rebalanceService)
+
+	useStore(t, &store{
+		disk:         NewDiskService(db),
+		localStorage: v2.NewLocalStorageService(db, nil),
+		snapraid:     NewSnapRAIDService(),
+		rebalance:    rebalance,
+	})
+
+	// the root filesystem is always mounted
+	data := model2.Volume{UUID: "e1b7c7a4-3c2d-4f0e-9a8b-6d5c4b3a2f01", MountPoint: "/"}
+	parity := model2.Volume{UUID: "e1b7c7a4-3c2d-4f0e-9a8b-6d5c4b3a2f02", MountPoint: "/"}
+
+	for _, volume := range []*model2.Volume{&data, &parity} {
+		assert.NilError(t, db.Create(volume).Error)
+	}
+
+	merge := model2.Merge{MountPoint: "/var/lib/casaos/files", SourceVolumes: []*model2.Volume{&data}}
+	assert.NilError(t, db.Create(&merge).Error)
+
+	assert.NilError(t, MyService.LocalStorage().SaveSnapRAIDInDB(&model2.SnapRAID{
+		MergeID:       merge.ID,
+		DataVolumes:   []string{data.UUID},
+		ParityVolumes: []string{parity.UUID},
+	}))
+
+	rebalance.status = &RebalanceStatus{JobState: JobState{MountPoint: merge.MountPoint, State: RebalanceStateMoving}, Operation: RebalanceOperationDrain}
+
+	_, err := MyService.SnapRAID().Run(merge.ID, snapraid.CommandSync)
+	assert.ErrorIs(t, err, ErrRebalanceRunning)
+	assert.Assert(t, MyService.SnapRAID().LastRun(merge.ID) == nil)
+}
@@ -102,13 +102,17 @@ func (s *storageStruct) MountStorage(mountPoint, deviceName string) error {
 		}
 		mountMu.Lock()
 		defer mountMu.Unlock()
-		delete(MountLists, mountPoint)
+		// the mount point could have been mounted again in the meantime, e.g. by the watchdog
+		if MountLists[mountPoint] == mnt {
+			delete(MountLists, mountPoint)
+		}
 	}()
 	MountLists[mountPoint] = mnt
 	return nil
 }
 
 func (s *storageStruct) UnmountStorage(mountPoint string) error {
+	MyService.Watchdog().Forget(mountPoint)
 	err := MountLists[mountPoint].Unmount()
 	if err != nil {
 		logger.Error("when umount then", zap.Error(err))
@@ -118,7 +122,8 @@ func (s *storageStruct) UnmountStorage(mountPoint string) error {
 }
 
 func (s *storageStruct) UnmountAllStorage() {
-	for _, v := range MountLists {
+	for k, v := range MountLists {
+		MyService.Watchdog().Forget(k)
 		err := v.Unmount()
 		if err != nil {
 			logger.Error("when umount then", zap.Error(err))
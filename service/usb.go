@@ -2,23 +2,41 @@ package service
 
 import (
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/IceWhaleTech/CasaOS-Common/utils/command"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
 	"github.com/shirou/gopsutil/host"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 type USBService interface {
 	UpdateUSBAutoMount(state string)
-	ExecUSBAutoMountShell(state string)
+	ApplyUSBAutoMount(state string)
+
+	GetUSBRules() ([]model2.USBRule, error)
+	CreateUSBRule(rule *model2.USBRule) error
+	UpdateUSBRule(rule *model2.USBRule) error
+	DeleteUSBRule(id uint) error
+	MatchUSBRule(device USBDevice) (model2.USBRule, error)
+
+	GetUSBPartitions() ([]USBPartition, error)
+	AutoMountUSB(device USBDevice) error
+	AutoUmountUSB(devicePath string) error
+	MountAllUSB()
 
 	GetSysInfo() host.InfoStat
 	GetDeviceTree() (string, error)
 }
 
-type usbService struct{}
+type usbService struct {
+	db *gorm.DB
+	mu sync.Mutex // so that a partition is not mounted twice, as it is plugged in while all are being mounted
+}
 
 func (s *usbService) UpdateUSBAutoMount(state string) {
 	config.ServerInfo.USBAutoMount = state
@@ -28,16 +46,18 @@ func (s *usbService) UpdateUSBAutoMount(state string) {
 	}
 }
 
-func (s *usbService) ExecUSBAutoMountShell(state string) {
-	if state == "False" {
-		if _, err := command.OnlyExec("source " + config.AppInfo.ShellPath + "/local-storage-helper.sh ;USB_Stop_Auto"); err != nil {
-			logger.Error("error when executing shell script to stop USB automount", zap.Error(err))
-		}
-	} else {
-		if _, err := command.OnlyExec("source " + config.AppInfo.ShellPath + "/local-storage-helper.sh ;USB_Start_Auto"); err != nil {
-			logger.Error("error when executing shell script to start USB automount", zap.Error(err))
-		}
+// ApplyUSBAutoMount applies the USB automount state. Either way udevil is stopped from mounting USB drives, which is
+// up to the USB rules of this service instead - then the ones already plugged in are mounted, unless state is False.
+func (s *usbService) ApplyUSBAutoMount(state string) {
+	if _, err := command.OnlyExec("source " + config.AppInfo.ShellPath + "/local-storage-helper.sh ;USB_Stop_Auto"); err != nil {
+		logger.Error("error when executing shell script to stop USB automount", zap.Error(err))
+	}
+
+	if strings.EqualFold(state, "False") {
+		return
 	}
+
+	s.MountAllUSB()
 }
 
 func (s *usbService) GetSysInfo() host.InfoStat {
@@ -64,6 +84,6 @@ func (s *usbService) GetDeviceTree() (string, error) {
 	return string(deviceTree), nil
 }
 
-func NewUSBService() USBService {
-	return &usbService{}
+func NewUSBService(db *gorm.DB) USBService {
+	return &usbService{db: db}
 }
@@ -0,0 +1,449 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/file"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mountpoint"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/moby/sys/mountinfo"
+	"go.uber.org/zap"
+)
+
+const (
+	USBRuleActionMount    = "mount"
+	USBRuleActionReadOnly = "readonly"
+	USBRuleActionIgnore   = "ignore"
+)
+
+var (
+	ErrUSBRuleNotFound = errors.New("usb rule not found")
+	ErrInvalidUSBRule  = errors.New("invalid usb rule")
+
+	// filesystems without ownership of their own, which take the owner of all their files as mount options
+	ownerlessFSTypes = []string{"vfat", "exfat", "ntfs", "ntfs3", "hfsplus", "iso9660", "udf"}
+)
+
+// USBDevice is a partition of a USB drive, as udev sees it.
+type USBDevice struct {
+	Path      string `json:"path"` // e.g. /dev/sdc1
+	VendorID  string `json:"vendor_id"`
+	ProductID string `json:"product_id"`
+	Serial    string `json:"serial"`
+	Vendor    string `json:"vendor"`
+	Model     string `json:"model"`
+	FSType    string `json:"fstype"`
+	Label     string `json:"label"`
+	UUID      string `json:"uuid"`
+}
+
+// USBPartition is a partition of a USB drive plugged in, with the rule that applies to it.
+type USBPartition struct {
+	USBDevice
+
+	Rule       model2.USBRule `json:"rule"`        // with an ID of 0 if no rule matches
+	MountPoint string         `json:"mount_point"` // empty if not mounted
+}
+
+// USBDeviceFromEnv returns the device of a uevent, or of the properties udev has for it.
+func USBDeviceFromEnv(env map[string]string) USBDevice {
+	devicePath := env["DEVNAME"]
+	if devicePath != "" && !filepath.IsAbs(devicePath) {
+		devicePath = filepath.Join("/dev", devicePath)
+	}
+
+	return USBDevice{
+		Path:      devicePath,
+		VendorID:  env["ID_VENDOR_ID"],
+		ProductID: env["ID_MODEL_ID"],
+		Serial:    env["ID_SERIAL_SHORT"],
+		Vendor:    env["ID_VENDOR"],
+		Model:     env["ID_MODEL"],
+		FSType:    env["ID_FS_TYPE"],
+		Label:     env["ID_FS_LABEL"],
+		UUID:      env["ID_FS_UUID"],
+	}
+}
+
+func (s *usbService) GetUSBRules() ([]model2.USBRule, error) {
+	var rules []model2.USBRule
+
+	if err := s.db.Order("priority, id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (s *usbService) CreateUSBRule(rule *model2.USBRule) error {
+	if err := validateUSBRule(*rule); err != nil {
+		return err
+	}
+
+	rule.ID = 0
+	return s.db.Create(rule).Error
+}
+
+// UpdateUSBRule replaces the rule with the ID of rule, or returns ErrUSBRuleNotFound
+func (s *usbService) UpdateUSBRule(rule *model2.USBRule) error {
+	if err := validateUSBRule(*rule); err != nil {
+		return err
+	}
+
+	var existing model2.USBRule
+	if result := s.db.Limit(1).Find(&existing, rule.ID); result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return ErrUSBRuleNotFound
+	}
+
+	rule.CreatedAt = existing.CreatedAt
+	return s.db.Save(rule).Error
+}
+
+func (s *usbService) DeleteUSBRule(id uint) error {
+	if result := s.db.Delete(&model2.USBRule{}, id); result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return ErrUSBRuleNotFound
+	}
+
+	return nil
+}
+
+// MatchUSBRule returns the first rule to match device - or, if none does, one to mount it. Nothing is mounted if USB auto-mount is off.
+func (s *usbService) MatchUSBRule(device USBDevice) (model2.USBRule, error) {
+	if strings.EqualFold(config.ServerInfo.USBAutoMount, "False") {
+		return model2.USBRule{Name: "USB auto-mount is off", Action: USBRuleActionIgnore}, nil
+	}
+
+	rules, err := s.GetUSBRules()
+	if err != nil {
+		return model2.USBRule{}, err
+	}
+
+	return matchUSBRule(rules, device), nil
+}
+
+func (s *usbService) GetUSBPartitions() ([]USBPartition, error) {
+	mounts, err := mountinfo.GetMounts(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]USBPartition, 0)
+	for _, device := range s.getUSBDevices() {
+		rule, err := s.MatchUSBRule(device)
+		if err != nil {
+			return nil, err
+		}
+
+		partition := USBPartition{USBDevice: device, Rule: rule}
+		for _, m := range mounts {
+			if m.Source == device.Path {
+				partition.MountPoint = m.Mountpoint
+				break
+			}
+		}
+
+		partitions = append(partitions, partition)
+	}
+
+	return partitions, nil
+}
+
+// AutoMountUSB mounts device as the rule that applies to it says - unless it is a volume, which is up to the reconciler, or mounted already.
+func (s *usbService) AutoMountUSB(device USBDevice) error {
+	if device.Path == "" || !mountableFSType(device.FSType) {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return err
+	}
+
+	if isVolumeDevice(device, volumes) {
+		return nil
+	}
+
+	mounts, err := mountinfo.GetMounts(sourceFilter(device.Path))
+	if err != nil {
+		return err
+	}
+
+	if len(mounts) > 0 {
+		return nil
+	}
+
+	rule, err := s.MatchUSBRule(device)
+	if err != nil {
+		return err
+	}
+
+	if rule.Action == USBRuleActionIgnore {
+		logger.Info("USB partition is not mounted as per rule", zap.String("device", device.Path), zap.String("rule", rule.Name))
+		return nil
+	}
+
+	mountPoint := usbMountPoint(rule, device, volumes)
+	if err := os.MkdirAll(mountPoint, 0o755); err != nil {
+		return err
+	}
+
+	options := usbMountOptions(rule, device.FSType)
+	if err := mount.Mount(device.Path, mountPoint, nil, &options); err != nil {
+		if err := os.Remove(mountPoint); err != nil {
+			logger.Error("error when removing mount point", zap.Error(err), zap.String("mount point", mountPoint))
+		}
+		return fmt.Errorf("%w: %s", err, device.Path)
+	}
+
+	logger.Info("USB partition mounted", zap.String("device", device.Path), zap.String("mount point", mountPoint), zap.String("options", options), zap.String("rule", rule.Name))
+	return nil
+}
+
+// AutoUmountUSB lazily umounts devicePath once it is removed, along with the mount points left empty - except for volumes, which are up to the watchdog.
+func (s *usbService) AutoUmountUSB(devicePath string) error {
+	mounts, err := mountinfo.GetMounts(sourceFilter(devicePath))
+	if err != nil {
+		return err
+	}
+
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, m := range mounts {
+		if slices.ContainsFunc(volumes, func(volume model2.Volume) bool { return volume.MountPoint == m.Mountpoint }) {
+			continue
+		}
+
+		if err := mount.UmountLazy(m.Mountpoint); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if empty, err := file.IsDirEmpty(m.Mountpoint); err == nil && empty {
+			if err := os.Remove(m.Mountpoint); err != nil {
+				logger.Error("error when removing mount point", zap.Error(err), zap.String("mount point", m.Mountpoint))
+			}
+		}
+
+		logger.Info("USB partition umounted", zap.String("device", devicePath), zap.String("mount point", m.Mountpoint))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *usbService) MountAllUSB() {
+	for _, device := range s.getUSBDevices() {
+		if err := s.AutoMountUSB(device); err != nil {
+			logger.Error("error when auto-mounting USB partition", zap.Error(err), zap.String("device", device.Path))
+		}
+	}
+}
+
+// getUSBDevices returns the partitions of the USB drives plugged in, with the properties udev has for them.
+func (s *usbService) getUSBDevices() []USBDevice {
+	devices := make([]USBDevice, 0)
+	for _, disk := range MyService.Disk().LSBLK(false) {
+		if disk.Tran != "usb" {
+			continue
+		}
+
+		for _, part := range disk.Children {
+			out, err := command.ExecuteCommand("udevadm", "info", "--query=property", "--name="+part.Path)
+			if err != nil {
+				logger.Error("error when getting udev properties of USB partition", zap.Error(err), zap.String("device", part.Path))
+				continue
+			}
+
+			devices = append(devices, USBDeviceFromEnv(parseUdevProperties(string(out))))
+		}
+	}
+
+	return devices
+}
+
+func validateUSBRule(rule model2.USBRule) error {
+	switch rule.Action {
+	case USBRuleActionMount, USBRuleActionReadOnly, USBRuleActionIgnore:
+	default:
+		return fmt.Errorf("%w: action should be mount, readonly or ignore", ErrInvalidUSBRule)
+	}
+
+	for _, pattern := range []string{rule.VendorID, rule.ProductID, rule.Serial, rule.FSType, rule.Label} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: %s - %s", ErrInvalidUSBRule, err.Error(), pattern)
+		}
+	}
+
+	if rule.MountPointTemplate != "" {
+		if err := mountpoint.Validate(rule.MountPointTemplate); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidUSBRule, err.Error())
+		}
+	}
+
+	if (rule.UID != nil && *rule.UID < 0) || (rule.GID != nil && *rule.GID < 0) {
+		return fmt.Errorf("%w: uid and gid should not be negative", ErrInvalidUSBRule)
+	}
+
+	return nil
+}
+
+// matchUSBRule returns the first of rules to match device, or one to mount it if none does.
+func matchUSBRule(rules []model2.USBRule, device USBDevice) model2.USBRule {
+	for _, rule := range rules {
+		if matchGlob(rule.VendorID, device.VendorID) &&
+			matchGlob(rule.ProductID, device.ProductID) &&
+			matchGlob(rule.Serial, device.Serial) &&
+			matchGlob(rule.FSType, device.FSType) &&
+			matchGlob(rule.Label, device.Label) {
+			return rule
+		}
+	}
+
+	return model2.USBRule{Name: "default", Action: USBRuleActionMount}
+}
+
+func matchGlob(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && matched
+}
+
+func usbMountOptions(rule model2.USBRule, fsType string) string {
+	options := []string{"nosuid", "nodev"}
+
+	if rule.Action == USBRuleActionReadOnly {
+		options = append(options, "ro")
+	}
+
+	// others keep the owners of their files, so there is nothing to set
+	if slices.Contains(ownerlessFSTypes, fsType) {
+		if rule.UID != nil {
+			options = append(options, "uid="+strconv.Itoa(*rule.UID))
+		}
+
+		if rule.GID != nil {
+			options = append(options, "gid="+strconv.Itoa(*rule.GID))
+		}
+	}
+
+	return strings.Join(options, ",")
+}
+
+func usbMountPoint(rule model2.USBRule, device USBDevice, volumes []model2.Volume) string {
+	template := rule.MountPointTemplate
+	if template == "" {
+		template = config.ServerInfo.AutoMountPointTemplate
+	}
+
+	values := mountpoint.Values{
+		Label:  device.Label,
+		Model:  device.Model,
+		Serial: device.Serial,
+		Vendor: device.Vendor,
+		UUID:   device.UUID,
+		Device: filepath.Base(device.Path),
+	}
+
+	mountPoint, err := mountpoint.Render(template, values)
+	if err != nil {
+		logger.Error("error when rendering mount point template - using default template", zap.Error(err), zap.String("template", template))
+		if mountPoint, err = mountpoint.Render(mountpoint.DefaultAutoTemplate, values); err != nil {
+			mountPoint = filepath.Join("/media", values.Device)
+		}
+	}
+
+	return mountpoint.Resolve(mountPoint, device.UUID, func(path string) bool {
+		for _, volume := range volumes {
+			if volume.MountPoint == path {
+				return true
+			}
+		}
+
+		if mounted, err := mountinfo.Mounted(path); err == nil && mounted {
+			return true
+		}
+
+		if file.Exists(path) {
+			empty, err := file.IsDirEmpty(path)
+			return err != nil || !empty
+		}
+
+		return false
+	})
+}
+
+// isVolumeDevice tells if device is one of volumes - by UUID, or by device path if it has none yet, e.g. as udev has not
+// probed it, so that it is not mounted both here and by the reconciler.
+func isVolumeDevice(device USBDevice, volumes []model2.Volume) bool {
+	uuid := device.UUID
+	if uuid == "" {
+		uuid, _ = partition.GetUUID(device.Path)
+	}
+
+	for _, volume := range volumes {
+		if volume.UUID == "" {
+			continue
+		}
+
+		if uuid != "" {
+			if volume.UUID == uuid {
+				return true
+			}
+			continue
+		}
+
+		// as the reconciler finds the device to mount the volume from
+		if devicePath, err := partition.GetDevicePath(volume.UUID); err == nil && devicePath == device.Path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mountableFSType tells if a filesystem of fsType can be mounted as is - unlike e.g. an encrypted or a RAID member.
+func mountableFSType(fsType string) bool {
+	return fsType != "" && fsType != "swap" && fsType != "crypto_LUKS" && !strings.HasSuffix(fsType, "_member")
+}
+
+func sourceFilter(source string) mountinfo.FilterFunc {
+	return func(i *mountinfo.Info) (skip bool, stop bool) {
+		return i.Source != source, false
+	}
+}
+
+func parseUdevProperties(output string) map[string]string {
+	env := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), "="); found {
+			env[key] = value
+		}
+	}
+
+	return env
+}
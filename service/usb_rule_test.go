@@ -0,0 +1,150 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/moby/sys/mountinfo"
+	"gotest.tools/v3/assert"
+)
+
+func TestMatchUSBRule(t *testing.T) {
+	uid := 1000
+
+	rules := []model2.USBRule{
+		{Name: "backup", VendorID: "0781", Label: "backup*", Action: USBRuleActionMount, UID: &uid},
+		{Name: "cameras", FSType: "exfat", Action: USBRuleActionReadOnly},
+		{Name: "everything else", Action: USBRuleActionIgnore},
+	}
+
+	backup := USBDevice{Path: "/dev/sdc1", VendorID: "0781", ProductID: "5581", FSType: "vfat", Label: "BACKUP-2024"}
+	assert.Equal(t, matchUSBRule(rules, backup).Name, "backup")
+
+	camera := USBDevice{Path: "/dev/sdd1", VendorID: "054c", FSType: "exfat", Label: "Backup"}
+	assert.Equal(t, matchUSBRule(rules, camera).Name, "cameras")
+
+	other := USBDevice{Path: "/dev/sde1", FSType: "ext4"}
+	assert.Equal(t, matchUSBRule(rules, other).Name, "everything else")
+
+	assert.Equal(t, matchUSBRule(nil, other).Action, USBRuleActionMount)
+}
+
+func TestUSBMountOptions(t *testing.T) {
+	uid, gid := 1000, 100
+
+	rule := model2.USBRule{Action: USBRuleActionReadOnly, UID: &uid, GID: &gid}
+	assert.Equal(t, usbMountOptions(rule, "exfat"), "nosuid,nodev,ro,uid=1000,gid=100")
+	assert.Equal(t, usbMountOptions(rule, "ext4"), "nosuid,nodev,ro")
+
+	rule = model2.USBRule{Action: USBRuleActionMount}
+	assert.Equal(t, usbMountOptions(rule, "vfat"), "nosuid,nodev")
+}
+
+func TestValidateUSBRule(t *testing.T) {
+	assert.NilError(t, validateUSBRule(model2.USBRule{Action: USBRuleActionIgnore, Label: "Backup*"}))
+	assert.ErrorIs(t, validateUSBRule(model2.USBRule{Action: "eject"}), ErrInvalidUSBRule)
+	assert.ErrorIs(t, validateUSBRule(model2.USBRule{Action: USBRuleActionMount, Serial: "[4C53"}), ErrInvalidUSBRule)
+	assert.ErrorIs(t, validateUSBRule(model2.USBRule{Action: USBRuleActionMount, MountPointTemplate: "/srv/{label}"}), ErrInvalidUSBRule)
+
+	uid := -1
+	assert.ErrorIs(t, validateUSBRule(model2.USBRule{Action: USBRuleActionMount, UID: &uid}), ErrInvalidUSBRule)
+}
+
+func TestUSBDeviceFromEnv(t *testing.T) {
+	output := "DEVNAME=/dev/sdc1\nDEVTYPE=partition\nID_BUS=usb\nID_VENDOR_ID=0781\nID_MODEL_ID=5581\nID_SERIAL_SHORT=4C530001231218112092\nID_FS_TYPE=exfat\nID_FS_LABEL=Backup\nID_FS_UUID=6E3B-1A2C\n"
+
+	device := USBDeviceFromEnv(parseUdevProperties(output))
+	assert.DeepEqual(t, device, USBDevice{
+		Path:      "/dev/sdc1",
+		VendorID:  "0781",
+		ProductID: "5581",
+		Serial:    "4C530001231218112092",
+		FSType:    "exfat",
+		Label:     "Backup",
+		UUID:      "6E3B-1A2C",
+	})
+
+	assert.Equal(t, USBDeviceFromEnv(map[string]string{"DEVNAME": "sdc1"}).Path, "/dev/sdc1")
+}
+
+func TestUSBRules(t *testing.T) {
+	db := newTestDB(t)
+	usb := NewUSBService(db)
+
+	second := model2.USBRule{Name: "second", Priority: 20, Action: USBRuleActionIgnore}
+	first := model2.USBRule{Name: "first", Priority: 10, FSType: "exfat", Action: USBRuleActionReadOnly}
+
+	assert.NilError(t, usb.CreateUSBRule(&second))
+	assert.NilError(t, usb.CreateUSBRule(&first))
+	assert.ErrorIs(t, usb.CreateUSBRule(&model2.USBRule{Action: "eject"}), ErrInvalidUSBRule)
+
+	rules, err := usb.GetUSBRules()
+	assert.NilError(t, err)
+	assert.Equal(t, len(rules), 2)
+	assert.Equal(t, rules[0].Name, "first")
+
+	config.ServerInfo.USBAutoMount = "True"
+
+	rule, err := usb.MatchUSBRule(USBDevice{FSType: "exfat"})
+	assert.NilError(t, err)
+	assert.Equal(t, rule.ID, first.ID)
+
+	first.Priority = 30
+	assert.NilError(t, usb.UpdateUSBRule(&first))
+
+	rule, err = usb.MatchUSBRule(USBDevice{FSType: "exfat"})
+	assert.NilError(t, err)
+	assert.Equal(t, rule.ID, second.ID)
+
+	config.ServerInfo.USBAutoMount = "False"
+
+	rule, err = usb.MatchUSBRule(USBDevice{FSType: "exfat"})
+	assert.NilError(t, err)
+	assert.Equal(t, rule.ID, uint(0))
+	assert.Equal(t, rule.Action, USBRuleActionIgnore)
+
+	assert.NilError(t, usb.DeleteUSBRule(second.ID))
+	assert.ErrorIs(t, usb.DeleteUSBRule(second.ID), ErrUSBRuleNotFound)
+	assert.ErrorIs(t, usb.UpdateUSBRule(&second), ErrUSBRuleNotFound)
+}
+
+func TestAutoMountUSBSkipped(t *testing.T) {
+	db := newTestDB(t)
+
+	useStore(t, &store{
+		disk: NewDiskService(db),
+		usb:  NewUSBService(db),
+	})
+
+	volume := model2.Volume{UUID: "9d8c7b6a-5f4e-4d3c-8b2a-1f0e9d8c7b6a", MountPoint: "/media/Backup"}
+	assert.NilError(t, db.Create(&volume).Error)
+
+	// udev may not have probed the UUID yet, unlike blkid
+	bin := t.TempDir()
+	blkid := "#!/bin/sh\n" +
+		"[ \"$2\" = \"" + volume.UUID + "\" ] && echo /dev/sdz1 && exit 0\n" +
+		"[ \"$5\" = /dev/sdz1 ] && echo " + volume.UUID + " && exit 0\n" +
+		"exit 2\n"
+	assert.NilError(t, os.WriteFile(filepath.Join(bin, "blkid"), []byte(blkid), 0o755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	// so that AutoMountUSB fails if it gets as far as matching a rule, rather than mounting anything
+	assert.NilError(t, db.Migrator().DropTable(&model2.USBRule{}))
+	config.ServerInfo.USBAutoMount = "True"
+
+	assert.Assert(t, MyService.USB().AutoMountUSB(USBDevice{Path: "/dev/sdy1", FSType: "exfat"}) != nil)
+
+	// a volume, which is up to the reconciler
+	assert.NilError(t, MyService.USB().AutoMountUSB(USBDevice{Path: "/dev/sdz1", FSType: "ext4", UUID: volume.UUID}))
+	assert.NilError(t, MyService.USB().AutoMountUSB(USBDevice{Path: "/dev/sdz1", FSType: "ext4"}))
+
+	// mounted already
+	mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter("/"))
+	assert.NilError(t, err)
+	assert.Assert(t, len(mounts) > 0)
+
+	assert.NilError(t, MyService.USB().AutoMountUSB(USBDevice{Path: mounts[0].Source, FSType: "ext4", UUID: "4e5f6a7b-8c9d-4e0f-9a1b-2c3d4e5f6a7b"}))
+}
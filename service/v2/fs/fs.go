@@ -42,3 +42,23 @@ func ExtendAll(m codegen.Mount) *codegen.Mount {
 
 	return &m
 }
+
+// Mounter is implemented by an extension that mounts its filesystem itself, rather than through mount(8).
+type Mounter interface {
+	Mount(m codegen.Mount) error
+}
+
+// MounterOf returns the extension that mounts filesystems of fstype itself, if any.
+func MounterOf(fstype string) Mounter {
+	for _, ext := range ExtensionMap {
+		if ext.GetFSType() != fstype && ext.GetFSTypeFull() != fstype {
+			continue
+		}
+
+		if mounter, ok := ext.(Mounter); ok {
+			return mounter
+		}
+	}
+
+	return nil
+}
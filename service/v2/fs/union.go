@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"sync"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/union"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/merge"
+)
+
+const (
+	UnionFS         = union.Subtype
+	UnionFSFullName = union.FSType
+)
+
+// checked once, as it logs - mergerfs installed later is used after a restart
+var isMergerFSInstalled = sync.OnceValue(merge.IsMergerFSInstalled)
+
+type unionFS struct{}
+
+func init() {
+	if ExtensionMap == nil {
+		ExtensionMap = make(map[string]Extension)
+	}
+
+	// register itself to ExtensionMap
+	ExtensionMap[UnionFS] = &unionFS{}
+}
+
+func (f *unionFS) GetFSType() string {
+	return UnionFS
+}
+
+func (f *unionFS) GetFSTypeFull() string {
+	return UnionFSFullName
+}
+
+func (f *unionFS) PreMount(m codegen.Mount) *codegen.Mount {
+	if m.Fstype == nil || *m.Fstype != UnionFS {
+		return &m
+	}
+
+	fstype := UnionFSFullName
+	m.Fstype = &fstype
+
+	return &m
+}
+
+func (f *unionFS) PostMount(m codegen.Mount) *codegen.Mount {
+	return &m
+}
+
+func (f *unionFS) Extend(m codegen.Mount) *codegen.Mount {
+	return &m
+}
+
+// Mount serves the union in this process, so it is gone when the process exits, until merges are restored on next start.
+func (f *unionFS) Mount(m codegen.Mount) error {
+	source, options := "", ""
+	if m.Source != nil {
+		source = *m.Source
+	}
+	if m.Options != nil {
+		options = *m.Options
+	}
+
+	return union.Mount(m.MountPoint, source, options)
+}
+
+// MergeFSType returns the filesystem type to mount a merge of fstype with - the built-in union filesystem in place of
+// mergerfs when mergerfs is not installed, with fewer features.
+func MergeFSType(fstype string) string {
+	if fstype != MergerFSFullName && fstype != MergerFS {
+		return fstype
+	}
+
+	if isMergerFSInstalled() || !union.Available() {
+		return fstype
+	}
+
+	return UnionFSFullName
+}
+
+// IsMergeSupported tells if merges can be mounted, with mergerfs or else the built-in union filesystem.
+func IsMergeSupported() bool {
+	if isMergerFSInstalled() {
+		return true
+	}
+
+	if union.Available() {
+		logger.Info("mergerfs is not installed - merges are mounted with the built-in union filesystem, with fewer features")
+		return true
+	}
+
+	return false
+}
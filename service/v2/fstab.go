@@ -7,30 +7,158 @@ import (
 	"go.uber.org/zap"
 )
 
-func (s *LocalStorageService) SaveToFStab(m codegen.Mount) error {
-	ft := fstab.Get()
+func (s *LocalStorageService) GetFStabEntries() ([]codegen.FStabEntry, error) {
+	entries, err := fstab.Get().GetEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]codegen.FStabEntry, 0, len(entries))
+	for _, entry := range entries {
+		results = append(results, FStabEntryAdapterOut(entry))
+	}
+
+	return results, nil
+}
+
+func (s *LocalStorageService) GetFStabEntry(mountpoint string) (*codegen.FStabEntry, error) {
+	entry, err := fstab.Get().GetEntryByMountPoint(mountpoint)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := ft.Add(fstab.Entry{
+	if entry == nil {
+		return nil, fstab.ErrFSTabEntryNotFound
+	}
+
+	result := FStabEntryAdapterOut(entry)
+	return &result, nil
+}
+
+func (s *LocalStorageService) SaveToFStab(m codegen.Mount) error {
+	entry := fstab.Entry{
 		MountPoint: m.MountPoint,
 
-		Source:  *m.Source,
-		FSType:  *m.Fstype,
-		Options: *m.Options,
-		Dump:    0,
-		Pass:    fstab.PassDoNotCheck,
-	}, true); err != nil {
+		Dump: 0,
+		Pass: fstab.PassDoNotCheck,
+	}
+
+	if m.Source != nil {
+		entry.Source = *m.Source
+	}
+
+	if m.Fstype != nil {
+		entry.FSType = *m.Fstype
+	}
+
+	if m.Options != nil {
+		entry.Options = *m.Options
+	}
+
+	if err := fstab.Get().Add(entry, true); err != nil {
 		logger.Error("Error when trying to persist mount", zap.Error(err), zap.Any("mount", m))
 		return err
 	}
 	return nil
 }
 
+// AddToFStab appends e to fstab, unless an entry with the same mount point exists. If dryRun is true, the change is only verified.
+func (s *LocalStorageService) AddToFStab(e codegen.FStabEntry, dryRun bool) error {
+	ft := fstab.Get()
+	if dryRun {
+		ft = ft.DryRun()
+	}
+
+	if err := ft.Add(FStabEntryAdapterIn(e), false); err != nil {
+		logger.Error("Error when trying to add fstab entry", zap.Error(err), zap.Any("entry", e), zap.Bool("dry run", dryRun))
+		return err
+	}
+	return nil
+}
+
+// UpdateFStab replaces the fstab entry with mountpoint in place with e. If dryRun is true, the change is only verified.
+func (s *LocalStorageService) UpdateFStab(mountpoint string, e codegen.FStabEntry, dryRun bool) error {
+	ft := fstab.Get()
+	if dryRun {
+		ft = ft.DryRun()
+	}
+
+	if err := ft.Update(mountpoint, FStabEntryAdapterIn(e)); err != nil {
+		logger.Error("Error when trying to update fstab entry", zap.Error(err), zap.String("mount point", mountpoint), zap.Any("entry", e), zap.Bool("dry run", dryRun))
+		return err
+	}
+	return nil
+}
+
 func (s *LocalStorageService) RemoveFromFStab(mountpoint string) error {
+	return s.removeFromFStab(mountpoint, false)
+}
+
+// CommentOutFromFStab comments out the fstab entry with mountpoint, instead of removing it.
+func (s *LocalStorageService) CommentOutFromFStab(mountpoint string) error {
+	return s.removeFromFStab(mountpoint, true)
+}
+
+func (s *LocalStorageService) removeFromFStab(mountpoint string, comment bool) error {
 	ft := fstab.Get()
 
-	if err := ft.RemoveByMountPoint(mountpoint, false); err != nil {
+	if err := ft.RemoveByMountPoint(mountpoint, comment); err != nil {
 		logger.Error("Error when trying to unpersist mount", zap.Error(err), zap.String("mount point", mountpoint))
 		return err
 	}
 	return nil
 }
+
+func FStabEntryAdapterOut(e *fstab.Entry) codegen.FStabEntry {
+	dump := codegen.FStabEntryDump(e.Dump)
+	pass := codegen.FStabEntryPass(e.Pass)
+
+	result := codegen.FStabEntry{
+		Source:     e.Source,
+		MountPoint: e.MountPoint,
+		Fstype:     e.FSType,
+		Options:    &e.Options,
+		Dump:       &dump,
+		Pass:       &pass,
+	}
+
+	if e.Comment != "" {
+		result.Comment = &e.Comment
+	}
+
+	if e.LineNumber > 0 {
+		result.LineNumber = &e.LineNumber
+	}
+
+	if device := fstab.ResolveSource(e.Source); device != "" {
+		result.Device = &device
+	}
+
+	return result
+}
+
+func FStabEntryAdapterIn(e codegen.FStabEntry) fstab.Entry {
+	result := fstab.Entry{
+		Source:     e.Source,
+		MountPoint: e.MountPoint,
+		FSType:     e.Fstype,
+	}
+
+	if e.Options != nil {
+		result.Options = *e.Options
+	}
+
+	if e.Dump != nil {
+		result.Dump = int(*e.Dump)
+	}
+
+	if e.Pass != nil {
+		result.Pass = int(*e.Pass)
+	}
+
+	if e.Comment != nil {
+		result.Comment = *e.Comment
+	}
+
+	return result
+}
@@ -2,16 +2,21 @@ package v2
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"strings"
 
 	"github.com/IceWhaleTech/CasaOS-Common/utils"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/file"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/union"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/utils/command"
 	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2/fs"
 	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -22,6 +27,12 @@ var (
 	ErrMergeMountPointDoesNotExist   = errors.New("merge mount point does not exist")
 	ErrMergeMountPointSourceConflict = errors.New("source mount point should not be a child path of the merge mount point")
 	ErrNilReference                  = errors.New("reference is nil")
+	ErrMergeNotFound                 = errors.New("merge not found")
+	ErrMergeAlreadyExists            = errors.New("merge already exists")
+	ErrMergeMountPointOverlap        = errors.New("merge mount point should not be the same as, under or above the mount point or a source of another merge")
+	ErrMergeSourceInUse              = errors.New("source is already used by another merge")
+	ErrMergeSourceIsParity           = errors.New("source is a snapraid parity volume")
+	ErrMergeDefaultNotDeletable      = errors.New("the default merge cannot be deleted")
 )
 
 // Make sure the serial disk is removed from the merge list when it is deleted from database, to keep the database consistent.
@@ -90,6 +101,10 @@ func (s *LocalStorageService) CreateMerge(merge *model2.Merge) error {
 		return ErrNilReference
 	}
 
+	if err := MergeOptions(*merge).Validate(); err != nil {
+		return err
+	}
+
 	if err := file.IsNotExistMkDir(merge.MountPoint); err != nil {
 		return err
 	}
@@ -111,12 +126,15 @@ func (s *LocalStorageService) CreateMerge(merge *model2.Merge) error {
 		return ErrMountPointIsNotEmpty
 	}
 
-	// create a new merge by mounting mergerfs
+	// create a new merge by mounting mergerfs - or the built-in union filesystem, if mergerfs is not installed
 	source := strings.Join(sources, ":")
+	options := MergeOptions(*merge).WithDefaults(mergerfs.DefaultOptions).String()
+	fstype := fs.MergeFSType(merge.FSType)
 	if _, err := s.Mount(codegen.Mount{
 		MountPoint: merge.MountPoint,
-		Fstype:     &merge.FSType,
+		Fstype:     &fstype,
 		Source:     &source,
+		Options:    &options,
 	}); err != nil {
 		logger.Error("failed to mount mergerfs", zap.Error(err), zap.String("mountPoint", merge.MountPoint), zap.String("source", source))
 		return err
@@ -135,6 +153,11 @@ func (s *LocalStorageService) UpdateMerge(merge *model2.Merge) error {
 		return ErrMergeMountPointDoesNotExist
 	}
 
+	options := MergeOptions(*merge)
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
 	merge.SourceVolumes = excludeVolumesWithWrongMountPointAndUUID(merge.SourceVolumes)
 
 	sources, err := buildSources(merge)
@@ -158,50 +181,162 @@ func (s *LocalStorageService) UpdateMerge(merge *model2.Merge) error {
 		}
 	}
 
+	// the built-in union filesystem takes no option but minfreespace, and only when mounted
+	if union.IsMounted(merge.MountPoint) {
+		return nil
+	}
+
+	// apply the options live, with the defaults for any option not set, so that unsetting an option reverts it
+	if err := mergerfs.ApplyOptions(merge.MountPoint, options.WithDefaults(mergerfs.DefaultOptions)); err != nil {
+		logger.Error("failed to set mergerfs options", zap.Error(err), zap.String("mountPoint", merge.MountPoint), zap.Any("options", options))
+		return err
+	}
+
 	return nil
 }
 
-func (s *LocalStorageService) CheckMergeMount() {
-
-	mergesFromDB, err := s.GetMergeAllFromDB(nil)
-	if err != nil {
-		logger.Error("failed to get merge list from database", zap.Error(err))
-		return
+// ValidateMerge returns ErrMergeMountPointOverlap if the mount point of merge overlaps with another merge, or
+// ErrMergeSourceInUse if any of its sources is used by another merge - as two pools writing to the same disk would
+// each see the files of the other, and their usage would not add up.
+func (s *LocalStorageService) ValidateMerge(merge *model2.Merge) error {
+	if merge == nil {
+		logger.Error("`merge` should not be nil")
+		return ErrNilReference
 	}
 
-	mounts, err := s.GetMounts(codegen.GetMountsParams{})
+	merges, err := s.GetMergeAllFromDB(nil)
 	if err != nil {
-		logger.Error("failed to get mount list from system", zap.Error(err))
-		return
+		return err
 	}
 
-	for i := range mergesFromDB {
+	sources := mergeSourcePaths(merge)
+
+	for _, other := range merges {
+		if other.ID == merge.ID {
+			continue
+		}
+
+		if isUnder(merge.MountPoint, other.MountPoint) || isUnder(other.MountPoint, merge.MountPoint) {
+			return fmt.Errorf("%w: %s is merged at %s", ErrMergeMountPointOverlap, merge.MountPoint, other.MountPoint)
+		}
 
-		isMergeExist := false
+		for _, source := range mergeSourcePaths(&other) {
+			if isUnder(merge.MountPoint, source) || isUnder(source, merge.MountPoint) {
+				return fmt.Errorf("%w: %s is a source of the merge at %s", ErrMergeMountPointOverlap, source, other.MountPoint)
+			}
 
-		// for each merge from database by mount point, check if it already mounted, i.e. a mergerfs mount
-		for _, mount := range mounts {
-			if mount.MountPoint == mergesFromDB[i].MountPoint {
-				if *mount.Fstype == mergesFromDB[i].FSType {
-					logger.Info("merge already exists", zap.Any("merge", mergesFromDB[i]))
-					isMergeExist = true
-					break
+			for _, path := range sources {
+				if isUnder(path, source) || isUnder(source, path) {
+					return fmt.Errorf("%w: %s is a source of the merge at %s", ErrMergeSourceInUse, source, other.MountPoint)
 				}
-				logger.Error("not a mergerfs mount point", zap.Any("mount", mount))
 			}
 		}
 
-		if isMergeExist {
-			if err := s.UpdateMerge(&mergesFromDB[i]); err != nil {
-				logger.Error("failed to update merge", zap.Error(err), zap.Any("merge", mergesFromDB[i]))
+		for _, volume := range other.SourceVolumes {
+			for _, v := range merge.SourceVolumes {
+				if volume != nil && v != nil && volume.UUID == v.UUID {
+					return fmt.Errorf("%w: volume %s is a source of the merge at %s", ErrMergeSourceInUse, v.UUID, other.MountPoint)
+				}
 			}
+		}
+	}
+
+	return s.validateMergeParity(merge, sources)
+}
+
+// ValidateNewMerge returns an error if merge, to be created with its ID if it has one, has the ID or the mount point of
+// an existing merge, or is not valid as per ValidateMerge.
+func (s *LocalStorageService) ValidateNewMerge(merge *model2.Merge) error {
+	if merge == nil {
+		logger.Error("`merge` should not be nil")
+		return ErrNilReference
+	}
+
+	if merge.ID != 0 {
+		if _, err := s.GetMergeFromDB(merge.ID); err == nil {
+			return fmt.Errorf("%w: with id %d", ErrMergeAlreadyExists, merge.ID)
+		} else if !errors.Is(err, ErrMergeNotFound) {
+			return err
+		}
+	}
+
+	if existing, err := s.GetFirstMergeFromDB(merge.MountPoint); err != nil {
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("%w: %s", ErrMergeMountPointAlreadyExists, merge.MountPoint)
+	}
+
+	return s.ValidateMerge(merge)
+}
+
+// validateMergeParity returns an error if a source of merge is, or is under, a parity volume of a SnapRAID array -
+// files on it would not be protected, and would take the space the parity needs.
+func (s *LocalStorageService) validateMergeParity(merge *model2.Merge, sources []string) error {
+	snapraids, err := s.GetSnapRAIDAllFromDB()
+	if err != nil {
+		return err
+	}
+
+	for _, snapraid := range snapraids {
+		if len(snapraid.ParityVolumes) == 0 {
 			continue
-		} else {
-			if err := s.CreateMerge(&mergesFromDB[i]); err != nil {
-				logger.Error("failed to create merge", zap.Error(err), zap.Any("merge", mergesFromDB[i]))
+		}
+
+		var parities []model2.Volume
+		if err := s._db.Where("uuid IN ?", snapraid.ParityVolumes).Find(&parities).Error; err != nil {
+			return err
+		}
+
+		for _, parity := range parities {
+			for _, v := range merge.SourceVolumes {
+				if v != nil && v.UUID == parity.UUID {
+					return fmt.Errorf("%w: volume %s is a parity volume of the merge with id %d", ErrMergeSourceIsParity, v.UUID, snapraid.MergeID)
+				}
+			}
+
+			for _, path := range sources {
+				if parity.MountPoint != "" && (isUnder(path, parity.MountPoint) || isUnder(parity.MountPoint, path)) {
+					return fmt.Errorf("%w: %s is a parity volume of the merge with id %d", ErrMergeSourceIsParity, parity.MountPoint, snapraid.MergeID)
+				}
 			}
 		}
 	}
+
+	return nil
+}
+
+// DeleteMerge unmounts merge, removes its mount point if left empty, and deletes it from the database. Files on its sources are kept.
+func (s *LocalStorageService) DeleteMerge(merge *model2.Merge) error {
+	if merge == nil {
+		logger.Error("`merge` should not be nil")
+		return ErrNilReference
+	}
+
+	// it would be created again on next start
+	if merge.MountPoint == common.DefaultMountPoint {
+		return ErrMergeDefaultNotDeletable
+	}
+
+	if err := s.Umount(merge.MountPoint); err != nil && !errors.Is(err, ErrNotMounted) {
+		return err
+	}
+
+	if err := os.Remove(merge.MountPoint); err != nil && !os.IsNotExist(err) {
+		logger.Info("mount point of deleted merge is left as it is not empty", zap.Error(err), zap.String("mount point", merge.MountPoint))
+	}
+
+	return s.DeleteMergeInDB(merge)
+}
+
+// MergeOptions returns the mergerfs options set for merge.
+func MergeOptions(merge model2.Merge) mergerfs.Options {
+	return mergerfs.Options{
+		CategoryCreate: merge.CreatePolicy,
+		MinFreeSpace:   merge.MinFreeSpace,
+		MoveOnENOSPC:   merge.MoveOnENOSPC,
+		CacheFiles:     merge.CacheFiles,
+		Func:           merge.FuncPolicies,
+	}
 }
 
 // filter out any volume that are not mounted based on its UUID and mount point (in reality, could have a different disk mounted on the same path)
@@ -256,6 +391,23 @@ func filterVolumes(volumes []*model2.Volume, filter func(*model2.Volume) bool) [
 	return filteredVolumes
 }
 
+// mergeSourcePaths returns the source base path and the mount points of the source volumes of merge
+func mergeSourcePaths(merge *model2.Merge) []string {
+	paths := make([]string, 0, len(merge.SourceVolumes)+1)
+
+	if merge.SourceBasePath != nil && *merge.SourceBasePath != "" {
+		paths = append(paths, *merge.SourceBasePath)
+	}
+
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil && volume.MountPoint != "" {
+			paths = append(paths, volume.MountPoint)
+		}
+	}
+
+	return paths
+}
+
 func buildSources(merge *model2.Merge) ([]string, error) {
 	sources := make([]string, 0)
 
@@ -294,8 +446,25 @@ func buildSources(merge *model2.Merge) ([]string, error) {
 			return nil, ErrMergeMountPointSourceConflict
 		}
 
-		sources = append(sources, sourceVolume.MountPoint)
+		branch := MergeBranchOf(merge, sourceVolume)
+		if err := branch.Validate(); err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, branch.String())
 	}
 
 	return sources, nil
 }
+
+// MergeBranchOf returns the mergerfs branch for a source volume of merge, with its mode and minfreespace.
+func MergeBranchOf(merge *model2.Merge, volume *model2.Volume) mergerfs.Branch {
+	branch := mergerfs.Branch{Path: volume.MountPoint}
+
+	if b, ok := merge.Branches[volume.UUID]; ok {
+		branch.Mode = b.Mode
+		branch.MinFreeSpace = b.MinFreeSpace
+	}
+
+	return branch
+}
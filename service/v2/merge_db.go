@@ -4,6 +4,7 @@ import (
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/sqlite"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
 	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"gorm.io/gorm"
 )
 
 func init() {
@@ -39,21 +40,42 @@ func (s *LocalStorageService) GetFirstMergeFromDB(mountPoint string) (*model2.Me
 	return &merge, nil
 }
 
+// GetMergeFromDB returns the merge with id, or ErrMergeNotFound
+func (s *LocalStorageService) GetMergeFromDB(id uint) (*model2.Merge, error) {
+	var merge model2.Merge
+
+	if result := s._db.Preload(model2.MergeSourceVolumes).Limit(1).Find(&merge, id); result.Error != nil {
+		return nil, result.Error
+	} else if result.RowsAffected == 0 {
+		return nil, ErrMergeNotFound
+	}
+
+	return &merge, nil
+}
+
 func (s *LocalStorageService) UpdateMergeSourcesInDB(existingMergeInDB *model2.Merge) error {
 	if existingMergeInDB == nil {
 		return nil
 	}
 
-	if err := s._db.Model(existingMergeInDB).Update(model.MergeSourceBasePath, existingMergeInDB.SourceBasePath).Error; err != nil {
+	return updateMergeSources(s._db, existingMergeInDB)
+}
+
+func updateMergeSources(db *gorm.DB, existingMergeInDB *model2.Merge) error {
+	if err := db.Model(existingMergeInDB).Update(model.MergeSourceBasePath, existingMergeInDB.SourceBasePath).Error; err != nil {
+		return err
+	}
+
+	if err := db.Model(existingMergeInDB).Select(model.MergeBranches).Updates(existingMergeInDB).Error; err != nil {
 		return err
 	}
 
 	// start association mode
-	if err := s._db.Model(existingMergeInDB).Association(model2.MergeSourceVolumes).Error; err != nil {
+	if err := db.Model(existingMergeInDB).Association(model2.MergeSourceVolumes).Error; err != nil {
 		return err
 	}
 
-	if err := s._db.Model(existingMergeInDB).Association(model2.MergeSourceVolumes).Replace(existingMergeInDB.SourceVolumes); err != nil {
+	if err := db.Model(existingMergeInDB).Association(model2.MergeSourceVolumes).Replace(existingMergeInDB.SourceVolumes); err != nil {
 		return err
 	}
 
@@ -66,3 +88,36 @@ func (s *LocalStorageService) CreateMergeInDB(merge *model2.Merge) error {
 	}
 	return nil
 }
+
+func (s *LocalStorageService) UpdateMergeOptionsInDB(existingMergeInDB *model2.Merge) error {
+	if existingMergeInDB == nil {
+		return nil
+	}
+
+	return updateMergeOptions(s._db, existingMergeInDB)
+}
+
+func updateMergeOptions(db *gorm.DB, existingMergeInDB *model2.Merge) error {
+	return db.Model(existingMergeInDB).Select(model2.MergeOptionColumns).Updates(existingMergeInDB).Error
+}
+
+// UpdateMergeInDB updates both the sources and the options of the merge in one transaction, so that either all of
+// them are saved or none.
+func (s *LocalStorageService) UpdateMergeInDB(existingMergeInDB *model2.Merge) error {
+	if existingMergeInDB == nil {
+		return nil
+	}
+
+	return s._db.Transaction(func(tx *gorm.DB) error {
+		if err := updateMergeSources(tx, existingMergeInDB); err != nil {
+			return err
+		}
+
+		return updateMergeOptions(tx, existingMergeInDB)
+	})
+}
+
+// DeleteMergeInDB deletes merge along with its links to its source volumes in o_merge_disk - not the volumes.
+func (s *LocalStorageService) DeleteMergeInDB(merge *model2.Merge) error {
+	return s._db.Select(model2.MergeSourceVolumes).Delete(merge).Error
+}
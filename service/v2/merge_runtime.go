@@ -0,0 +1,89 @@
+package v2
+
+import (
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/union"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+)
+
+// GetMergeRuntime returns the config of merge as the running mergerfs has it, with its version and pid, and how it
+// drifted from the branches and options saved for merge. The error is in the result, e.g. if merge is not mounted.
+func (s *LocalStorageService) GetMergeRuntime(merge model2.Merge) codegen.MergeRuntime {
+	result := codegen.MergeRuntime{
+		MergeId:    int(merge.ID),
+		MountPoint: merge.MountPoint,
+	}
+
+	runtime, err := mergerfs.GetRuntime(merge.MountPoint)
+	if err != nil {
+		message := err.Error()
+		result.Error = &message
+		return result
+	}
+
+	result.Mounted = true
+
+	if runtime.Version != "" {
+		result.Version = &runtime.Version
+	}
+
+	if runtime.PID != 0 {
+		result.Pid = &runtime.PID
+	}
+
+	branches := make([]codegen.MergeRuntimeBranch, 0, len(runtime.Branches))
+	for _, branch := range runtime.Branches {
+		b := codegen.MergeRuntimeBranch{Path: branch.Path, Mode: branch.Mode}
+		if b.Mode == "" {
+			b.Mode = mergerfs.BranchModeRW
+		}
+
+		if branch.MinFreeSpace != "" {
+			minFreeSpace := branch.MinFreeSpace
+			b.MinFreeSpace = &minFreeSpace
+		}
+
+		branches = append(branches, b)
+	}
+	result.Branches = &branches
+	result.Options = &runtime.Options
+
+	drifts := make([]codegen.MergeDrift, 0)
+	for _, drift := range runtime.Compare(mergeBranchesOf(&merge), expectedOptions(merge)) {
+		drifts = append(drifts, codegen.MergeDrift{Name: drift.Name, Expected: drift.Expected, Actual: drift.Actual})
+	}
+	result.Drift = &drifts
+	result.Drifted = len(drifts) > 0
+
+	return result
+}
+
+// mergeBranchesOf returns the branches saved for merge, in the order it is mounted with.
+func mergeBranchesOf(merge *model2.Merge) []mergerfs.Branch {
+	branches := make([]mergerfs.Branch, 0, len(merge.SourceVolumes)+1)
+
+	if merge.SourceBasePath != nil && *merge.SourceBasePath != "" {
+		branches = append(branches, mergerfs.Branch{Path: *merge.SourceBasePath})
+	}
+
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil {
+			branches = append(branches, MergeBranchOf(merge, volume))
+		}
+	}
+
+	return branches
+}
+
+// expectedOptions returns the options merge is mounted with - only minfreespace for the built-in union filesystem,
+// which takes no other.
+func expectedOptions(merge model2.Merge) mergerfs.Options {
+	options := MergeOptions(merge).WithDefaults(mergerfs.DefaultOptions)
+
+	if union.IsMounted(merge.MountPoint) {
+		return mergerfs.Options{MinFreeSpace: options.MinFreeSpace}
+	}
+
+	return options
+}
@@ -1,6 +1,8 @@
 package v2
 
 import (
+	"errors"
+	"slices"
 	"testing"
 
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/sqlite"
@@ -94,3 +96,174 @@ func TestHookAfterDeleteSerialDisk(t *testing.T) {
 	actualMerge = actualMerges[0]
 	assert.Equal(t, len(actualMerge.SourceVolumes), 0)
 }
+
+func TestLocateMergePathNotInMerge(t *testing.T) {
+	merge := model2.Merge{MountPoint: "/mnt/locate"}
+	assert.NilError(t, _db.Create(&merge).Error)
+	defer _db.Delete(&merge)
+
+	_, err := _service.LocateMergePath("/mnt/locate2/a.txt")
+	assert.ErrorIs(t, err, ErrPathNotInMerge)
+
+	assert.Assert(t, isUnder("/mnt/locate/a.txt", "/mnt/locate"))
+	assert.Assert(t, isUnder("/mnt/locate", "/mnt/locate/"))
+	assert.Assert(t, !isUnder("/mnt/locate2", "/mnt/locate"))
+}
+
+func TestValidateMerge(t *testing.T) {
+	volume1 := model2.Volume{UUID: "3f6b1b5e-8f8e-4a53-9d0e-2f1c1b8a0a01", MountPoint: "/srv/disk1"}
+	volume2 := model2.Volume{UUID: "3f6b1b5e-8f8e-4a53-9d0e-2f1c1b8a0a02", MountPoint: "/srv/disk2"}
+	assert.NilError(t, _db.Create(&volume1).Error)
+	assert.NilError(t, _db.Create(&volume2).Error)
+
+	media := model2.Merge{MountPoint: "/srv/media", SourceVolumes: []*model2.Volume{&volume1}}
+	assert.NilError(t, _db.Create(&media).Error)
+
+	// the merge itself is not a conflict
+	assert.NilError(t, _service.ValidateMerge(&media))
+
+	backup := model2.Merge{MountPoint: "/srv/backup", SourceVolumes: []*model2.Volume{&volume2}}
+	assert.NilError(t, _service.ValidateMerge(&backup))
+
+	assert.ErrorIs(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv/media/backup"}), ErrMergeMountPointOverlap)
+	assert.ErrorIs(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv"}), ErrMergeMountPointOverlap)
+	assert.ErrorIs(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv/disk1/backup"}), ErrMergeMountPointOverlap)
+	assert.ErrorIs(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv/backup", SourceVolumes: []*model2.Volume{&volume2, &volume1}}), ErrMergeSourceInUse)
+
+	sourceBasePath := "/srv/disk1/files"
+	assert.ErrorIs(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv/backup", SourceBasePath: &sourceBasePath}), ErrMergeSourceInUse)
+
+	// deleting the merge removes its links, not its volumes
+	merge, err := _service.GetMergeFromDB(media.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(merge.SourceVolumes), 1)
+
+	assert.NilError(t, _service.DeleteMergeInDB(merge))
+
+	_, err = _service.GetMergeFromDB(media.ID)
+	assert.ErrorIs(t, err, ErrMergeNotFound)
+
+	var links int64
+	assert.NilError(t, _db.Table("o_merge_disk").Where("merge_id = ?", media.ID).Count(&links).Error)
+	assert.Equal(t, links, int64(0))
+
+	var volume model2.Volume
+	assert.NilError(t, _db.Where(&model2.Volume{UUID: volume1.UUID}).First(&volume).Error)
+
+	assert.NilError(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv/media/backup"}))
+}
+
+func TestValidateMergeParity(t *testing.T) {
+	data := model2.Volume{UUID: "7a3c5e0d-2b6f-4c1e-8d9a-1e2f3a4b5c01", MountPoint: "/srv/array/data"}
+	parity := model2.Volume{UUID: "7a3c5e0d-2b6f-4c1e-8d9a-1e2f3a4b5c02", MountPoint: "/srv/array/parity"}
+	assert.NilError(t, _db.Create(&data).Error)
+	assert.NilError(t, _db.Create(&parity).Error)
+
+	array := model2.Merge{MountPoint: "/srv/protected", SourceVolumes: []*model2.Volume{&data}}
+	assert.NilError(t, _db.Create(&array).Error)
+
+	assert.NilError(t, _service.SaveSnapRAIDInDB(&model2.SnapRAID{
+		MergeID:       array.ID,
+		DataVolumes:   []string{data.UUID},
+		ParityVolumes: []string{parity.UUID},
+	}))
+
+	array.SourceVolumes = append(array.SourceVolumes, &parity)
+	assert.ErrorIs(t, _service.ValidateMerge(&array), ErrMergeSourceIsParity)
+
+	sourceBasePath := "/srv/array/parity/files"
+	assert.ErrorIs(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv/unprotected", SourceBasePath: &sourceBasePath}), ErrMergeSourceIsParity)
+
+	assert.NilError(t, _service.DeleteSnapRAIDInDB(array.ID))
+	assert.NilError(t, _service.ValidateMerge(&model2.Merge{MountPoint: "/srv/unprotected", SourceBasePath: &sourceBasePath}))
+}
+
+func TestValidateNewMerge(t *testing.T) {
+	volume := model2.Volume{UUID: "5b1e0c8a-7d2f-4e3a-9c6b-0a1b2c3d4e01", MountPoint: "/srv/pool/disk1"}
+	assert.NilError(t, _db.Create(&volume).Error)
+
+	pool := model2.Merge{MountPoint: "/srv/pool/media", SourceVolumes: []*model2.Volume{&volume}}
+	assert.NilError(t, _service.CreateMergeInDB(&pool))
+
+	assert.ErrorIs(t, _service.ValidateNewMerge(&model2.Merge{ID: pool.ID, MountPoint: "/srv/pool/backup"}), ErrMergeAlreadyExists)
+	assert.ErrorIs(t, _service.ValidateNewMerge(&model2.Merge{ID: pool.ID + 100, MountPoint: pool.MountPoint}), ErrMergeMountPointAlreadyExists)
+	assert.ErrorIs(t, _service.ValidateNewMerge(&model2.Merge{ID: pool.ID + 100, MountPoint: "/srv/pool/backup", SourceVolumes: []*model2.Volume{&volume}}), ErrMergeSourceInUse)
+
+	backup := model2.Merge{ID: pool.ID + 100, MountPoint: "/srv/pool/backup"}
+	assert.NilError(t, _service.ValidateNewMerge(&backup))
+
+	// created with the id asked for
+	assert.NilError(t, _service.CreateMergeInDB(&backup))
+
+	merge, err := _service.GetMergeFromDB(pool.ID + 100)
+	assert.NilError(t, err)
+	assert.Equal(t, merge.MountPoint, backup.MountPoint)
+}
+
+func TestMergeOptionsInDB(t *testing.T) {
+	moveOnENOSPC := false
+
+	merge := model2.Merge{
+		MountPoint:   "/srv/options",
+		CreatePolicy: "epmfs",
+		FuncPolicies: map[string]string{"getattr": "newest", "unlink": "all"},
+	}
+	assert.NilError(t, _service.CreateMergeInDB(&merge))
+
+	// as set by SetMerge
+	merge.CreatePolicy = "lfs"
+	merge.MinFreeSpace = "4G"
+	merge.MoveOnENOSPC = &moveOnENOSPC
+	merge.FuncPolicies = map[string]string{"getattr": "newest"}
+	assert.NilError(t, _service.UpdateMergeOptionsInDB(&merge))
+
+	reloaded, err := _service.GetMergeFromDB(merge.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, reloaded.CreatePolicy, "lfs")
+	assert.Equal(t, reloaded.MinFreeSpace, "4G")
+	assert.Equal(t, *reloaded.MoveOnENOSPC, false)
+	assert.DeepEqual(t, reloaded.FuncPolicies, map[string]string{"getattr": "newest"})
+
+	// options unset are unset in the db too
+	merge.CreatePolicy = ""
+	merge.MoveOnENOSPC = nil
+	merge.FuncPolicies = nil
+	assert.NilError(t, _service.UpdateMergeOptionsInDB(&merge))
+
+	reloaded, err = _service.GetMergeFromDB(merge.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, reloaded.CreatePolicy, "")
+	assert.Assert(t, reloaded.MoveOnENOSPC == nil)
+	assert.Equal(t, len(reloaded.FuncPolicies), 0)
+
+	assert.NilError(t, _service.DeleteMergeInDB(reloaded))
+}
+
+func TestUpdateMergeInDBRollback(t *testing.T) {
+	sourceBasePath := "/var/lib/casaos/files"
+
+	merge := model2.Merge{MountPoint: "/srv/rollback", CreatePolicy: "epmfs"}
+	assert.NilError(t, _service.CreateMergeInDB(&merge))
+
+	// fail the options, which are written after the sources
+	errOptions := errors.New("options not written")
+	assert.NilError(t, _service._db.Callback().Update().Before("gorm:update").Register("test:fail_options", func(db *gorm.DB) {
+		if slices.Contains(db.Statement.Selects, "CreatePolicy") {
+			_ = db.AddError(errOptions)
+		}
+	}))
+	defer func() {
+		assert.NilError(t, _service._db.Callback().Update().Remove("test:fail_options"))
+	}()
+
+	merge.SourceBasePath = &sourceBasePath
+	merge.CreatePolicy = "lfs"
+	assert.ErrorIs(t, _service.UpdateMergeInDB(&merge), errOptions)
+
+	reloaded, err := _service.GetMergeFromDB(merge.ID)
+	assert.NilError(t, err)
+	assert.Assert(t, reloaded.SourceBasePath == nil)
+	assert.Equal(t, reloaded.CreatePolicy, "epmfs")
+
+	assert.NilError(t, _service.DeleteMergeInDB(reloaded))
+}
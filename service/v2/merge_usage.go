@@ -0,0 +1,159 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mergerfs"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"go.uber.org/zap"
+)
+
+var ErrPathNotInMerge = errors.New("path is not in any merge")
+
+// GetMergeBranches returns the branches of merge as mergerfs currently has them, with the space used on each, and the
+// number and size of files on each if withFiles - which walks every branch.
+func (s *LocalStorageService) GetMergeBranches(ctx context.Context, merge model2.Merge, withFiles bool) ([]codegen.MergeBranch, error) {
+	branches, err := mergerfs.GetBranches(merge.MountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	usages, err := mergerfs.GetBranchUsages(branches)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]codegen.MergeBranch, 0, len(usages))
+	for _, usage := range usages {
+		mode := usage.Mode
+		if mode == "" {
+			mode = mergerfs.BranchModeRW
+		}
+
+		result := codegen.MergeBranch{
+			Path:       usage.Path,
+			VolumeUuid: volumeUUIDOf(merge, usage.Path),
+			Mode:       mode,
+			Total:      usage.Total,
+			Used:       usage.Used,
+			Free:       usage.Free,
+			Percent:    usage.Percent(),
+		}
+
+		if usage.MinFreeSpace != "" {
+			minFreeSpace := usage.MinFreeSpace
+			result.MinFreeSpace = &minFreeSpace
+		}
+
+		if withFiles {
+			files, size, err := mergerfs.CountFiles(ctx, usage.Path)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+
+				logger.Error("error when counting files on branch of merge", zap.Error(err), zap.String("mount point", merge.MountPoint), zap.String("branch", usage.Path))
+			} else {
+				result.Files = &files
+				result.Size = &size
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// LocateMergePath returns the branches a file or directory at path in a merge lives on.
+func (s *LocalStorageService) LocateMergePath(path string) (*codegen.MergePath, error) {
+	path = filepath.Clean(path)
+
+	merges, err := s.GetMergeAllFromDB(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the innermost merge, should one be mounted under another
+	var merge *model2.Merge
+	for i := range merges {
+		if !isUnder(path, merges[i].MountPoint) {
+			continue
+		}
+
+		if merge == nil || len(merges[i].MountPoint) > len(merge.MountPoint) {
+			merge = &merges[i]
+		}
+	}
+
+	if merge == nil {
+		return nil, ErrPathNotInMerge
+	}
+
+	paths, err := mergerfs.AllPaths(path)
+	if err != nil {
+		return nil, err
+	}
+
+	branches, err := mergerfs.GetBranches(merge.MountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	result := codegen.MergePath{
+		Path:       path,
+		MountPoint: merge.MountPoint,
+		Branches:   make([]codegen.MergePathBranch, 0, len(paths)),
+	}
+
+	if basePath, err := mergerfs.BasePath(path); err != nil {
+		logger.Error("error when getting base path of path in merge", zap.Error(err), zap.String("path", path))
+	} else {
+		result.BasePath = &basePath
+	}
+
+	for _, p := range paths {
+		pathBranch := codegen.MergePathBranch{Path: p}
+
+		for _, branch := range branches {
+			if !isUnder(p, branch.Path) {
+				continue
+			}
+
+			mode := branch.Mode
+			if mode == "" {
+				mode = mergerfs.BranchModeRW
+			}
+
+			pathBranch.Branch = branch.Path
+			pathBranch.Mode = &mode
+			pathBranch.VolumeUuid = volumeUUIDOf(*merge, branch.Path)
+			break
+		}
+
+		result.Branches = append(result.Branches, pathBranch)
+	}
+
+	return &result, nil
+}
+
+func volumeUUIDOf(merge model2.Merge, mountPoint string) *string {
+	for _, volume := range merge.SourceVolumes {
+		if volume != nil && volume.MountPoint == mountPoint {
+			uuid := volume.UUID
+			return &uuid
+		}
+	}
+
+	return nil
+}
+
+func isUnder(path, dir string) bool {
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -2,12 +2,18 @@ package v2
 
 import (
 	"errors"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/IceWhaleTech/CasaOS-Common/utils/file"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/fstab"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/systemd"
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
 
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2/fs"
 	"github.com/moby/sys/mountinfo"
@@ -49,10 +55,57 @@ func (s *LocalStorageService) GetMounts(params codegen.GetMountsParams) ([]codeg
 		return nil, err
 	}
 
+	// parents are needed to tell if a mount is visible to containers, and may not pass the filter
+	allMounts, err := s._mountinfo.GetMounts(nil)
+	if err != nil {
+		logger.Error("Error when trying to get all mounted volumes", zap.Error(err))
+		return nil, err
+	}
+
+	byID := make(map[int]*mountinfo.Info, len(allMounts))
+	for _, mountInfo := range allMounts {
+		byID[mountInfo.ID] = mountInfo
+	}
+
+	var p *persistence
+	if params.WithPersistence != nil && *params.WithPersistence {
+		if p, err = s.loadPersistence(); err != nil {
+			logger.Error("Error when trying to load how mounts are persisted", zap.Error(err))
+			return nil, err
+		}
+	}
+
 	results := make([]codegen.Mount, len(mounts))
 
 	for i, mountInfo := range mounts {
 		results[i] = *fs.ExtendAll(MountAdapter(mountInfo))
+
+		propagates := mount.PropagatesToBindMounts(byID[mountInfo.Parent])
+		results[i].PropagatesToBindMounts = &propagates
+
+		if params.WithUsage != nil && *params.WithUsage {
+			if usage, err := mount.GetUsage(mountInfo.Mountpoint, mount.DefaultProbeTimeout); err != nil {
+				logger.Error("Error when trying to get usage of mounted volume", zap.Error(err), zap.String("mount point", mountInfo.Mountpoint))
+			} else {
+				results[i].Usage = UsageAdapter(usage)
+			}
+		}
+
+		if params.WithDevice != nil && *params.WithDevice && strings.HasPrefix(mountInfo.Source, "/dev/") {
+			if disk, err := partition.GetDiskOf(mountInfo.Source); err != nil {
+				logger.Error("Error when trying to get disk of mounted volume", zap.Error(err), zap.String("source", mountInfo.Source))
+			} else if disk != nil {
+				results[i].Device = DeviceAdapter(disk)
+			}
+		}
+
+		if p != nil {
+			persistedIn := p.persistedIn(mountInfo)
+			results[i].PersistedIn = &persistedIn
+
+			merges := p.mergesOf(mountInfo.Mountpoint)
+			results[i].Merges = &merges
+		}
 	}
 
 	return results, nil
@@ -86,7 +139,12 @@ func (s *LocalStorageService) Mount(m codegen.Mount) (*codegen.Mount, error) {
 		return nil, ErrMountPointIsNotEmpty
 	}
 
-	if err := mount.Mount(*m.Source, m.MountPoint, m.Fstype, m.Options); err != nil {
+	if m.Fstype != nil && fs.MounterOf(*m.Fstype) != nil {
+		if err := fs.MounterOf(*m.Fstype).Mount(m); err != nil {
+			logger.Error("error when trying to mount", zap.Error(err), zap.Any("mount", m))
+			return nil, err
+		}
+	} else if err := mount.Mount(*m.Source, m.MountPoint, m.Fstype, m.Options); err != nil {
 		logger.Error("error when trying to mount", zap.Error(err), zap.Any("mount", m))
 		return nil, err
 	}
@@ -109,6 +167,10 @@ func (s *LocalStorageService) Mount(m codegen.Mount) (*codegen.Mount, error) {
 
 	results[0] = *fs.PostMountAll(results[0])
 
+	if results[0].PropagatesToBindMounts != nil && !*results[0].PropagatesToBindMounts {
+		logger.Info("mounted, but parent mount is not shared - bind mounts of it made earlier, e.g. by app containers, will not see it until made again", zap.String("mount point", m.MountPoint))
+	}
+
 	return &results[0], nil
 }
 
@@ -135,13 +197,162 @@ func (s *LocalStorageService) Umount(mountpoint string) error {
 	return nil
 }
 
+// persistence is what tells how each mount is restored after reboot, loaded once for all of them.
+type persistence struct {
+	merges         map[string]bool     // by mount point
+	mergesBySource map[string][]string // mount points of merges, by mount point of their sources
+	volumes        map[string]bool     // by UUID, of their filesystems and of their LUKS containers
+	units          map[string]bool     // UUIDs mounted by systemd mount units
+	entries        []*fstab.Entry
+	uuids          map[string]string // by device path
+}
+
+func (s *LocalStorageService) loadPersistence() (*persistence, error) {
+	p := &persistence{
+		merges:         map[string]bool{},
+		mergesBySource: map[string][]string{},
+		volumes:        map[string]bool{},
+		units:          map[string]bool{},
+		uuids:          map[string]string{},
+	}
+
+	merges, err := s.GetMergeAllFromDB(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, merge := range merges {
+		p.merges[merge.MountPoint] = true
+
+		if merge.SourceBasePath != nil && *merge.SourceBasePath != "" {
+			p.mergesBySource[*merge.SourceBasePath] = append(p.mergesBySource[*merge.SourceBasePath], merge.MountPoint)
+		}
+
+		for _, volume := range merge.SourceVolumes {
+			if volume != nil {
+				p.mergesBySource[volume.MountPoint] = append(p.mergesBySource[volume.MountPoint], merge.MountPoint)
+			}
+		}
+	}
+
+	var volumes []model2.Volume
+	if err := s._db.Find(&volumes).Error; err != nil {
+		return nil, err
+	}
+
+	for _, volume := range volumes {
+		p.volumes[volume.UUID] = true
+		if volume.CryptUUID != "" {
+			p.volumes[volume.CryptUUID] = true
+		}
+	}
+
+	// the rest is only as good as it can be found
+	if units, err := systemd.List(); err != nil {
+		logger.Error("Error when trying to list mount units", zap.Error(err))
+	} else {
+		for _, u := range units {
+			// as volumes are persisted with systemd, by UUID
+			if uuid, found := strings.CutPrefix(u.What, "/dev/disk/by-uuid/"); found {
+				p.units[uuid] = true
+			}
+		}
+	}
+
+	if p.entries, err = fstab.Get().GetEntries(); err != nil {
+		logger.Error("Error when trying to get fstab entries", zap.Error(err))
+	}
+
+	if p.uuids, err = partition.GetUUIDs(); err != nil {
+		logger.Error("Error when trying to get UUIDs of devices", zap.Error(err))
+	}
+
+	return p, nil
+}
+
+// persistedIn tells how m is restored after reboot - by the UUID of its source device if any, then by its mount point.
+func (p *persistence) persistedIn(m *mountinfo.Info) codegen.MountPersistedIn {
+	if p.merges[m.Mountpoint] {
+		return codegen.MountPersistedInCasaos
+	}
+
+	if strings.HasPrefix(m.Source, "/dev/") {
+		// the kernel may report the resolved device path or not, e.g. /dev/dm-0 or /dev/mapper/luks-<uuid>
+		device := m.Source
+		if resolved, err := filepath.EvalSymlinks(m.Source); err == nil {
+			device = resolved
+		}
+
+		uuid := p.uuids[m.Source]
+		if uuid == "" {
+			uuid = p.uuids[device]
+		}
+
+		// a mount unit is checked before database, as the volume is in database either way
+		switch {
+		case uuid != "" && p.units[uuid]:
+			return codegen.MountPersistedInSystemd
+		case uuid != "" && p.volumes[uuid]:
+			return codegen.MountPersistedInCasaos
+		}
+
+		for _, entry := range p.entries {
+			if uuid != "" && (entry.Source == uuid || entry.Source == "UUID="+uuid) || fstab.ResolveSource(entry.Source) == device {
+				return codegen.MountPersistedInFstab
+			}
+		}
+	}
+
+	for _, entry := range p.entries {
+		if entry.MountPoint == m.Mountpoint {
+			return codegen.MountPersistedInFstab
+		}
+	}
+
+	return codegen.MountPersistedInNone
+}
+
+// mergesOf returns the mount points of the merges mountPoint is a source of.
+func (p *persistence) mergesOf(mountPoint string) []string {
+	merges := p.mergesBySource[mountPoint]
+	if merges == nil {
+		return []string{}
+	}
+
+	return merges
+}
+
 func MountAdapter(m *mountinfo.Info) codegen.Mount {
+	propagation := codegen.MountPropagation(mount.Propagation(m.Optional))
+
 	return codegen.Mount{
 		MountPoint: m.Mountpoint,
 
-		Id:      &m.ID,
-		Options: &m.Options,
-		Source:  &m.Source,
-		Fstype:  &m.FSType,
+		Id:          &m.ID,
+		Options:     &m.Options,
+		Source:      &m.Source,
+		Fstype:      &m.FSType,
+		Propagation: &propagation,
+	}
+}
+
+func UsageAdapter(usage *mount.Usage) *codegen.MountUsage {
+	return &codegen.MountUsage{
+		Total:       &usage.Total,
+		Used:        &usage.Used,
+		Available:   &usage.Available,
+		InodesTotal: &usage.InodesTotal,
+		InodesUsed:  &usage.InodesUsed,
+		InodesFree:  &usage.InodesFree,
+	}
+}
+
+func DeviceAdapter(disk *partition.Disk) *codegen.MountDevice {
+	return &codegen.MountDevice{
+		Path:      &disk.Path,
+		DiskId:    &disk.ID,
+		Model:     &disk.Model,
+		Serial:    &disk.Serial,
+		Transport: &disk.Transport,
 	}
 }
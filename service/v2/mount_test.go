@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/codegen"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/fstab"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
 	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2/wrapper"
 	"gotest.tools/v3/assert"
 
@@ -389,6 +391,11 @@ func TestGetMounts(t *testing.T) {
 	}
 
 	assert.Equal(t, len(mounts), len(_allMountInfo))
+
+	for i := range mounts {
+		assert.Equal(t, string(*mounts[i].Propagation), mount.Propagation(_allMountInfo[i].Optional))
+		assert.Assert(t, mounts[i].PropagatesToBindMounts != nil)
+	}
 }
 
 func TestGetMountsWithFilter(t *testing.T) {
@@ -451,3 +458,33 @@ func TestGetMountsWithFilter(t *testing.T) {
 		assert.Equal(t, *mounts[i].Options, expectedMountsByType[i].Options)
 	}
 }
+
+func TestPersistedIn(t *testing.T) {
+	p := &persistence{
+		merges:         map[string]bool{"/DATA": true},
+		mergesBySource: map[string][]string{"/media/sdz1": {"/DATA"}},
+		volumes:        map[string]bool{"4f1c2d3e-0001-4a5b-8c7d-9e0f1a2b3c4d": true},
+		units:          map[string]bool{"4f1c2d3e-0002-4a5b-8c7d-9e0f1a2b3c4d": true},
+		entries: []*fstab.Entry{
+			{Source: "UUID=4f1c2d3e-0003-4a5b-8c7d-9e0f1a2b3c4d", MountPoint: "/mnt/backup"},
+			{Source: "//nas/share", MountPoint: "/mnt/nas"},
+		},
+		uuids: map[string]string{
+			"/dev/sdz1": "4f1c2d3e-0001-4a5b-8c7d-9e0f1a2b3c4d",
+			"/dev/sdz2": "4f1c2d3e-0002-4a5b-8c7d-9e0f1a2b3c4d",
+			"/dev/sdz3": "4f1c2d3e-0003-4a5b-8c7d-9e0f1a2b3c4d",
+		},
+	}
+
+	assert.Equal(t, p.persistedIn(&mountinfo.Info{Mountpoint: "/DATA", Source: "/media/sdz1:/media/sdz2"}), codegen.MountPersistedInCasaos)
+	assert.Equal(t, p.persistedIn(&mountinfo.Info{Mountpoint: "/media/sdz1", Source: "/dev/sdz1"}), codegen.MountPersistedInCasaos)
+	assert.Equal(t, p.persistedIn(&mountinfo.Info{Mountpoint: "/media/sdz2", Source: "/dev/sdz2"}), codegen.MountPersistedInSystemd)
+
+	// by UUID, wherever it is mounted
+	assert.Equal(t, p.persistedIn(&mountinfo.Info{Mountpoint: "/mnt/elsewhere", Source: "/dev/sdz3"}), codegen.MountPersistedInFstab)
+	assert.Equal(t, p.persistedIn(&mountinfo.Info{Mountpoint: "/mnt/nas", Source: "//nas/share"}), codegen.MountPersistedInFstab)
+	assert.Equal(t, p.persistedIn(&mountinfo.Info{Mountpoint: "/media/sdz4", Source: "/dev/sdz4"}), codegen.MountPersistedInNone)
+
+	assert.DeepEqual(t, p.mergesOf("/media/sdz1"), []string{"/DATA"})
+	assert.DeepEqual(t, p.mergesOf("/media/sdz2"), []string{})
+}
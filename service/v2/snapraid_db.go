@@ -0,0 +1,48 @@
+package v2
+
+import (
+	"errors"
+
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+)
+
+var ErrSnapRAIDNotConfigured = errors.New("snapraid is not configured for the merge")
+
+// GetSnapRAIDFromDB returns the SnapRAID config of the merge with mergeID, or ErrSnapRAIDNotConfigured
+func (s *LocalStorageService) GetSnapRAIDFromDB(mergeID uint) (*model2.SnapRAID, error) {
+	var snapraid model2.SnapRAID
+
+	if result := s._db.Where(&model2.SnapRAID{MergeID: mergeID}).Limit(1).Find(&snapraid); result.Error != nil {
+		return nil, result.Error
+	} else if result.RowsAffected == 0 {
+		return nil, ErrSnapRAIDNotConfigured
+	}
+
+	return &snapraid, nil
+}
+
+func (s *LocalStorageService) GetSnapRAIDAllFromDB() ([]model2.SnapRAID, error) {
+	var snapraids []model2.SnapRAID
+
+	if err := s._db.Find(&snapraids).Error; err != nil {
+		return nil, err
+	}
+
+	return snapraids, nil
+}
+
+// SaveSnapRAIDInDB creates or replaces the SnapRAID config of the merge of snapraid.
+func (s *LocalStorageService) SaveSnapRAIDInDB(snapraid *model2.SnapRAID) error {
+	if existing, err := s.GetSnapRAIDFromDB(snapraid.MergeID); err == nil {
+		snapraid.ID = existing.ID
+		snapraid.CreatedAt = existing.CreatedAt
+	} else if !errors.Is(err, ErrSnapRAIDNotConfigured) {
+		return err
+	}
+
+	return s._db.Save(snapraid).Error
+}
+
+func (s *LocalStorageService) DeleteSnapRAIDInDB(mergeID uint) error {
+	return s._db.Where(&model2.SnapRAID{MergeID: mergeID}).Delete(&model2.SnapRAID{}).Error
+}
@@ -0,0 +1,38 @@
+package v2
+
+import (
+	"testing"
+
+	model2 "github.com/IceWhaleTech/CasaOS-LocalStorage/service/model"
+	"gotest.tools/v3/assert"
+)
+
+func TestSnapRAIDInDB(t *testing.T) {
+	_, err := _service.GetSnapRAIDFromDB(42)
+	assert.ErrorIs(t, err, ErrSnapRAIDNotConfigured)
+
+	expected := model2.SnapRAID{
+		MergeID:       42,
+		DataVolumes:   []string{"0b4d2c1e-1f33-4d0e-9c1a-7d0c8c2b1a11"},
+		ParityVolumes: []string{"36c94c85-debf-49b6-9f19-866c14b3a0c6"},
+		SyncSchedule:  "0 3 * * *",
+	}
+	assert.NilError(t, _service.SaveSnapRAIDInDB(&expected))
+
+	// saved again, it replaces the config of the merge
+	replaced := expected
+	replaced.ID = 0
+	replaced.ScrubSchedule = "0 5 * * 0"
+	assert.NilError(t, _service.SaveSnapRAIDInDB(&replaced))
+
+	actual, err := _service.GetSnapRAIDFromDB(42)
+	assert.NilError(t, err)
+	assert.Equal(t, actual.ID, expected.ID)
+	assert.DeepEqual(t, actual.ParityVolumes, expected.ParityVolumes)
+	assert.Equal(t, actual.ScrubSchedule, "0 5 * * 0")
+
+	assert.NilError(t, _service.DeleteSnapRAIDInDB(42))
+
+	_, err = _service.GetSnapRAIDFromDB(42)
+	assert.ErrorIs(t, err, ErrSnapRAIDNotConfigured)
+}
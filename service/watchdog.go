@@ -0,0 +1,326 @@
+package service
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/common"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/config"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/luks"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/mount"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/pkg/partition"
+	"github.com/IceWhaleTech/CasaOS-LocalStorage/service/v2/fs"
+	"github.com/moby/sys/mountinfo"
+	"go.uber.org/zap"
+)
+
+const (
+	ManagedMountTypeVolume = "volume"
+	ManagedMountTypeMerge  = "merge"
+	ManagedMountTypeCloud  = "cloud"
+
+	EventMountStatus = common.ServiceName + ":mount_status"
+
+	watchdogBackoffBase = 10 * time.Second
+	watchdogBackoffMax  = 10 * time.Minute
+)
+
+type WatchdogService interface {
+	// Check probes every managed mount once, and tries to recover those that are stale or gone.
+	Check()
+	// Forget stops watching a cloud mount that is intentionally unmounted.
+	Forget(mountPoint string)
+	// GetMountHealthList returns the state of each managed mount as last probed, by mount point.
+	GetMountHealthList() []MountHealth
+}
+
+type MountHealth struct {
+	Type        string      `json:"type"` // volume, merge, cloud
+	MountPoint  string      `json:"mount_point"`
+	State       mount.State `json:"state"`
+	Error       string      `json:"error,omitempty"`
+	Failures    int         `json:"failures"`
+	NextAttempt time.Time   `json:"next_attempt,omitempty"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// a mount this service is responsible for, along with how to bring it back
+type managedMount struct {
+	Type       string
+	MountPoint string
+	FSType     string // empty if any
+	Remount    func() error
+	Systemd    bool // mounted by its systemd unit - only reported as in mountinfo, never probed or remounted
+}
+
+type watchdogService struct {
+	running sync.Mutex
+
+	mu          sync.Mutex
+	health      map[string]*MountHealth
+	cloudMounts map[string]string // mount point -> remote name, as cloud mounts disappear from MountLists when they die
+}
+
+func (w *watchdogService) Check() {
+	// mounts are still being brought up in order, which remounting them here would race with
+	if MyService.Reconciler().RestoreStatus().State == RestoreStateRunning {
+		return
+	}
+
+	// skip this round if the previous one is still stuck on a hung probe
+	if !w.running.TryLock() {
+		logger.Info("previous mount watchdog check is still running - skipping")
+		return
+	}
+	defer w.running.Unlock()
+
+	for _, m := range w.managedMounts() {
+		w.check(m)
+	}
+}
+
+func (w *watchdogService) Forget(mountPoint string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.cloudMounts, mountPoint)
+	delete(w.health, mountPoint)
+}
+
+func (w *watchdogService) GetMountHealthList() []MountHealth {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	list := make([]MountHealth, 0, len(w.health))
+	for _, h := range w.health {
+		list = append(list, *h)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].MountPoint < list[j].MountPoint })
+
+	return list
+}
+
+func (w *watchdogService) check(m managedMount) {
+	if m.Systemd {
+		// a statfs would trigger an automount, and keep it from expiring when idle
+		state, err := mountState(m.MountPoint)
+		w.updateState(m, state, err)
+		return
+	}
+
+	state, err := mount.Probe(m.MountPoint, m.FSType, mount.DefaultProbeTimeout)
+
+	h := w.updateState(m, state, err)
+	if state == mount.StateHealthy {
+		return
+	}
+
+	if time.Now().Before(h.NextAttempt) {
+		return
+	}
+
+	logger.Info("trying to recover mount...", zap.String("type", m.Type), zap.String("mount point", m.MountPoint), zap.String("state", string(state)), zap.Error(err))
+
+	if state == mount.StateStale {
+		if err := mount.UmountLazy(m.MountPoint); err != nil {
+			logger.Error("error when lazily umounting stale mount", zap.Error(err), zap.String("mount point", m.MountPoint))
+		}
+	}
+
+	if err := m.Remount(); err != nil {
+		logger.Error("error when remounting", zap.Error(err), zap.String("type", m.Type), zap.String("mount point", m.MountPoint))
+		w.backoff(m.MountPoint, err)
+		return
+	}
+
+	state, err = mount.Probe(m.MountPoint, m.FSType, mount.DefaultProbeTimeout)
+	w.updateState(m, state, err)
+
+	if state != mount.StateHealthy {
+		w.backoff(m.MountPoint, err)
+	}
+}
+
+// record the latest state of a mount, and publish an event if it is different from the previous one
+func (w *watchdogService) updateState(m managedMount, state mount.State, err error) MountHealth {
+	w.mu.Lock()
+
+	h, ok := w.health[m.MountPoint]
+	if !ok {
+		h = &MountHealth{Type: m.Type, MountPoint: m.MountPoint, State: mount.StateHealthy}
+		w.health[m.MountPoint] = h
+	}
+
+	previousState := h.State
+
+	h.State = state
+	h.UpdatedAt = time.Now()
+	h.Error = ""
+	if err != nil {
+		h.Error = err.Error()
+	}
+
+	if state == mount.StateHealthy {
+		h.Failures = 0
+		h.NextAttempt = time.Time{}
+	}
+
+	result := *h
+
+	w.mu.Unlock()
+
+	if previousState != state {
+		message := map[string]interface{}{
+			"type":           m.Type,
+			"mount_point":    m.MountPoint,
+			"state":          state,
+			"previous_state": previousState,
+			"error":          result.Error,
+		}
+
+		if err := MyService.Notify().SendNotify(EventMountStatus, message); err != nil {
+			logger.Error("error when sending notification", zap.Error(err), zap.String("message path", EventMountStatus), zap.Any("message", message))
+		}
+	}
+
+	return result
+}
+
+func (w *watchdogService) backoff(mountPoint string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	h, ok := w.health[mountPoint]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		h.Error = err.Error()
+	}
+
+	delay := watchdogBackoffMax
+	if h.Failures < 16 { // avoid overflow
+		delay = watchdogBackoffBase * time.Duration(1<<h.Failures)
+		if delay > watchdogBackoffMax {
+			delay = watchdogBackoffMax
+		}
+	}
+
+	h.Failures++
+	h.NextAttempt = time.Now().Add(delay)
+}
+
+// build the list of managed mounts from their persisted definitions
+func (w *watchdogService) managedMounts() []managedMount {
+	managedMounts := make([]managedMount, 0)
+
+	volumes, err := MyService.Disk().GetSerialAllFromDB()
+	if err != nil {
+		logger.Error("error when getting all volumes from database", zap.Error(err))
+	}
+
+	persistedWithSystemd := systemdVolumes()
+
+	for i := range volumes {
+		volume := volumes[i]
+
+		// locked on purpose, or still waiting to be unlocked
+		if volume.CryptUUID != "" && !luks.IsOpen(luks.MapperName(volume.CryptUUID)) {
+			continue
+		}
+
+		managedMounts = append(managedMounts, managedMount{
+			Type:       ManagedMountTypeVolume,
+			MountPoint: volume.MountPoint,
+			Systemd:    persistedWithSystemd[volume.UUID],
+			Remount: func() error {
+				path, err := partition.GetDevicePath(volume.UUID)
+				if err != nil {
+					return err
+				}
+
+				if output, err := MyService.Disk().MountDisk(path, volume.MountPoint); err != nil {
+					logger.Error(output, zap.Error(err), zap.String("path", path), zap.String("mount point", volume.MountPoint))
+					return err
+				}
+
+				return nil
+			},
+		})
+	}
+
+	if strings.ToLower(config.ServerInfo.EnableMergerFS) == "true" {
+		merges, err := MyService.LocalStorage().GetMergeAllFromDB(nil)
+		if err != nil {
+			logger.Error("error when getting all merges from database", zap.Error(err))
+		}
+
+		for i := range merges {
+			merge := merges[i]
+			managedMounts = append(managedMounts, managedMount{
+				Type:       ManagedMountTypeMerge,
+				MountPoint: merge.MountPoint,
+				FSType:     fs.MergeFSType(merge.FSType),
+				Remount: func() error {
+					return MyService.LocalStorage().CreateMerge(&merge)
+				},
+			})
+		}
+	}
+
+	mountMu.Lock()
+	w.mu.Lock()
+	for mountPoint, mnt := range MountLists {
+		w.cloudMounts[mountPoint] = mnt.Fs.Name()
+	}
+	for mountPoint, fsName := range w.cloudMounts {
+		mountPoint, fsName := mountPoint, fsName
+		managedMounts = append(managedMounts, managedMount{
+			Type:       ManagedMountTypeCloud,
+			MountPoint: mountPoint,
+			Remount: func() error {
+				mountMu.Lock()
+				mnt, ok := MountLists[mountPoint]
+				mountMu.Unlock()
+
+				if ok {
+					if err := mnt.Unmount(); err != nil {
+						logger.Error("error when umounting cloud storage", zap.Error(err), zap.String("mount point", mountPoint))
+					}
+				}
+
+				return MyService.Storage().MountStorage(mountPoint, fsName)
+			},
+		})
+	}
+	w.mu.Unlock()
+	mountMu.Unlock()
+
+	return managedMounts
+}
+
+// mountState tells if mountPoint is mounted, as in mountinfo, without touching the mount point itself.
+func mountState(mountPoint string) (mount.State, error) {
+	mounted, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(mountPoint))
+	if err != nil {
+		return mount.StateGone, err
+	}
+
+	if len(mounted) == 0 {
+		return mount.StateGone, nil
+	}
+
+	return mount.StateHealthy, nil
+}
+
+func NewWatchdogService() WatchdogService {
+	return &watchdogService{
+		health:      make(map[string]*MountHealth),
+		cloudMounts: make(map[string]string),
+	}
+}